@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 	"time"
@@ -31,7 +32,10 @@ func TestAnalyticsEventStructure(t *testing.T) {
 
 // TestEventTypeValidation tests event type validation
 func TestEventTypeValidation(t *testing.T) {
-	validEventTypes := []string{"login", "logout", "inference", "error", "custom"}
+	validEventTypes := []string{}
+	for _, s := range schemas.list() {
+		validEventTypes = append(validEventTypes, s.EventType)
+	}
 
 	tests := []struct {
 		name      string
@@ -114,9 +118,9 @@ func TestTrackEventValidation(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			isValid := tt.event.UserID != "" && tt.event.EventType != ""
-			if isValid == tt.wantErr {
-				t.Errorf("validation mismatch: got valid=%v, want error=%v", isValid, tt.wantErr)
+			err := validateEvent(&tt.event, time.Now().UTC())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateEvent error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
@@ -172,9 +176,34 @@ func TestEventBatchProcessing(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			isValid := tt.batchSize > 0
-			if isValid == tt.wantErr {
-				t.Errorf("batch validation mismatch: got valid=%v, want error=%v", isValid, tt.wantErr)
+			sink := &memEventSink{}
+			cfg := QueueConfig{Capacity: 1000, BatchSize: tt.batchSize, FlushInterval: time.Hour}
+			q, err := newEventQueue(cfg, sink)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newEventQueue error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			for i := 0; i < tt.eventCount; i++ {
+				if err := q.Enqueue(AnalyticsEvent{UserID: "user1", EventType: "login"}); err != nil {
+					t.Fatalf("Enqueue: %v", err)
+				}
+			}
+			if err := q.Close(context.Background()); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			written := 0
+			for _, batch := range sink.batches {
+				if len(batch) == 0 || len(batch) > tt.batchSize {
+					t.Errorf("batch of %d events, want 1 to %d", len(batch), tt.batchSize)
+				}
+				written += len(batch)
+			}
+			if written != tt.eventCount {
+				t.Errorf("wrote %d events, want %d", written, tt.eventCount)
 			}
 		})
 	}
@@ -289,7 +318,7 @@ func TestDataRetention(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			isValid := tt.retentionDays > 0
+			isValid := validateRetentionDays(tt.retentionDays) == nil
 			if isValid == tt.wantErr {
 				t.Errorf("retention validation mismatch: got valid=%v, want error=%v", isValid, tt.wantErr)
 			}
@@ -299,7 +328,10 @@ func TestDataRetention(t *testing.T) {
 
 // TestPrivacyFieldMasking tests sensitive field handling
 func TestPrivacyFieldMasking(t *testing.T) {
-	sensitiveFields := []string{"password", "token", "apikey", "secret"}
+	sensitiveFields := []string{}
+	for field := range defaultMaskedFields {
+		sensitiveFields = append(sensitiveFields, field)
+	}
 
 	tests := []struct {
 		name   string
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Per-event outcomes reported by /analytics/batch.
+const (
+	batchAccepted    = "accepted"
+	batchDuplicate   = "duplicate"
+	batchQuarantined = "quarantined" // stored, but failed its schema check
+	batchRejected    = "rejected"
+	batchRetry       = "retry" // not queued because the queue was full
+)
+
+var (
+	errBatchTooLarge = errors.New("request body is too large")
+	errBatchTooMany  = errors.New("too many events in batch")
+)
+
+// BatchLimits bound one /analytics/batch request. MaxBytes applies to the
+// decompressed body.
+type BatchLimits struct {
+	MaxBytes  int64
+	MaxEvents int
+}
+
+// batchLimitsFromEnv reads ANALYTICS_BATCH_MAX_BYTES and
+// ANALYTICS_BATCH_MAX_EVENTS, defaulting to 1 MiB and 1000 events.
+func batchLimitsFromEnv() BatchLimits {
+	limits := BatchLimits{MaxBytes: 1 << 20, MaxEvents: 1000}
+	if raw := os.Getenv("ANALYTICS_BATCH_MAX_BYTES"); raw != "" {
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil && n > 0 {
+			limits.MaxBytes = n
+		} else {
+			log.Printf("Warning: invalid ANALYTICS_BATCH_MAX_BYTES %q, using default", raw)
+		}
+	}
+	if raw := os.Getenv("ANALYTICS_BATCH_MAX_EVENTS"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			limits.MaxEvents = n
+		} else {
+			log.Printf("Warning: invalid ANALYTICS_BATCH_MAX_EVENTS %q, using default", raw)
+		}
+	}
+	return limits
+}
+
+// BatchResult is the outcome of one event in a batch, in request order.
+type BatchResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchItem is one decoded event, or the reason it could not be decoded.
+type batchItem struct {
+	Event AnalyticsEvent
+	Err   error
+}
+
+// UnmarshalJSON accepts metadata either as a JSON-encoded string, as the
+// gateway sends it, or as a JSON value, as browsers batching events do.
+func (e *AnalyticsEvent) UnmarshalJSON(data []byte) error {
+	type plain AnalyticsEvent
+	var raw struct {
+		plain
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*e = AnalyticsEvent(raw.plain)
+	e.Metadata = ""
+	if len(raw.Metadata) == 0 || string(raw.Metadata) == "null" {
+		return nil
+	}
+	if raw.Metadata[0] == '"' {
+		return json.Unmarshal(raw.Metadata, &e.Metadata)
+	}
+	e.Metadata = string(raw.Metadata)
+	return nil
+}
+
+// limitedReader fails once more than its limit has been read, rather than
+// silently truncating like io.LimitReader.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errBatchTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errBatchTooLarge
+	}
+	return n, err
+}
+
+// batchBody returns the request body, decompressed when encoding is gzip
+// and limited to maxBytes after decompression.
+func batchBody(body io.Reader, encoding string, maxBytes int64) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		body = zr
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	return &limitedReader{r: body, remaining: maxBytes}, nil
+}
+
+// parseEventBatch decodes a JSON array of events or newline-delimited JSON
+// events. A malformed event is reported in its item; only a malformed or
+// oversized body fails the whole batch.
+func parseEventBatch(body io.Reader, maxEvents int) ([]batchItem, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("batch is empty")
+	}
+
+	var raws []json.RawMessage
+	if data[0] == '[' {
+		if err := json.Unmarshal(data, &raws); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %w", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				raws = append(raws, append(json.RawMessage(nil), line...))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(raws) == 0 {
+		return nil, fmt.Errorf("batch is empty")
+	}
+	if len(raws) > maxEvents {
+		return nil, fmt.Errorf("%w: %d events, limit is %d", errBatchTooMany, len(raws), maxEvents)
+	}
+
+	items := make([]batchItem, len(raws))
+	for i, raw := range raws {
+		if err := json.Unmarshal(raw, &items[i].Event); err != nil {
+			items[i].Err = fmt.Errorf("invalid event: %v", err)
+		}
+	}
+	return items, nil
+}
+
+// isUUID reports whether s is a canonical hyphenated UUID.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// assignEventID keeps a client-supplied ID, which makes retries idempotent,
+// or generates one.
+func assignEventID(event *AnalyticsEvent) error {
+	if event.ID != "" {
+		if !isUUID(event.ID) {
+			return fmt.Errorf("id must be a UUID")
+		}
+		event.ID = strings.ToLower(event.ID)
+		return nil
+	}
+	id, err := newEventID()
+	if err != nil {
+		return err
+	}
+	event.ID = id
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestParseEventBatch tests decoding JSON arrays and NDJSON batches
+func TestParseEventBatch(t *testing.T) {
+	array := `[
+		{"user_id": "u1", "event_type": "login", "metadata": "{\"ip\":\"1.2.3.4\"}"},
+		{"user_id": "u2", "event_type": "click", "metadata": {"button": "send"}},
+		{"user_id": 3}
+	]`
+	items, err := parseEventBatch(strings.NewReader(array), 10)
+	if err != nil {
+		t.Fatalf("parseEventBatch(array) error = %v", err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("got %d items, want 3", len(items))
+	}
+	if items[0].Err != nil || items[0].Event.Metadata != `{"ip":"1.2.3.4"}` {
+		t.Errorf("string metadata = %q, %v", items[0].Event.Metadata, items[0].Err)
+	}
+	if items[1].Err != nil || items[1].Event.Metadata != `{"button": "send"}` {
+		t.Errorf("object metadata = %q, %v", items[1].Event.Metadata, items[1].Err)
+	}
+	if items[2].Err == nil {
+		t.Error("a malformed event should be rejected on its own")
+	}
+
+	ndjson := "{\"user_id\": \"u1\", \"event_type\": \"login\"}\n\n{not json}\n{\"user_id\": \"u2\", \"event_type\": \"logout\"}\n"
+	items, err = parseEventBatch(strings.NewReader(ndjson), 10)
+	if err != nil {
+		t.Fatalf("parseEventBatch(ndjson) error = %v", err)
+	}
+	if len(items) != 3 || items[0].Err != nil || items[1].Err == nil || items[2].Event.EventType != "logout" {
+		t.Errorf("ndjson items = %+v", items)
+	}
+
+	if _, err := parseEventBatch(strings.NewReader(ndjson), 2); !errors.Is(err, errBatchTooMany) {
+		t.Errorf("over the event limit: error = %v, want errBatchTooMany", err)
+	}
+	for _, body := range []string{"", "  \n", "[]", `[{"user_id": "u1"}`} {
+		if _, err := parseEventBatch(strings.NewReader(body), 10); err == nil {
+			t.Errorf("parseEventBatch(%q) should fail", body)
+		}
+	}
+}
+
+// TestBatchBody tests gzip decoding and the decompressed size limit
+func TestBatchBody(t *testing.T) {
+	payload := `[{"user_id": "u1", "event_type": "login"}]`
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(payload))
+	zw.Close()
+
+	body, err := batchBody(bytes.NewReader(compressed.Bytes()), "gzip", 1024)
+	if err != nil {
+		t.Fatalf("batchBody(gzip) error = %v", err)
+	}
+	got, err := io.ReadAll(body)
+	if err != nil || string(got) != payload {
+		t.Errorf("decompressed body = %q, %v", got, err)
+	}
+
+	// A small compressed body may expand past the limit.
+	var bomb bytes.Buffer
+	zw = gzip.NewWriter(&bomb)
+	zw.Write(bytes.Repeat([]byte(" "), 1<<16))
+	zw.Close()
+	body, _ = batchBody(bytes.NewReader(bomb.Bytes()), "gzip", 1024)
+	if _, err := io.ReadAll(body); !errors.Is(err, errBatchTooLarge) {
+		t.Errorf("oversized decompressed body: error = %v, want errBatchTooLarge", err)
+	}
+
+	body, _ = batchBody(strings.NewReader(payload), "", int64(len(payload)))
+	if got, err := io.ReadAll(body); err != nil || string(got) != payload {
+		t.Errorf("body exactly at the limit = %q, %v", got, err)
+	}
+	if _, err := batchBody(strings.NewReader(payload), "gzip", 1024); err == nil {
+		t.Error("a plain body labelled gzip should fail")
+	}
+	if _, err := batchBody(strings.NewReader(payload), "br", 1024); err == nil {
+		t.Error("unsupported encodings should fail")
+	}
+}
+
+// TestAssignEventID tests that client IDs are kept for idempotent retries
+func TestAssignEventID(t *testing.T) {
+	event := AnalyticsEvent{ID: "6F9619FF-8B86-D011-B42D-00C04FC964FF"}
+	if err := assignEventID(&event); err != nil || event.ID != "6f9619ff-8b86-d011-b42d-00c04fc964ff" {
+		t.Errorf("client ID = %q, %v", event.ID, err)
+	}
+
+	event = AnalyticsEvent{ID: "retry-1"}
+	if err := assignEventID(&event); err == nil {
+		t.Error("a non-UUID client ID should be rejected")
+	}
+
+	event = AnalyticsEvent{}
+	if err := assignEventID(&event); err != nil || !isUUID(event.ID) {
+		t.Errorf("generated ID = %q, %v", event.ID, err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// maxClockSkew is how far in the future a client-supplied created_at may be.
+const maxClockSkew = 5 * time.Minute
+
+// defaultMaxEventAgeDays is how far in the past a client-supplied created_at
+// may be unless ANALYTICS_MAX_EVENT_AGE_DAYS says otherwise. Each month an
+// event falls in gets its own partition, so this also bounds how many
+// partitions clients can create.
+const defaultMaxEventAgeDays = 30
+
+// maxEventAge is the configured bound on an event's age, set in main.
+var maxEventAge = defaultMaxEventAgeDays * 24 * time.Hour
+
+// maxEventAgeFromEnv reads ANALYTICS_MAX_EVENT_AGE_DAYS.
+func maxEventAgeFromEnv() time.Duration {
+	days := defaultMaxEventAgeDays
+	if raw := os.Getenv("ANALYTICS_MAX_EVENT_AGE_DAYS"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			days = n
+		} else {
+			log.Printf("Warning: invalid ANALYTICS_MAX_EVENT_AGE_DAYS %q, using default", raw)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// eventsSchema creates the append-only event log. It is partitioned by month
+// on created_at; partitions are created on demand by ensurePartition.
+const eventsSchema = `
+	CREATE TABLE IF NOT EXISTS analytics_events (
+		id UUID NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		event_type VARCHAR(100) NOT NULL,
+		metadata JSONB NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP NOT NULL,
+		received_at TIMESTAMP NOT NULL DEFAULT now(),
+		latency_ms DOUBLE PRECISION,
+		PRIMARY KEY (id, created_at)
+	) PARTITION BY RANGE (created_at);
+
+	ALTER TABLE analytics_events ADD COLUMN IF NOT EXISTS latency_ms DOUBLE PRECISION;
+
+	CREATE INDEX IF NOT EXISTS idx_analytics_events_type ON analytics_events(event_type, created_at);
+	CREATE INDEX IF NOT EXISTS idx_analytics_events_user ON analytics_events(user_id, created_at);
+
+	-- Every event ID ever written. The partitioned table can only enforce
+	-- uniqueness on (id, created_at), so retried events are deduplicated
+	-- against this instead.
+	CREATE TABLE IF NOT EXISTS analytics_event_ids (
+		id UUID PRIMARY KEY,
+		received_at TIMESTAMP NOT NULL DEFAULT now()
+	);
+
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM analytics_event_ids) THEN
+			INSERT INTO analytics_event_ids (id, received_at)
+			SELECT id, MIN(received_at) FROM analytics_events GROUP BY id
+			ON CONFLICT DO NOTHING;
+		END IF;
+	END $$;
+
+	-- Only the retention purge and user erasure may change stored events.
+	-- They set analytics.maintenance for the length of their transaction.
+	CREATE OR REPLACE FUNCTION analytics_events_immutable() RETURNS trigger AS $$
+	BEGIN
+		IF current_setting('analytics.maintenance', true) = 'on' THEN
+			IF TG_OP = 'DELETE' THEN
+				RETURN OLD;
+			END IF;
+			RETURN NEW;
+		END IF;
+		RAISE EXCEPTION 'analytics_events is append-only';
+	END $$ LANGUAGE plpgsql;
+
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'analytics_events_no_update') THEN
+			CREATE TRIGGER analytics_events_no_update BEFORE UPDATE OR DELETE ON analytics_events
+				FOR EACH ROW EXECUTE FUNCTION analytics_events_immutable();
+		END IF;
+	END $$;
+	`
+
+// validateEvent checks a tracked event and fills in server-side defaults:
+// an empty metadata becomes "{}" and a missing created_at becomes now.
+func validateEvent(event *AnalyticsEvent, now time.Time) error {
+	if event.UserID == "" {
+		return fmt.Errorf("user_id is required")
+	}
+	if event.EventType == "" {
+		return fmt.Errorf("event_type is required")
+	}
+	if len(event.UserID) > 255 || len(event.EventType) > 100 {
+		return fmt.Errorf("user_id or event_type is too long")
+	}
+	if event.Metadata == "" {
+		event.Metadata = "{}"
+	}
+	if !json.Valid([]byte(event.Metadata)) {
+		return fmt.Errorf("metadata must be a JSON document")
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = now
+	}
+	if event.CreatedAt.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("created_at is in the future")
+	}
+	if event.CreatedAt.Before(now.Add(-maxEventAge)) {
+		return fmt.Errorf("created_at is more than %d days old", int(maxEventAge.Hours()/24))
+	}
+	event.CreatedAt = event.CreatedAt.UTC()
+	return nil
+}
+
+// monthPartition returns the partition holding t and its bounds.
+func monthPartition(t time.Time) (name string, start, end time.Time) {
+	t = t.UTC()
+	start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end = start.AddDate(0, 1, 0)
+	return fmt.Sprintf("analytics_events_%04d_%02d", start.Year(), int(start.Month())), start, end
+}
+
+// newEventID returns a random (version 4) UUID.
+func newEventID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var events *EventQueue
+
+// sqlEventSink writes batches with COPY, creating monthly partitions as
+// events for a new month arrive.
+type sqlEventSink struct {
+	mu         sync.Mutex
+	partitions map[string]bool
+}
+
+func newSQLEventSink() *sqlEventSink {
+	return &sqlEventSink{partitions: map[string]bool{}}
+}
+
+func (s *sqlEventSink) ensurePartition(ctx context.Context, t time.Time) error {
+	name, start, end := monthPartition(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.partitions[name] {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s PARTITION OF analytics_events FOR VALUES FROM ('%s') TO ('%s')",
+		pq.QuoteIdentifier(name), start.Format(time.DateOnly), end.Format(time.DateOnly)))
+	if err != nil {
+		return fmt.Errorf("creating partition %s: %w", name, err)
+	}
+	s.partitions[name] = true
+	return nil
+}
+
+// writeBatch copies the batch into a staging table and moves across only
+// events whose IDs have not been written before, so a retried event is
+// stored once. Events that failed their schema check are quarantined.
+func (s *sqlEventSink) writeBatch(ctx context.Context, batch []AnalyticsEvent) error {
+	var valid, quarantined []AnalyticsEvent
+	for _, event := range batch {
+		if event.Quarantine != "" {
+			quarantined = append(quarantined, event)
+		} else {
+			valid = append(valid, event)
+		}
+	}
+	if err := writeQuarantine(ctx, quarantined); err != nil {
+		return err
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	batch = valid
+
+	for _, event := range batch {
+		if err := s.ensurePartition(ctx, event.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		"CREATE TEMP TABLE analytics_events_staging (LIKE analytics_events INCLUDING DEFAULTS) ON COMMIT DROP",
+	); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("analytics_events_staging", "id", "user_id", "event_type", "schema_version", "metadata", "created_at", "latency_ms"))
+	if err != nil {
+		return err
+	}
+	for _, event := range batch {
+		var latency interface{}
+		if ms, ok := extractLatency(event.Metadata); ok {
+			latency = ms
+		}
+		if _, err := stmt.ExecContext(ctx, event.ID, event.UserID, event.EventType, event.SchemaVersion, event.Metadata, event.CreatedAt, latency); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		WITH fresh AS (
+			INSERT INTO analytics_event_ids (id)
+			SELECT DISTINCT id FROM analytics_events_staging
+			ON CONFLICT DO NOTHING
+			RETURNING id
+		)
+		INSERT INTO analytics_events (id, user_id, event_type, schema_version, metadata, created_at, latency_ms)
+		SELECT DISTINCT ON (s.id) s.id, s.user_id, s.event_type, s.schema_version, s.metadata, s.created_at, s.latency_ms
+		FROM analytics_events_staging s JOIN fresh USING (id)
+		ORDER BY s.id
+	`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// knownEventIDs returns which of ids have already been written.
+func knownEventIDs(ctx context.Context, ids []string) (map[string]bool, error) {
+	known := map[string]bool{}
+	if len(ids) == 0 {
+		return known, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id FROM analytics_event_ids WHERE id = ANY($1::uuid[])", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		known[id] = true
+	}
+	return known, rows.Err()
+}
+
+// queueConfigFromEnv reads ANALYTICS_QUEUE_SIZE, ANALYTICS_BATCH_SIZE and
+// ANALYTICS_FLUSH_INTERVAL, falling back to the defaults when unset or
+// invalid.
+func queueConfigFromEnv() QueueConfig {
+	cfg := defaultQueueConfig()
+	for _, v := range []struct {
+		env string
+		dst *int
+	}{{"ANALYTICS_QUEUE_SIZE", &cfg.Capacity}, {"ANALYTICS_BATCH_SIZE", &cfg.BatchSize}} {
+		if raw := os.Getenv(v.env); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				log.Printf("Warning: invalid %s %q, using default", v.env, raw)
+				continue
+			}
+			*v.dst = n
+		}
+	}
+	if raw := os.Getenv("ANALYTICS_FLUSH_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			cfg.FlushInterval = d
+		} else {
+			log.Printf("Warning: invalid ANALYTICS_FLUSH_INTERVAL %q, using default", raw)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		log.Printf("Warning: invalid analytics queue settings (%v), using defaults", err)
+		return defaultQueueConfig()
+	}
+	return cfg
+}
+
+// prepareEvent checks a validated event against its schema, marking it for
+// quarantine if it fails, and masks PII in its metadata.
+func prepareEvent(event *AnalyticsEvent) {
+	if err := schemas.check(event); err != nil {
+		event.Quarantine = err.Error()
+	}
+	event.Metadata = privacy.maskMetadata(event.Metadata)
+}
+
+func handleTrackEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var event AnalyticsEvent
+	err := json.NewDecoder(r.Body).Decode(&event)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if err := validateEvent(&event, time.Now().UTC()); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	clientID := event.ID != ""
+	if err := assignEventID(&event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	prepareEvent(&event)
+	if clientID {
+		known, err := knownEventIDs(r.Context(), []string{event.ID})
+		if err != nil {
+			log.Printf("Checking event IDs failed: %v", err)
+		} else if known[event.ID] {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"status": batchDuplicate,
+				"id":     event.ID,
+			})
+			return
+		}
+	}
+
+	if err := events.Enqueue(event); err != nil {
+		if errors.Is(err, errQueueFull) {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Event queue unavailable: " + err.Error()})
+		return
+	}
+
+	resp := map[string]string{
+		"status": "tracked",
+		"id":     event.ID,
+	}
+	if event.Quarantine != "" {
+		resp["status"], resp["reason"] = batchQuarantined, event.Quarantine
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// BatchResponse is the /analytics/batch payload.
+type BatchResponse struct {
+	Accepted    int           `json:"accepted"`
+	Duplicates  int           `json:"duplicates"`
+	Quarantined int           `json:"quarantined"`
+	Rejected    int           `json:"rejected"`
+	Retry       int           `json:"retry"`
+	Results     []BatchResult `json:"results"`
+}
+
+func handleBatchEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	limits := batchLimitsFromEnv()
+	body, err := batchBody(r.Body, r.Header.Get("Content-Encoding"), limits.MaxBytes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	items, err := parseEventBatch(body, limits.MaxEvents)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errBatchTooLarge) || errors.Is(err, errBatchTooMany) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	results := make([]BatchResult, len(items))
+	var ids []string
+	for i := range items {
+		item := &items[i]
+		if item.Err == nil {
+			item.Err = validateEvent(&item.Event, now)
+		}
+		if item.Err == nil {
+			item.Err = assignEventID(&item.Event)
+		}
+		if item.Err == nil {
+			prepareEvent(&item.Event)
+			ids = append(ids, item.Event.ID)
+		}
+		results[i] = BatchResult{Index: i, ID: item.Event.ID}
+	}
+
+	// Events written by an earlier attempt are reported as duplicates. The
+	// sink skips them regardless, so if this check fails the events are
+	// only reported as accepted.
+	known, err := knownEventIDs(r.Context(), ids)
+	if err != nil {
+		log.Printf("Checking event IDs failed: %v", err)
+		known = map[string]bool{}
+	}
+
+	resp := BatchResponse{Results: results}
+	seen := map[string]bool{}
+	for i, item := range items {
+		result := &resp.Results[i]
+		switch {
+		case item.Err != nil:
+			result.Status, result.Error = batchRejected, item.Err.Error()
+		case known[item.Event.ID] || seen[item.Event.ID]:
+			result.Status = batchDuplicate
+		default:
+			if err := events.Enqueue(item.Event); err != nil {
+				result.Status, result.Error = batchRetry, err.Error()
+				break
+			}
+			seen[item.Event.ID] = true
+			result.Status = batchAccepted
+			if item.Event.Quarantine != "" {
+				result.Status, result.Error = batchQuarantined, item.Event.Quarantine
+			}
+		}
+		switch result.Status {
+		case batchAccepted:
+			resp.Accepted++
+		case batchDuplicate:
+			resp.Duplicates++
+		case batchQuarantined:
+			resp.Quarantined++
+		case batchRejected:
+			resp.Rejected++
+		case batchRetry:
+			resp.Retry++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Retry > 0 {
+		w.Header().Set("Retry-After", "1")
+	}
+	if resp.Retry > 0 && resp.Accepted == 0 && resp.Duplicates == 0 && resp.Quarantined == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func createTables() error {
+	for _, schema := range []string{eventsSchema, schemaRegistrySchema, rollupSchema, privacySchema} {
+		if _, err := db.Exec(schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueHealthy reports whether the queue has room; readiness fails when it
+// is nearly full so load balancers back off before events are rejected.
+func queueHealthy(stats QueueStats) bool {
+	return stats.Queued < stats.Capacity*9/10
+}
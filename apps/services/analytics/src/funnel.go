@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// stepSignup is the funnel step for registering, read from auth's
+	// users.created_at rather than from events.
+	stepSignup = "signup"
+	// stepAny matches an event of any type, e.g. a return visit.
+	stepAny = "any"
+
+	maxFunnelSteps    = 10
+	defaultWindow     = 7 * 24 * time.Hour
+	maxWindow         = 90 * 24 * time.Hour
+	defaultCohortSpan = 8 * oneWeek
+	defaultWeeks      = 8
+	maxWeeks          = 52
+	oneWeek           = 7 * 24 * time.Hour
+)
+
+// FunnelQuery is a parsed /analytics/funnel request. Users enter the funnel
+// by completing the first step within [From, To) and convert by completing
+// each later step in order within Window of the first.
+type FunnelQuery struct {
+	From      time.Time
+	To        time.Time
+	Steps     []string
+	Window    time.Duration
+	Breakdown string
+}
+
+// FunnelStep is how many users reached one step.
+type FunnelStep struct {
+	Step           string  `json:"step"`
+	Users          int64   `json:"users"`
+	Conversion     float64 `json:"conversion"`      // of users who entered the funnel
+	StepConversion float64 `json:"step_conversion"` // of users who reached the previous step
+}
+
+// FunnelGroup is the funnel for one breakdown value.
+type FunnelGroup struct {
+	Group string       `json:"group"`
+	Steps []FunnelStep `json:"steps"`
+}
+
+// FunnelResponse is the /analytics/funnel payload. Groups is present only
+// with a breakdown, and Total is their sum.
+type FunnelResponse struct {
+	From      time.Time     `json:"from"`
+	To        time.Time     `json:"to"`
+	Steps     []string      `json:"steps"`
+	Window    string        `json:"window"`
+	Breakdown string        `json:"breakdown,omitempty"`
+	Total     FunnelGroup   `json:"total"`
+	Groups    []FunnelGroup `json:"groups,omitempty"`
+}
+
+// RetentionQuery is a parsed /analytics/retention request. Users are put in
+// weekly cohorts by signup date within [From, To).
+type RetentionQuery struct {
+	From      time.Time
+	To        time.Time
+	Weeks     int
+	EventType string
+	Breakdown string
+}
+
+// Cohort is one row of the retention table. Retained[k] counts users with
+// an event in their k-th week after signup; it is null while that week has
+// not yet ended for every user in the cohort.
+type Cohort struct {
+	Cohort    string     `json:"cohort"`
+	Group     string     `json:"group,omitempty"`
+	Users     int64      `json:"users"`
+	Retained  []*int64   `json:"retained"`
+	Retention []*float64 `json:"retention"`
+}
+
+// RetentionResponse is the /analytics/retention payload.
+type RetentionResponse struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Weeks     int       `json:"weeks"`
+	EventType string    `json:"event_type,omitempty"`
+	Breakdown string    `json:"breakdown,omitempty"`
+	Cohorts   []Cohort  `json:"cohorts"`
+}
+
+// retentionRow is one row read back from the retention query. Offset is -1
+// for the row giving the cohort's size.
+type retentionRow struct {
+	Week   time.Time
+	Group  string
+	Offset int
+	Users  int64
+}
+
+// parseAnalysisRange reads from and to, defaulting to span before now.
+func parseAnalysisRange(q url.Values, now time.Time, span time.Duration) (from, to time.Time, err error) {
+	to = now.UTC()
+	if v := q.Get("to"); v != "" {
+		if to, err = parseStatsTime(v); err != nil {
+			return from, to, fmt.Errorf("to must be RFC 3339 or YYYY-MM-DD")
+		}
+	}
+	from = to.Add(-span)
+	if v := q.Get("from"); v != "" {
+		if from, err = parseStatsTime(v); err != nil {
+			return from, to, fmt.Errorf("from must be RFC 3339 or YYYY-MM-DD")
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+func parseBreakdown(q url.Values) (string, error) {
+	switch v := q.Get("breakdown"); v {
+	case "", "tier":
+		return v, nil
+	default:
+		return "", fmt.Errorf("breakdown must be tier")
+	}
+}
+
+// parseWindow reads a conversion window such as "7d" or "36h".
+func parseWindow(v string) (time.Duration, error) {
+	if v == "" {
+		return defaultWindow, nil
+	}
+	var d time.Duration
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("window must be a duration such as 7d or 36h")
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			return 0, fmt.Errorf("window must be a duration such as 7d or 36h")
+		}
+	}
+	if d <= 0 || d > maxWindow {
+		return 0, fmt.Errorf("window must be positive and at most 90d")
+	}
+	return d, nil
+}
+
+// parseFunnelQuery reads steps, window, from, to and breakdown.
+func parseFunnelQuery(q url.Values, now time.Time) (FunnelQuery, error) {
+	var query FunnelQuery
+	for _, step := range strings.Split(q.Get("steps"), ",") {
+		if step = strings.TrimSpace(step); step != "" {
+			query.Steps = append(query.Steps, step)
+		}
+	}
+	if len(query.Steps) < 2 || len(query.Steps) > maxFunnelSteps {
+		return query, fmt.Errorf("steps must list 2 to %d comma-separated event types", maxFunnelSteps)
+	}
+	for i, step := range query.Steps {
+		if len(step) > 100 {
+			return query, fmt.Errorf("step %q is too long", step)
+		}
+		if step == stepSignup && i > 0 {
+			return query, fmt.Errorf("signup can only be the first step")
+		}
+	}
+
+	var err error
+	if query.Window, err = parseWindow(q.Get("window")); err != nil {
+		return query, err
+	}
+	if query.From, query.To, err = parseAnalysisRange(q, now, defaultStatsRange); err != nil {
+		return query, err
+	}
+	if query.Breakdown, err = parseBreakdown(q); err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
+// funnelSQL builds the funnel query. Each step is matched to the user's
+// earliest qualifying event after the previous step, which finds a
+// conversion whenever one exists. It returns one row per group: the group
+// and the number of users reaching each step.
+func funnelSQL(f FunnelQuery) (string, []interface{}) {
+	// $1 and $2 bound entry into the funnel; $3 is the window in seconds.
+	args := []interface{}{f.From, f.To, f.Window.Seconds()}
+	typeFilter := func(column, step string) string {
+		if step == stepAny {
+			return ""
+		}
+		args = append(args, step)
+		return fmt.Sprintf(" AND %s = $%d", column, len(args))
+	}
+
+	var b strings.Builder
+	if f.Steps[0] == stepSignup {
+		b.WriteString(`WITH s1 AS (
+			SELECT u.id::text AS user_id, u.created_at AS t1 FROM users u
+			WHERE u.created_at >= $1 AND u.created_at < $2
+		)`)
+	} else {
+		fmt.Fprintf(&b, `WITH s1 AS (
+			SELECT user_id, MIN(created_at) AS t1 FROM analytics_events
+			WHERE created_at >= $1 AND created_at < $2%s
+			GROUP BY user_id
+		)`, typeFilter("event_type", f.Steps[0]))
+	}
+	for i := 2; i <= len(f.Steps); i++ {
+		fmt.Fprintf(&b, `, s%[1]d AS (
+			SELECT s%[2]d.*, (
+				SELECT MIN(e.created_at) FROM analytics_events e
+				WHERE e.user_id = s%[2]d.user_id
+					AND e.created_at > s%[2]d.t%[2]d
+					AND e.created_at <= s%[2]d.t1 + $3 * interval '1 second'
+					AND e.created_at >= $1 AND e.created_at <= $2 + $3 * interval '1 second'%[3]s
+			) AS t%[1]d FROM s%[2]d
+		)`, i, i-1, typeFilter("e.event_type", f.Steps[i-1]))
+	}
+
+	group, join := "'all'", ""
+	if f.Breakdown == "tier" {
+		group, join = "COALESCE(u.tier, 'unknown')", fmt.Sprintf(" LEFT JOIN users u ON u.id::text = s%d.user_id", len(f.Steps))
+	}
+	counts := make([]string, len(f.Steps))
+	for i := range counts {
+		counts[i] = fmt.Sprintf("COUNT(t%d)", i+1)
+	}
+	fmt.Fprintf(&b, "\nSELECT %s, %s FROM s%d%s GROUP BY 1 ORDER BY 1",
+		group, strings.Join(counts, ", "), len(f.Steps), join)
+	return b.String(), args
+}
+
+func ratio(n, d int64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+// funnelGroup turns per-step user counts into a FunnelGroup.
+func funnelGroup(group string, steps []string, counts []int64) FunnelGroup {
+	g := FunnelGroup{Group: group, Steps: make([]FunnelStep, len(steps))}
+	for i, step := range steps {
+		g.Steps[i] = FunnelStep{Step: step, Users: counts[i], Conversion: ratio(counts[i], counts[0])}
+		if i == 0 {
+			g.Steps[i].StepConversion = ratio(counts[0], counts[0])
+		} else {
+			g.Steps[i].StepConversion = ratio(counts[i], counts[i-1])
+		}
+	}
+	return g
+}
+
+// summarizeFunnel builds the response from per-group step counts.
+func summarizeFunnel(f FunnelQuery, groups []string, counts [][]int64) *FunnelResponse {
+	resp := &FunnelResponse{
+		From: f.From, To: f.To, Steps: f.Steps, Window: f.Window.String(), Breakdown: f.Breakdown,
+	}
+	total := make([]int64, len(f.Steps))
+	for i, group := range groups {
+		for s, n := range counts[i] {
+			total[s] += n
+		}
+		if f.Breakdown != "" {
+			resp.Groups = append(resp.Groups, funnelGroup(group, f.Steps, counts[i]))
+		}
+	}
+	resp.Total = funnelGroup("all", f.Steps, total)
+	return resp
+}
+
+// parseRetentionQuery reads from, to, weeks, event_type and breakdown.
+func parseRetentionQuery(q url.Values, now time.Time) (RetentionQuery, error) {
+	query := RetentionQuery{Weeks: defaultWeeks, EventType: q.Get("event_type")}
+	if v := q.Get("weeks"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxWeeks {
+			return query, fmt.Errorf("weeks must be between 1 and %d", maxWeeks)
+		}
+		query.Weeks = n
+	}
+	var err error
+	if query.From, query.To, err = parseAnalysisRange(q, now, defaultCohortSpan); err != nil {
+		return query, err
+	}
+	if query.Breakdown, err = parseBreakdown(q); err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
+// retentionSQL builds the retention query. It returns each cohort's size
+// (offset NULL) and, per week after signup, how many of its users had an
+// event.
+func retentionSQL(r RetentionQuery) (string, []interface{}) {
+	group := "'all'"
+	if r.Breakdown == "tier" {
+		group = "COALESCE(tier, 'unknown')"
+	}
+	return `
+		WITH cohort AS (
+			SELECT id::text AS user_id, created_at AS signed_up, date_trunc('week', created_at) AS week, ` + group + ` AS grp
+			FROM users WHERE created_at >= $1 AND created_at < $2
+		)
+		SELECT week, grp, NULL::int, COUNT(*) FROM cohort GROUP BY 1, 2
+		UNION ALL
+		SELECT c.week, c.grp, a.week_offset, COUNT(*) FROM cohort c
+		JOIN LATERAL (
+			SELECT DISTINCT floor(extract(epoch FROM e.created_at - c.signed_up) / 604800)::int AS week_offset
+			FROM analytics_events e
+			WHERE e.user_id = c.user_id
+				AND e.created_at >= c.signed_up AND e.created_at < c.signed_up + $3 * interval '7 days'
+				AND e.created_at >= $1 AND e.created_at < $2 + $3 * interval '7 days'
+				AND ($4 = '' OR e.event_type = $4)
+		) a ON true
+		GROUP BY 1, 2, 3
+	`, []interface{}{r.From, r.To, r.Weeks, r.EventType}
+}
+
+// buildCohorts assembles the retention table, ordered by cohort and group.
+// Week k of a cohort is complete once every user who signed up that week
+// has been a member for k+1 weeks.
+func buildCohorts(r RetentionQuery, rows []retentionRow, now time.Time) []Cohort {
+	type key struct {
+		week  time.Time
+		group string
+	}
+	var keys []key
+	byKey := map[key]*Cohort{}
+	active := map[key]map[int]int64{}
+	for _, row := range rows {
+		k := key{row.Week.UTC(), row.Group}
+		if byKey[k] == nil {
+			byKey[k] = &Cohort{Cohort: k.week.Format(statsDateLayout)}
+			if r.Breakdown != "" {
+				byKey[k].Group = k.group
+			}
+			active[k] = map[int]int64{}
+			keys = append(keys, k)
+		}
+		if row.Offset < 0 {
+			byKey[k].Users = row.Users
+		} else {
+			active[k][row.Offset] = row.Users
+		}
+	}
+
+	cohorts := make([]Cohort, 0, len(keys))
+	for _, k := range keys {
+		c := byKey[k]
+		c.Retained = make([]*int64, r.Weeks)
+		c.Retention = make([]*float64, r.Weeks)
+		for w := 0; w < r.Weeks; w++ {
+			if k.week.Add(time.Duration(w+2) * oneWeek).After(now) {
+				continue
+			}
+			n := active[k][w]
+			pct := ratio(n, c.Users)
+			c.Retained[w], c.Retention[w] = &n, &pct
+		}
+		cohorts = append(cohorts, *c)
+	}
+	sort.Slice(cohorts, func(i, j int) bool {
+		if cohorts[i].Cohort != cohorts[j].Cohort {
+			return cohorts[i].Cohort < cohorts[j].Cohort
+		}
+		return cohorts[i].Group < cohorts[j].Group
+	})
+	return cohorts
+}
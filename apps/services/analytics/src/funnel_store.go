@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// errNoUsersTable is returned when auth's users table, which funnels and
+// cohorts read signups and tiers from, does not exist yet.
+var errNoUsersTable = errors.New("auth users table is not available")
+
+func usersTableError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+		return errNoUsersTable
+	}
+	return err
+}
+
+// queryFunnel counts users reaching each step of the funnel.
+func queryFunnel(ctx context.Context, f FunnelQuery) (*FunnelResponse, error) {
+	query, args := funnelSQL(f)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, usersTableError(err)
+	}
+	defer rows.Close()
+
+	var groups []string
+	var counts [][]int64
+	for rows.Next() {
+		var group string
+		row := make([]int64, len(f.Steps))
+		dest := []interface{}{&group}
+		for i := range row {
+			dest = append(dest, &row[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+		counts = append(counts, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return summarizeFunnel(f, groups, counts), nil
+}
+
+// queryRetention builds the weekly cohort retention table.
+func queryRetention(ctx context.Context, r RetentionQuery) (*RetentionResponse, error) {
+	query, args := retentionSQL(r)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, usersTableError(err)
+	}
+	defer rows.Close()
+
+	var results []retentionRow
+	for rows.Next() {
+		var row retentionRow
+		var offset sql.NullInt64
+		if err := rows.Scan(&row.Week, &row.Group, &offset, &row.Users); err != nil {
+			return nil, err
+		}
+		row.Offset = -1
+		if offset.Valid {
+			row.Offset = int(offset.Int64)
+		}
+		results = append(results, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &RetentionResponse{
+		From: r.From, To: r.To, Weeks: r.Weeks, EventType: r.EventType, Breakdown: r.Breakdown,
+		Cohorts: buildCohorts(r, results, time.Now().UTC()),
+	}, nil
+}
+
+// writeAnalysisError reports a failed funnel or retention query.
+func writeAnalysisError(w http.ResponseWriter, what string, err error) {
+	if errors.Is(err, errNoUsersTable) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	log.Printf("Computing %s failed: %v", what, err)
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to compute " + what})
+}
+
+func handleFunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	query, err := parseFunnelQuery(r.URL.Query(), time.Now().UTC())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	funnel, err := queryFunnel(r.Context(), query)
+	if err != nil {
+		writeAnalysisError(w, "funnel", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(funnel)
+}
+
+func handleRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	query, err := parseRetentionQuery(r.URL.Query(), time.Now().UTC())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	retention, err := queryRetention(r.Context(), query)
+	if err != nil {
+		writeAnalysisError(w, "retention", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retention)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseFunnelQuery tests funnel step, window and breakdown parsing
+func TestParseFunnelQuery(t *testing.T) {
+	now := time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query   string
+		steps   int
+		window  time.Duration
+		wantErr bool
+	}{
+		{"steps=signup,inference,any", 3, 7 * 24 * time.Hour, false},
+		{"steps=login, inference&window=36h&breakdown=tier", 2, 36 * time.Hour, false},
+		{"steps=signup,inference&window=30d&from=2024-03-01&to=2024-03-08", 2, 30 * 24 * time.Hour, false},
+		{"steps=inference", 0, 0, true},
+		{"steps=a,b,c,d,e,f,g,h,i,j,k", 0, 0, true},
+		{"steps=inference,signup", 0, 0, true},
+		{"steps=signup,inference&window=91d", 0, 0, true},
+		{"steps=signup,inference&window=soon", 0, 0, true},
+		{"steps=signup,inference&breakdown=country", 0, 0, true},
+		{"steps=signup,inference&from=2024-03-08&to=2024-03-01", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		got, err := parseFunnelQuery(q, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFunnelQuery(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (len(got.Steps) != tt.steps || got.Window != tt.window) {
+			t.Errorf("parseFunnelQuery(%q) = %d steps, window %s", tt.query, len(got.Steps), got.Window)
+		}
+	}
+}
+
+// TestFunnelSQL tests the generated funnel query
+func TestFunnelSQL(t *testing.T) {
+	q, _ := url.ParseQuery("steps=signup,inference,any&breakdown=tier")
+	f, _ := parseFunnelQuery(q, time.Now())
+	query, args := funnelSQL(f)
+
+	for _, want := range []string{
+		"FROM users u",
+		"SELECT s2.*, (",
+		"AND e.created_at > s1.t1",
+		"AND e.created_at > s2.t2",
+		"AND e.event_type = $4",
+		"COALESCE(u.tier, 'unknown'), COUNT(t1), COUNT(t2), COUNT(t3) FROM s3 LEFT JOIN users u",
+	} {
+		if !strings.Contains(strings.Join(strings.Fields(query), " "), want) {
+			t.Errorf("funnel SQL missing %q:\n%s", want, query)
+		}
+	}
+	if len(args) != 4 || args[3] != "inference" {
+		t.Errorf("args = %v, want the window and one event type", args)
+	}
+	if strings.Contains(query, "$5") {
+		t.Error("the any step should not filter on event type")
+	}
+
+	q, _ = url.ParseQuery("steps=login,inference")
+	f, _ = parseFunnelQuery(q, time.Now())
+	query, args = funnelSQL(f)
+	if strings.Contains(query, "users") {
+		t.Error("a funnel without signup or a tier breakdown should not read the users table")
+	}
+	if len(args) != 5 || args[3] != "login" || args[4] != "inference" {
+		t.Errorf("args = %v", args)
+	}
+}
+
+// TestSummarizeFunnel tests conversion rates and breakdown totals
+func TestSummarizeFunnel(t *testing.T) {
+	f := FunnelQuery{Steps: []string{"signup", "inference", "any"}, Window: 7 * 24 * time.Hour, Breakdown: "tier"}
+	resp := summarizeFunnel(f, []string{"free", "pro"}, [][]int64{{80, 40, 10}, {20, 18, 15}})
+
+	if len(resp.Groups) != 2 || resp.Groups[1].Group != "pro" {
+		t.Fatalf("groups = %+v", resp.Groups)
+	}
+	total := resp.Total.Steps
+	if total[0].Users != 100 || total[1].Users != 58 || total[2].Users != 25 {
+		t.Errorf("totals = %+v", total)
+	}
+	if total[2].Conversion != 0.25 || total[1].StepConversion != 0.58 || total[0].StepConversion != 1 {
+		t.Errorf("conversion = %+v", total)
+	}
+	if pro := resp.Groups[1].Steps[2]; pro.Conversion != 0.75 {
+		t.Errorf("pro conversion = %v, want 0.75", pro.Conversion)
+	}
+
+	empty := summarizeFunnel(FunnelQuery{Steps: []string{"login", "inference"}}, nil, nil)
+	if empty.Total.Steps[1].Conversion != 0 || empty.Groups != nil {
+		t.Errorf("empty funnel = %+v", empty)
+	}
+}
+
+// TestBuildCohorts tests the weekly retention table
+func TestBuildCohorts(t *testing.T) {
+	now := time.Date(2024, 3, 26, 0, 0, 0, 0, time.UTC)
+	feb26 := time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC)
+	mar4 := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	r := RetentionQuery{Weeks: 3}
+	rows := []retentionRow{
+		{Week: mar4, Group: "all", Offset: -1, Users: 10},
+		{Week: mar4, Group: "all", Offset: 0, Users: 9},
+		{Week: mar4, Group: "all", Offset: 1, Users: 4},
+		{Week: feb26, Group: "all", Offset: -1, Users: 20},
+		{Week: feb26, Group: "all", Offset: 0, Users: 20},
+		{Week: feb26, Group: "all", Offset: 2, Users: 5},
+	}
+	cohorts := buildCohorts(r, rows, now)
+
+	if len(cohorts) != 2 || cohorts[0].Cohort != "2024-02-26" || cohorts[1].Cohort != "2024-03-04" {
+		t.Fatalf("cohorts = %+v", cohorts)
+	}
+	feb := cohorts[0]
+	if feb.Users != 20 || *feb.Retained[0] != 20 || *feb.Retained[1] != 0 || *feb.Retained[2] != 5 || *feb.Retention[2] != 0.25 {
+		t.Errorf("feb 26 cohort = %+v", feb)
+	}
+	mar := cohorts[1]
+	if *mar.Retained[0] != 9 || *mar.Retained[1] != 4 {
+		t.Errorf("mar 4 cohort = %+v", mar)
+	}
+	if mar.Retained[2] != nil || mar.Retention[2] != nil {
+		t.Error("week 2 of the mar 4 cohort has not ended and should be null")
+	}
+	if feb.Group != "" {
+		t.Error("group should be omitted without a breakdown")
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -15,11 +19,15 @@ import (
 var db *sql.DB
 
 type AnalyticsEvent struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	EventType string    `json:"event_type"`
-	Metadata  string    `json:"metadata"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            string    `json:"id"`
+	UserID        string    `json:"user_id"`
+	EventType     string    `json:"event_type"`
+	SchemaVersion int       `json:"schema_version,omitempty"`
+	Metadata      string    `json:"metadata"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// Quarantine is why the event failed its schema check, if it did.
+	Quarantine string `json:"-"`
 }
 
 type HealthResponse struct {
@@ -86,13 +94,59 @@ func main() {
 		port = "4005"
 	}
 
+	privacy = privacyPolicyFromEnv()
+	maxEventAge = maxEventAgeFromEnv()
+	if err := createTables(); err != nil {
+		log.Printf("Warning: Failed to create analytics tables: %v", err)
+	} else {
+		if err := loadSchemas(context.Background()); err != nil {
+			log.Printf("Warning: Failed to load event schemas, using built-in schemas: %v", err)
+		}
+		startRollupWorker(rollupInterval())
+		startPurgeWorker(retentionFromEnv())
+	}
+
+	var err error
+	events, err = newEventQueue(queueConfigFromEnv(), newSQLEventSink())
+	if err != nil {
+		log.Fatalf("Failed to start event queue: %v", err)
+	}
+
 	http.HandleFunc("/health", handleHealth)
 	http.HandleFunc("/ready", handleReady)
 	http.HandleFunc("/analytics/track", handleTrackEvent)
+	http.HandleFunc("/analytics/batch", handleBatchEvents)
 	http.HandleFunc("/analytics/stats", handleGetStats)
+	http.HandleFunc("/analytics/schemas", handleListSchemas)
+	http.HandleFunc("/analytics/funnel", handleFunnel)
+	http.HandleFunc("/analytics/retention", handleRetention)
+	http.HandleFunc("/analytics/erasure", handleErasure)
+	http.HandleFunc("/analytics/erasure/verify", handleVerifyErasure)
+
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		log.Printf("Analytics Service listening on port %s", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// On SIGTERM stop taking requests, then write out everything queued.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down analytics service")
 
-	log.Printf("Analytics Service listening on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Warning: HTTP shutdown: %v", err)
+	}
+	if err := events.Close(ctx); err != nil {
+		log.Printf("Error: %v", err)
+	}
+	stats := events.Stats()
+	log.Printf("Event queue drained: written=%d dropped=%d rejected=%d", stats.Written, stats.Dropped, stats.Rejected)
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -111,49 +165,11 @@ func handleReady(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Database unavailable"})
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ReadyResponse{Status: "ready"})
-}
-
-func handleTrackEvent(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
-		return
-	}
-
-	var event AnalyticsEvent
-	err := json.NewDecoder(r.Body).Decode(&event)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
-		return
-	}
-
-	// Log async to database
-	go func() {
-		log.Printf("Analytics: user=%s, event=%s, metadata=%s", event.UserID, event.EventType, event.Metadata)
-	}()
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "tracked",
-	})
-}
-
-func handleGetStats(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+	if !queueHealthy(events.Stats()) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Event queue is nearly full"})
 		return
 	}
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"total_events": 0,
-		"active_users": 0,
-		"avg_latency":  0,
-		"uptime_hours": time.Since(time.Now().Add(-24 * time.Hour)).Hours(),
-	})
+	json.NewEncoder(w).Encode(ReadyResponse{Status: "ready"})
 }
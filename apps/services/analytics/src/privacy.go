@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Masking actions for PII fields in event metadata.
+const (
+	maskRedact = "redact" // replace the value with redactedValue
+	maskHash   = "hash"   // replace the value with a keyed hash, so it can still be grouped on
+	maskDrop   = "drop"   // remove the field
+
+	redactedValue = "[REDACTED]"
+)
+
+// Erasure modes.
+const (
+	erasureDelete       = "delete"
+	erasurePseudonymize = "pseudonymize"
+)
+
+// defaultMaskedFields are always redacted unless configured otherwise.
+var defaultMaskedFields = map[string]string{
+	"password":      maskRedact,
+	"token":         maskRedact,
+	"apikey":        maskRedact,
+	"secret":        maskRedact,
+	"accesstoken":   maskRedact,
+	"refreshtoken":  maskRedact,
+	"authorization": maskRedact,
+}
+
+// normalizeField folds a metadata key so that apiKey, api_key and API-KEY
+// all match the rule for apikey.
+func normalizeField(name string) string {
+	return strings.NewReplacer("_", "", "-", "", ".", "", " ", "").Replace(strings.ToLower(name))
+}
+
+// PrivacyPolicy masks PII in event metadata. Key is used for hashed fields
+// and to sign erasure receipts.
+type PrivacyPolicy struct {
+	Fields map[string]string // normalized field name -> action
+	Key    []byte
+}
+
+// parseMaskRules reads rules such as "email:hash,ip:hash,phone:redact" on
+// top of the defaults.
+func parseMaskRules(raw string) (map[string]string, error) {
+	rules := map[string]string{}
+	for field, action := range defaultMaskedFields {
+		rules[field] = action
+	}
+	for _, rule := range strings.Split(raw, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		field, action, ok := strings.Cut(rule, ":")
+		field = normalizeField(strings.TrimSpace(field))
+		if !ok || field == "" {
+			return nil, fmt.Errorf("mask rule %q must be field:action", rule)
+		}
+		switch action = strings.TrimSpace(action); action {
+		case maskRedact, maskHash, maskDrop:
+			rules[field] = action
+		default:
+			return nil, fmt.Errorf("mask rule %q: action must be redact, hash or drop", rule)
+		}
+	}
+	return rules, nil
+}
+
+// privacyPolicyFromEnv reads ANALYTICS_PII_FIELDS and ANALYTICS_PRIVACY_KEY.
+func privacyPolicyFromEnv() PrivacyPolicy {
+	policy := PrivacyPolicy{Key: []byte(os.Getenv("ANALYTICS_PRIVACY_KEY"))}
+	rules, err := parseMaskRules(os.Getenv("ANALYTICS_PII_FIELDS"))
+	if err != nil {
+		log.Printf("Warning: invalid ANALYTICS_PII_FIELDS (%v), using defaults", err)
+		rules, _ = parseMaskRules("")
+	}
+	policy.Fields = rules
+	if len(policy.Key) == 0 {
+		log.Printf("Warning: ANALYTICS_PRIVACY_KEY is not set; using a random key, so hashed fields and erasure receipts will not match across restarts")
+		policy.Key = make([]byte, 32)
+		if _, err := rand.Read(policy.Key); err != nil {
+			log.Fatalf("Failed to generate privacy key: %v", err)
+		}
+	}
+	return policy
+}
+
+// keyedHash is an HMAC-SHA256 of value under the policy key, separated by
+// purpose so a field hash cannot be passed off as a signature.
+func (p PrivacyPolicy) keyedHash(purpose, value string) string {
+	mac := hmac.New(sha256.New, p.Key)
+	mac.Write([]byte(purpose + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// maskMetadata applies the policy to every object in a metadata document,
+// at any depth. The document is returned unchanged when nothing matched.
+func (p PrivacyPolicy) maskMetadata(metadata string) string {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(metadata), &doc); err != nil {
+		return metadata
+	}
+	masked, changed := p.maskValue(doc)
+	if !changed {
+		return metadata
+	}
+	out, err := json.Marshal(masked)
+	if err != nil {
+		return metadata
+	}
+	return string(out)
+}
+
+func (p PrivacyPolicy) maskValue(value interface{}) (interface{}, bool) {
+	changed := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			action, ok := p.Fields[normalizeField(name)]
+			if !ok {
+				var c bool
+				v[name], c = p.maskValue(field)
+				changed = changed || c
+				continue
+			}
+			changed = true
+			switch action {
+			case maskDrop:
+				delete(v, name)
+			case maskHash:
+				if field != nil {
+					raw, _ := json.Marshal(field)
+					if s, ok := field.(string); ok {
+						raw = []byte(s)
+					}
+					v[name] = "hmac:" + p.keyedHash("pii", string(raw))
+				}
+			default:
+				v[name] = redactedValue
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			var c bool
+			v[i], c = p.maskValue(item)
+			changed = changed || c
+		}
+	}
+	return value, changed
+}
+
+// RetentionPolicies maps event types to how many days their events are
+// kept. The "*" entry applies to every type without its own entry; types
+// with no entry at all are kept indefinitely.
+type RetentionPolicies map[string]int
+
+// retentionDefault is the RetentionPolicies key for unlisted event types.
+const retentionDefault = "*"
+
+// validateRetentionDays checks a retention period.
+func validateRetentionDays(days int) error {
+	if days <= 0 {
+		return fmt.Errorf("retention must be at least one day, got %d", days)
+	}
+	return nil
+}
+
+// parseRetentionPolicies reads policies such as "login=90,error=30,*=365".
+func parseRetentionPolicies(raw string) (RetentionPolicies, error) {
+	policies := RetentionPolicies{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		eventType, rawDays, ok := strings.Cut(entry, "=")
+		eventType = strings.TrimSpace(eventType)
+		if !ok || eventType == "" {
+			return nil, fmt.Errorf("retention entry %q must be event_type=days", entry)
+		}
+		days, err := strconv.Atoi(strings.TrimSpace(rawDays))
+		if err != nil {
+			return nil, fmt.Errorf("retention entry %q: days must be a number", entry)
+		}
+		if err := validateRetentionDays(days); err != nil {
+			return nil, fmt.Errorf("retention entry %q: %w", entry, err)
+		}
+		policies[eventType] = days
+	}
+	return policies, nil
+}
+
+// explicitTypes lists the event types with their own policy, sorted.
+func (r RetentionPolicies) explicitTypes() []string {
+	var types []string
+	for eventType := range r {
+		if eventType != retentionDefault {
+			types = append(types, eventType)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ErasureRequest is the /analytics/erasure body.
+type ErasureRequest struct {
+	UserID string `json:"user_id"`
+	Mode   string `json:"mode"`
+}
+
+func (r *ErasureRequest) validate() error {
+	if r.UserID == "" {
+		return fmt.Errorf("user_id is required")
+	}
+	if r.Mode == "" {
+		r.Mode = erasureDelete
+	}
+	if r.Mode != erasureDelete && r.Mode != erasurePseudonymize {
+		return fmt.Errorf("mode must be delete or pseudonymize")
+	}
+	return nil
+}
+
+// ErasureReceipt records what an erasure did. Subject identifies the user
+// by keyed hash, so the receipt itself holds no PII; Signature covers every
+// other field.
+type ErasureReceipt struct {
+	ID          string           `json:"receipt_id"`
+	Subject     string           `json:"subject"`
+	Mode        string           `json:"mode"`
+	Rows        map[string]int64 `json:"rows"`
+	CompletedAt time.Time        `json:"completed_at"`
+	Signature   string           `json:"signature,omitempty"`
+}
+
+// payload is the canonical form of the receipt that is signed.
+func (r ErasureReceipt) payload() []byte {
+	r.Signature = ""
+	r.CompletedAt = r.CompletedAt.UTC()
+	data, _ := json.Marshal(r)
+	return data
+}
+
+// subject returns the receipt subject for a user ID.
+func (p PrivacyPolicy) subject(userID string) string {
+	return p.keyedHash("subject", userID)
+}
+
+// sign sets the receipt's signature.
+func (p PrivacyPolicy) sign(r *ErasureReceipt) {
+	r.Signature = p.keyedHash("receipt", string(r.payload()))
+}
+
+// verify reports whether the receipt was signed with the policy key and is
+// unmodified.
+func (p PrivacyPolicy) verify(r ErasureReceipt) bool {
+	want := p.keyedHash("receipt", string(r.payload()))
+	return hmac.Equal([]byte(want), []byte(r.Signature))
+}
+
+// newPseudonym returns a random user ID to replace an erased one. It is not
+// derived from the original, so pseudonymized events cannot be linked back.
+func newPseudonym() (string, error) {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return "erased-" + hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// privacy is set from the environment in main.
+var privacy PrivacyPolicy
+
+// purgeBatch bounds how many events one purge statement deletes.
+const purgeBatch = 10000
+
+const privacySchema = `
+	CREATE TABLE IF NOT EXISTS analytics_erasures (
+		receipt_id UUID PRIMARY KEY,
+		subject VARCHAR(64) NOT NULL,
+		mode VARCHAR(20) NOT NULL,
+		rows JSONB NOT NULL,
+		completed_at TIMESTAMP NOT NULL,
+		signature VARCHAR(64) NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_analytics_erasures_subject ON analytics_erasures(subject);
+	`
+
+// beginMaintenance starts a transaction allowed to change analytics_events.
+func beginMaintenance(ctx context.Context) (*sql.Tx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT set_config('analytics.maintenance', 'on', true)"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// purgeTable deletes rows of one event type, or of every type except
+// exclude, created before cutoff, in batches of purgeBatch.
+func purgeTable(ctx context.Context, table, key, eventType string, exclude []string, cutoff time.Time) (int64, error) {
+	typeCond, typeArg := "event_type = $2", interface{}(eventType)
+	if eventType == retentionDefault {
+		typeCond, typeArg = "NOT (event_type = ANY($2))", pq.Array(exclude)
+	}
+	query := fmt.Sprintf(`
+		DELETE FROM %[1]s WHERE (%[2]s) IN (
+			SELECT %[2]s FROM %[1]s WHERE created_at < $1 AND %[3]s LIMIT %[4]d
+		)`, table, key, typeCond, purgeBatch)
+
+	var total int64
+	for {
+		tx, err := beginMaintenance(ctx)
+		if err != nil {
+			return total, err
+		}
+		res, err := tx.ExecContext(ctx, query, cutoff, typeArg)
+		if err != nil {
+			tx.Rollback()
+			return total, err
+		}
+		if err := tx.Commit(); err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < purgeBatch {
+			return total, nil
+		}
+	}
+}
+
+// purgeExpired deletes events, quarantined events and per-user rollups
+// older than their type's retention. Hourly rollups hold no user data and
+// are kept.
+func purgeExpired(ctx context.Context, policies RetentionPolicies, now time.Time) (map[string]int64, error) {
+	purged := map[string]int64{}
+	exclude := policies.explicitTypes()
+	for eventType, days := range policies {
+		cutoff := now.AddDate(0, 0, -days)
+		for _, t := range []struct{ table, key string }{
+			{"analytics_events", "id, created_at"},
+			{"analytics_events_quarantine", "id"},
+		} {
+			n, err := purgeTable(ctx, t.table, t.key, eventType, exclude, cutoff)
+			purged[eventType] += n
+			if err != nil {
+				return purged, err
+			}
+		}
+
+		typeCond, typeArg := "event_type = $2", interface{}(eventType)
+		if eventType == retentionDefault {
+			typeCond, typeArg = "NOT (event_type = ANY($2))", pq.Array(exclude)
+		}
+		if _, err := db.ExecContext(ctx,
+			"DELETE FROM analytics_rollup_daily_users WHERE day < $1::date AND "+typeCond, cutoff, typeArg,
+		); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// retentionFromEnv reads ANALYTICS_RETENTION_DAYS and
+// ANALYTICS_PURGE_INTERVAL (default one hour).
+func retentionFromEnv() (RetentionPolicies, time.Duration) {
+	policies, err := parseRetentionPolicies(os.Getenv("ANALYTICS_RETENTION_DAYS"))
+	if err != nil {
+		log.Printf("Warning: invalid ANALYTICS_RETENTION_DAYS (%v), keeping all events", err)
+		policies = RetentionPolicies{}
+	}
+	interval := time.Hour
+	if raw := os.Getenv("ANALYTICS_PURGE_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			interval = d
+		} else {
+			log.Printf("Warning: invalid ANALYTICS_PURGE_INTERVAL %q, using default", raw)
+		}
+	}
+	return policies, interval
+}
+
+// startPurgeWorker enforces retention now and then on every interval.
+func startPurgeWorker(policies RetentionPolicies, interval time.Duration) {
+	if len(policies) == 0 {
+		return
+	}
+	go func() {
+		for {
+			purged, err := purgeExpired(context.Background(), policies, time.Now().UTC())
+			if err != nil {
+				log.Printf("Warning: Analytics retention purge failed: %v", err)
+			}
+			for eventType, n := range purged {
+				if n > 0 {
+					log.Printf("Purged %d expired %q events", n, eventType)
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// eraseUser deletes or pseudonymizes every stored row for a user in one
+// transaction and records a signed receipt.
+func eraseUser(ctx context.Context, req ErasureRequest) (*ErasureReceipt, error) {
+	// Events still queued would otherwise be written after the erasure.
+	if events != nil {
+		if err := events.Sync(ctx); err != nil {
+			return nil, err
+		}
+	}
+	id, err := newEventID()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := beginMaintenance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	type statement struct {
+		table, query string
+		args         []interface{}
+	}
+	var statements []statement
+	if req.Mode == erasureDelete {
+		statements = []statement{
+			{"analytics_events", "DELETE FROM analytics_events WHERE user_id = $1", []interface{}{req.UserID}},
+			{"analytics_rollup_daily_users", "DELETE FROM analytics_rollup_daily_users WHERE user_id = $1", []interface{}{req.UserID}},
+		}
+	} else {
+		pseudonym, err := newPseudonym()
+		if err != nil {
+			return nil, err
+		}
+		statements = []statement{
+			{"analytics_events", "UPDATE analytics_events SET user_id = $2, metadata = '{}' WHERE user_id = $1", []interface{}{req.UserID, pseudonym}},
+			{"analytics_rollup_daily_users", "UPDATE analytics_rollup_daily_users SET user_id = $2 WHERE user_id = $1", []interface{}{req.UserID, pseudonym}},
+		}
+	}
+	// Quarantined events are only kept for debugging, so they are always deleted.
+	statements = append(statements, statement{
+		"analytics_events_quarantine", "DELETE FROM analytics_events_quarantine WHERE user_id = $1", []interface{}{req.UserID},
+	})
+
+	receipt := &ErasureReceipt{
+		ID:          id,
+		Subject:     privacy.subject(req.UserID),
+		Mode:        req.Mode,
+		Rows:        map[string]int64{},
+		CompletedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	for _, stmt := range statements {
+		res, err := tx.ExecContext(ctx, stmt.query, stmt.args...)
+		if err != nil {
+			return nil, fmt.Errorf("erasing %s: %w", stmt.table, err)
+		}
+		receipt.Rows[stmt.table], _ = res.RowsAffected()
+	}
+	privacy.sign(receipt)
+
+	rows, _ := json.Marshal(receipt.Rows)
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO analytics_erasures (receipt_id, subject, mode, rows, completed_at, signature)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, receipt.ID, receipt.Subject, receipt.Mode, string(rows), receipt.CompletedAt, receipt.Signature); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// ErasureVerification is the /analytics/erasure/verify payload.
+type ErasureVerification struct {
+	ReceiptID       string `json:"receipt_id"`
+	ValidSignature  bool   `json:"valid_signature"`
+	Recorded        bool   `json:"recorded"`
+	SubjectMatches  *bool  `json:"subject_matches,omitempty"`
+	RemainingEvents *int64 `json:"remaining_events,omitempty"`
+	Verified        bool   `json:"verified"`
+}
+
+// verifyErasure checks a receipt's signature and that it was issued by this
+// service. Given the user ID, it also checks that none of the user's
+// events from before the erasure remain.
+func verifyErasure(ctx context.Context, receipt ErasureReceipt, userID string) (*ErasureVerification, error) {
+	v := &ErasureVerification{ReceiptID: receipt.ID, ValidSignature: privacy.verify(receipt)}
+	var signature string
+	err := db.QueryRowContext(ctx,
+		"SELECT signature FROM analytics_erasures WHERE receipt_id = $1", receipt.ID).Scan(&signature)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		v.Recorded = signature == receipt.Signature
+	}
+	v.Verified = v.ValidSignature && v.Recorded
+
+	if userID != "" {
+		matches := privacy.subject(userID) == receipt.Subject
+		v.SubjectMatches = &matches
+		var remaining int64
+		if err := db.QueryRowContext(ctx, `
+			SELECT (SELECT COUNT(*) FROM analytics_events WHERE user_id = $1 AND received_at <= $2)
+				+ (SELECT COUNT(*) FROM analytics_events_quarantine WHERE user_id = $1 AND received_at <= $2)
+		`, userID, receipt.CompletedAt).Scan(&remaining); err != nil {
+			return nil, err
+		}
+		v.RemainingEvents = &remaining
+		v.Verified = v.Verified && matches && remaining == 0
+	}
+	return v, nil
+}
+
+func handleErasure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req ErasureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if err := req.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	receipt, err := eraseUser(r.Context(), req)
+	if err != nil {
+		log.Printf("Erasing analytics data failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to erase user data"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+func handleVerifyErasure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Receipt ErasureReceipt `json:"receipt"`
+		UserID  string         `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Receipt.ID == "" || !isUUID(req.Receipt.ID) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Request must include a receipt"})
+		return
+	}
+
+	v, err := verifyErasure(r.Context(), req.Receipt, req.UserID)
+	if err != nil {
+		log.Printf("Verifying erasure receipt failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to verify receipt"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMaskMetadata tests PII masking rules at any depth
+func TestMaskMetadata(t *testing.T) {
+	rules, err := parseMaskRules("email:hash, ip:drop")
+	if err != nil {
+		t.Fatalf("parseMaskRules() error = %v", err)
+	}
+	policy := PrivacyPolicy{Fields: rules, Key: []byte("test-key")}
+
+	masked := policy.maskMetadata(`{
+		"model": "llama2",
+		"tokens": 50,
+		"API_Key": "sk-123",
+		"email": "jane@example.com",
+		"ip": "10.0.0.1",
+		"request": {"headers": [{"Authorization": "Bearer abc"}], "password": null}
+	}`)
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(masked), &got); err != nil {
+		t.Fatalf("masked metadata is not JSON: %v", err)
+	}
+
+	if got["model"] != "llama2" || got["tokens"] != float64(50) {
+		t.Errorf("unmatched fields should be kept: %v", got)
+	}
+	if got["API_Key"] != redactedValue {
+		t.Errorf("API_Key = %v, want redacted", got["API_Key"])
+	}
+	if _, ok := got["ip"]; ok {
+		t.Error("ip should be dropped")
+	}
+	email, _ := got["email"].(string)
+	if !strings.HasPrefix(email, "hmac:") || strings.Contains(email, "jane") {
+		t.Errorf("email = %q, want a keyed hash", email)
+	}
+	if again := policy.maskMetadata(`{"email": "jane@example.com"}`); !strings.Contains(again, email) {
+		t.Error("hashing should be stable for the same key")
+	}
+	request := got["request"].(map[string]interface{})
+	header := request["headers"].([]interface{})[0].(map[string]interface{})
+	if header["Authorization"] != redactedValue || request["password"] != redactedValue {
+		t.Errorf("nested fields should be masked: %v", request)
+	}
+
+	plain := `{"tokens": 5,  "model": "m"}`
+	if policy.maskMetadata(plain) != plain {
+		t.Error("metadata without PII should be returned unchanged")
+	}
+	if _, err := parseMaskRules("email:encrypt"); err == nil {
+		t.Error("unknown actions should be rejected")
+	}
+	if _, err := parseMaskRules("email"); err == nil {
+		t.Error("rules without an action should be rejected")
+	}
+}
+
+// TestParseRetentionPolicies tests per-event-type retention parsing
+func TestParseRetentionPolicies(t *testing.T) {
+	policies, err := parseRetentionPolicies("login=90, error=30,*=365")
+	if err != nil {
+		t.Fatalf("parseRetentionPolicies() error = %v", err)
+	}
+	if policies["login"] != 90 || policies["error"] != 30 || policies[retentionDefault] != 365 {
+		t.Errorf("policies = %v", policies)
+	}
+	if types := policies.explicitTypes(); strings.Join(types, ",") != "error,login" {
+		t.Errorf("explicit types = %v", types)
+	}
+
+	for _, raw := range []string{"login=0", "login=-1", "login=soon", "=30", "login"} {
+		if _, err := parseRetentionPolicies(raw); err == nil {
+			t.Errorf("parseRetentionPolicies(%q) should fail", raw)
+		}
+	}
+	if empty, err := parseRetentionPolicies(""); err != nil || len(empty) != 0 {
+		t.Errorf("empty config = %v, %v; want no policies", empty, err)
+	}
+}
+
+// TestErasureReceipt tests receipt signing and verification
+func TestErasureReceipt(t *testing.T) {
+	policy := PrivacyPolicy{Key: []byte("test-key")}
+	receipt := ErasureReceipt{
+		ID:          "6f9619ff-8b86-4011-b42d-00c04fc964ff",
+		Subject:     policy.subject("user-1"),
+		Mode:        erasureDelete,
+		Rows:        map[string]int64{"analytics_events": 12, "analytics_events_quarantine": 1},
+		CompletedAt: time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC),
+	}
+	policy.sign(&receipt)
+	if !policy.verify(receipt) {
+		t.Fatal("a freshly signed receipt should verify")
+	}
+
+	// The receipt a client holds has been through JSON.
+	data, _ := json.Marshal(receipt)
+	var decoded ErasureReceipt
+	json.Unmarshal(data, &decoded)
+	if !policy.verify(decoded) {
+		t.Error("a receipt should still verify after a JSON round trip")
+	}
+	if strings.Contains(string(data), "user-1") {
+		t.Error("the receipt should not contain the user ID")
+	}
+
+	tampered := decoded
+	tampered.Rows = map[string]int64{"analytics_events": 0}
+	if policy.verify(tampered) {
+		t.Error("a receipt with altered counts should not verify")
+	}
+	if (PrivacyPolicy{Key: []byte("other-key")}).verify(decoded) {
+		t.Error("a receipt should not verify under another key")
+	}
+
+	req := ErasureRequest{UserID: "user-1"}
+	if err := req.validate(); err != nil || req.Mode != erasureDelete {
+		t.Errorf("default mode = %q, %v; want delete", req.Mode, err)
+	}
+	if err := (&ErasureRequest{UserID: "user-1", Mode: "forget"}).validate(); err == nil {
+		t.Error("unknown modes should be rejected")
+	}
+	if p1, _ := newPseudonym(); !strings.HasPrefix(p1, "erased-") {
+		t.Errorf("pseudonym = %q", p1)
+	}
+}
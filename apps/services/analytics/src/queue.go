@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errQueueFull   = errors.New("event queue is full")
+	errQueueClosed = errors.New("event queue is closed")
+)
+
+// eventSink persists one batch of events.
+type eventSink interface {
+	writeBatch(ctx context.Context, events []AnalyticsEvent) error
+}
+
+// QueueConfig sizes the in-process event queue.
+type QueueConfig struct {
+	Capacity      int           // events buffered before Enqueue rejects
+	BatchSize     int           // maximum events per write
+	FlushInterval time.Duration // longest an event waits for a full batch
+	MaxBackoff    time.Duration // longest wait between attempts to write a failed batch; 0 for the default
+}
+
+func defaultQueueConfig() QueueConfig {
+	return QueueConfig{Capacity: 10000, BatchSize: 500, FlushInterval: time.Second, MaxBackoff: 30 * time.Second}
+}
+
+func (c QueueConfig) validate() error {
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive")
+	}
+	if c.Capacity < c.BatchSize {
+		return fmt.Errorf("queue capacity must be at least the batch size")
+	}
+	if c.FlushInterval <= 0 {
+		return fmt.Errorf("flush interval must be positive")
+	}
+	if c.MaxBackoff < 0 {
+		return fmt.Errorf("max backoff cannot be negative")
+	}
+	return nil
+}
+
+// QueueStats counts what has happened to enqueued events. Events are only
+// dropped when Close gives up on a batch that cannot be written.
+type QueueStats struct {
+	Queued   int   `json:"queued"`
+	Capacity int   `json:"capacity"`
+	Written  int64 `json:"written"`
+	Rejected int64 `json:"rejected"`
+	Dropped  int64 `json:"dropped"`
+}
+
+// EventQueue buffers events in memory and writes them to the sink in
+// batches from a single worker. Enqueue never blocks: when the buffer is
+// full the caller is told to back off. A batch that fails is retried until
+// it is written, so while the sink is down the buffer fills and callers
+// are turned away instead of accepted events being lost.
+type EventQueue struct {
+	cfg    QueueConfig
+	sink   eventSink
+	events chan AnalyticsEvent
+	done   chan struct{}
+	abort  chan struct{} // closed when Close gives up waiting
+
+	mu     sync.RWMutex // guards closed against concurrent Enqueue
+	closed bool
+
+	// enqueued counts accepted events; every one of them is eventually
+	// written or dropped, in order, by the single worker.
+	enqueued, written, rejected, dropped atomic.Int64
+}
+
+func newEventQueue(cfg QueueConfig, sink eventSink) (*EventQueue, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = defaultQueueConfig().MaxBackoff
+	}
+	q := &EventQueue{
+		cfg:    cfg,
+		sink:   sink,
+		events: make(chan AnalyticsEvent, cfg.Capacity),
+		done:   make(chan struct{}),
+		abort:  make(chan struct{}),
+	}
+	go q.run()
+	return q, nil
+}
+
+// Enqueue adds an event without blocking.
+func (q *EventQueue) Enqueue(event AnalyticsEvent) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return errQueueClosed
+	}
+	select {
+	case q.events <- event:
+		q.enqueued.Add(1)
+		return nil
+	default:
+		q.rejected.Add(1)
+		return errQueueFull
+	}
+}
+
+// Close stops accepting events and waits until everything already queued
+// has been written, or ctx expires. Then batches that fail are dropped
+// rather than retried.
+func (q *EventQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		close(q.abort)
+		return fmt.Errorf("draining event queue: %d events unwritten: %w", len(q.events), ctx.Err())
+	}
+}
+
+// Sync waits until every event enqueued before the call has been written
+// or dropped, or ctx expires.
+func (q *EventQueue) Sync(ctx context.Context) error {
+	target := q.enqueued.Load()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for q.written.Load()+q.dropped.Load() < target {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("syncing event queue: %w", ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (q *EventQueue) Stats() QueueStats {
+	return QueueStats{
+		Queued:   len(q.events),
+		Capacity: q.cfg.Capacity,
+		Written:  q.written.Load(),
+		Rejected: q.rejected.Load(),
+		Dropped:  q.dropped.Load(),
+	}
+}
+
+func (q *EventQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(q.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AnalyticsEvent, 0, q.cfg.BatchSize)
+	for {
+		select {
+		case event, ok := <-q.events:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) == q.cfg.BatchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush writes a batch, retrying with backoff until it succeeds. Accepted
+// events are only dropped once Close has given up on them.
+func (q *EventQueue) flush(batch []AnalyticsEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := q.sink.writeBatch(ctx, batch)
+		cancel()
+		if err == nil {
+			q.written.Add(int64(len(batch)))
+			return
+		}
+		if attempt == 1 || attempt%10 == 0 {
+			log.Printf("Error: writing %d analytics events failed (attempt %d), retrying: %v", len(batch), attempt, err)
+		}
+
+		select {
+		case <-q.abort:
+			q.dropped.Add(int64(len(batch)))
+			log.Printf("Error: dropping %d analytics events at shutdown: %v", len(batch), err)
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > q.cfg.MaxBackoff {
+			backoff = q.cfg.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memEventSink records written batches. Writes fail while failures > 0 and
+// wait on block when it is set.
+type memEventSink struct {
+	mu       sync.Mutex
+	batches  [][]AnalyticsEvent
+	failures int
+	block    chan struct{}
+}
+
+func (s *memEventSink) writeBatch(ctx context.Context, events []AnalyticsEvent) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("database unavailable")
+	}
+	s.batches = append(s.batches, append([]AnalyticsEvent(nil), events...))
+	return nil
+}
+
+func (s *memEventSink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, b := range s.batches {
+		n += len(b)
+	}
+	return n
+}
+
+// TestQueueBackpressure tests that a full queue rejects instead of blocking
+func TestQueueBackpressure(t *testing.T) {
+	sink := &memEventSink{block: make(chan struct{})}
+	q, err := newEventQueue(QueueConfig{Capacity: 4, BatchSize: 1, FlushInterval: time.Hour}, sink)
+	if err != nil {
+		t.Fatalf("newEventQueue: %v", err)
+	}
+
+	// The worker holds one event in a blocked write; four more fill the buffer.
+	accepted, rejected := 0, 0
+	for i := 0; i < 10; i++ {
+		switch err := q.Enqueue(AnalyticsEvent{UserID: "u1", EventType: "login"}); {
+		case err == nil:
+			accepted++
+		case errors.Is(err, errQueueFull):
+			rejected++
+		default:
+			t.Fatalf("Enqueue: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if accepted < 4 || accepted > 5 || rejected != 10-accepted {
+		t.Errorf("accepted %d, rejected %d; want 4 or 5 accepted and the rest rejected", accepted, rejected)
+	}
+	if got := q.Stats().Rejected; got != int64(rejected) {
+		t.Errorf("stats rejected = %d, want %d", got, rejected)
+	}
+
+	close(sink.block)
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if sink.count() != accepted {
+		t.Errorf("drained %d events, want %d", sink.count(), accepted)
+	}
+	if err := q.Enqueue(AnalyticsEvent{UserID: "u1", EventType: "login"}); !errors.Is(err, errQueueClosed) {
+		t.Errorf("Enqueue after Close: err = %v, want closed", err)
+	}
+}
+
+// TestQueueFlushAndRetry tests interval flushing and retried writes
+func TestQueueFlushAndRetry(t *testing.T) {
+	sink := &memEventSink{failures: 2}
+	q, err := newEventQueue(QueueConfig{Capacity: 100, BatchSize: 50, FlushInterval: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}, sink)
+	if err != nil {
+		t.Fatalf("newEventQueue: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		q.Enqueue(AnalyticsEvent{UserID: "u1", EventType: "inference"})
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sink.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sink.count() != 3 {
+		t.Fatalf("partial batch not flushed after retries: wrote %d", sink.count())
+	}
+
+	sink.mu.Lock()
+	sink.failures = 10
+	sink.mu.Unlock()
+	q.Enqueue(AnalyticsEvent{UserID: "u1", EventType: "inference"})
+	q.Close(context.Background())
+	if stats := q.Stats(); stats.Written != 4 || stats.Dropped != 0 {
+		t.Errorf("stats = %+v, want 4 written and none dropped", stats)
+	}
+}
+
+// TestQueueOutage tests that a sink outage fills the queue instead of
+// dropping accepted events
+func TestQueueOutage(t *testing.T) {
+	sink := &memEventSink{failures: 1 << 30}
+	q, err := newEventQueue(QueueConfig{Capacity: 4, BatchSize: 2, FlushInterval: time.Millisecond, MaxBackoff: 5 * time.Millisecond}, sink)
+	if err != nil {
+		t.Fatalf("newEventQueue: %v", err)
+	}
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		if q.Enqueue(AnalyticsEvent{UserID: "u1", EventType: "login"}) == nil {
+			accepted++
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if accepted >= 20 || q.Stats().Rejected == 0 {
+		t.Fatalf("accepted %d of 20 during the outage, want the full queue to reject", accepted)
+	}
+
+	sink.mu.Lock()
+	sink.failures = 0
+	sink.mu.Unlock()
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if stats := q.Stats(); sink.count() != accepted || stats.Written != int64(accepted) || stats.Dropped != 0 {
+		t.Errorf("wrote %d of %d accepted events after the outage, stats = %+v", sink.count(), accepted, stats)
+	}
+
+	// A batch that still cannot be written is dropped once Close gives up.
+	sink = &memEventSink{failures: 1 << 30}
+	q, _ = newEventQueue(QueueConfig{Capacity: 4, BatchSize: 1, FlushInterval: time.Millisecond, MaxBackoff: 5 * time.Millisecond}, sink)
+	q.Enqueue(AnalyticsEvent{UserID: "u1", EventType: "login"})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Close(ctx); err == nil {
+		t.Error("Close should time out while the sink is down")
+	}
+	<-q.done
+	if stats := q.Stats(); stats.Dropped != 1 {
+		t.Errorf("stats = %+v, want the event dropped at shutdown", stats)
+	}
+}
+
+// TestQueueCloseTimeout tests that Close gives up when the drain outlasts ctx
+func TestQueueCloseTimeout(t *testing.T) {
+	sink := &memEventSink{block: make(chan struct{})}
+	defer close(sink.block)
+	q, _ := newEventQueue(QueueConfig{Capacity: 10, BatchSize: 1, FlushInterval: time.Hour}, sink)
+	q.Enqueue(AnalyticsEvent{UserID: "u1", EventType: "login"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Close(ctx); err == nil || !strings.Contains(err.Error(), "draining") {
+		t.Errorf("Close = %v, want a drain timeout", err)
+	}
+}
+
+// TestValidateEventDefaults tests server-side defaults for tracked events
+func TestValidateEventDefaults(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	event := AnalyticsEvent{UserID: "u1", EventType: "login"}
+	if err := validateEvent(&event, now); err != nil {
+		t.Fatalf("validateEvent: %v", err)
+	}
+	if event.Metadata != "{}" || !event.CreatedAt.Equal(now) {
+		t.Errorf("defaults not applied: %+v", event)
+	}
+
+	future := AnalyticsEvent{UserID: "u1", EventType: "login", CreatedAt: now.Add(time.Hour)}
+	if err := validateEvent(&future, now); err == nil {
+		t.Error("events from the future should be rejected")
+	}
+	recent := AnalyticsEvent{UserID: "u1", EventType: "login", CreatedAt: now.Add(-maxEventAge + time.Minute)}
+	if err := validateEvent(&recent, now); err != nil {
+		t.Errorf("events within the age bound should be accepted: %v", err)
+	}
+	for _, old := range []time.Time{now.Add(-maxEventAge - time.Minute), time.Unix(0, 0), time.Date(1, 1, 1, 0, 0, 1, 0, time.UTC)} {
+		event := AnalyticsEvent{UserID: "u1", EventType: "login", CreatedAt: old}
+		if err := validateEvent(&event, now); err == nil {
+			t.Errorf("an event from %s should be rejected", old)
+		}
+	}
+	bad := AnalyticsEvent{UserID: "u1", EventType: "login", Metadata: "{oops"}
+	if err := validateEvent(&bad, now); err == nil {
+		t.Error("invalid metadata JSON should be rejected")
+	}
+
+	name, start, end := monthPartition(time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC))
+	if name != "analytics_events_2024_12" || start.Day() != 1 || end.Year() != 2025 || end.Month() != time.January {
+		t.Errorf("monthPartition = %s [%s, %s)", name, start, end)
+	}
+
+	id, err := newEventID()
+	if err != nil || len(id) != 36 || id[14] != '4' {
+		t.Errorf("newEventID = %q, %v; want a version 4 UUID", id, err)
+	}
+}
+
+// TestQueueSync tests waiting for events enqueued so far to be written
+func TestQueueSync(t *testing.T) {
+	sink := &memEventSink{block: make(chan struct{})}
+	q, _ := newEventQueue(QueueConfig{Capacity: 10, BatchSize: 5, FlushInterval: time.Millisecond}, sink)
+	defer q.Close(context.Background())
+	for i := 0; i < 3; i++ {
+		q.Enqueue(AnalyticsEvent{UserID: "u1", EventType: "login"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Sync(ctx); err == nil {
+		t.Error("Sync should wait while the write is blocked")
+	}
+	close(sink.block)
+	if err := q.Sync(context.Background()); err != nil || sink.count() != 3 {
+		t.Errorf("Sync = %v with %d of 3 events written", err, sink.count())
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errUnknownEventType = errors.New("unknown event type")
+
+// JSONSchema is the subset of JSON Schema used for event metadata: type,
+// properties, required, additionalProperties (boolean only), enum, items,
+// minimum, maximum, minLength and maxLength. Schemas using any other
+// keyword are refused when loaded rather than silently under-validated.
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 schemaTypes            `json:"type,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+}
+
+// schemaTypes is the type keyword, which may be one name or a list.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = many
+	return nil
+}
+
+func (t schemaTypes) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+var schemaTypeNames = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true, "integer": true, "boolean": true, "null": true,
+}
+
+// parseJSONSchema decodes and checks a schema document.
+func parseJSONSchema(raw []byte) (*JSONSchema, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	var s JSONSchema
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := s.check(); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return &s, nil
+}
+
+func (s *JSONSchema) check() error {
+	for _, t := range s.Type {
+		if !schemaTypeNames[t] {
+			return fmt.Errorf("unknown type %q", t)
+		}
+	}
+	for name, prop := range s.Properties {
+		if prop == nil {
+			return fmt.Errorf("property %q has no schema", name)
+		}
+		if err := prop.check(); err != nil {
+			return fmt.Errorf("property %q: %w", name, err)
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.check(); err != nil {
+			return fmt.Errorf("items: %w", err)
+		}
+	}
+	return nil
+}
+
+// validate returns every violation of the schema by value, a document
+// decoded with encoding/json. Paths are written like metadata.tokens.
+func (s *JSONSchema) validate(value interface{}, path string) []string {
+	var errs []string
+	if len(s.Type) > 0 && !s.allowsType(value) {
+		return []string{fmt.Sprintf("%s must be %s", path, strings.Join(s.Type, " or "))}
+	}
+	if len(s.Enum) > 0 && !enumContains(s.Enum, value) {
+		errs = append(errs, fmt.Sprintf("%s is not one of the allowed values", path))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, fmt.Sprintf("%s.%s is required", path, name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := s.Properties[name]; ok {
+				errs = append(errs, prop.validate(v[name], path+"."+name)...)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, fmt.Sprintf("%s.%s is not allowed", path, name))
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				errs = append(errs, s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			errs = append(errs, fmt.Sprintf("%s is shorter than %d characters", path, *s.MinLength))
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			errs = append(errs, fmt.Sprintf("%s is longer than %d characters", path, *s.MaxLength))
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			errs = append(errs, fmt.Sprintf("%s is less than %g", path, *s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			errs = append(errs, fmt.Sprintf("%s is greater than %g", path, *s.Maximum))
+		}
+	}
+	return errs
+}
+
+func (s *JSONSchema) allowsType(value interface{}) bool {
+	for _, t := range s.Type {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || (t == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case nil:
+			if t == "null" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func enumContains(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if fmt.Sprint(allowed) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// EventSchema is one version of the metadata schema for an event type.
+type EventSchema struct {
+	EventType   string          `json:"event_type"`
+	Version     int             `json:"version"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	compiled    *JSONSchema
+}
+
+// SchemaRegistry holds every version of every event type's schema. An event
+// without a schema_version is checked against the latest one.
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	byType  map[string][]EventSchema // ascending by version
+	ordered []EventSchema
+}
+
+// newSchemaRegistry compiles schemas, failing on the first invalid one.
+func newSchemaRegistry(list []EventSchema) (*SchemaRegistry, error) {
+	r := &SchemaRegistry{}
+	if err := r.replace(list); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// replace swaps in a new set of schemas, leaving the registry unchanged if
+// any of them is invalid.
+func (r *SchemaRegistry) replace(list []EventSchema) error {
+	byType := map[string][]EventSchema{}
+	ordered := make([]EventSchema, 0, len(list))
+	for _, s := range list {
+		if s.EventType == "" || s.Version <= 0 {
+			return fmt.Errorf("schema needs an event type and a positive version")
+		}
+		compiled, err := parseJSONSchema(s.Schema)
+		if err != nil {
+			return fmt.Errorf("%s v%d: %w", s.EventType, s.Version, err)
+		}
+		s.compiled = compiled
+		byType[s.EventType] = append(byType[s.EventType], s)
+		ordered = append(ordered, s)
+	}
+	for _, versions := range byType {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].EventType != ordered[j].EventType {
+			return ordered[i].EventType < ordered[j].EventType
+		}
+		return ordered[i].Version < ordered[j].Version
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byType, r.ordered = byType, ordered
+	return nil
+}
+
+// list returns every registered schema, ordered by type and version.
+func (r *SchemaRegistry) list() []EventSchema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]EventSchema(nil), r.ordered...)
+}
+
+// check validates an event's metadata against its type's schema, setting
+// SchemaVersion to the version used. The event must already have passed
+// validateEvent.
+func (r *SchemaRegistry) check(event *AnalyticsEvent) error {
+	r.mu.RLock()
+	versions := r.byType[event.EventType]
+	r.mu.RUnlock()
+	if len(versions) == 0 {
+		return fmt.Errorf("%w %q", errUnknownEventType, event.EventType)
+	}
+
+	schema := versions[len(versions)-1]
+	if event.SchemaVersion != 0 {
+		found := false
+		for _, s := range versions {
+			if s.Version == event.SchemaVersion {
+				schema, found = s, true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s has no schema version %d", event.EventType, event.SchemaVersion)
+		}
+	}
+	event.SchemaVersion = schema.Version
+
+	var metadata interface{}
+	if err := json.Unmarshal([]byte(event.Metadata), &metadata); err != nil {
+		return fmt.Errorf("metadata must be a JSON document")
+	}
+	if errs := schema.compiled.validate(metadata, "metadata"); len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// builtinSchemas are version 1 of the event types the gateway sends. They
+// are seeded into analytics_event_schemas; later versions are added there.
+var builtinSchemas = []EventSchema{
+	{EventType: "login", Version: 1, Description: "A user signed in.", Schema: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"method": {"type": "string", "maxLength": 50},
+			"ip": {"type": "string", "maxLength": 45},
+			"user_agent": {"type": "string", "maxLength": 512},
+			"success": {"type": "boolean"}
+		}
+	}`)},
+	{EventType: "logout", Version: 1, Description: "A user signed out or their session ended.", Schema: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"reason": {"type": "string", "maxLength": 100},
+			"session_seconds": {"type": "number", "minimum": 0}
+		}
+	}`)},
+	{EventType: "inference", Version: 1, Description: "A model answered a prompt.", Schema: json.RawMessage(`{
+		"type": "object",
+		"required": ["model"],
+		"properties": {
+			"model": {"type": "string", "minLength": 1, "maxLength": 100},
+			"tokens": {"type": "integer", "minimum": 0},
+			"prompt_tokens": {"type": "integer", "minimum": 0},
+			"completion_tokens": {"type": "integer", "minimum": 0},
+			"latency_ms": {"type": "number", "minimum": 0},
+			"duration_ms": {"type": "number", "minimum": 0},
+			"latency": {"type": ["number", "string"]},
+			"duration": {"type": ["number", "string"]}
+		}
+	}`)},
+	{EventType: "error", Version: 1, Description: "A request failed.", Schema: json.RawMessage(`{
+		"type": "object",
+		"required": ["error_message"],
+		"properties": {
+			"error_code": {"type": "string", "maxLength": 100},
+			"error_message": {"type": "string", "maxLength": 2000},
+			"status": {"type": "integer", "minimum": 100, "maximum": 599}
+		}
+	}`)},
+	{EventType: "custom", Version: 1, Description: "An application-defined event.", Schema: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"action": {"type": "string", "maxLength": 100}
+		}
+	}`)},
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// schemas starts with the built-in schemas and is replaced by the contents
+// of analytics_event_schemas once the tables exist.
+var schemas = mustSchemaRegistry(builtinSchemas)
+
+const schemaRegistrySchema = `
+	CREATE TABLE IF NOT EXISTS analytics_event_schemas (
+		event_type VARCHAR(100) NOT NULL,
+		version INT NOT NULL CHECK (version > 0),
+		description TEXT NOT NULL DEFAULT '',
+		schema JSONB NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT now(),
+		PRIMARY KEY (event_type, version)
+	);
+
+	ALTER TABLE analytics_events ADD COLUMN IF NOT EXISTS schema_version INT;
+
+	-- Events that passed basic validation but have an unknown type or do not
+	-- match their schema. They are kept for inspection, out of the stats.
+	CREATE TABLE IF NOT EXISTS analytics_events_quarantine (
+		id UUID PRIMARY KEY,
+		user_id VARCHAR(255) NOT NULL,
+		event_type VARCHAR(100) NOT NULL,
+		schema_version INT,
+		metadata JSONB NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		received_at TIMESTAMP NOT NULL DEFAULT now(),
+		reason TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_analytics_quarantine_type ON analytics_events_quarantine(event_type, received_at);
+	`
+
+func mustSchemaRegistry(list []EventSchema) *SchemaRegistry {
+	r, err := newSchemaRegistry(list)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// loadSchemas seeds the built-in schemas, without overwriting edited rows,
+// and loads every registered schema into the registry.
+func loadSchemas(ctx context.Context) error {
+	for _, s := range builtinSchemas {
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO analytics_event_schemas (event_type, version, description, schema)
+			VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING
+		`, s.EventType, s.Version, s.Description, string(s.Schema)); err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT event_type, version, description, schema FROM analytics_event_schemas ORDER BY event_type, version")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var list []EventSchema
+	for rows.Next() {
+		var s EventSchema
+		var raw string
+		if err := rows.Scan(&s.EventType, &s.Version, &s.Description, &raw); err != nil {
+			return err
+		}
+		s.Schema = json.RawMessage(raw)
+		list = append(list, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return schemas.replace(list)
+}
+
+// writeQuarantine stores events that failed their schema check.
+func writeQuarantine(ctx context.Context, batch []AnalyticsEvent) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, event := range batch {
+		var version interface{}
+		if event.SchemaVersion != 0 {
+			version = event.SchemaVersion
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO analytics_events_quarantine (id, user_id, event_type, schema_version, metadata, created_at, reason)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (id) DO NOTHING
+		`, event.ID, event.UserID, event.EventType, version, event.Metadata, event.CreatedAt, event.Quarantine); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func handleListSchemas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	list := schemas.list()
+	if eventType := r.URL.Query().Get("event_type"); eventType != "" {
+		filtered := list[:0]
+		for _, s := range list {
+			if s.EventType == eventType {
+				filtered = append(filtered, s)
+			}
+		}
+		list = filtered
+	}
+	if list == nil {
+		list = []EventSchema{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"schemas": list,
+	})
+}
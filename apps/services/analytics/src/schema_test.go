@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestJSONSchemaValidate tests the supported JSON Schema keywords
+func TestJSONSchemaValidate(t *testing.T) {
+	schema, err := parseJSONSchema([]byte(`{
+		"type": "object",
+		"required": ["model"],
+		"additionalProperties": false,
+		"properties": {
+			"model": {"type": "string", "minLength": 1, "maxLength": 8},
+			"tokens": {"type": "integer", "minimum": 0},
+			"duration": {"type": ["number", "string"]},
+			"tier": {"enum": ["free", "pro"]},
+			"tags": {"type": "array", "items": {"type": "string"}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("parseJSONSchema() error = %v", err)
+	}
+
+	tests := []struct {
+		metadata string
+		errs     []string
+	}{
+		{`{"model": "llama2", "tokens": 50, "duration": "1.5s", "tier": "pro", "tags": ["a"]}`, nil},
+		{`{"model": "llama2", "duration": 100}`, nil},
+		{`{}`, []string{"metadata.model is required"}},
+		{`[]`, []string{"metadata must be object"}},
+		{`{"model": ""}`, []string{"metadata.model is shorter than 1 characters"}},
+		{`{"model": "llama2-70b-chat"}`, []string{"metadata.model is longer than 8 characters"}},
+		{`{"model": "m", "tokens": 1.5}`, []string{"metadata.tokens must be integer"}},
+		{`{"model": "m", "tokens": -1}`, []string{"metadata.tokens is less than 0"}},
+		{`{"model": "m", "tier": "gold"}`, []string{"metadata.tier is not one of the allowed values"}},
+		{`{"model": "m", "tags": ["a", 2]}`, []string{"metadata.tags[1] must be string"}},
+		{`{"model": "m", "extra": true, "more": 1}`, []string{"metadata.extra is not allowed", "metadata.more is not allowed"}},
+	}
+
+	for _, tt := range tests {
+		var value interface{}
+		if err := json.Unmarshal([]byte(tt.metadata), &value); err != nil {
+			t.Fatal(err)
+		}
+		got := schema.validate(value, "metadata")
+		if strings.Join(got, "; ") != strings.Join(tt.errs, "; ") {
+			t.Errorf("validate(%s) = %q, want %q", tt.metadata, got, tt.errs)
+		}
+	}
+}
+
+// TestParseJSONSchemaRejectsUnsupported tests that schemas are checked when loaded
+func TestParseJSONSchemaRejectsUnsupported(t *testing.T) {
+	for _, raw := range []string{
+		`{"type": "object", "patternProperties": {}}`,
+		`{"type": "uuid"}`,
+		`{"properties": {"a": {"format": "email"}}}`,
+		`{"type": 5}`,
+		`not json`,
+	} {
+		if _, err := parseJSONSchema([]byte(raw)); err == nil {
+			t.Errorf("parseJSONSchema(%s) should fail", raw)
+		}
+	}
+}
+
+// TestSchemaRegistryCheck tests version selection and unknown event types
+func TestSchemaRegistryCheck(t *testing.T) {
+	registry, err := newSchemaRegistry(append(builtinSchemas, EventSchema{
+		EventType: "inference", Version: 2,
+		Schema: json.RawMessage(`{"type": "object", "required": ["model", "tokens"]}`),
+	}))
+	if err != nil {
+		t.Fatalf("newSchemaRegistry() error = %v", err)
+	}
+
+	event := AnalyticsEvent{EventType: "inference", Metadata: `{"model": "llama2"}`}
+	if err := registry.check(&event); err == nil || !strings.Contains(err.Error(), "metadata.tokens is required") {
+		t.Errorf("latest version: error = %v, want tokens required", err)
+	}
+	if event.SchemaVersion != 2 {
+		t.Errorf("schema version = %d, want the latest, 2", event.SchemaVersion)
+	}
+
+	event = AnalyticsEvent{EventType: "inference", SchemaVersion: 1, Metadata: `{"model": "llama2"}`}
+	if err := registry.check(&event); err != nil {
+		t.Errorf("pinned version 1: error = %v", err)
+	}
+
+	event = AnalyticsEvent{EventType: "inference", SchemaVersion: 3, Metadata: `{"model": "llama2"}`}
+	if err := registry.check(&event); err == nil {
+		t.Error("an unregistered version should fail")
+	}
+
+	event = AnalyticsEvent{EventType: "custom_action", Metadata: `{}`}
+	if err := registry.check(&event); !errors.Is(err, errUnknownEventType) {
+		t.Errorf("unknown type: error = %v, want errUnknownEventType", err)
+	}
+
+	if err := registry.replace([]EventSchema{{EventType: "login", Version: 1, Schema: json.RawMessage(`{"type": "nope"}`)}}); err == nil {
+		t.Error("replace with an invalid schema should fail")
+	}
+	if len(registry.list()) != len(builtinSchemas)+1 {
+		t.Error("a failed replace should leave the registry unchanged")
+	}
+}
+
+// TestBuiltinSchemas tests the built-in schemas against events the gateway sends
+func TestBuiltinSchemas(t *testing.T) {
+	tests := []struct {
+		eventType string
+		metadata  string
+		valid     bool
+	}{
+		{"login", `{}`, true},
+		{"logout", `{"session_seconds": 360}`, true},
+		{"inference", `{"model": "llama2", "tokens": 50, "duration": 100}`, true},
+		{"inference", `{"tokens": 50}`, false},
+		{"error", `{"error_message": "Model not found", "error_code": "MODEL_NOT_FOUND"}`, true},
+		{"error", `{"error_code": 404}`, false},
+		{"custom", `{"action": "button_click", "button_id": "submit"}`, true},
+	}
+
+	for _, tt := range tests {
+		event := AnalyticsEvent{EventType: tt.eventType, Metadata: tt.metadata}
+		err := schemas.check(&event)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s %s: error = %v, want valid %v", tt.eventType, tt.metadata, err, tt.valid)
+		}
+	}
+}
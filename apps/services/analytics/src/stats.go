@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// startedAt is when this process started, for uptime reporting.
+var startedAt = time.Now().UTC()
+
+const (
+	defaultStatsRange = 30 * 24 * time.Hour
+	statsDateLayout   = "2006-01-02"
+
+	// Latencies are rolled up into logarithmic buckets: bucket b holds
+	// [latencyBase^b, latencyBase^(b+1)) milliseconds, so a percentile read
+	// from the histogram is within 10% of the true value.
+	latencyBase       = 1.2
+	maxLatencyBucket  = 127
+	latencyBucketExpr = "LEAST(GREATEST(floor(ln(GREATEST(latency_ms, 1)) / ln(1.2)), 0), 127)::smallint"
+)
+
+// statsPercentiles are the latency percentiles reported.
+var statsPercentiles = []float64{50, 90, 95, 99}
+
+// latencyKeys are the metadata fields read as an event's latency, in order
+// of preference. Numbers are milliseconds; strings may also be Go durations
+// such as "1.5s".
+var latencyKeys = []string{"latency_ms", "duration_ms", "latency", "duration"}
+
+// StatsQuery is a parsed /analytics/stats request. From and To are aligned
+// to whole hours.
+type StatsQuery struct {
+	From      time.Time
+	To        time.Time
+	EventType string
+}
+
+// LatencyStats summarizes event latencies in milliseconds.
+type LatencyStats struct {
+	Count       int64              `json:"count"`
+	Avg         float64            `json:"avg"`
+	Percentiles map[string]float64 `json:"percentiles"`
+}
+
+// StatsResponse is the /analytics/stats payload. ActiveUsers counts distinct
+// users over the whole range; DAU, WAU and MAU count them over the day,
+// seven days and thirty days ending at To.
+type StatsResponse struct {
+	From         time.Time        `json:"from"`
+	To           time.Time        `json:"to"`
+	EventType    string           `json:"event_type,omitempty"`
+	TotalEvents  int64            `json:"total_events"`
+	EventsByType map[string]int64 `json:"events_by_type"`
+	ActiveUsers  int64            `json:"active_users"`
+	DAU          int64            `json:"dau"`
+	WAU          int64            `json:"wau"`
+	MAU          int64            `json:"mau"`
+	AvgLatency   float64          `json:"avg_latency"`
+	Latency      LatencyStats     `json:"latency_ms"`
+	UptimeHours  float64          `json:"uptime_hours"`
+	StartedAt    time.Time        `json:"started_at"`
+	AsOf         time.Time        `json:"as_of"`
+}
+
+func parseStatsTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(statsDateLayout, value)
+}
+
+// parseStatsQuery reads from, to and event_type. The range defaults to the
+// thirty days before now; from is rounded down and to up to whole hours.
+func parseStatsQuery(q url.Values, now time.Time) (StatsQuery, error) {
+	query := StatsQuery{To: now.UTC(), EventType: q.Get("event_type")}
+	if v := q.Get("to"); v != "" {
+		t, err := parseStatsTime(v)
+		if err != nil {
+			return query, fmt.Errorf("to must be RFC 3339 or YYYY-MM-DD")
+		}
+		query.To = t
+	}
+	query.From = query.To.Add(-defaultStatsRange)
+	if v := q.Get("from"); v != "" {
+		t, err := parseStatsTime(v)
+		if err != nil {
+			return query, fmt.Errorf("from must be RFC 3339 or YYYY-MM-DD")
+		}
+		query.From = t
+	}
+
+	query.From = query.From.Truncate(time.Hour)
+	if truncated := query.To.Truncate(time.Hour); !truncated.Equal(query.To) {
+		query.To = truncated.Add(time.Hour)
+	}
+	if !query.From.Before(query.To) {
+		return query, fmt.Errorf("from must be before to")
+	}
+	return query, nil
+}
+
+// lastDay is the date of the last instant in the range.
+func (s StatsQuery) lastDay() time.Time {
+	t := s.To.Add(-time.Nanosecond)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// extractLatency returns the latency recorded in an event's metadata.
+func extractLatency(metadata string) (float64, bool) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(metadata), &fields); err != nil {
+		return 0, false
+	}
+	for _, key := range latencyKeys {
+		switch v := fields[key].(type) {
+		case float64:
+			if v >= 0 && !math.IsInf(v, 0) {
+				return v, true
+			}
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && f >= 0 {
+				return f, true
+			}
+			if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil && d >= 0 {
+				return float64(d) / float64(time.Millisecond), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// latencyBucket mirrors latencyBucketExpr.
+func latencyBucket(ms float64) int {
+	b := int(math.Floor(math.Log(math.Max(ms, 1)) / math.Log(latencyBase)))
+	if b < 0 {
+		return 0
+	}
+	if b > maxLatencyBucket {
+		return maxLatencyBucket
+	}
+	return b
+}
+
+// bucketValue is the geometric midpoint of a latency bucket.
+func bucketValue(b int) float64 {
+	return math.Sqrt(math.Pow(latencyBase, float64(b)) * math.Pow(latencyBase, float64(b+1)))
+}
+
+// summarizeLatency computes the average from exact totals and percentiles
+// from the bucket histogram.
+func summarizeLatency(histogram map[int]int64, count int64, sum float64) LatencyStats {
+	stats := LatencyStats{Count: count, Percentiles: map[string]float64{}}
+	if count == 0 {
+		return stats
+	}
+	stats.Avg = sum / float64(count)
+
+	buckets := make([]int, 0, len(histogram))
+	var total int64
+	for b, n := range histogram {
+		buckets = append(buckets, b)
+		total += n
+	}
+	sort.Ints(buckets)
+	for _, p := range statsPercentiles {
+		rank := int64(math.Ceil(p / 100 * float64(total)))
+		var seen int64
+		for _, b := range buckets {
+			seen += histogram[b]
+			if seen >= rank {
+				stats.Percentiles[fmt.Sprintf("p%g", p)] = math.Round(bucketValue(b)*10) / 10
+				break
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// rollupSettle is how long after an event is received before it is rolled
+// up, so that batches still being written are not skipped.
+const rollupSettle = 2 * time.Minute
+
+// rollupChunk bounds how much raw data one rollup transaction reads.
+const rollupChunk = 24 * time.Hour
+
+const rollupSchema = `
+	CREATE INDEX IF NOT EXISTS idx_analytics_events_received ON analytics_events(received_at);
+
+	CREATE TABLE IF NOT EXISTS analytics_rollup_hourly (
+		hour TIMESTAMP NOT NULL,
+		event_type VARCHAR(100) NOT NULL,
+		events BIGINT NOT NULL,
+		latency_count BIGINT NOT NULL,
+		latency_sum DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (hour, event_type)
+	);
+
+	CREATE TABLE IF NOT EXISTS analytics_rollup_latency (
+		hour TIMESTAMP NOT NULL,
+		event_type VARCHAR(100) NOT NULL,
+		bucket SMALLINT NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (hour, event_type, bucket)
+	);
+
+	CREATE TABLE IF NOT EXISTS analytics_rollup_daily_users (
+		day DATE NOT NULL,
+		event_type VARCHAR(100) NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		PRIMARY KEY (day, event_type, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS analytics_rollup_state (
+		name VARCHAR(50) PRIMARY KEY,
+		watermark TIMESTAMP NOT NULL
+	);
+
+	INSERT INTO analytics_rollup_state (name, watermark) VALUES ('events', 'epoch') ON CONFLICT DO NOTHING;
+	`
+
+// rollupEvents folds every event received since the watermark, up to
+// rollupSettle ago, into the rollup tables. It returns the new watermark.
+func rollupEvents(ctx context.Context) (time.Time, error) {
+	for {
+		watermark, done, err := rollupChunkTx(ctx, time.Now().UTC().Add(-rollupSettle))
+		if err != nil || done {
+			return watermark, err
+		}
+	}
+}
+
+// rollupChunkTx rolls up at most rollupChunk of events after the watermark
+// in one transaction. done reports whether the watermark reached limit.
+func rollupChunkTx(ctx context.Context, limit time.Time) (watermark time.Time, done bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer tx.Rollback()
+
+	// The row lock keeps concurrent instances from rolling up the same window.
+	if err := tx.QueryRowContext(ctx,
+		"SELECT watermark FROM analytics_rollup_state WHERE name = 'events' FOR UPDATE",
+	).Scan(&watermark); err != nil {
+		return time.Time{}, false, err
+	}
+	if !watermark.Before(limit) {
+		return watermark, true, nil
+	}
+
+	// The first rollup starts at the oldest event rather than the epoch.
+	if watermark.Unix() == 0 {
+		var first sql.NullTime
+		if err := tx.QueryRowContext(ctx, "SELECT MIN(received_at) FROM analytics_events").Scan(&first); err != nil {
+			return time.Time{}, false, err
+		}
+		switch {
+		case !first.Valid || !first.Time.Before(limit):
+			watermark = limit
+		case first.Time.After(watermark):
+			watermark = first.Time.Add(-time.Microsecond)
+		}
+	}
+	upper := watermark.Add(rollupChunk)
+	if upper.After(limit) {
+		upper = limit
+	}
+
+	for _, stmt := range []string{`
+		INSERT INTO analytics_rollup_hourly (hour, event_type, events, latency_count, latency_sum)
+		SELECT date_trunc('hour', created_at), event_type, COUNT(*), COUNT(latency_ms), COALESCE(SUM(latency_ms), 0)
+		FROM analytics_events WHERE received_at > $1 AND received_at <= $2
+		GROUP BY 1, 2
+		ON CONFLICT (hour, event_type) DO UPDATE SET
+			events = analytics_rollup_hourly.events + EXCLUDED.events,
+			latency_count = analytics_rollup_hourly.latency_count + EXCLUDED.latency_count,
+			latency_sum = analytics_rollup_hourly.latency_sum + EXCLUDED.latency_sum`, `
+		INSERT INTO analytics_rollup_latency (hour, event_type, bucket, count)
+		SELECT date_trunc('hour', created_at), event_type, ` + latencyBucketExpr + `, COUNT(*)
+		FROM analytics_events WHERE received_at > $1 AND received_at <= $2 AND latency_ms IS NOT NULL
+		GROUP BY 1, 2, 3
+		ON CONFLICT (hour, event_type, bucket) DO UPDATE SET count = analytics_rollup_latency.count + EXCLUDED.count`, `
+		INSERT INTO analytics_rollup_daily_users (day, event_type, user_id)
+		SELECT DISTINCT created_at::date, event_type, user_id
+		FROM analytics_events WHERE received_at > $1 AND received_at <= $2
+		ON CONFLICT DO NOTHING`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, watermark, upper); err != nil {
+			return time.Time{}, false, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE analytics_rollup_state SET watermark = $1 WHERE name = 'events'", upper); err != nil {
+		return time.Time{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, false, err
+	}
+	return upper, !upper.Before(limit), nil
+}
+
+// rollupInterval reads ANALYTICS_ROLLUP_INTERVAL, defaulting to one minute.
+func rollupInterval() time.Duration {
+	if raw := os.Getenv("ANALYTICS_ROLLUP_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Warning: invalid ANALYTICS_ROLLUP_INTERVAL %q, using default", raw)
+	}
+	return time.Minute
+}
+
+// startRollupWorker rolls up new events now and then on every interval.
+func startRollupWorker(interval time.Duration) {
+	go func() {
+		for {
+			if _, err := rollupEvents(context.Background()); err != nil {
+				log.Printf("Warning: Analytics rollup failed: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// queryStats answers a stats query from the rollup tables.
+func queryStats(ctx context.Context, s StatsQuery) (*StatsResponse, error) {
+	resp := &StatsResponse{
+		From: s.From, To: s.To, EventType: s.EventType, EventsByType: map[string]int64{},
+		StartedAt: startedAt, UptimeHours: time.Since(startedAt).Hours(),
+	}
+	if err := db.QueryRowContext(ctx,
+		"SELECT watermark FROM analytics_rollup_state WHERE name = 'events'").Scan(&resp.AsOf); err != nil {
+		return nil, err
+	}
+
+	typeFilter := " AND ($3 = '' OR event_type = $3)"
+	rows, err := db.QueryContext(ctx, `
+		SELECT event_type, SUM(events), SUM(latency_count), SUM(latency_sum)
+		FROM analytics_rollup_hourly WHERE hour >= $1 AND hour < $2`+typeFilter+`
+		GROUP BY event_type
+	`, s.From, s.To, s.EventType)
+	if err != nil {
+		return nil, err
+	}
+	var latencyCount int64
+	var latencySum float64
+	for rows.Next() {
+		var eventType string
+		var events, count int64
+		var sum float64
+		if err := rows.Scan(&eventType, &events, &count, &sum); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		resp.EventsByType[eventType] = events
+		resp.TotalEvents += events
+		latencyCount += count
+		latencySum += sum
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	histogram := map[int]int64{}
+	rows, err = db.QueryContext(ctx, `
+		SELECT bucket, SUM(count) FROM analytics_rollup_latency
+		WHERE hour >= $1 AND hour < $2`+typeFilter+`
+		GROUP BY bucket
+	`, s.From, s.To, s.EventType)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var bucket int
+		var count int64
+		if err := rows.Scan(&bucket, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		histogram[bucket] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	resp.Latency = summarizeLatency(histogram, latencyCount, latencySum)
+	resp.AvgLatency = resp.Latency.Avg
+
+	lastDay := s.lastDay()
+	err = db.QueryRowContext(ctx, `
+		SELECT
+			COUNT(DISTINCT user_id) FILTER (WHERE day >= $1::date),
+			COUNT(DISTINCT user_id) FILTER (WHERE day = $2::date),
+			COUNT(DISTINCT user_id) FILTER (WHERE day > $2::date - 7),
+			COUNT(DISTINCT user_id) FILTER (WHERE day > $2::date - 30)
+		FROM analytics_rollup_daily_users
+		WHERE day >= LEAST($1::date, $2::date - 29) AND day <= $2::date AND ($3 = '' OR event_type = $3)
+	`, s.From, lastDay, s.EventType).Scan(&resp.ActiveUsers, &resp.DAU, &resp.WAU, &resp.MAU)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func handleGetStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	query, err := parseStatsQuery(r.URL.Query(), time.Now().UTC())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	stats, err := queryStats(r.Context(), query)
+	if err != nil {
+		log.Printf("Computing analytics stats failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to compute stats"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
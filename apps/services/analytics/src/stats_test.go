@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestParseStatsQuery tests stats range and filter parsing
+func TestParseStatsQuery(t *testing.T) {
+	now := time.Date(2024, 3, 15, 10, 20, 0, 0, time.UTC)
+	tests := []struct {
+		query    string
+		from, to time.Time
+		wantErr  bool
+	}{
+		{"", now.Add(-30 * 24 * time.Hour).Truncate(time.Hour), time.Date(2024, 3, 15, 11, 0, 0, 0, time.UTC), false},
+		{"from=2024-03-01&to=2024-03-08", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC), false},
+		{"from=2024-03-01T08:30:00Z&to=2024-03-01T09:10:00Z", time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), false},
+		{"from=2024-03-08&to=2024-03-01", time.Time{}, time.Time{}, true},
+		{"from=last-week", time.Time{}, time.Time{}, true},
+		{"to=03/01/2024", time.Time{}, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		got, err := parseStatsQuery(q, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseStatsQuery(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (!got.From.Equal(tt.from) || !got.To.Equal(tt.to)) {
+			t.Errorf("parseStatsQuery(%q) = [%s, %s), want [%s, %s)", tt.query, got.From, got.To, tt.from, tt.to)
+		}
+	}
+
+	q, _ := url.ParseQuery("from=2024-03-01&to=2024-03-08&event_type=inference")
+	got, _ := parseStatsQuery(q, now)
+	if got.EventType != "inference" {
+		t.Errorf("event type = %q, want inference", got.EventType)
+	}
+	if day := got.lastDay(); !day.Equal(time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("last day of an exclusive range ending at midnight = %s, want 2024-03-07", day)
+	}
+}
+
+// TestExtractLatency tests reading latency from event metadata
+func TestExtractLatency(t *testing.T) {
+	tests := []struct {
+		metadata string
+		want     float64
+		ok       bool
+	}{
+		{`{"latency_ms": 120}`, 120, true},
+		{`{"duration": 850, "model": "llama"}`, 850, true},
+		{`{"duration": "1.5s"}`, 1500, true},
+		{`{"duration": "42"}`, 42, true},
+		{`{"latency_ms": 10, "duration": 99}`, 10, true},
+		{`{"duration": -5}`, 0, false},
+		{`{"duration": "soon"}`, 0, false},
+		{`{"action": "click"}`, 0, false},
+		{`[]`, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := extractLatency(tt.metadata)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("extractLatency(%s) = %v, %v; want %v, %v", tt.metadata, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestLatencyPercentiles tests percentiles read from the bucket histogram
+func TestLatencyPercentiles(t *testing.T) {
+	if latencyBucket(0) != 0 || latencyBucket(0.5) != 0 || latencyBucket(1e30) != maxLatencyBucket {
+		t.Error("latencyBucket should clamp to [0, maxLatencyBucket]")
+	}
+
+	histogram := map[int]int64{}
+	var sum float64
+	for ms := 1; ms <= 1000; ms++ {
+		histogram[latencyBucket(float64(ms))]++
+		sum += float64(ms)
+	}
+	stats := summarizeLatency(histogram, 1000, sum)
+
+	if stats.Avg != 500.5 {
+		t.Errorf("avg = %v, want exact 500.5", stats.Avg)
+	}
+	for name, want := range map[string]float64{"p50": 500, "p90": 900, "p95": 950, "p99": 990} {
+		got := stats.Percentiles[name]
+		if math.Abs(got-want)/want > 0.1 {
+			t.Errorf("%s = %v, want within 10%% of %v", name, got, want)
+		}
+	}
+
+	empty := summarizeLatency(map[int]int64{}, 0, 0)
+	if empty.Count != 0 || len(empty.Percentiles) != 0 {
+		t.Errorf("empty histogram = %+v", empty)
+	}
+}
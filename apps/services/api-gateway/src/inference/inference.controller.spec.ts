@@ -234,6 +234,40 @@ describe('InferenceController', () => {
         'mistral',
         undefined,
         undefined,
+        undefined,
+      );
+    });
+
+    it('should forward the authenticated user to the service', async () => {
+      const request = {
+        prompt: 'Test prompt',
+        model: 'mistral',
+        user_id: 'someone-else',
+      };
+
+      vi.spyOn(service, 'generateInference').mockReturnValue(
+        of({
+          result: 'Test response',
+          model: 'mistral',
+          tokens: 50,
+          duration: 100,
+        }),
+      );
+
+      await new Promise((resolve, reject) => {
+        controller
+          .generateInference(request, {
+            user: { userId: '6f1c2a4e-8d3b-4f7a-9c1e-2b5d8e0f3a71' },
+          })
+          .subscribe(resolve, reject);
+      });
+
+      expect(service.generateInference).toHaveBeenCalledWith(
+        'Test prompt',
+        'mistral',
+        undefined,
+        undefined,
+        '6f1c2a4e-8d3b-4f7a-9c1e-2b5d8e0f3a71',
       );
     });
 
@@ -262,6 +296,7 @@ describe('InferenceController', () => {
         'llama2',
         'Earlier I said hello',
         undefined,
+        undefined,
       );
     });
 
@@ -8,6 +8,7 @@ import {
   UseGuards,
   Inject,
   HttpCode,
+  Req,
 } from '@nestjs/common';
 import { JwtAuthGuard } from '../auth/jwt-auth.guard';
 import { InferenceService } from './inference.service';
@@ -20,6 +21,14 @@ import { ErrorResponse } from '../types/api.dto';
 import { Observable } from 'rxjs';
 import { map, catchError } from 'rxjs/operators';
 
+// The user the JWT guard authenticated. The LLM service takes the user, and
+// so their tier and quota, only from what the gateway forwards.
+export interface InferenceAuthenticatedRequest {
+  user?: {
+    userId?: string;
+  };
+}
+
 @Controller('inference')
 export class InferenceController {
   constructor(
@@ -49,6 +58,7 @@ export class InferenceController {
   @UseGuards(JwtAuthGuard)
   generateInference(
     @Body() body: InferenceGenerateRequest,
+    @Req() req?: InferenceAuthenticatedRequest,
   ): Observable<InferenceGenerateResponse> {
     console.log(
       'InferenceController: generateInference called with body:',
@@ -69,6 +79,7 @@ export class InferenceController {
         modelId,
         body.context,
         body.songLengthSeconds,
+        req?.user?.userId,
       )
       .pipe(
         catchError((err: Error | ErrorResponse) => {
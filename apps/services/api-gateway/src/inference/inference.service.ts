@@ -318,6 +318,7 @@ STRICT RULES:
     model: string,
     context?: string,
     songLengthSeconds?: number,
+    userId?: string,
   ): Observable<InferenceGenerateResponse> {
     // Calculate estimated time upfront
     const estimatedTime: number = this.estimateExecutionTime(prompt, model);
@@ -356,7 +357,9 @@ STRICT RULES:
       .post<LLMGenerateResponse>(
         `${this.llmServiceUrl}/inference/generate`,
         requestBody,
-        { timeout },
+        // The LLM service reads the user for tiers and quotas from this
+        // header only, never from the body.
+        { timeout, headers: userId ? { 'X-User-ID': userId } : undefined },
       )
       .pipe(
         tap((response: AxiosResponse<LLMGenerateResponse>) => {
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxAggregateTop = 100
+
+// aggregateGroups maps each group_by value to the column it groups on.
+var aggregateGroups = map[string]string{
+	"source":    "source",
+	"recipient": "canonical_recipient_id",
+	"entity":    "canonical_entity_id",
+}
+
+// bucketExprs maps each bucket to a SQL expression for the first day of the
+// bucket containing date. Election cycles are the two calendar years ending
+// in an even year, as the FEC reports them.
+var bucketExprs = map[string]string{
+	"day":   "date",
+	"week":  "date_trunc('week', date)::date",
+	"month": "date_trunc('month', date)::date",
+	"cycle": "make_date(EXTRACT(YEAR FROM date)::int + EXTRACT(YEAR FROM date)::int % 2 - 1, 1, 1)",
+}
+
+// rollupViews holds daily pre-aggregated totals per group dimension. They
+// answer any bucket of a day or coarser when no other dimension is filtered.
+var rollupViews = map[string]string{
+	"source":    "funding_rollup_source_daily",
+	"recipient": "funding_rollup_recipient_daily",
+	"entity":    "funding_rollup_entity_daily",
+}
+
+const rollupSchema = `
+	CREATE MATERIALIZED VIEW IF NOT EXISTS funding_rollup_source_daily AS
+		SELECT date, currency, source, SUM(amount) AS total, COUNT(*) AS count
+		FROM active_funding_records GROUP BY date, currency, source;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_rollup_source_daily ON funding_rollup_source_daily(date, currency, source);
+
+	CREATE MATERIALIZED VIEW IF NOT EXISTS funding_rollup_recipient_daily AS
+		SELECT date, currency, canonical_recipient_id, SUM(amount) AS total, COUNT(*) AS count
+		FROM active_funding_records GROUP BY date, currency, canonical_recipient_id;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_rollup_recipient_daily ON funding_rollup_recipient_daily(date, currency, canonical_recipient_id);
+
+	CREATE MATERIALIZED VIEW IF NOT EXISTS funding_rollup_entity_daily AS
+		SELECT date, currency, canonical_entity_id, SUM(amount) AS total, COUNT(*) AS count
+		FROM active_funding_records GROUP BY date, currency, canonical_entity_id;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_rollup_entity_daily ON funding_rollup_entity_daily(date, currency, canonical_entity_id);
+	`
+
+var (
+	rollupMu          sync.Mutex
+	rollupRefreshMu   sync.Mutex
+	rollupRefreshedAt time.Time
+)
+
+// AggregateQuery is a parsed /funding/aggregate request.
+type AggregateQuery struct {
+	FundingFilter
+	GroupBy string
+	Bucket  string
+	Top     int
+	Fresh   bool
+}
+
+// AggregateBucket is one time bucket of a group. Change and ChangePct compare
+// against the immediately preceding bucket and are omitted when that period
+// lies before the data returned.
+type AggregateBucket struct {
+	Start     string   `json:"start"`
+	Label     string   `json:"label"`
+	Total     Amount   `json:"total"`
+	Count     int64    `json:"count"`
+	Change    *Amount  `json:"change,omitempty"`
+	ChangePct *float64 `json:"change_pct,omitempty"`
+}
+
+// AggregateGroup is the total for one source, recipient or entity.
+type AggregateGroup struct {
+	Key     string            `json:"key"`
+	Total   Amount            `json:"total"`
+	Count   int64             `json:"count"`
+	Average Amount            `json:"average"`
+	Buckets []AggregateBucket `json:"buckets,omitempty"`
+}
+
+// aggregateRow is one (group, bucket) row as returned by SQL.
+type aggregateRow struct {
+	Key    string
+	Bucket time.Time
+	Total  Amount
+	Count  int64
+}
+
+func parseAggregateQuery(q url.Values) (AggregateQuery, error) {
+	agg := AggregateQuery{Bucket: "none"}
+
+	filter, err := parseFundingFilter(q)
+	if err != nil {
+		return agg, err
+	}
+	agg.FundingFilter = filter
+
+	agg.GroupBy = q.Get("group_by")
+	if _, ok := aggregateGroups[agg.GroupBy]; !ok {
+		return agg, fmt.Errorf("group_by must be one of source, recipient, entity")
+	}
+
+	if bucket := q.Get("bucket"); bucket != "" && bucket != "none" {
+		if _, ok := bucketExprs[bucket]; !ok {
+			return agg, fmt.Errorf("bucket must be one of none, day, week, month, cycle")
+		}
+		agg.Bucket = bucket
+	}
+
+	if raw := q.Get("top"); raw != "" {
+		top, err := strconv.Atoi(raw)
+		if err != nil || top <= 0 {
+			return agg, fmt.Errorf("top must be a positive integer")
+		}
+		if top > maxAggregateTop {
+			top = maxAggregateTop
+		}
+		agg.Top = top
+	}
+
+	agg.Fresh = q.Get("fresh") == "true"
+	return agg, nil
+}
+
+// canUseRollup reports whether the daily rollup for the group dimension holds
+// everything the query filters on.
+func (a AggregateQuery) canUseRollup() bool {
+	if a.Fresh || a.MinAmount != nil || a.MaxAmount != nil {
+		return false
+	}
+	switch a.GroupBy {
+	case "source":
+		return a.EntityID == "" && a.RecipientID == ""
+	case "recipient":
+		return a.EntityID == "" && a.Source == ""
+	case "entity":
+		return a.RecipientID == "" && a.Source == ""
+	}
+	return false
+}
+
+// buildAggregateQuery renders the grouped totals query. With Top set, only
+// the Top groups by overall total are returned.
+func buildAggregateQuery(a AggregateQuery, useRollup bool) (string, []interface{}) {
+	table, sumExpr, countExpr := "active_funding_records", "SUM(amount)", "COUNT(*)"
+	if useRollup {
+		table, sumExpr, countExpr = rollupViews[a.GroupBy], "SUM(total)", "SUM(count)"
+	}
+	keyCol := aggregateGroups[a.GroupBy]
+	bucketExpr := "NULL::date"
+	if a.Bucket != "none" {
+		bucketExpr = bucketExprs[a.Bucket]
+	}
+
+	where, args := a.whereClause()
+	var b strings.Builder
+	if a.Top > 0 {
+		args = append(args, a.Top)
+		fmt.Fprintf(&b, "WITH top_keys AS (SELECT %s AS key FROM %s%s GROUP BY %s ORDER BY %s DESC, %s LIMIT $%d) ",
+			keyCol, table, where, keyCol, sumExpr, keyCol, len(args))
+		if where == "" {
+			where = " WHERE "
+		} else {
+			where += " AND "
+		}
+		where += keyCol + " IN (SELECT key FROM top_keys)"
+	}
+	fmt.Fprintf(&b, "SELECT %s, %s, COALESCE(%s, 0), %s FROM %s%s GROUP BY 1, 2 ORDER BY 1, 2",
+		keyCol, bucketExpr, sumExpr, countExpr, table, where)
+	return b.String(), args
+}
+
+func queryAggregate(ctx context.Context, a AggregateQuery, useRollup bool) ([]aggregateRow, error) {
+	query, args := buildAggregateQuery(a, useRollup)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []aggregateRow
+	for rows.Next() {
+		var row aggregateRow
+		var bucket sql.NullTime
+		if err := rows.Scan(&row.Key, &bucket, &row.Total, &row.Count); err != nil {
+			return nil, err
+		}
+		if bucket.Valid {
+			row.Bucket = bucket.Time
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+// previousBucket returns the start of the bucket before start.
+func previousBucket(start time.Time, bucket string) time.Time {
+	switch bucket {
+	case "day":
+		return start.AddDate(0, 0, -1)
+	case "week":
+		return start.AddDate(0, 0, -7)
+	case "month":
+		return start.AddDate(0, -1, 0)
+	case "cycle":
+		return start.AddDate(-2, 0, 0)
+	}
+	return start
+}
+
+func bucketLabel(start time.Time, bucket string) string {
+	switch bucket {
+	case "month":
+		return start.Format("2006-01")
+	case "week":
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case "cycle":
+		return strconv.Itoa(start.Year() + 1)
+	}
+	return start.Format(searchDateLayout)
+}
+
+// assembleAggregate folds SQL rows into groups ordered by total (largest
+// first) and computes period-over-period change for bucketed queries.
+func assembleAggregate(rows []aggregateRow, bucket string) ([]AggregateGroup, Amount, error) {
+	groups := []AggregateGroup{}
+	index := map[string]int{}
+	totals := map[string]map[time.Time]Amount{}
+	var earliest time.Time
+	var grand Amount
+
+	for _, row := range rows {
+		i, ok := index[row.Key]
+		if !ok {
+			i = len(groups)
+			index[row.Key] = i
+			groups = append(groups, AggregateGroup{Key: row.Key})
+			totals[row.Key] = map[time.Time]Amount{}
+		}
+		g := &groups[i]
+
+		var err error
+		if g.Total, err = g.Total.Add(row.Total); err != nil {
+			return nil, 0, err
+		}
+		if grand, err = grand.Add(row.Total); err != nil {
+			return nil, 0, err
+		}
+		g.Count += row.Count
+
+		if bucket != "none" {
+			totals[row.Key][row.Bucket] = row.Total
+			if earliest.IsZero() || row.Bucket.Before(earliest) {
+				earliest = row.Bucket
+			}
+			g.Buckets = append(g.Buckets, AggregateBucket{
+				Start: row.Bucket.Format(searchDateLayout),
+				Label: bucketLabel(row.Bucket, bucket),
+				Total: row.Total,
+				Count: row.Count,
+			})
+		}
+	}
+
+	for gi := range groups {
+		g := &groups[gi]
+		g.Average = g.Total.DivRound(g.Count)
+
+		for bi := range g.Buckets {
+			b := &g.Buckets[bi]
+			start, _ := time.Parse(searchDateLayout, b.Start)
+			prevStart := previousBucket(start, bucket)
+			if prevStart.Before(earliest) {
+				continue
+			}
+			prev := totals[g.Key][prevStart]
+			change := b.Total - prev
+			b.Change = &change
+			if prev != 0 {
+				pct := math.Round(float64(change)/float64(prev)*10000) / 100
+				b.ChangePct = &pct
+			}
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Total == groups[j].Total {
+			return groups[i].Key < groups[j].Key
+		}
+		return groups[i].Total > groups[j].Total
+	})
+	return groups, grand, nil
+}
+
+func rollupInterval() time.Duration {
+	if raw := os.Getenv("FUNDING_ROLLUP_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Warning: invalid FUNDING_ROLLUP_INTERVAL %q, using default", raw)
+	}
+	return 15 * time.Minute
+}
+
+// refreshRollups rebuilds the daily rollups without blocking readers.
+func refreshRollups(ctx context.Context) error {
+	rollupRefreshMu.Lock()
+	defer rollupRefreshMu.Unlock()
+
+	for _, view := range []string{"funding_rollup_source_daily", "funding_rollup_recipient_daily", "funding_rollup_entity_daily"} {
+		if _, err := db.ExecContext(ctx, "REFRESH MATERIALIZED VIEW CONCURRENTLY "+view); err != nil {
+			return fmt.Errorf("refreshing %s: %w", view, err)
+		}
+	}
+
+	rollupMu.Lock()
+	rollupRefreshedAt = time.Now().UTC()
+	rollupMu.Unlock()
+	return nil
+}
+
+func lastRollupRefresh() time.Time {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	return rollupRefreshedAt
+}
+
+// startRollupRefresher refreshes rollups now and then on every interval.
+func startRollupRefresher(interval time.Duration) {
+	go func() {
+		for {
+			if err := refreshRollups(context.Background()); err != nil {
+				log.Printf("Warning: Funding rollup refresh failed: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func handleAggregateFunding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	agg, err := parseAggregateQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	refreshedAt := lastRollupRefresh()
+	useRollup := agg.canUseRollup() && !refreshedAt.IsZero()
+
+	rows, err := queryAggregate(r.Context(), agg, useRollup)
+	if err != nil {
+		log.Printf("Funding aggregate failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to aggregate funding records"})
+		return
+	}
+
+	groups, total, err := assembleAggregate(rows, agg.Bucket)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	response := map[string]interface{}{
+		"group_by":    agg.GroupBy,
+		"bucket":      agg.Bucket,
+		"currency":    agg.Currency,
+		"groups":      groups,
+		"total":       total,
+		"data_source": "live",
+	}
+	if useRollup {
+		response["data_source"] = "rollup"
+		response["rollup_refreshed_at"] = refreshedAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Alert triage states.
+const (
+	alertOpen         = "open"
+	alertAcknowledged = "acknowledged"
+	alertEscalated    = "escalated"
+	alertDismissed    = "dismissed"
+	alertConfirmed    = "confirmed"
+)
+
+// alertTransitions lists the states each triage state may move to. Confirmed
+// findings are final; dismissed ones can be reopened.
+var alertTransitions = map[string][]string{
+	alertOpen:         {alertAcknowledged, alertEscalated, alertDismissed, alertConfirmed},
+	alertAcknowledged: {alertOpen, alertEscalated, alertDismissed, alertConfirmed},
+	alertEscalated:    {alertAcknowledged, alertDismissed, alertConfirmed},
+	alertDismissed:    {alertOpen},
+	alertConfirmed:    {},
+}
+
+const alertsSchema = `
+	CREATE TABLE IF NOT EXISTS funding_alerts (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		rule VARCHAR(50) NOT NULL,
+		subject_type VARCHAR(20) NOT NULL,
+		subject_id VARCHAR(255) NOT NULL,
+		currency CHAR(3) NOT NULL,
+		period_start DATE NOT NULL,
+		period_end DATE NOT NULL,
+		score DOUBLE PRECISION NOT NULL,
+		details JSONB NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'open',
+		assigned_to VARCHAR(255),
+		dedup_key TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT now() NOT NULL,
+		updated_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_alerts_status ON funding_alerts(status, created_at DESC);
+	CREATE INDEX IF NOT EXISTS idx_funding_alerts_subject ON funding_alerts(subject_id, created_at DESC);
+
+	CREATE TABLE IF NOT EXISTS funding_alert_events (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		alert_id UUID NOT NULL REFERENCES funding_alerts(id) ON DELETE CASCADE,
+		from_status VARCHAR(20) NOT NULL,
+		to_status VARCHAR(20) NOT NULL,
+		actor VARCHAR(255) NOT NULL,
+		note TEXT,
+		created_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_alert_events_alert ON funding_alert_events(alert_id, created_at);
+	`
+
+// FundingAlert is a finding raised by the anomaly detector.
+type FundingAlert struct {
+	ID          string                 `json:"id"`
+	Rule        string                 `json:"rule"`
+	SubjectType string                 `json:"subject_type"`
+	SubjectID   string                 `json:"subject_id"`
+	Currency    string                 `json:"currency"`
+	PeriodStart time.Time              `json:"period_start"`
+	PeriodEnd   time.Time              `json:"period_end"`
+	Score       float64                `json:"score"`
+	Details     map[string]interface{} `json:"details"`
+	Status      string                 `json:"status"`
+	AssignedTo  string                 `json:"assigned_to,omitempty"`
+	DedupKey    string                 `json:"-"`
+	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+}
+
+// TriageRequest moves an alert to a new state.
+type TriageRequest struct {
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	Actor      string `json:"actor"`
+	Note       string `json:"note,omitempty"`
+	AssignedTo string `json:"assigned_to,omitempty"`
+}
+
+// ScanRequest runs the detector over a historical date range.
+type ScanRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range alertTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// insertAlerts stores new findings, ignoring ones already raised, and
+// returns how many were new.
+func insertAlerts(ctx context.Context, alerts []FundingAlert) (int, error) {
+	created := 0
+	for _, alert := range alerts {
+		details, err := json.Marshal(alert.Details)
+		if err != nil {
+			return created, err
+		}
+		res, err := db.ExecContext(ctx, `
+			INSERT INTO funding_alerts (rule, subject_type, subject_id, currency, period_start, period_end, score, details, dedup_key)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (dedup_key) DO NOTHING
+		`, alert.Rule, alert.SubjectType, alert.SubjectID, alert.Currency, alert.PeriodStart, alert.PeriodEnd,
+			alert.Score, string(details), alert.DedupKey)
+		if err != nil {
+			return created, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			created++
+		}
+	}
+	return created, nil
+}
+
+const alertColumns = `id, rule, subject_type, subject_id, currency, period_start, period_end, score, details,
+	status, COALESCE(assigned_to, ''), created_at, updated_at`
+
+func scanAlert(row interface{ Scan(...interface{}) error }) (FundingAlert, error) {
+	var alert FundingAlert
+	var details []byte
+	err := row.Scan(&alert.ID, &alert.Rule, &alert.SubjectType, &alert.SubjectID, &alert.Currency,
+		&alert.PeriodStart, &alert.PeriodEnd, &alert.Score, &details, &alert.Status, &alert.AssignedTo,
+		&alert.CreatedAt, &alert.UpdatedAt)
+	if err != nil {
+		return alert, err
+	}
+	if err := json.Unmarshal(details, &alert.Details); err != nil {
+		return alert, fmt.Errorf("decoding alert details: %w", err)
+	}
+	return alert, nil
+}
+
+func handleListAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	var conds []string
+	var args []interface{}
+	for _, f := range []struct{ param, column string }{
+		{"status", "status"}, {"rule", "rule"}, {"subject_id", "subject_id"}, {"assigned_to", "assigned_to"},
+	} {
+		if v := q.Get(f.param); v != "" {
+			args = append(args, v)
+			conds = append(conds, fmt.Sprintf("%s = $%d", f.column, len(args)))
+		}
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	limit, offset := defaultSearchLimit, 0
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 && v <= maxSearchLimit {
+		limit = v
+	}
+	if v, err := strconv.Atoi(q.Get("offset")); err == nil && v >= 0 {
+		offset = v
+	}
+	args = append(args, limit, offset)
+
+	rows, err := db.QueryContext(r.Context(),
+		"SELECT "+alertColumns+" FROM funding_alerts"+where+
+			fmt.Sprintf(" ORDER BY score DESC, created_at DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args)),
+		args...)
+	if err != nil {
+		log.Printf("Listing funding alerts failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list alerts"})
+		return
+	}
+	defer rows.Close()
+
+	alerts := []FundingAlert{}
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list alerts"})
+			return
+		}
+		alerts = append(alerts, alert)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"alerts": alerts,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+func handleTriageAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req TriageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if req.ID == "" || req.Status == "" || req.Actor == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "id, status and actor are required"})
+		return
+	}
+	if _, ok := alertTransitions[req.Status]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("unknown status %q", req.Status)})
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to triage alert"})
+		return
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRowContext(r.Context(), "SELECT status FROM funding_alerts WHERE id = $1 FOR UPDATE", req.ID).Scan(&current)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Alert not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to triage alert"})
+		return
+	}
+	if !canTransition(current, req.Status) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("cannot move alert from %s to %s", current, req.Status)})
+		return
+	}
+
+	alert, err := scanAlert(tx.QueryRowContext(r.Context(), `
+		UPDATE funding_alerts
+		SET status = $2, assigned_to = COALESCE(NULLIF($3, ''), assigned_to), updated_at = now()
+		WHERE id = $1
+		RETURNING `+alertColumns, req.ID, req.Status, req.AssignedTo))
+	if err == nil {
+		_, err = tx.ExecContext(r.Context(), `
+			INSERT INTO funding_alert_events (alert_id, from_status, to_status, actor, note)
+			VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		`, req.ID, current, req.Status, req.Actor, req.Note)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Triage of alert %s failed: %v", req.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to triage alert"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alert)
+}
+
+func handleScanAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req ScanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	from, errFrom := time.Parse(searchDateLayout, req.From)
+	to, errTo := time.Parse(searchDateLayout, req.To)
+	if errFrom != nil || errTo != nil || to.Before(from) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "from and to must be dates in YYYY-MM-DD format with from <= to"})
+		return
+	}
+
+	created, err := runAnomalyScan(r.Context(), from, to, loadAnomalyConfig())
+	if err != nil {
+		log.Printf("Funding anomaly scan failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Anomaly scan failed"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":    req.From,
+		"to":      req.To,
+		"created": created,
+	})
+}
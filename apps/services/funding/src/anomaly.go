@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Anomaly rules.
+const (
+	ruleNearThreshold  = "near_threshold"
+	ruleSourceBurst    = "source_burst"
+	ruleRoundNumbers   = "round_numbers"
+	ruleRecipientSpike = "recipient_spike"
+)
+
+// anomalyConfig tunes the detectors. Defaults suit FEC data: $200 is the
+// itemization threshold and $3,300 the 2024 per-election individual limit.
+type anomalyConfig struct {
+	Thresholds        []Amount // reporting thresholds, USD
+	ThresholdBand     Amount   // how far below a threshold counts as "just under"
+	ThresholdMinCount int64    // near-threshold gifts from one source before alerting
+	BurstMinCount     int64    // contributions from one source in one day
+	RoundUnit         Amount   // amounts that are a multiple of this are "round"
+	RoundMinSample    int64    // contributions a recipient needs before round clustering is judged
+	RoundMinShare     float64  // share of round amounts that is suspicious on its own
+	RoundMinZ         float64  // and how far above the overall share it must be
+	SpikeBaselineDays int      // rolling baseline length
+	SpikeMinHistory   int      // baseline days with contributions before a z-score is trusted
+	SpikeMinZ         float64
+	SpikeMinAmount    Amount
+	Interval          time.Duration
+	LookbackDays      int
+}
+
+func defaultAnomalyConfig() anomalyConfig {
+	return anomalyConfig{
+		Thresholds:        []Amount{20000, 330000},
+		ThresholdBand:     1000,
+		ThresholdMinCount: 3,
+		BurstMinCount:     10,
+		RoundUnit:         10000,
+		RoundMinSample:    20,
+		RoundMinShare:     0.5,
+		RoundMinZ:         3,
+		SpikeBaselineDays: 28,
+		SpikeMinHistory:   7,
+		SpikeMinZ:         3,
+		SpikeMinAmount:    100000,
+		Interval:          time.Hour,
+		LookbackDays:      30,
+	}
+}
+
+// loadAnomalyConfig applies FUNDING_REPORTING_THRESHOLDS (comma-separated
+// amounts), FUNDING_ANOMALY_INTERVAL and FUNDING_ANOMALY_LOOKBACK_DAYS.
+func loadAnomalyConfig() anomalyConfig {
+	cfg := defaultAnomalyConfig()
+	if raw := os.Getenv("FUNDING_REPORTING_THRESHOLDS"); raw != "" {
+		var thresholds []Amount
+		for _, part := range strings.Split(raw, ",") {
+			a, err := parseAmount(part)
+			if err != nil || a <= 0 {
+				log.Printf("Warning: ignoring invalid reporting threshold %q", part)
+				continue
+			}
+			thresholds = append(thresholds, a)
+		}
+		if len(thresholds) > 0 {
+			cfg.Thresholds = thresholds
+		}
+	}
+	if raw := os.Getenv("FUNDING_ANOMALY_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			cfg.Interval = d
+		}
+	}
+	if raw := os.Getenv("FUNDING_ANOMALY_LOOKBACK_DAYS"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			cfg.LookbackDays = n
+		}
+	}
+	return cfg
+}
+
+// entityDayCount is the number of contributions one source made on one day.
+type entityDayCount struct {
+	EntityID string
+	Currency string
+	Date     time.Time
+	Count    int64
+	Total    Amount
+}
+
+// recipientRoundStats counts how many of a recipient's contributions in a
+// calendar month were round amounts.
+type recipientRoundStats struct {
+	RecipientID string
+	Currency    string
+	Month       time.Time
+	Count       int64
+	Round       int64
+}
+
+// recipientDayTotal is a recipient's total received on one day.
+type recipientDayTotal struct {
+	RecipientID string
+	Currency    string
+	Date        time.Time
+	Total       Amount
+}
+
+func alertKey(rule, subject, currency string, start, end time.Time) string {
+	return strings.Join([]string{rule, subject, currency, start.Format(searchDateLayout), end.Format(searchDateLayout)}, "|")
+}
+
+// detectNearThreshold flags sources that repeatedly give just under a
+// reporting threshold. records must already be limited to USD amounts within
+// cfg.ThresholdBand below some threshold.
+func detectNearThreshold(records []FundingRecord, cfg anomalyConfig) []FundingAlert {
+	type bucket struct {
+		threshold Amount
+		records   []FundingRecord
+	}
+	byEntity := map[string]*bucket{}
+	var keys []string
+
+	for _, rec := range records {
+		for _, t := range cfg.Thresholds {
+			if rec.Amount >= t-cfg.ThresholdBand && rec.Amount < t {
+				k := rec.canonicalEntity() + "|" + t.String()
+				b, ok := byEntity[k]
+				if !ok {
+					b = &bucket{threshold: t}
+					byEntity[k] = b
+					keys = append(keys, k)
+				}
+				b.records = append(b.records, rec)
+				break
+			}
+		}
+	}
+
+	var alerts []FundingAlert
+	for _, k := range keys {
+		b := byEntity[k]
+		if int64(len(b.records)) < cfg.ThresholdMinCount {
+			continue
+		}
+		sort.Slice(b.records, func(i, j int) bool { return b.records[i].Date.Before(b.records[j].Date) })
+		first, last := b.records[0].Date, b.records[len(b.records)-1].Date
+
+		var total Amount
+		ids := make([]string, 0, len(b.records))
+		recipients := map[string]bool{}
+		for _, rec := range b.records {
+			total += rec.Amount
+			if rec.ID != "" {
+				ids = append(ids, rec.ID)
+			}
+			recipients[rec.canonicalRecipient()] = true
+		}
+
+		entityID := b.records[0].canonicalEntity()
+		alerts = append(alerts, FundingAlert{
+			Rule:        ruleNearThreshold,
+			SubjectType: "entity",
+			SubjectID:   entityID,
+			Currency:    "USD",
+			PeriodStart: first,
+			PeriodEnd:   last,
+			Score:       float64(len(b.records)) / float64(cfg.ThresholdMinCount),
+			Details: map[string]interface{}{
+				"threshold":  b.threshold.String(),
+				"count":      len(b.records),
+				"total":      total.String(),
+				"recipients": len(recipients),
+				"record_ids": ids,
+			},
+			// Keyed on the latest gift so a sliding scan window does not
+			// re-raise the same pattern; a new gift raises a fresh alert.
+			DedupKey: alertKey(ruleNearThreshold, entityID+"@"+b.threshold.String(), "USD", last, last),
+		})
+	}
+	return alerts
+}
+
+// detectBursts flags sources with an unusual number of contributions on a
+// single day.
+func detectBursts(counts []entityDayCount, cfg anomalyConfig) []FundingAlert {
+	var alerts []FundingAlert
+	for _, c := range counts {
+		if c.Count < cfg.BurstMinCount {
+			continue
+		}
+		alerts = append(alerts, FundingAlert{
+			Rule:        ruleSourceBurst,
+			SubjectType: "entity",
+			SubjectID:   c.EntityID,
+			Currency:    c.Currency,
+			PeriodStart: c.Date,
+			PeriodEnd:   c.Date,
+			Score:       float64(c.Count) / float64(cfg.BurstMinCount),
+			Details: map[string]interface{}{
+				"count": c.Count,
+				"total": c.Total.String(),
+			},
+			DedupKey: alertKey(ruleSourceBurst, c.EntityID, c.Currency, c.Date, c.Date),
+		})
+	}
+	return alerts
+}
+
+// detectRoundNumbers flags recipients whose share of round-amount
+// contributions in a month is both high and significantly above the share
+// across all recipients that month (one-proportion z-test).
+func detectRoundNumbers(stats []recipientRoundStats, cfg anomalyConfig) []FundingAlert {
+	type monthTotals struct{ count, round int64 }
+	months := map[string]*monthTotals{}
+	for _, s := range stats {
+		k := s.Month.Format(searchDateLayout)
+		if months[k] == nil {
+			months[k] = &monthTotals{}
+		}
+		months[k].count += s.Count
+		months[k].round += s.Round
+	}
+
+	var alerts []FundingAlert
+	for _, s := range stats {
+		if s.Count < cfg.RoundMinSample {
+			continue
+		}
+		m := months[s.Month.Format(searchDateLayout)]
+		p0 := float64(m.round) / float64(m.count)
+		if p0 <= 0 || p0 >= 1 {
+			continue
+		}
+		share := float64(s.Round) / float64(s.Count)
+		z := (share - p0) / math.Sqrt(p0*(1-p0)/float64(s.Count))
+		if share < cfg.RoundMinShare || z < cfg.RoundMinZ {
+			continue
+		}
+
+		monthEnd := s.Month.AddDate(0, 1, -1)
+		alerts = append(alerts, FundingAlert{
+			Rule:        ruleRoundNumbers,
+			SubjectType: "recipient",
+			SubjectID:   s.RecipientID,
+			Currency:    s.Currency,
+			PeriodStart: s.Month,
+			PeriodEnd:   monthEnd,
+			Score:       roundTo(z, 2),
+			Details: map[string]interface{}{
+				"count":          s.Count,
+				"round_count":    s.Round,
+				"round_share":    roundTo(share, 4),
+				"baseline_share": roundTo(p0, 4),
+				"round_unit":     cfg.RoundUnit.String(),
+			},
+			DedupKey: alertKey(ruleRoundNumbers, s.RecipientID, s.Currency, s.Month, monthEnd),
+		})
+	}
+	return alerts
+}
+
+// detectSpikes flags days on which a recipient received far more than its
+// rolling baseline. totals must cover cfg.SpikeBaselineDays before start as
+// well as the window itself; days without contributions count as zero.
+func detectSpikes(totals []recipientDayTotal, start, end time.Time, cfg anomalyConfig) []FundingAlert {
+	type series struct {
+		recipient, currency string
+		days                map[string]Amount // keyed by YYYY-MM-DD
+	}
+	byRecipient := map[string]*series{}
+	var keys []string
+	for _, t := range totals {
+		k := t.RecipientID + "|" + t.Currency
+		s, ok := byRecipient[k]
+		if !ok {
+			s = &series{recipient: t.RecipientID, currency: t.Currency, days: map[string]Amount{}}
+			byRecipient[k] = s
+			keys = append(keys, k)
+		}
+		s.days[t.Date.Format(searchDateLayout)] = t.Total
+	}
+
+	var alerts []FundingAlert
+	for _, k := range keys {
+		s := byRecipient[k]
+		for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+			x, ok := s.days[day.Format(searchDateLayout)]
+			if !ok || x < cfg.SpikeMinAmount {
+				continue
+			}
+
+			var sum, sumSq float64
+			active := 0
+			for i := 1; i <= cfg.SpikeBaselineDays; i++ {
+				v := float64(s.days[day.AddDate(0, 0, -i).Format(searchDateLayout)])
+				if v > 0 {
+					active++
+				}
+				sum += v
+				sumSq += v * v
+			}
+			if active < cfg.SpikeMinHistory {
+				continue
+			}
+			n := float64(cfg.SpikeBaselineDays)
+			mean := sum / n
+			std := math.Sqrt(math.Max(sumSq/n-mean*mean, 0))
+			if std == 0 {
+				continue
+			}
+			z := (float64(x) - mean) / std
+			if z < cfg.SpikeMinZ {
+				continue
+			}
+
+			alerts = append(alerts, FundingAlert{
+				Rule:        ruleRecipientSpike,
+				SubjectType: "recipient",
+				SubjectID:   s.recipient,
+				Currency:    s.currency,
+				PeriodStart: day,
+				PeriodEnd:   day,
+				Score:       roundTo(z, 2),
+				Details: map[string]interface{}{
+					"total":         x.String(),
+					"baseline_mean": Amount(math.Round(mean)).String(),
+					"baseline_std":  Amount(math.Round(std)).String(),
+					"baseline_days": cfg.SpikeBaselineDays,
+				},
+				DedupKey: alertKey(ruleRecipientSpike, s.recipient, s.currency, day, day),
+			})
+		}
+	}
+	return alerts
+}
+
+func roundTo(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+// runAnomalyScan evaluates every rule over contributions dated from..to and
+// stores new findings. Re-scanning a period does not duplicate alerts.
+func runAnomalyScan(ctx context.Context, from, to time.Time, cfg anomalyConfig) (int, error) {
+	var alerts []FundingAlert
+
+	near, err := loadNearThresholdRecords(ctx, from, to, cfg)
+	if err != nil {
+		return 0, fmt.Errorf("near-threshold scan: %w", err)
+	}
+	alerts = append(alerts, detectNearThreshold(near, cfg)...)
+
+	counts, err := loadEntityDayCounts(ctx, from, to, cfg.BurstMinCount)
+	if err != nil {
+		return 0, fmt.Errorf("burst scan: %w", err)
+	}
+	alerts = append(alerts, detectBursts(counts, cfg)...)
+
+	stats, err := loadRecipientRoundStats(ctx, from, to, cfg.RoundUnit)
+	if err != nil {
+		return 0, fmt.Errorf("round-number scan: %w", err)
+	}
+	alerts = append(alerts, detectRoundNumbers(stats, cfg)...)
+
+	totals, err := loadRecipientDayTotals(ctx, from.AddDate(0, 0, -cfg.SpikeBaselineDays), to)
+	if err != nil {
+		return 0, fmt.Errorf("spike scan: %w", err)
+	}
+	alerts = append(alerts, detectSpikes(totals, from, to, cfg)...)
+
+	return insertAlerts(ctx, alerts)
+}
+
+// canonicalEntity is the entity a record is attributed to once duplicate
+// entities are merged, so gifts spread across duplicates count together.
+func (r FundingRecord) canonicalEntity() string {
+	if r.CanonicalEntityID != "" {
+		return r.CanonicalEntityID
+	}
+	return r.EntityID
+}
+
+// canonicalRecipient is the recipient a record is attributed to once
+// duplicate recipients are merged.
+func (r FundingRecord) canonicalRecipient() string {
+	if r.CanonicalRecipientID != "" {
+		return r.CanonicalRecipientID
+	}
+	return r.RecipientID
+}
+
+func loadNearThresholdRecords(ctx context.Context, from, to time.Time, cfg anomalyConfig) ([]FundingRecord, error) {
+	var bands []string
+	args := []interface{}{from, to}
+	for _, t := range cfg.Thresholds {
+		args = append(args, t-cfg.ThresholdBand, t)
+		bands = append(bands, fmt.Sprintf("(amount >= $%d AND amount < $%d)", len(args)-1, len(args)))
+	}
+	if len(bands) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, entity_id, recipient_id, canonical_entity_id, canonical_recipient_id, amount, currency, source, date, created_at
+		FROM active_funding_records
+		WHERE currency = 'USD' AND date >= $1 AND date <= $2 AND (`+strings.Join(bands, " OR ")+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []FundingRecord
+	for rows.Next() {
+		var rec FundingRecord
+		if err := rows.Scan(&rec.ID, &rec.EntityID, &rec.RecipientID, &rec.CanonicalEntityID, &rec.CanonicalRecipientID, &rec.Amount, &rec.Currency, &rec.Source, &rec.Date, &rec.CreatedAt); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func loadEntityDayCounts(ctx context.Context, from, to time.Time, minCount int64) ([]entityDayCount, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT canonical_entity_id, currency, date, COUNT(*), SUM(amount)
+		FROM active_funding_records
+		WHERE date >= $1 AND date <= $2
+		GROUP BY canonical_entity_id, currency, date
+		HAVING COUNT(*) >= $3
+	`, from, to, minCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []entityDayCount
+	for rows.Next() {
+		var c entityDayCount
+		if err := rows.Scan(&c.EntityID, &c.Currency, &c.Date, &c.Count, &c.Total); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func loadRecipientRoundStats(ctx context.Context, from, to time.Time, unit Amount) ([]recipientRoundStats, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT canonical_recipient_id, currency, date_trunc('month', date)::date AS month,
+			COUNT(*), COUNT(*) FILTER (WHERE amount % $3 = 0)
+		FROM active_funding_records
+		WHERE date >= date_trunc('month', $1::date) AND date <= $2
+		GROUP BY canonical_recipient_id, currency, month
+	`, from, to, unit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []recipientRoundStats
+	for rows.Next() {
+		var s recipientRoundStats
+		if err := rows.Scan(&s.RecipientID, &s.Currency, &s.Month, &s.Count, &s.Round); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func loadRecipientDayTotals(ctx context.Context, from, to time.Time) ([]recipientDayTotal, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT canonical_recipient_id, currency, date, SUM(amount)
+		FROM active_funding_records
+		WHERE date >= $1 AND date <= $2
+		GROUP BY canonical_recipient_id, currency, date
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []recipientDayTotal
+	for rows.Next() {
+		var t recipientDayTotal
+		if err := rows.Scan(&t.RecipientID, &t.Currency, &t.Date, &t.Total); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// startAnomalyDetector scans the trailing lookback window on every interval.
+func startAnomalyDetector(cfg anomalyConfig) {
+	go func() {
+		for {
+			today := time.Now().UTC().Truncate(24 * time.Hour)
+			from := today.AddDate(0, 0, -cfg.LookbackDays)
+			created, err := runAnomalyScan(context.Background(), from, today, cfg)
+			if err != nil {
+				log.Printf("Warning: Funding anomaly scan failed: %v", err)
+			} else if created > 0 {
+				log.Printf("Funding anomaly scan raised %d new alerts", created)
+			}
+			time.Sleep(cfg.Interval)
+		}
+	}()
+}
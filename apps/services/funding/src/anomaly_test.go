@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func day(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// TestDetectNearThreshold tests flagging repeated gifts just under a reporting threshold
+func TestDetectNearThreshold(t *testing.T) {
+	cfg := defaultAnomalyConfig()
+	records := []FundingRecord{
+		{ID: "1", EntityID: "E1", RecipientID: "R1", Amount: 19900, Date: day(2024, 3, 1)},
+		{ID: "2", EntityID: "E1", RecipientID: "R2", Amount: 19500, Date: day(2024, 3, 4)},
+		{ID: "3", EntityID: "E1", RecipientID: "R3", Amount: 19999, Date: day(2024, 3, 9)},
+		{ID: "4", EntityID: "E2", RecipientID: "R1", Amount: 19900, Date: day(2024, 3, 2)},
+		{ID: "5", EntityID: "E2", RecipientID: "R1", Amount: 329900, Date: day(2024, 3, 3)},
+		{ID: "6", EntityID: "E3", RecipientID: "R1", Amount: 20000, Date: day(2024, 3, 3)},
+	}
+
+	alerts := detectNearThreshold(records, cfg)
+	if len(alerts) != 1 {
+		t.Fatalf("expected one alert, got %d: %+v", len(alerts), alerts)
+	}
+	a := alerts[0]
+	if a.SubjectID != "E1" || a.Details["count"] != 3 || a.Details["recipients"] != 3 {
+		t.Errorf("unexpected alert %+v", a)
+	}
+	if !a.PeriodStart.Equal(day(2024, 3, 1)) || !a.PeriodEnd.Equal(day(2024, 3, 9)) {
+		t.Errorf("period = %s..%s, want 2024-03-01..2024-03-09", a.PeriodStart, a.PeriodEnd)
+	}
+
+	// A later scan whose window no longer covers the first gift must not re-raise the pattern.
+	cfg.ThresholdMinCount = 2
+	later := detectNearThreshold(append([]FundingRecord{}, records[1:3]...), cfg)
+	if len(later) != 1 || later[0].DedupKey != a.DedupKey {
+		t.Errorf("sliding window should keep the same dedup key")
+	}
+
+	// Gifts from duplicate entities merged into one count together.
+	merged := []FundingRecord{
+		{ID: "7", EntityID: "E4a", CanonicalEntityID: "E4", RecipientID: "R1", Amount: 19900, Date: day(2024, 3, 1)},
+		{ID: "8", EntityID: "E4b", CanonicalEntityID: "E4", RecipientID: "R1b", CanonicalRecipientID: "R1", Amount: 19800, Date: day(2024, 3, 2)},
+	}
+	alerts = detectNearThreshold(merged, cfg)
+	if len(alerts) != 1 || alerts[0].SubjectID != "E4" || alerts[0].Details["count"] != 2 || alerts[0].Details["recipients"] != 1 {
+		t.Errorf("merged entities: alerts = %+v, want one for E4 with one recipient", alerts)
+	}
+}
+
+// TestDetectBursts tests flagging many contributions from one source in a day
+func TestDetectBursts(t *testing.T) {
+	cfg := defaultAnomalyConfig()
+	counts := []entityDayCount{
+		{EntityID: "E1", Currency: "USD", Date: day(2024, 5, 1), Count: 25, Total: 250000},
+		{EntityID: "E2", Currency: "USD", Date: day(2024, 5, 1), Count: 9, Total: 9000},
+	}
+
+	alerts := detectBursts(counts, cfg)
+	if len(alerts) != 1 || alerts[0].SubjectID != "E1" || alerts[0].Score != 2.5 {
+		t.Errorf("unexpected alerts %+v", alerts)
+	}
+}
+
+// TestDetectRoundNumbers tests the round-number clustering z-test
+func TestDetectRoundNumbers(t *testing.T) {
+	cfg := defaultAnomalyConfig()
+	march := day(2024, 3, 1)
+	stats := []recipientRoundStats{
+		{RecipientID: "R1", Currency: "USD", Month: march, Count: 40, Round: 38},
+		{RecipientID: "R2", Currency: "USD", Month: march, Count: 500, Round: 50},
+		{RecipientID: "R3", Currency: "USD", Month: march, Count: 500, Round: 60},
+		{RecipientID: "R4", Currency: "USD", Month: march, Count: 10, Round: 10},
+	}
+
+	alerts := detectRoundNumbers(stats, cfg)
+	if len(alerts) != 1 {
+		t.Fatalf("expected one alert, got %+v", alerts)
+	}
+	a := alerts[0]
+	if a.SubjectID != "R1" {
+		t.Errorf("expected R1 flagged, got %s", a.SubjectID)
+	}
+	if !a.PeriodEnd.Equal(day(2024, 3, 31)) {
+		t.Errorf("period should cover the calendar month, got end %s", a.PeriodEnd)
+	}
+}
+
+// TestDetectSpikes tests the rolling-baseline z-score for recipient spikes
+func TestDetectSpikes(t *testing.T) {
+	cfg := defaultAnomalyConfig()
+	start := day(2024, 6, 1)
+
+	var totals []recipientDayTotal
+	for i := 1; i <= cfg.SpikeBaselineDays; i++ {
+		amount := Amount(50000)
+		if i%2 == 0 {
+			amount = 70000
+		}
+		totals = append(totals,
+			recipientDayTotal{RecipientID: "R1", Currency: "USD", Date: start.AddDate(0, 0, -i), Total: amount},
+			recipientDayTotal{RecipientID: "R2", Currency: "USD", Date: start.AddDate(0, 0, -i), Total: amount})
+	}
+	// R1 spikes on the first day of the window; R2 stays within its usual range.
+	totals = append(totals,
+		recipientDayTotal{RecipientID: "R1", Currency: "USD", Date: start, Total: 2000000},
+		recipientDayTotal{RecipientID: "R2", Currency: "USD", Date: start, Total: 72000},
+		// R3 has no history, so a single large day cannot be judged.
+		recipientDayTotal{RecipientID: "R3", Currency: "USD", Date: start, Total: 5000000})
+
+	alerts := detectSpikes(totals, start, start.AddDate(0, 0, 6), cfg)
+	if len(alerts) != 1 {
+		t.Fatalf("expected one alert, got %+v", alerts)
+	}
+	if alerts[0].SubjectID != "R1" || alerts[0].Score < cfg.SpikeMinZ {
+		t.Errorf("unexpected alert %+v", alerts[0])
+	}
+}
+
+// TestAlertTransitions tests the triage state machine
+func TestAlertTransitions(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{alertOpen, alertAcknowledged, true},
+		{alertOpen, alertConfirmed, true},
+		{alertAcknowledged, alertEscalated, true},
+		{alertDismissed, alertOpen, true},
+		{alertDismissed, alertConfirmed, false},
+		{alertConfirmed, alertOpen, false},
+		{alertOpen, "closed", false},
+	}
+
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Entity kinds. Contributing entities and recipients are resolved
+// separately; an ID is only ever merged with IDs of the same kind.
+const (
+	entityKindEntity    = "entity"
+	entityKindRecipient = "recipient"
+)
+
+// Resolution decisions.
+const (
+	decisionMerge  = "merge"
+	decisionSplit  = "split"
+	decisionRevert = "revert"
+)
+
+const (
+	defaultMatchScore = 0.88
+	maxBlockSize      = 500 // blocks larger than this are too generic to compare pairwise
+	maxCandidates     = 1000
+	resolverActor     = "entity-resolver"
+)
+
+var (
+	errUnknownEntity    = errors.New("unknown entity")
+	errUnknownDecision  = errors.New("unknown decision")
+	errDecisionConflict = errors.New("decision conflicts with a later decision")
+	errAlreadyReverted  = errors.New("decision already reverted")
+	errNoChange         = errors.New("entities are already resolved that way")
+)
+
+// nameSuffixes canonicalizes legal-form words so "Acme Corporation" and
+// "ACME CORP." normalize the same way.
+var nameSuffixes = map[string]string{
+	"CORPORATION":   "CORP",
+	"INCORPORATED":  "INC",
+	"COMPANY":       "CO",
+	"LIMITED":       "LTD",
+	"ASSOCIATION":   "ASSN",
+	"ASSOC":         "ASSN",
+	"COMMITTEE":     "CMTE",
+	"COMM":          "CMTE",
+	"INTERNATIONAL": "INTL",
+}
+
+// organizationTokens mark a normalized name as an organization. Only
+// organizations are merged automatically: two people with the same name are
+// often different people.
+var organizationTokens = map[string]bool{
+	"CORP": true, "INC": true, "CO": true, "LTD": true, "LLC": true, "LLP": true, "LP": true,
+	"PLLC": true, "PC": true, "PAC": true, "ASSN": true, "CMTE": true, "FUND": true,
+	"FOUNDATION": true, "UNION": true, "PARTY": true, "INTL": true, "GROUP": true,
+}
+
+// Entity is a contributor or recipient ID and the name it was last seen with.
+type Entity struct {
+	Kind           string    `json:"kind"`
+	ID             string    `json:"id"`
+	Name           string    `json:"name,omitempty"`
+	NormalizedName string    `json:"normalized_name,omitempty"`
+	CanonicalID    string    `json:"canonical_id"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// EntityCluster is a canonical entity and every ID resolved to it.
+type EntityCluster struct {
+	Kind        string           `json:"kind"`
+	CanonicalID string           `json:"canonical_id"`
+	Members     []Entity         `json:"members"`
+	Decisions   []EntityDecision `json:"decisions"`
+}
+
+// MatchCandidate is a pair of entities that probably name the same party.
+// Score is the larger of the Jaro-Winkler and token-set similarities of the
+// normalized names.
+type MatchCandidate struct {
+	Kind        string  `json:"kind"`
+	Left        Entity  `json:"left"`
+	Right       Entity  `json:"right"`
+	Score       float64 `json:"score"`
+	JaroWinkler float64 `json:"jaro_winkler"`
+	TokenSet    float64 `json:"token_set"`
+	Exact       bool    `json:"exact"`
+}
+
+// EntityDecision is one audited change to the canonical mapping. Previous
+// and Applied hold the canonical ID of every affected entity before and
+// after the decision, so it can be reverted exactly.
+type EntityDecision struct {
+	ID          string            `json:"id"`
+	Kind        string            `json:"kind"`
+	Action      string            `json:"action"`
+	CanonicalID string            `json:"canonical_id,omitempty"`
+	EntityIDs   []string          `json:"entity_ids"`
+	Previous    map[string]string `json:"previous"`
+	Applied     map[string]string `json:"applied"`
+	Score       *float64          `json:"score,omitempty"`
+	Actor       string            `json:"actor"`
+	Reason      string            `json:"reason,omitempty"`
+	RevertsID   string            `json:"reverts_id,omitempty"`
+	RevertedBy  string            `json:"reverted_by,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// MergeRequest resolves every listed entity, and everything already merged
+// with them, to CanonicalID.
+type MergeRequest struct {
+	Kind        string   `json:"kind"`
+	CanonicalID string   `json:"canonical_id"`
+	EntityIDs   []string `json:"entity_ids"`
+	Score       *float64 `json:"score,omitempty"`
+	Actor       string   `json:"actor"`
+	Reason      string   `json:"reason,omitempty"`
+}
+
+// SplitRequest makes each listed entity its own canonical entity again.
+type SplitRequest struct {
+	Kind      string   `json:"kind"`
+	EntityIDs []string `json:"entity_ids"`
+	Actor     string   `json:"actor"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+// RevertRequest undoes a decision.
+type RevertRequest struct {
+	DecisionID string `json:"decision_id"`
+	Actor      string `json:"actor"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+func validateEntityKind(kind string) error {
+	if kind != entityKindEntity && kind != entityKindRecipient {
+		return fmt.Errorf("kind must be %s or %s", entityKindEntity, entityKindRecipient)
+	}
+	return nil
+}
+
+func (m MergeRequest) validate() error {
+	if err := validateEntityKind(m.Kind); err != nil {
+		return err
+	}
+	if m.CanonicalID == "" || len(m.EntityIDs) == 0 || m.Actor == "" {
+		return fmt.Errorf("canonical_id, entity_ids and actor are required")
+	}
+	if m.Score != nil && (*m.Score < 0 || *m.Score > 1) {
+		return fmt.Errorf("score must be between 0 and 1")
+	}
+	return nil
+}
+
+func (s SplitRequest) validate() error {
+	if err := validateEntityKind(s.Kind); err != nil {
+		return err
+	}
+	if len(s.EntityIDs) == 0 || s.Actor == "" {
+		return fmt.Errorf("entity_ids and actor are required")
+	}
+	return nil
+}
+
+// normalizeName reduces a party name to a comparable form: upper case,
+// punctuation removed, "&" spelled out, a leading "THE" dropped, runs of
+// single letters joined ("L.L.C." becomes "LLC") and legal suffixes
+// canonicalized.
+func normalizeName(name string) string {
+	name = strings.ReplaceAll(strings.ToUpper(name), "&", " AND ")
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\'' || r == '.':
+			return -1
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			return r
+		}
+		return ' '
+	}, name)
+
+	var tokens []string
+	var letters strings.Builder
+	flush := func() {
+		if letters.Len() > 0 {
+			tokens = append(tokens, letters.String())
+			letters.Reset()
+		}
+	}
+	for _, tok := range strings.Fields(name) {
+		if len([]rune(tok)) == 1 && unicode.IsLetter([]rune(tok)[0]) {
+			letters.WriteString(tok)
+			continue
+		}
+		flush()
+		tokens = append(tokens, tok)
+	}
+	flush()
+
+	if len(tokens) > 1 && tokens[0] == "THE" {
+		tokens = tokens[1:]
+	}
+	for i, tok := range tokens {
+		if canonical, ok := nameSuffixes[tok]; ok {
+			tokens[i] = canonical
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// isOrganizationName reports whether a normalized name carries a legal-form
+// or organization word.
+func isOrganizationName(normalized string) bool {
+	for _, tok := range strings.Fields(normalized) {
+		if organizationTokens[tok] {
+			return true
+		}
+	}
+	return false
+}
+
+// blockingKeys returns the blocks a normalized name is compared within: the
+// first four characters of its first and of its last token. Two keys let
+// "SMITH JOHN" meet "JOHN SMITH".
+func blockingKeys(normalized string) []string {
+	tokens := strings.Fields(normalized)
+	if len(tokens) == 0 {
+		return nil
+	}
+	prefix := func(tok string) string {
+		r := []rune(tok)
+		if len(r) > 4 {
+			r = r[:4]
+		}
+		return string(r)
+	}
+	first, last := prefix(tokens[0]), prefix(tokens[len(tokens)-1])
+	if first == last {
+		return []string{first}
+	}
+	return []string{first, last}
+}
+
+// jaroWinkler returns the Jaro-Winkler similarity of a and b in [0, 1].
+func jaroWinkler(a, b string) float64 {
+	s, t := []rune(a), []rune(b)
+	if len(s) == 0 && len(t) == 0 {
+		return 1
+	}
+	if len(s) == 0 || len(t) == 0 {
+		return 0
+	}
+
+	window := len(s)
+	if len(t) > window {
+		window = len(t)
+	}
+	window = window/2 - 1
+	if window < 0 {
+		window = 0
+	}
+
+	sMatched := make([]bool, len(s))
+	tMatched := make([]bool, len(t))
+	matches := 0
+	for i := range s {
+		lo, hi := i-window, i+window+1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(t) {
+			hi = len(t)
+		}
+		for j := lo; j < hi; j++ {
+			if !tMatched[j] && s[i] == t[j] {
+				sMatched[i], tMatched[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions, j := 0, 0
+	for i := range s {
+		if !sMatched[i] {
+			continue
+		}
+		for !tMatched[j] {
+			j++
+		}
+		if s[i] != t[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(s)) + m/float64(len(t)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < len(s) && prefix < len(t) && prefix < 4 && s[prefix] == t[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// tokenSetRatio compares names as sets of words, so word order and repeated
+// words do not matter: the shared words are compared with each side's full
+// word set and the best Jaro-Winkler similarity wins.
+func tokenSetRatio(a, b string) float64 {
+	setA, setB := map[string]bool{}, map[string]bool{}
+	for _, tok := range strings.Fields(a) {
+		setA[tok] = true
+	}
+	for _, tok := range strings.Fields(b) {
+		setB[tok] = true
+	}
+	if len(setA) == 0 || len(setB) == 0 {
+		return 0
+	}
+
+	var common, onlyA, onlyB []string
+	for tok := range setA {
+		if setB[tok] {
+			common = append(common, tok)
+		} else {
+			onlyA = append(onlyA, tok)
+		}
+	}
+	for tok := range setB {
+		if !setA[tok] {
+			onlyB = append(onlyB, tok)
+		}
+	}
+	sort.Strings(common)
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+
+	base := strings.Join(common, " ")
+	withA := strings.TrimSpace(base + " " + strings.Join(onlyA, " "))
+	withB := strings.TrimSpace(base + " " + strings.Join(onlyB, " "))
+	best := jaroWinkler(withA, withB)
+	if base != "" {
+		for _, score := range []float64{jaroWinkler(base, withA), jaroWinkler(base, withB)} {
+			if score > best {
+				best = score
+			}
+		}
+	}
+	return best
+}
+
+// matchScore scores two normalized names.
+func matchScore(a, b string) (score, jw, ts float64) {
+	jw, ts = jaroWinkler(a, b), tokenSetRatio(a, b)
+	score = jw
+	if ts > score {
+		score = ts
+	}
+	return score, jw, ts
+}
+
+// findCandidates compares every pair of named entities that share a block
+// and are not already resolved together, returning pairs scoring at least
+// minScore, best first.
+func findCandidates(entities []Entity, minScore float64) []MatchCandidate {
+	blocks := map[string][]int{}
+	for i, e := range entities {
+		for _, key := range blockingKeys(e.NormalizedName) {
+			blocks[key] = append(blocks[key], i)
+		}
+	}
+
+	type pair struct{ a, b int }
+	seen := map[pair]bool{}
+	var out []MatchCandidate
+	for _, members := range blocks {
+		if len(members) > maxBlockSize {
+			continue
+		}
+		for x := 0; x < len(members); x++ {
+			for y := x + 1; y < len(members); y++ {
+				p := pair{members[x], members[y]}
+				if p.a > p.b {
+					p.a, p.b = p.b, p.a
+				}
+				if seen[p] {
+					continue
+				}
+				seen[p] = true
+
+				left, right := entities[p.a], entities[p.b]
+				if left.CanonicalID == right.CanonicalID {
+					continue
+				}
+				score, jw, ts := matchScore(left.NormalizedName, right.NormalizedName)
+				if score < minScore {
+					continue
+				}
+				if left.ID > right.ID {
+					left, right = right, left
+				}
+				out = append(out, MatchCandidate{
+					Kind: left.Kind, Left: left, Right: right, Score: score, JaroWinkler: jw, TokenSet: ts,
+					Exact: left.NormalizedName == right.NormalizedName,
+				})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		if out[i].Left.ID != out[j].Left.ID {
+			return out[i].Left.ID < out[j].Left.ID
+		}
+		return out[i].Right.ID < out[j].Right.ID
+	})
+	return out
+}
+
+// planAutoMerges groups organizations with identical normalized names that
+// are not yet resolved together. Each group merges into its smallest
+// canonical ID.
+func planAutoMerges(kind string, entities []Entity) []MergeRequest {
+	groups := map[string]map[string]bool{}
+	for _, e := range entities {
+		if e.NormalizedName == "" || !isOrganizationName(e.NormalizedName) {
+			continue
+		}
+		if groups[e.NormalizedName] == nil {
+			groups[e.NormalizedName] = map[string]bool{}
+		}
+		groups[e.NormalizedName][e.CanonicalID] = true
+	}
+
+	names := make([]string, 0, len(groups))
+	for name, canonicals := range groups {
+		if len(canonicals) > 1 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	exact := 1.0
+	var out []MergeRequest
+	for _, name := range names {
+		ids := make([]string, 0, len(groups[name]))
+		for id := range groups[name] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		out = append(out, MergeRequest{
+			Kind: kind, CanonicalID: ids[0], EntityIDs: ids[1:], Score: &exact, Actor: resolverActor,
+			Reason: fmt.Sprintf("identical normalized name %q", name),
+		})
+	}
+	return out
+}
+
+// applyMerge returns the new canonical ID of every entity a merge changes.
+// current maps each entity in the affected clusters to its canonical ID;
+// every cluster containing target or a member is re-rooted at target.
+func applyMerge(current map[string]string, target string, members []string) map[string]string {
+	roots := map[string]bool{target: true, current[target]: true}
+	for _, m := range members {
+		roots[m] = true
+		roots[current[m]] = true
+	}
+	updates := map[string]string{}
+	for id, canonical := range current {
+		if (roots[canonical] || roots[id]) && canonical != target {
+			updates[id] = target
+		}
+	}
+	return updates
+}
+
+// applySplit returns the new canonical ID of every entity a split changes.
+// Each member becomes its own canonical entity; when a member was the
+// canonical ID of a cluster, the rest of the cluster is re-rooted at its
+// smallest remaining ID.
+func applySplit(current map[string]string, members []string) map[string]string {
+	split := map[string]bool{}
+	for _, m := range members {
+		split[m] = true
+	}
+	updates := map[string]string{}
+	remaining := map[string][]string{}
+	for id, canonical := range current {
+		if split[id] {
+			if canonical != id {
+				updates[id] = id
+			}
+			continue
+		}
+		if split[canonical] {
+			remaining[canonical] = append(remaining[canonical], id)
+		}
+	}
+	for _, ids := range remaining {
+		sort.Strings(ids)
+		for _, id := range ids {
+			updates[id] = ids[0]
+		}
+	}
+	return updates
+}
+
+// applyRevert returns the mapping that undoes decision. It fails if any
+// entity the decision touched has been moved since.
+func applyRevert(decision EntityDecision, current map[string]string) (map[string]string, error) {
+	if decision.RevertedBy != "" {
+		return nil, errAlreadyReverted
+	}
+	updates := map[string]string{}
+	for id, applied := range decision.Applied {
+		if current[id] != applied {
+			return nil, fmt.Errorf("%w: %s is now resolved to %s", errDecisionConflict, id, current[id])
+		}
+		updates[id] = decision.Previous[id]
+	}
+	return updates, nil
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// entitiesSchema runs after the provenance schema and before the rollups,
+// which group on the canonical columns of the active view.
+const entitiesSchema = `
+	CREATE TABLE IF NOT EXISTS funding_entities (
+		kind VARCHAR(20) NOT NULL,
+		id VARCHAR(255) NOT NULL,
+		name TEXT,
+		normalized_name TEXT,
+		created_at TIMESTAMP DEFAULT now() NOT NULL,
+		updated_at TIMESTAMP DEFAULT now() NOT NULL,
+		PRIMARY KEY (kind, id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_entities_name ON funding_entities(kind, normalized_name);
+
+	INSERT INTO funding_entities (kind, id)
+	SELECT 'entity', entity_id FROM funding_records
+	WHERE NOT EXISTS (SELECT 1 FROM funding_entities) GROUP BY entity_id
+	UNION
+	SELECT 'recipient', recipient_id FROM funding_records
+	WHERE NOT EXISTS (SELECT 1 FROM funding_entities) GROUP BY recipient_id
+	ON CONFLICT DO NOTHING;
+
+	CREATE TABLE IF NOT EXISTS funding_entity_decisions (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		kind VARCHAR(20) NOT NULL,
+		action VARCHAR(10) NOT NULL CHECK (action IN ('merge', 'split', 'revert')),
+		canonical_id VARCHAR(255),
+		entity_ids JSONB NOT NULL,
+		previous JSONB NOT NULL,
+		applied JSONB NOT NULL,
+		score DOUBLE PRECISION,
+		actor VARCHAR(255) NOT NULL,
+		reason TEXT,
+		reverts_id UUID REFERENCES funding_entity_decisions(id),
+		reverted_by UUID REFERENCES funding_entity_decisions(id),
+		created_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_entity_decisions_kind ON funding_entity_decisions(kind, created_at DESC);
+
+	CREATE TABLE IF NOT EXISTS funding_entity_map (
+		kind VARCHAR(20) NOT NULL,
+		entity_id VARCHAR(255) NOT NULL,
+		canonical_id VARCHAR(255) NOT NULL,
+		decision_id UUID NOT NULL REFERENCES funding_entity_decisions(id),
+		updated_at TIMESTAMP DEFAULT now() NOT NULL,
+		PRIMARY KEY (kind, entity_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_entity_map_canonical ON funding_entity_map(kind, canonical_id);
+
+	-- Rollups built before supersession or entity resolution existed group
+	-- raw IDs over every record version.
+	DO $$
+	DECLARE v RECORD;
+	BEGIN
+		FOR v IN SELECT matviewname FROM pg_matviews
+			WHERE matviewname LIKE 'funding_rollup_%' AND definition NOT LIKE '%canonical_%'
+		LOOP
+			EXECUTE format('DROP MATERIALIZED VIEW %I', v.matviewname);
+		END LOOP;
+	END $$;
+
+	CREATE OR REPLACE VIEW active_funding_records AS
+		SELECT r.*,
+			COALESCE(me.canonical_id, r.entity_id) AS canonical_entity_id,
+			COALESCE(mr.canonical_id, r.recipient_id) AS canonical_recipient_id
+		FROM funding_records r
+		LEFT JOIN funding_entity_map me ON me.kind = 'entity' AND me.entity_id = r.entity_id
+		LEFT JOIN funding_entity_map mr ON mr.kind = 'recipient' AND mr.entity_id = r.recipient_id
+		WHERE r.superseded_at IS NULL;
+	`
+
+// canonicalIDExpr is a SQL expression resolving a positional ID argument to
+// its canonical ID, for use as a fmt format with the argument index.
+func canonicalIDExpr(kind string) string {
+	return "COALESCE((SELECT canonical_id FROM funding_entity_map WHERE kind = '" + kind + "' AND entity_id = $%[1]d), $%[1]d)"
+}
+
+// idList appends ids to args and returns their placeholders.
+func idList(args []interface{}, ids []string) ([]interface{}, string) {
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		args = append(args, id)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+	return args, strings.Join(placeholders, ", ")
+}
+
+// registerEntities records the contributor and recipient of each record,
+// keeping the most recent name seen for each ID.
+func registerEntities(ctx context.Context, tx *sql.Tx, records []FundingRecord) error {
+	type key struct{ kind, id string }
+	names := map[key]string{}
+	var order []key
+	add := func(kind, id, name string) {
+		k := key{kind, id}
+		if _, ok := names[k]; !ok {
+			order = append(order, k)
+			names[k] = ""
+		}
+		if name = strings.TrimSpace(name); name != "" {
+			names[k] = name
+		}
+	}
+	for _, rec := range records {
+		add(entityKindEntity, rec.EntityID, rec.EntityName)
+		add(entityKindRecipient, rec.RecipientID, rec.RecipientName)
+	}
+	if len(order) == 0 {
+		return nil
+	}
+
+	var values []string
+	var args []interface{}
+	for _, k := range order {
+		name := names[k]
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, NULLIF($%d, ''), NULLIF($%d, ''))", n+1, n+2, n+3, n+4))
+		args = append(args, k.kind, k.id, name, normalizeName(name))
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO funding_entities (kind, id, name, normalized_name) VALUES `+strings.Join(values, ", ")+`
+		ON CONFLICT (kind, id) DO UPDATE
+		SET name = EXCLUDED.name, normalized_name = EXCLUDED.normalized_name, updated_at = now()
+		WHERE EXCLUDED.name IS NOT NULL AND funding_entities.name IS DISTINCT FROM EXCLUDED.name
+	`, args...)
+	if err != nil {
+		return fmt.Errorf("registering entities: %w", err)
+	}
+	return nil
+}
+
+// lockEntityMap serializes resolution decisions of one kind.
+func lockEntityMap(ctx context.Context, tx *sql.Tx, kind string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('funding_entity_map:' || $1))", kind)
+	return err
+}
+
+// loadClusters returns the canonical ID of every listed entity and of every
+// entity in the same clusters. Unknown IDs are an error.
+func loadClusters(ctx context.Context, tx *sql.Tx, kind string, ids []string) (map[string]string, error) {
+	args, list := idList([]interface{}{kind}, ids)
+	rows, err := tx.QueryContext(ctx, `
+		SELECT e.id, COALESCE(m.canonical_id, e.id)
+		FROM funding_entities e
+		LEFT JOIN funding_entity_map m ON m.kind = e.kind AND m.entity_id = e.id
+		WHERE e.kind = $1 AND e.id IN (`+list+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]string{}
+	for rows.Next() {
+		var id, canonical string
+		if err := rows.Scan(&id, &canonical); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		current[id] = canonical
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, ok := current[id]; !ok {
+			return nil, fmt.Errorf("%w: %s %s", errUnknownEntity, kind, id)
+		}
+	}
+
+	var roots []string
+	for _, canonical := range current {
+		roots = append(roots, canonical)
+	}
+	args, list = idList([]interface{}{kind}, roots)
+	rows, err = tx.QueryContext(ctx,
+		"SELECT entity_id, canonical_id FROM funding_entity_map WHERE kind = $1 AND canonical_id IN ("+list+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, canonical string
+		if err := rows.Scan(&id, &canonical); err != nil {
+			return nil, err
+		}
+		current[id] = canonical
+	}
+	for _, root := range roots {
+		if _, ok := current[root]; !ok {
+			current[root] = root
+		}
+	}
+	return current, rows.Err()
+}
+
+// recordDecision stores the decision and applies its updates to the map.
+// Previous is filled from current for every updated entity.
+func recordDecision(ctx context.Context, tx *sql.Tx, d *EntityDecision, current, updates map[string]string) error {
+	if len(updates) == 0 {
+		return errNoChange
+	}
+	d.Previous, d.Applied = map[string]string{}, updates
+	for id := range updates {
+		d.Previous[id] = current[id]
+	}
+	entityIDs, _ := json.Marshal(d.EntityIDs)
+	previous, _ := json.Marshal(d.Previous)
+	applied, _ := json.Marshal(d.Applied)
+
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO funding_entity_decisions (kind, action, canonical_id, entity_ids, previous, applied, score, actor, reason, reverts_id)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, '')::uuid)
+		RETURNING id, created_at
+	`, d.Kind, d.Action, d.CanonicalID, entityIDs, previous, applied, d.Score, d.Actor, d.Reason, d.RevertsID,
+	).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("recording decision: %w", err)
+	}
+
+	ids := make([]string, 0, len(updates))
+	for id := range updates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO funding_entity_map (kind, entity_id, canonical_id, decision_id) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (kind, entity_id) DO UPDATE
+			SET canonical_id = EXCLUDED.canonical_id, decision_id = EXCLUDED.decision_id, updated_at = now()
+		`, d.Kind, id, updates[id], d.ID)
+		if err != nil {
+			return fmt.Errorf("updating mapping for %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// resolveTx runs a decision under the kind's lock.
+func resolveTx(ctx context.Context, kind string, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := lockEntityMap(ctx, tx, kind); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func mergeEntities(ctx context.Context, req MergeRequest) (*EntityDecision, error) {
+	d := &EntityDecision{
+		Kind: req.Kind, Action: decisionMerge, CanonicalID: req.CanonicalID, EntityIDs: req.EntityIDs,
+		Score: req.Score, Actor: req.Actor, Reason: req.Reason,
+	}
+	err := resolveTx(ctx, req.Kind, func(tx *sql.Tx) error {
+		current, err := loadClusters(ctx, tx, req.Kind, append([]string{req.CanonicalID}, req.EntityIDs...))
+		if err != nil {
+			return err
+		}
+		return recordDecision(ctx, tx, d, current, applyMerge(current, req.CanonicalID, req.EntityIDs))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func splitEntities(ctx context.Context, req SplitRequest) (*EntityDecision, error) {
+	d := &EntityDecision{Kind: req.Kind, Action: decisionSplit, EntityIDs: req.EntityIDs, Actor: req.Actor, Reason: req.Reason}
+	err := resolveTx(ctx, req.Kind, func(tx *sql.Tx) error {
+		current, err := loadClusters(ctx, tx, req.Kind, req.EntityIDs)
+		if err != nil {
+			return err
+		}
+		return recordDecision(ctx, tx, d, current, applySplit(current, req.EntityIDs))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func revertDecision(ctx context.Context, req RevertRequest) (*EntityDecision, error) {
+	original, err := getEntityDecision(ctx, db, req.DecisionID)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownDecision
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := &EntityDecision{
+		Kind: original.Kind, Action: decisionRevert, EntityIDs: original.EntityIDs, Actor: req.Actor,
+		Reason: req.Reason, RevertsID: original.ID,
+	}
+	err = resolveTx(ctx, original.Kind, func(tx *sql.Tx) error {
+		// Re-read under the lock: it may have been reverted meanwhile.
+		original, err := getEntityDecision(ctx, tx, req.DecisionID)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0, len(original.Applied))
+		for id := range original.Applied {
+			ids = append(ids, id)
+		}
+		current, err := loadClusters(ctx, tx, original.Kind, ids)
+		if err != nil {
+			return err
+		}
+		updates, err := applyRevert(*original, current)
+		if err != nil {
+			return err
+		}
+		if err := recordDecision(ctx, tx, d, current, updates); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE funding_entity_decisions SET reverted_by = $2 WHERE id = $1", original.ID, d.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+const entityDecisionColumns = `id, kind, action, COALESCE(canonical_id, ''), entity_ids, previous, applied, score, actor,
+	COALESCE(reason, ''), COALESCE(reverts_id::text, ''), COALESCE(reverted_by::text, ''), created_at`
+
+func scanEntityDecision(row interface{ Scan(...interface{}) error }) (*EntityDecision, error) {
+	var d EntityDecision
+	var entityIDs, previous, applied []byte
+	var score sql.NullFloat64
+	err := row.Scan(&d.ID, &d.Kind, &d.Action, &d.CanonicalID, &entityIDs, &previous, &applied, &score, &d.Actor,
+		&d.Reason, &d.RevertsID, &d.RevertedBy, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if score.Valid {
+		d.Score = &score.Float64
+	}
+	for _, f := range []struct {
+		raw []byte
+		dst interface{}
+	}{{entityIDs, &d.EntityIDs}, {previous, &d.Previous}, {applied, &d.Applied}} {
+		if err := json.Unmarshal(f.raw, f.dst); err != nil {
+			return nil, fmt.Errorf("decoding decision %s: %w", d.ID, err)
+		}
+	}
+	return &d, nil
+}
+
+func getEntityDecision(ctx context.Context, q queryer, id string) (*EntityDecision, error) {
+	return scanEntityDecision(q.QueryRowContext(ctx,
+		"SELECT "+entityDecisionColumns+" FROM funding_entity_decisions WHERE id = $1", id))
+}
+
+// getEntityCluster returns the cluster an entity belongs to and every
+// decision that touched one of its members.
+func getEntityCluster(ctx context.Context, kind, id string) (*EntityCluster, error) {
+	cluster := EntityCluster{Kind: kind, Members: []Entity{}, Decisions: []EntityDecision{}}
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(m.canonical_id, e.id) FROM funding_entities e
+		LEFT JOIN funding_entity_map m ON m.kind = e.kind AND m.entity_id = e.id
+		WHERE e.kind = $1 AND e.id = $2
+	`, kind, id).Scan(&cluster.CanonicalID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.kind, e.id, COALESCE(e.name, ''), COALESCE(e.normalized_name, ''), COALESCE(m.canonical_id, e.id), e.updated_at
+		FROM funding_entities e
+		LEFT JOIN funding_entity_map m ON m.kind = e.kind AND m.entity_id = e.id
+		WHERE e.kind = $1 AND COALESCE(m.canonical_id, e.id) = $2
+		ORDER BY e.id
+	`, kind, cluster.CanonicalID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var e Entity
+		if err := rows.Scan(&e.Kind, &e.ID, &e.Name, &e.NormalizedName, &e.CanonicalID, &e.UpdatedAt); err != nil {
+			return nil, err
+		}
+		cluster.Members = append(cluster.Members, e)
+		ids = append(ids, e.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	args, list := idList([]interface{}{kind}, ids)
+	drows, err := db.QueryContext(ctx, `
+		SELECT `+entityDecisionColumns+` FROM funding_entity_decisions
+		WHERE kind = $1 AND EXISTS (SELECT 1 FROM jsonb_object_keys(applied) k WHERE k IN (`+list+`))
+		ORDER BY created_at DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer drows.Close()
+	for drows.Next() {
+		d, err := scanEntityDecision(drows)
+		if err != nil {
+			return nil, err
+		}
+		cluster.Decisions = append(cluster.Decisions, *d)
+	}
+	return &cluster, drows.Err()
+}
+
+// listNamedEntities loads every named entity of a kind for matching.
+func listNamedEntities(ctx context.Context, kind string) ([]Entity, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.kind, e.id, e.name, e.normalized_name, COALESCE(m.canonical_id, e.id), e.updated_at
+		FROM funding_entities e
+		LEFT JOIN funding_entity_map m ON m.kind = e.kind AND m.entity_id = e.id
+		WHERE e.kind = $1 AND e.normalized_name IS NOT NULL
+	`, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entities []Entity
+	for rows.Next() {
+		var e Entity
+		if err := rows.Scan(&e.Kind, &e.ID, &e.Name, &e.NormalizedName, &e.CanonicalID, &e.UpdatedAt); err != nil {
+			return nil, err
+		}
+		entities = append(entities, e)
+	}
+	return entities, rows.Err()
+}
+
+// refreshAfterDecision rebuilds the rollups so aggregates see the new
+// mapping; live queries see it immediately through the active view.
+func refreshAfterDecision() {
+	go func() {
+		if err := refreshRollups(context.Background()); err != nil {
+			log.Printf("Warning: Funding rollup refresh after entity decision failed: %v", err)
+		}
+	}()
+}
+
+func writeEntityError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnknownEntity), errors.Is(err, errUnknownDecision):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+	case errors.Is(err, errNoChange), errors.Is(err, errDecisionConflict), errors.Is(err, errAlreadyReverted):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+	default:
+		log.Printf("Entity resolution failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to resolve entities"})
+	}
+}
+
+func handleEntities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	kind, id := q.Get("kind"), q.Get("id")
+	if err := validateEntityKind(kind); err != nil || id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "kind (entity or recipient) and id are required"})
+		return
+	}
+
+	cluster, err := getEntityCluster(r.Context(), kind, id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Entity not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Loading entity cluster failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load entity"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cluster)
+}
+
+func handleEntityCandidates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	kind := q.Get("kind")
+	if err := validateEntityKind(kind); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	minScore := defaultMatchScore
+	if v := q.Get("min_score"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "min_score must be in (0, 1]"})
+			return
+		}
+		minScore = f
+	}
+	limit := defaultSearchLimit
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 && v <= maxCandidates {
+		limit = v
+	}
+
+	entities, err := listNamedEntities(r.Context(), kind)
+	if err != nil {
+		log.Printf("Loading entities for matching failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to find candidates"})
+		return
+	}
+	candidates := findCandidates(entities, minScore)
+	total := len(candidates)
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	if candidates == nil {
+		candidates = []MatchCandidate{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"candidates": candidates,
+		"total":      total,
+		"min_score":  minScore,
+	})
+}
+
+// handleResolveEntities merges organizations whose normalized names are
+// identical. Fuzzier matches are left to review through the candidates
+// endpoint.
+func handleResolveEntities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if err := validateEntityKind(req.Kind); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	entities, err := listNamedEntities(r.Context(), req.Kind)
+	if err != nil {
+		writeEntityError(w, err)
+		return
+	}
+	decisions := []EntityDecision{}
+	for _, merge := range planAutoMerges(req.Kind, entities) {
+		d, err := mergeEntities(r.Context(), merge)
+		if errors.Is(err, errNoChange) {
+			continue
+		}
+		if err != nil {
+			writeEntityError(w, err)
+			return
+		}
+		decisions = append(decisions, *d)
+	}
+	if len(decisions) > 0 {
+		refreshAfterDecision()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"decisions": decisions})
+}
+
+func handleMergeEntities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req MergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if err := req.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	d, err := mergeEntities(r.Context(), req)
+	if err != nil {
+		writeEntityError(w, err)
+		return
+	}
+	refreshAfterDecision()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+func handleSplitEntities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req SplitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if err := req.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	d, err := splitEntities(r.Context(), req)
+	if err != nil {
+		writeEntityError(w, err)
+		return
+	}
+	refreshAfterDecision()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+func handleRevertEntityDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req RevertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if req.DecisionID == "" || req.Actor == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "decision_id and actor are required"})
+		return
+	}
+
+	d, err := revertDecision(r.Context(), req)
+	if err != nil {
+		writeEntityError(w, err)
+		return
+	}
+	refreshAfterDecision()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// TestNormalizeName tests that spelling variants of a name normalize alike
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"ACME Corp", "ACME CORP"},
+		{"Acme Corporation", "ACME CORP"},
+		{"ACME CORP.", "ACME CORP"},
+		{"The Acme Company, L.L.C.", "ACME CO LLC"},
+		{"Smith & Sons, Inc.", "SMITH AND SONS INC"},
+		{"O'Brien for Congress Committee", "OBRIEN FOR CONGRESS CMTE"},
+		{"  doe,  jane  ", "DOE JANE"},
+		{"The", "THE"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestNameSimilarity tests the Jaro-Winkler and token-set scores
+func TestNameSimilarity(t *testing.T) {
+	near := func(got, want float64) bool { return math.Abs(got-want) < 0.001 }
+
+	if got := jaroWinkler("MARTHA", "MARHTA"); !near(got, 0.961) {
+		t.Errorf("jaroWinkler(MARTHA, MARHTA) = %.3f, want 0.961", got)
+	}
+	if got := jaroWinkler("DIXON", "DICKSONX"); !near(got, 0.813) {
+		t.Errorf("jaroWinkler(DIXON, DICKSONX) = %.3f, want 0.813", got)
+	}
+	if got := jaroWinkler("ACME", "ZYXW"); got != 0 {
+		t.Errorf("jaroWinkler of disjoint names = %.3f, want 0", got)
+	}
+	if got := tokenSetRatio("DOE JANE", "JANE DOE"); got != 1 {
+		t.Errorf("tokenSetRatio should ignore word order, got %.3f", got)
+	}
+
+	score, jw, ts := matchScore("SMITH JOHN", "JOHN SMITH")
+	if score != ts || jw >= ts {
+		t.Errorf("matchScore = %.3f (jw %.3f, ts %.3f), want the token-set score", score, jw, ts)
+	}
+}
+
+// TestFindCandidates tests blocking and candidate scoring
+func TestFindCandidates(t *testing.T) {
+	entity := func(id, name, canonical string) Entity {
+		return Entity{Kind: entityKindEntity, ID: id, Name: name, NormalizedName: normalizeName(name), CanonicalID: canonical}
+	}
+	entities := []Entity{
+		entity("e1", "ACME Corp", "e1"),
+		entity("e2", "Acme Corporation", "e2"),
+		entity("e3", "ACME CORP.", "e1"), // already merged into e1
+		entity("e4", "Acme Corp Holdings", "e4"),
+		entity("e5", "Smith, John", "e5"),
+		entity("e6", "John Smith", "e6"),
+		entity("e7", "Zenith Widgets LLC", "e7"),
+	}
+
+	candidates := findCandidates(entities, defaultMatchScore)
+	pairs := map[[2]string]MatchCandidate{}
+	for _, c := range candidates {
+		pairs[[2]string{c.Left.ID, c.Right.ID}] = c
+	}
+
+	for _, want := range [][2]string{{"e1", "e2"}, {"e2", "e3"}, {"e5", "e6"}} {
+		if _, ok := pairs[want]; !ok {
+			t.Errorf("expected candidate pair %v, got %v", want, pairs)
+		}
+	}
+	if _, ok := pairs[[2]string{"e1", "e3"}]; ok {
+		t.Error("entities already resolved together should not be candidates")
+	}
+	for pair := range pairs {
+		if pair[0] == "e7" || pair[1] == "e7" {
+			t.Errorf("unrelated name matched: %v", pair)
+		}
+	}
+	if !pairs[[2]string{"e1", "e2"}].Exact || pairs[[2]string{"e5", "e6"}].Exact {
+		t.Error("only identical normalized names should be exact matches")
+	}
+	if candidates[0].Score < candidates[len(candidates)-1].Score {
+		t.Error("candidates should be ordered best first")
+	}
+}
+
+// TestPlanAutoMerges tests that only identical organization names merge automatically
+func TestPlanAutoMerges(t *testing.T) {
+	entity := func(id, name, canonical string) Entity {
+		return Entity{Kind: entityKindEntity, ID: id, NormalizedName: normalizeName(name), CanonicalID: canonical}
+	}
+	merges := planAutoMerges(entityKindEntity, []Entity{
+		entity("e2", "Acme Corporation", "e2"),
+		entity("e1", "ACME Corp", "e1"),
+		entity("e3", "ACME CORP.", "e3"),
+		entity("p1", "Doe, Jane", "p1"), // people with the same name are left for review
+		entity("p2", "DOE JANE", "p2"),
+		entity("x1", "Widgets Inc", "x1"),
+		entity("x2", "Widgets Inc", "x1"),
+	})
+
+	if len(merges) != 1 {
+		t.Fatalf("got %d merges, want 1: %+v", len(merges), merges)
+	}
+	m := merges[0]
+	if m.CanonicalID != "e1" || len(m.EntityIDs) != 2 || m.EntityIDs[0] != "e2" || m.EntityIDs[1] != "e3" {
+		t.Errorf("merge = %+v, want e2 and e3 into e1", m)
+	}
+	if err := m.validate(); err != nil {
+		t.Errorf("planned merge is invalid: %v", err)
+	}
+}
+
+// TestEntityDecisions tests that merges and splits are applied and reverted exactly
+func TestEntityDecisions(t *testing.T) {
+	// apply mimics recordDecision against an in-memory mapping.
+	apply := func(mapping, updates map[string]string) EntityDecision {
+		d := EntityDecision{Previous: map[string]string{}, Applied: updates}
+		for id, canonical := range updates {
+			d.Previous[id] = mapping[id]
+			mapping[id] = canonical
+		}
+		return d
+	}
+	mapping := map[string]string{"a": "a", "b": "b", "c": "c", "d": "d"}
+
+	merge1 := apply(mapping, applyMerge(mapping, "a", []string{"b"}))
+	merge2 := apply(mapping, applyMerge(mapping, "c", []string{"b", "d"}))
+	for id, want := range map[string]string{"a": "c", "b": "c", "c": "c", "d": "c"} {
+		if mapping[id] != want {
+			t.Errorf("after merges %s -> %s, want %s", id, mapping[id], want)
+		}
+	}
+
+	if updates := applyMerge(mapping, "c", []string{"a"}); len(updates) != 0 {
+		t.Errorf("merging an existing member changed %v", updates)
+	}
+
+	split := apply(mapping, applySplit(mapping, []string{"c"}))
+	for id, want := range map[string]string{"a": "a", "b": "a", "c": "c", "d": "a"} {
+		if mapping[id] != want {
+			t.Errorf("after split %s -> %s, want %s", id, mapping[id], want)
+		}
+	}
+
+	if _, err := applyRevert(merge2, mapping); !errors.Is(err, errDecisionConflict) {
+		t.Errorf("reverting a decision undone by a later split: err = %v, want conflict", err)
+	}
+
+	apply(mapping, mustRevert(t, split, mapping))
+	apply(mapping, mustRevert(t, merge2, mapping))
+	apply(mapping, mustRevert(t, merge1, mapping))
+	for id, canonical := range mapping {
+		if id != canonical {
+			t.Errorf("after reverting everything %s -> %s, want itself", id, canonical)
+		}
+	}
+
+	merge1.RevertedBy = "later"
+	if _, err := applyRevert(merge1, mapping); !errors.Is(err, errAlreadyReverted) {
+		t.Errorf("reverting twice: err = %v, want already reverted", err)
+	}
+}
+
+func mustRevert(t *testing.T, d EntityDecision, mapping map[string]string) map[string]string {
+	t.Helper()
+	updates, err := applyRevert(d, mapping)
+	if err != nil {
+		t.Fatalf("applyRevert: %v", err)
+	}
+	return updates
+}
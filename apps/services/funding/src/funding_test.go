@@ -1,76 +1,510 @@
 package main
 
 import (
-"testing"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
 )
 
 // TestFundingServiceInitialization tests service startup
 func TestFundingServiceInitialization(t *testing.T) {
-if true == false {
-t.Error("service initialization failed")
-}
+	if true == false {
+		t.Error("service initialization failed")
+	}
 }
 
 // TestProcessPayment tests payment processing
 func TestProcessPayment(t *testing.T) {
-tests := []struct {
-name      string
-amount    float64
-currency  string
-userID    string
-wantErr   bool
-}{
-{"valid payment", 100.00, "USD", "user123", false},
-{"zero amount", 0.0, "USD", "user123", true},
-{"negative amount", -50.00, "USD", "user123", true},
-{"missing user", 100.00, "USD", "", true},
-{"invalid currency", 100.00, "", "user123", true},
+	tests := []struct {
+		name     string
+		amount   string
+		currency string
+		userID   string
+		wantErr  bool
+	}{
+		{"valid payment", "100.00", "USD", "user123", false},
+		{"zero amount", "0", "USD", "user123", true},
+		{"negative amount", "-50.00", "USD", "user123", true},
+		{"missing user", "100.00", "USD", "", true},
+		{"invalid currency", "100.00", "", "user123", true},
+		{"unsupported currency", "100.00", "XYZ", "user123", true},
+		{"fractional yen", "100.50", "JPY", "user123", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newTestPaymentService()
+			amount, err := parseAmount(tt.amount)
+			if err != nil {
+				t.Fatalf("parseAmount(%q): %v", tt.amount, err)
+			}
+			txn, err := svc.ProcessPayment(context.Background(), PaymentRequest{
+				UserID:         tt.userID,
+				Amount:         amount,
+				Currency:       tt.currency,
+				Purpose:        purposePremiumTier,
+				PaymentMethod:  "tok_visa",
+				IdempotencyKey: "key-" + tt.name,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProcessPayment error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidPayment) {
+					t.Errorf("error %v should be a validation error", err)
+				}
+				return
+			}
+			if txn.Status != paymentCaptured || txn.Amount != amount || txn.ProcessorRef == "" {
+				t.Errorf("transaction = %+v, want captured %s with a processor ref", txn, amount)
+			}
+		})
+	}
 }
 
-for _, tt := range tests {
-t.Run(tt.name, func(t *testing.T) {
-if !tt.wantErr && tt.amount <= 0 {
-t.Error("amount should be positive for valid cases")
+// TestTransactionRecording tests transaction recording
+func TestTransactionRecording(t *testing.T) {
+	svc, store := newTestPaymentService()
+	ctx := context.Background()
+	for _, key := range []string{"txn1", "txn2", "txn3"} {
+		if _, err := svc.ProcessPayment(ctx, testPaymentRequest(key, "tok_visa")); err != nil {
+			t.Fatalf("ProcessPayment(%s): %v", key, err)
+		}
+	}
+	if len(store.txns) != 3 {
+		t.Fatalf("recorded %d transactions, want 3", len(store.txns))
+	}
+	for _, key := range []string{"txn1", "txn2", "txn3"} {
+		txn, err := store.getTransactionByKey(ctx, key)
+		if err != nil || txn.Status != paymentCaptured || txn.Version < 2 {
+			t.Errorf("transaction %s = %+v (err %v), want a saved capture", key, txn, err)
+		}
+	}
 }
-if !tt.wantErr && tt.currency == "" {
-t.Error("currency should not be empty for valid cases")
+
+// TestRefund tests refund processing
+func TestRefund(t *testing.T) {
+	tests := []struct {
+		name          string
+		transactionID string
+		wantErr       bool
+	}{
+		{"valid refund", "txn123", false},
+		{"invalid transaction", "unknown", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newTestPaymentService()
+			txn, err := svc.ProcessPayment(context.Background(), testPaymentRequest("charge", "tok_visa"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.rename(txn.ID, "txn123")
+
+			got, err := svc.Refund(context.Background(), RefundRequest{TransactionID: tt.transactionID, IdempotencyKey: "refund-1"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Refund error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, errUnknownTransaction) {
+					t.Errorf("error %v should be errUnknownTransaction", err)
+				}
+				return
+			}
+			if got.Status != paymentRefunded || got.RefundedAmount != got.Amount {
+				t.Errorf("refunded transaction = %+v, want fully refunded", got)
+			}
+		})
+	}
 }
-})
+
+// TestPaymentValidation tests exact decimal amount parsing
+func TestPaymentValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Amount
+		wantErr bool
+	}{
+		{"typical amount", "99.99", 9999, false},
+		{"whole dollars", "100", 10000, false},
+		{"one decimal", "12.5", 1250, false},
+		{"leading dot", ".75", 75, false},
+		{"trailing zeros beyond cents", "1.500", 150, false},
+		{"smallest unit", "0.01", 1, false},
+		{"negative", "-50.25", -5025, false},
+		{"sub-cent precision", "0.001", 0, true},
+		{"half cent", "10.005", 0, true},
+		{"exponent", "1e2", 0, true},
+		{"thousands separator", "1,000.00", 0, true},
+		{"empty", "", 0, true},
+		{"bare dot", ".", 0, true},
+		{"overflow", "92233720368547758.08", 0, true},
+		{"beyond NUMERIC(15,2)", "10000000000000.00", 0, true},
+		{"largest amount", "9999999999999.99", maxAmount, false},
+		{"largest negative amount", "-9999999999999.99", -maxAmount, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAmount(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAmount(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseAmount(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+
+	// 0.1 + 0.2 drifts in float64; it must not here.
+	a, _ := parseAmount("0.1")
+	b, _ := parseAmount("0.2")
+	sum, err := a.Add(b)
+	if err != nil || sum.String() != "0.30" {
+		t.Errorf("0.1 + 0.2 = %s (err %v), want 0.30", sum, err)
+	}
+
+	// Ten thousand one-cent contributions total exactly $100.00.
+	cents := make([]Amount, 10000)
+	for i := range cents {
+		cents[i] = 1
+	}
+	total, err := sumAmounts(cents)
+	if err != nil || total.String() != "100.00" {
+		t.Errorf("sum of 10000 cents = %s (err %v), want 100.00", total, err)
+	}
+
+	if _, err := Amount(9223372036854775807).Add(1); err == nil {
+		t.Error("expected overflow error")
+	}
 }
+
+// TestAmountRounding tests half-to-even rounding for derived amounts
+func TestAmountRounding(t *testing.T) {
+	divTests := []struct {
+		amount Amount
+		n      int64
+		want   string
+	}{
+		{1000, 3, "3.33"},
+		{1001, 2, "5.00"}, // 5.005 rounds to even
+		{1003, 2, "5.02"}, // 5.015 rounds to even
+		{1005, 4, "2.51"}, // 2.5125 rounds up
+		{-1001, 2, "-5.00"},
+		{-1003, 2, "-5.02"},
+		{200, 3, "0.67"},
+		{0, 5, "0.00"},
+	}
+	for _, tt := range divTests {
+		if got := tt.amount.DivRound(tt.n).String(); got != tt.want {
+			t.Errorf("%s / %d = %s, want %s", tt.amount, tt.n, got, tt.want)
+		}
+	}
+
+	roundTests := []struct {
+		input string
+		want  string
+	}{
+		{"5.005", "5.00"},
+		{"5.015", "5.02"},
+		{"5.0051", "5.01"},
+		{"2.3333333333", "2.33"},
+		{"-7.125", "-7.12"},
+		{"42", "42.00"},
+	}
+	for _, tt := range roundTests {
+		got, err := parseAmountRounded(tt.input)
+		if err != nil {
+			t.Errorf("parseAmountRounded(%q) error: %v", tt.input, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("parseAmountRounded(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
 }
 
-// TestTransactionRecording tests transaction recording
-func TestTransactionRecording(t *testing.T) {
-transactions := []string{"txn1", "txn2", "txn3"}
-if len(transactions) == 0 {
-t.Fatal("expected transactions to record")
+// TestAmountJSON tests that amounts are emitted as strings and accepted as strings or numbers
+func TestAmountJSON(t *testing.T) {
+	var record FundingRecord
+	if err := json.Unmarshal([]byte(`{"amount": "1234.56", "currency": "USD"}`), &record); err != nil {
+		t.Fatalf("unmarshal string amount: %v", err)
+	}
+	if record.Amount != 123456 {
+		t.Errorf("string amount = %d, want 123456", record.Amount)
+	}
+
+	if err := json.Unmarshal([]byte(`{"amount": 0.29}`), &record); err != nil {
+		t.Fatalf("unmarshal number amount: %v", err)
+	}
+	if record.Amount != 29 {
+		t.Errorf("number amount = %d, want 29", record.Amount)
+	}
+
+	if err := json.Unmarshal([]byte(`{"amount": "0.299"}`), &record); err == nil {
+		t.Error("expected error for sub-cent amount")
+	}
+
+	out, err := json.Marshal(Amount(-5))
+	if err != nil || string(out) != `"-0.05"` {
+		t.Errorf("marshal = %s (err %v), want \"-0.05\"", out, err)
+	}
 }
+
+// TestFundingRecordValidation tests required fields on recorded funding
+func TestFundingRecordValidation(t *testing.T) {
+	valid := FundingRecord{
+		EntityID:    "entity1",
+		RecipientID: "recipient1",
+		Amount:      25000,
+		Currency:    "USD",
+		Source:      "FEC",
+		Date:        time.Date(2026, 2, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(*FundingRecord)
+		wantErr bool
+	}{
+		{"valid record", func(r *FundingRecord) {}, false},
+		{"missing entity", func(r *FundingRecord) { r.EntityID = "" }, true},
+		{"missing recipient", func(r *FundingRecord) { r.RecipientID = "" }, true},
+		{"missing source", func(r *FundingRecord) { r.Source = "" }, true},
+		{"missing currency", func(r *FundingRecord) { r.Currency = "" }, true},
+		{"unsupported currency", func(r *FundingRecord) { r.Currency = "XYZ" }, true},
+		{"whole yen", func(r *FundingRecord) { r.Currency = "JPY"; r.Amount = 500000 }, false},
+		{"fractional yen", func(r *FundingRecord) { r.Currency = "JPY"; r.Amount = 500050 }, true},
+		{"zero amount", func(r *FundingRecord) { r.Amount = 0 }, true},
+		{"negative amount", func(r *FundingRecord) { r.Amount = -10 }, true},
+		{"largest amount", func(r *FundingRecord) { r.Amount = maxAmount }, false},
+		{"amount beyond storage", func(r *FundingRecord) { r.Amount = maxAmount + 1 }, true},
+		{"missing date", func(r *FundingRecord) { r.Date = time.Time{} }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := valid
+			tt.mutate(&record)
+			err := validateFundingRecord(record)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateFundingRecord() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
 }
 
-// TestRefund tests refund processing
-func TestRefund(t *testing.T) {
-tests := []struct {
-name        string
-transactionID string
-wantErr     bool
-}{
-{"valid refund", "txn123", false},
-{"invalid transaction", "unknown", true},
+// TestParseFundingSearch tests search query parameter parsing
+func TestParseFundingSearch(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{"entity only", "entity_id=e1", false},
+		{"recipient only", "recipient_id=r1", false},
+		{"no filters", "", true},
+		{"date range", "entity_id=e1&from=2024-01-01&to=2024-12-31", false},
+		{"inverted date range", "entity_id=e1&from=2024-12-31&to=2024-01-01", true},
+		{"bad date", "entity_id=e1&from=01/01/2024", true},
+		{"amount range", "entity_id=e1&min_amount=100&max_amount=2000.50", false},
+		{"inverted amount range", "entity_id=e1&min_amount=500&max_amount=100", true},
+		{"bad amount", "entity_id=e1&min_amount=lots", true},
+		{"sub-cent amount", "entity_id=e1&min_amount=0.001", true},
+		{"euro search", "entity_id=e1&currency=eur", false},
+		{"unknown currency", "entity_id=e1&currency=XYZ", true},
+		{"sort by amount", "entity_id=e1&sort=amount&order=asc", false},
+		{"unknown sort", "entity_id=e1&sort=name", true},
+		{"bad order", "entity_id=e1&order=sideways", true},
+		{"zero limit", "entity_id=e1&limit=0", true},
+		{"negative offset", "entity_id=e1&offset=-1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			_, err := parseFundingSearch(q)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseFundingSearch(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			}
+		})
+	}
+
+	q, _ := url.ParseQuery("entity_id=e1&limit=100000")
+	search, err := parseFundingSearch(q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if search.Limit != maxSearchLimit {
+		t.Errorf("limit should be capped at %d, got %d", maxSearchLimit, search.Limit)
+	}
+}
+
+// TestFundingSearchQuery tests SQL generation for search filters
+func TestFundingSearchQuery(t *testing.T) {
+	q, _ := url.ParseQuery("entity_id=e1&source=FEC&from=2024-01-01&min_amount=100&sort=amount&order=asc")
+	search, err := parseFundingSearch(q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	where, args := search.whereClause()
+	want := " WHERE canonical_entity_id = COALESCE((SELECT canonical_id FROM funding_entity_map WHERE kind = 'entity' AND entity_id = $1), $1) AND source = $2 AND currency = $3 AND date >= $4 AND amount >= $5"
+	if where != want {
+		t.Errorf("where clause mismatch:\n got %q\nwant %q", where, want)
+	}
+	if len(args) != 5 {
+		t.Errorf("expected 5 args, got %d", len(args))
+	}
+
+	order := search.orderClause()
+	if !strings.Contains(order, "amount ASC") {
+		t.Errorf("order clause should sort by amount ascending, got %q", order)
+	}
 }
 
-for _, tt := range tests {
-t.Run(tt.name, func(t *testing.T) {
-if tt.transactionID == "" {
-t.Error("transaction ID should not be empty")
+// TestParseAggregateQuery tests aggregate query parameter parsing
+func TestParseAggregateQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{"group by source", "group_by=source", false},
+		{"monthly by recipient", "group_by=recipient&bucket=month", false},
+		{"top donors per cycle", "group_by=entity&bucket=cycle&top=10", false},
+		{"missing group", "bucket=month", true},
+		{"unknown group", "group_by=state", true},
+		{"unknown bucket", "group_by=source&bucket=quarter", true},
+		{"bad top", "group_by=source&top=0", true},
+		{"bad date filter", "group_by=source&from=yesterday", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			_, err := parseAggregateQuery(q)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseAggregateQuery(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			}
+		})
+	}
 }
-})
+
+// TestAggregateRollupSelection tests when daily rollups can answer a query
+func TestAggregateRollupSelection(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"group_by=source&from=2024-01-01", true},
+		{"group_by=recipient&recipient_id=C001", true},
+		{"group_by=recipient&entity_id=E1", false},
+		{"group_by=entity&min_amount=199", false},
+		{"group_by=source&fresh=true", false},
+	}
+
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		agg, err := parseAggregateQuery(q)
+		if err != nil {
+			t.Fatalf("parseAggregateQuery(%q): %v", tt.query, err)
+		}
+		if got := agg.canUseRollup(); got != tt.want {
+			t.Errorf("canUseRollup(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
 }
+
+// TestBuildAggregateQuery tests SQL generation for grouped totals
+func TestBuildAggregateQuery(t *testing.T) {
+	q, _ := url.ParseQuery("group_by=entity&bucket=month&top=5&source=FEC")
+	agg, err := parseAggregateQuery(q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	query, args := buildAggregateQuery(agg, false)
+	for _, want := range []string{
+		"WITH top_keys AS (SELECT canonical_entity_id AS key FROM active_funding_records WHERE source = $1 AND currency = $2 GROUP BY canonical_entity_id ORDER BY SUM(amount) DESC, canonical_entity_id LIMIT $3)",
+		"date_trunc('month', date)::date",
+		"AND canonical_entity_id IN (SELECT key FROM top_keys)",
+		"GROUP BY 1, 2",
+	} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query missing %q:\n%s", want, query)
+		}
+	}
+	if len(args) != 3 {
+		t.Errorf("expected 3 args, got %d", len(args))
+	}
+
+	q, _ = url.ParseQuery("group_by=source")
+	agg, _ = parseAggregateQuery(q)
+	query, _ = buildAggregateQuery(agg, true)
+	if !strings.Contains(query, "FROM funding_rollup_source_daily") || !strings.Contains(query, "SUM(total)") {
+		t.Errorf("rollup query should read the source rollup:\n%s", query)
+	}
 }
 
-// TestPaymentValidation tests payment validation
-func TestPaymentValidation(t *testing.T) {
-amount := 99.99
-if amount <= 0 {
-t.Error("amount should be positive")
+// TestAssembleAggregate tests group ordering, averages and period-over-period change
+func TestAssembleAggregate(t *testing.T) {
+	month := func(m time.Month) time.Time { return time.Date(2024, m, 1, 0, 0, 0, 0, time.UTC) }
+	rows := []aggregateRow{
+		{Key: "A", Bucket: month(1), Total: 10000, Count: 2},
+		{Key: "A", Bucket: month(2), Total: 15000, Count: 3},
+		{Key: "A", Bucket: month(4), Total: 5000, Count: 1},
+		{Key: "B", Bucket: month(2), Total: 100000, Count: 3},
+	}
+
+	groups, total, err := assembleAggregate(rows, "month")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.String() != "1300.00" {
+		t.Errorf("grand total = %s, want 1300.00", total)
+	}
+	if len(groups) != 2 || groups[0].Key != "B" {
+		t.Fatalf("groups should be ordered by total, got %+v", groups)
+	}
+	if groups[0].Average.String() != "333.33" {
+		t.Errorf("B average = %s, want 333.33", groups[0].Average)
+	}
+
+	// B's January is within the returned range, so February is a change from zero.
+	if b := groups[0].Buckets[0]; b.Change == nil || b.Change.String() != "1000.00" || b.ChangePct != nil {
+		t.Errorf("B February change = %+v", b)
+	}
+
+	a := groups[1].Buckets
+	if a[0].Change != nil {
+		t.Error("first bucket has no previous period to compare")
+	}
+	if a[1].Change == nil || a[1].Change.String() != "50.00" || a[1].ChangePct == nil || *a[1].ChangePct != 50 {
+		t.Errorf("A February change = %+v", a[1])
+	}
+	// March is empty, so April compares against zero.
+	if a[2].Change == nil || a[2].Change.String() != "50.00" || a[2].ChangePct != nil {
+		t.Errorf("A April change = %+v", a[2])
+	}
 }
+
+// TestElectionCycleBuckets tests cycle bucket labels and stepping
+func TestElectionCycleBuckets(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := bucketLabel(start, "cycle"); got != "2024" {
+		t.Errorf("cycle label = %s, want 2024", got)
+	}
+	if got := previousBucket(start, "cycle"); !got.Equal(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("previous cycle start = %s, want 2021-01-01", got)
+	}
+	if got := bucketLabel(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), "week"); got != "2024-W01" {
+		t.Errorf("week label = %s, want 2024-W01", got)
+	}
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported bulk file formats.
+const (
+	formatFECIndividual = "fec-indiv" // FEC itcont.txt: contributions from individuals
+	formatFECCommittee  = "fec-pas2"  // FEC itpas2.txt: committee contributions to candidates
+	formatCSV           = "csv"       // generic delimited file described by a ColumnMapping
+)
+
+// ingestBatchSize is the number of rows committed per transaction.
+var ingestBatchSize int64 = 500
+
+const (
+	fecDateLayout      = "01022006"
+	fecIndividualWidth = 21
+	fecCommitteeWidth  = 22
+)
+
+// Ingest job states.
+const (
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+)
+
+// errSkipRow marks a row that is valid but intentionally not loaded, such as
+// an FEC memo entry that would double count a contribution.
+var errSkipRow = errors.New("row skipped")
+
+// ColumnMapping describes how a generic CSV file maps onto FundingRecord
+// fields. Columns maps a field name (entity_id, recipient_id, amount, date,
+// and optionally currency, source, entity_name and recipient_name) to a
+// header name, or to a zero-based column index when the file has no header
+// row.
+type ColumnMapping struct {
+	Delimiter  string            `json:"delimiter,omitempty"`
+	HasHeader  bool              `json:"has_header"`
+	Columns    map[string]string `json:"columns"`
+	DateFormat string            `json:"date_format,omitempty"`
+	Currency   string            `json:"currency,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	KeyColumns []string          `json:"key_columns,omitempty"`
+}
+
+// IngestJob tracks one bulk load. Checkpoint is the last row number whose
+// outcome has been committed, so an interrupted job resumes after it.
+type IngestJob struct {
+	ID             string         `json:"id"`
+	Source         string         `json:"source"`
+	Format         string         `json:"format"`
+	Path           string         `json:"path"`
+	SourceURL      string         `json:"source_url,omitempty"`
+	RetrievedAt    time.Time      `json:"retrieved_at"`
+	Checksum       string         `json:"checksum"`
+	Mapping        *ColumnMapping `json:"mapping,omitempty"`
+	Status         string         `json:"status"`
+	RowsRead       int64          `json:"rows_read"`
+	RowsInserted   int64          `json:"rows_inserted"`
+	RowsDuplicate  int64          `json:"rows_duplicate"`
+	RowsSuperseded int64          `json:"rows_superseded"`
+	RowsSkipped    int64          `json:"rows_skipped"`
+	RowsRejected   int64          `json:"rows_rejected"`
+	Checkpoint     int64          `json:"checkpoint"`
+	Error          string         `json:"error,omitempty"`
+	StartedAt      time.Time      `json:"started_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	CompletedAt    *time.Time     `json:"completed_at,omitempty"`
+}
+
+// IngestReject is one line of a job's reject report.
+type IngestReject struct {
+	JobID     string    `json:"job_id"`
+	RowNumber int64     `json:"row_number"`
+	Reason    string    `json:"reason"`
+	Raw       string    `json:"raw"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ingestRow is a parsed row ready to load, keyed for deduplication. Raw is
+// the source line it came from, kept as provenance.
+type ingestRow struct {
+	RowNumber  int64
+	NaturalKey string
+	Record     FundingRecord
+	Raw        string
+}
+
+// ingestBatch is the unit of commit: the rows and rejects read since the last
+// checkpoint, and the checkpoint to record once they are stored.
+type ingestBatch struct {
+	Rows       []ingestRow
+	Rejects    []IngestReject
+	Skipped    int64
+	Read       int64
+	Checkpoint int64
+}
+
+// ingestStore persists batches. commitBatch must store rows, rejects and the
+// job counters atomically so a resumed job neither loses nor repeats rows.
+type ingestStore interface {
+	commitBatch(ctx context.Context, job *IngestJob, batch ingestBatch) error
+}
+
+// rowParser turns the fields of one data row into a funding record and its
+// natural key.
+type rowParser func(fields []string) (FundingRecord, string, error)
+
+// rowReader yields data rows one at a time. raw is the original line for the
+// reject report.
+type rowReader interface {
+	Read() (fields []string, raw string, err error)
+}
+
+// runIngest streams rows from r through parse into store, committing every
+// ingestBatchSize rows. Rows at or before job.Checkpoint are skipped so a
+// re-run resumes where the last committed batch ended.
+func runIngest(ctx context.Context, job *IngestJob, rows rowReader, parse rowParser, store ingestStore) error {
+	var batch ingestBatch
+	rowNum := int64(0)
+
+	flush := func() error {
+		if batch.Read == 0 {
+			return nil
+		}
+		batch.Checkpoint = rowNum
+		if err := store.commitBatch(ctx, job, batch); err != nil {
+			return err
+		}
+		batch = ingestBatch{}
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fields, raw, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		rowNum++
+		if rowNum <= job.Checkpoint {
+			continue
+		}
+		batch.Read++
+
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return fmt.Errorf("reading row %d: %w", rowNum, err)
+			}
+			batch.Rejects = append(batch.Rejects, IngestReject{JobID: job.ID, RowNumber: rowNum, Reason: err.Error(), Raw: raw})
+		} else if strings.TrimSpace(raw) == "" {
+			batch.Skipped++
+		} else {
+			record, key, perr := parse(fields)
+			if perr == nil {
+				perr = validateFundingRecord(record)
+			}
+			switch {
+			case errors.Is(perr, errSkipRow):
+				batch.Skipped++
+			case perr != nil:
+				batch.Rejects = append(batch.Rejects, IngestReject{JobID: job.ID, RowNumber: rowNum, Reason: perr.Error(), Raw: raw})
+			default:
+				batch.Rows = append(batch.Rows, ingestRow{RowNumber: rowNum, NaturalKey: key, Record: record, Raw: raw})
+			}
+		}
+
+		if batch.Read >= ingestBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+// pipeReader reads FEC bulk files: one record per line, '|' separated, no
+// header and no quoting.
+type pipeReader struct {
+	r *bufio.Reader
+}
+
+func newPipeReader(r io.Reader) *pipeReader {
+	return &pipeReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+func (p *pipeReader) Read() ([]string, string, error) {
+	line, err := p.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return nil, "", io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	return strings.Split(line, "|"), line, nil
+}
+
+// csvReader reads generic delimited files, tolerating ragged rows so that
+// malformed lines end up in the reject report rather than aborting the job.
+type csvReader struct {
+	r     *csv.Reader
+	delim string
+}
+
+func newCSVReader(r io.Reader, delimiter string) *csvReader {
+	cr := csv.NewReader(bufio.NewReaderSize(r, 64*1024))
+	if delimiter != "" {
+		cr.Comma = []rune(delimiter)[0]
+	}
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = false
+	if delimiter == "" {
+		delimiter = ","
+	}
+	return &csvReader{r: cr, delim: delimiter}
+}
+
+func (c *csvReader) Read() ([]string, string, error) {
+	fields, err := c.r.Read()
+	return fields, strings.Join(fields, c.delim), err
+}
+
+// newRowParser returns the reader and parser for a job's format. For CSV the
+// header row, if any, is consumed here to resolve column names.
+func newRowParser(job *IngestJob, r io.Reader) (rowReader, rowParser, error) {
+	switch job.Format {
+	case formatFECIndividual:
+		return newPipeReader(r), parseFECIndividual, nil
+	case formatFECCommittee:
+		return newPipeReader(r), parseFECCommittee, nil
+	case formatCSV:
+		if job.Mapping == nil {
+			return nil, nil, fmt.Errorf("csv format requires a column mapping")
+		}
+		reader := newCSVReader(r, job.Mapping.Delimiter)
+		var header []string
+		if job.Mapping.HasHeader {
+			var err error
+			header, _, err = reader.Read()
+			if err != nil {
+				return nil, nil, fmt.Errorf("reading header: %w", err)
+			}
+		}
+		parse, err := job.Mapping.compile(header, job.Source)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, parse, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported format %q", job.Format)
+	}
+}
+
+func parseFECIndividual(f []string) (FundingRecord, string, error) {
+	if len(f) != fecIndividualWidth {
+		return FundingRecord{}, "", fmt.Errorf("expected %d fields, got %d", fecIndividualWidth, len(f))
+	}
+	// CMTE_ID|AMNDT_IND|RPT_TP|TRANSACTION_PGI|IMAGE_NUM|TRANSACTION_TP|ENTITY_TP|NAME|CITY|STATE|
+	// ZIP_CODE|EMPLOYER|OCCUPATION|TRANSACTION_DT|TRANSACTION_AMT|OTHER_ID|TRAN_ID|FILE_NUM|MEMO_CD|MEMO_TEXT|SUB_ID
+	cmteID, name, zip, dt, amt, otherID, memo, subID := f[0], f[7], f[10], f[13], f[14], f[15], f[18], f[20]
+
+	entityID := otherID
+	if entityID == "" {
+		entityID = fecDonorID(name, zip)
+	}
+	rec, key, err := buildFECRecord(entityID, cmteID, dt, amt, memo, subID)
+	rec.EntityName = strings.TrimSpace(name)
+	return rec, key, err
+}
+
+func parseFECCommittee(f []string) (FundingRecord, string, error) {
+	if len(f) != fecCommitteeWidth {
+		return FundingRecord{}, "", fmt.Errorf("expected %d fields, got %d", fecCommitteeWidth, len(f))
+	}
+	// CMTE_ID|AMNDT_IND|RPT_TP|TRANSACTION_PGI|IMAGE_NUM|TRANSACTION_TP|ENTITY_TP|NAME|CITY|STATE|
+	// ZIP_CODE|EMPLOYER|OCCUPATION|TRANSACTION_DT|TRANSACTION_AMT|OTHER_ID|CAND_ID|TRAN_ID|FILE_NUM|MEMO_CD|MEMO_TEXT|SUB_ID
+	cmteID, name, dt, amt, otherID, candID, memo, subID := f[0], f[7], f[13], f[14], f[15], f[16], f[19], f[21]
+
+	recipientID := candID
+	if recipientID == "" {
+		recipientID = otherID
+	}
+	rec, key, err := buildFECRecord(cmteID, recipientID, dt, amt, memo, subID)
+	rec.RecipientName = strings.TrimSpace(name)
+	return rec, key, err
+}
+
+func buildFECRecord(entityID, recipientID, dt, amt, memo, subID string) (FundingRecord, string, error) {
+	if strings.TrimSpace(memo) == "X" {
+		return FundingRecord{}, "", errSkipRow
+	}
+	if subID == "" {
+		return FundingRecord{}, "", fmt.Errorf("missing SUB_ID")
+	}
+	date, err := time.Parse(fecDateLayout, dt)
+	if err != nil {
+		return FundingRecord{}, "", fmt.Errorf("invalid TRANSACTION_DT %q", dt)
+	}
+	amount, err := parseAmount(amt)
+	if err != nil {
+		return FundingRecord{}, "", fmt.Errorf("invalid TRANSACTION_AMT: %v", err)
+	}
+	return FundingRecord{
+		EntityID:    entityID,
+		RecipientID: recipientID,
+		Amount:      amount,
+		Currency:    "USD",
+		Source:      "FEC",
+		Date:        date,
+	}, "fec:" + subID, nil
+}
+
+// fecDonorID derives a stable identifier for an individual donor, who has no
+// FEC ID of their own, from the normalized name and five-digit ZIP.
+func fecDonorID(name, zip string) string {
+	name = strings.Join(strings.Fields(strings.ToUpper(name)), " ")
+	if len(zip) > 5 {
+		zip = zip[:5]
+	}
+	sum := sha256.Sum256([]byte(name + "|" + zip))
+	return "fec-ind-" + hex.EncodeToString(sum[:8])
+}
+
+// compile resolves the mapping against a header row and returns a parser.
+func (m *ColumnMapping) compile(header []string, defaultSource string) (rowParser, error) {
+	index := map[string]int{}
+	for field, column := range m.Columns {
+		idx := -1
+		if m.HasHeader {
+			for i, name := range header {
+				if strings.EqualFold(strings.TrimSpace(name), column) {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				return nil, fmt.Errorf("column %q for %s not found in header", column, field)
+			}
+		} else {
+			n, err := strconv.Atoi(column)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("column for %s must be a zero-based index when the file has no header", field)
+			}
+			idx = n
+		}
+		index[field] = idx
+	}
+	for _, required := range []string{"entity_id", "recipient_id", "amount", "date"} {
+		if _, ok := index[required]; !ok {
+			return nil, fmt.Errorf("mapping must include %s", required)
+		}
+	}
+	for _, key := range m.KeyColumns {
+		if _, ok := index[key]; !ok {
+			return nil, fmt.Errorf("key column %q is not mapped", key)
+		}
+	}
+
+	dateFormat := m.DateFormat
+	if dateFormat == "" {
+		dateFormat = searchDateLayout
+	}
+	source := m.Source
+	if source == "" {
+		source = defaultSource
+	}
+	currency := m.Currency
+	if currency == "" {
+		currency = "USD"
+	}
+
+	return func(f []string) (FundingRecord, string, error) {
+		get := func(field string) (string, bool) {
+			idx, ok := index[field]
+			if !ok {
+				return "", false
+			}
+			if idx >= len(f) {
+				return "", true
+			}
+			return strings.TrimSpace(f[idx]), true
+		}
+
+		rec := FundingRecord{Currency: currency, Source: source}
+		rec.EntityID, _ = get("entity_id")
+		rec.RecipientID, _ = get("recipient_id")
+		rec.EntityName, _ = get("entity_name")
+		rec.RecipientName, _ = get("recipient_name")
+		if v, ok := get("currency"); ok && v != "" {
+			rec.Currency = strings.ToUpper(v)
+		}
+		if v, ok := get("source"); ok && v != "" {
+			rec.Source = v
+		}
+
+		rawAmount, _ := get("amount")
+		amount, err := parseAmount(rawAmount)
+		if err != nil {
+			return FundingRecord{}, "", err
+		}
+		rec.Amount = amount
+
+		rawDate, _ := get("date")
+		date, err := time.Parse(dateFormat, rawDate)
+		if err != nil {
+			return FundingRecord{}, "", fmt.Errorf("invalid date %q (expected layout %s)", rawDate, dateFormat)
+		}
+		rec.Date = date
+
+		var key string
+		if len(m.KeyColumns) > 0 {
+			parts := make([]string, len(m.KeyColumns))
+			for i, col := range m.KeyColumns {
+				parts[i], _ = get(col)
+			}
+			key = rec.Source + ":" + strings.Join(parts, "|")
+		} else {
+			sum := sha256.Sum256([]byte(strings.Join(f, "\x1f")))
+			key = rec.Source + ":" + hex.EncodeToString(sum[:16])
+		}
+		return rec, key, nil
+	}, nil
+}
+
+// fileChecksum returns the hex SHA-256 of the stream. Jobs are identified by
+// format and checksum, so re-submitting the same file resumes its job.
+func fileChecksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
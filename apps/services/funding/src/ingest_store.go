@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ingestSchema = `
+	ALTER TABLE funding_records ADD COLUMN IF NOT EXISTS natural_key VARCHAR(255);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_funding_active_natural_key ON funding_records(natural_key) WHERE superseded_at IS NULL;
+	DROP INDEX IF EXISTS idx_funding_natural_key;
+
+	CREATE TABLE IF NOT EXISTS funding_ingest_jobs (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		source VARCHAR(100) NOT NULL,
+		format VARCHAR(20) NOT NULL,
+		path TEXT NOT NULL,
+		checksum CHAR(64) NOT NULL,
+		mapping JSONB,
+		status VARCHAR(20) NOT NULL,
+		rows_read BIGINT NOT NULL DEFAULT 0,
+		rows_inserted BIGINT NOT NULL DEFAULT 0,
+		rows_duplicate BIGINT NOT NULL DEFAULT 0,
+		rows_skipped BIGINT NOT NULL DEFAULT 0,
+		rows_rejected BIGINT NOT NULL DEFAULT 0,
+		checkpoint BIGINT NOT NULL DEFAULT 0,
+		error TEXT,
+		started_at TIMESTAMP DEFAULT now() NOT NULL,
+		updated_at TIMESTAMP DEFAULT now() NOT NULL,
+		completed_at TIMESTAMP NULL,
+		UNIQUE (format, source, checksum)
+	);
+
+	ALTER TABLE funding_ingest_jobs ADD COLUMN IF NOT EXISTS source_url TEXT;
+	ALTER TABLE funding_ingest_jobs ADD COLUMN IF NOT EXISTS retrieved_at TIMESTAMP;
+	ALTER TABLE funding_ingest_jobs ADD COLUMN IF NOT EXISTS rows_superseded BIGINT NOT NULL DEFAULT 0;
+
+	CREATE TABLE IF NOT EXISTS funding_ingest_rejects (
+		job_id UUID NOT NULL REFERENCES funding_ingest_jobs(id) ON DELETE CASCADE,
+		row_number BIGINT NOT NULL,
+		reason TEXT NOT NULL,
+		raw TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT now() NOT NULL,
+		PRIMARY KEY (job_id, row_number)
+	);
+	`
+
+// IngestRequest starts (or resumes) loading a bulk file that lives under the
+// ingest directory. SourceURL and RetrievedAt record where and when the file
+// was downloaded; RetrievedAt defaults to the file's modification time.
+type IngestRequest struct {
+	Path        string         `json:"path"`
+	Format      string         `json:"format"`
+	Source      string         `json:"source"`
+	Mapping     *ColumnMapping `json:"mapping,omitempty"`
+	SourceURL   string         `json:"source_url,omitempty"`
+	RetrievedAt *time.Time     `json:"retrieved_at,omitempty"`
+}
+
+var (
+	activeJobs   = map[string]bool{}
+	activeJobsMu sync.Mutex
+)
+
+func ingestDir() string {
+	if override := os.Getenv("FUNDING_INGEST_DIR"); override != "" {
+		return override
+	}
+	return filepath.Join("data", "funding")
+}
+
+// resolveIngestPath confines a requested path to the ingest directory.
+func resolveIngestPath(dir, path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("path is required")
+	}
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("path must be relative to the ingest directory")
+	}
+	clean := filepath.Clean(path)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path must stay within the ingest directory")
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+func validateIngestRequest(req *IngestRequest) error {
+	switch req.Format {
+	case formatFECIndividual, formatFECCommittee:
+		if req.Source == "" {
+			req.Source = "FEC"
+		}
+	case formatCSV:
+		if req.Mapping == nil {
+			return fmt.Errorf("mapping is required for csv format")
+		}
+		if req.Mapping.Delimiter != "" && len([]rune(req.Mapping.Delimiter)) != 1 {
+			return fmt.Errorf("mapping delimiter must be a single character")
+		}
+		if req.Source == "" {
+			req.Source = req.Mapping.Source
+		}
+		if req.Source == "" {
+			return fmt.Errorf("source is required for csv format")
+		}
+	default:
+		return fmt.Errorf("format must be one of %s, %s, %s", formatFECIndividual, formatFECCommittee, formatCSV)
+	}
+	return nil
+}
+
+// sqlIngestStore commits ingest batches to Postgres.
+type sqlIngestStore struct {
+	db *sql.DB
+}
+
+func (s sqlIngestStore) commitBatch(ctx context.Context, job *IngestJob, batch ingestBatch) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	inserted, superseded, duplicates, err := s.commitRows(ctx, tx, job, batch.Rows)
+	if err != nil {
+		return err
+	}
+
+	if len(batch.Rejects) > 0 {
+		var values []string
+		var args []interface{}
+		for _, rej := range batch.Rejects {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4))
+			args = append(args, job.ID, rej.RowNumber, rej.Reason, rej.Raw)
+		}
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO funding_ingest_rejects (job_id, row_number, reason, raw) VALUES "+
+				strings.Join(values, ", ")+" ON CONFLICT DO NOTHING", args...)
+		if err != nil {
+			return fmt.Errorf("inserting rejects: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE funding_ingest_jobs SET
+			rows_read = rows_read + $2,
+			rows_inserted = rows_inserted + $3,
+			rows_duplicate = rows_duplicate + $4,
+			rows_skipped = rows_skipped + $5,
+			rows_rejected = rows_rejected + $6,
+			checkpoint = $7,
+			rows_superseded = rows_superseded + $8,
+			updated_at = now()
+		WHERE id = $1
+	`, job.ID, batch.Read, inserted, duplicates, batch.Skipped, len(batch.Rejects), batch.Checkpoint, superseded)
+	if err != nil {
+		return fmt.Errorf("updating job checkpoint: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	job.RowsRead += batch.Read
+	job.RowsInserted += inserted
+	job.RowsDuplicate += duplicates
+	job.RowsSuperseded += superseded
+	job.RowsSkipped += batch.Skipped
+	job.RowsRejected += int64(len(batch.Rejects))
+	job.Checkpoint = batch.Checkpoint
+	return nil
+}
+
+// commitRows loads parsed rows inside tx. Rows whose natural key is already
+// active are duplicates unless an earlier job loaded different content, in
+// which case the new row supersedes the old record. Every inserted record
+// gets its provenance and journal entry.
+func (s sqlIngestStore) commitRows(ctx context.Context, tx *sql.Tx, job *IngestJob, rows []ingestRow) (inserted, superseded, duplicates int64, err error) {
+	if len(rows) == 0 {
+		return 0, 0, 0, nil
+	}
+
+	var placeholders []string
+	var args []interface{}
+	for _, row := range rows {
+		args = append(args, row.NaturalKey)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+	active := map[string]activeRecord{}
+	existing, err := tx.QueryContext(ctx, `
+		SELECT r.id, r.natural_key, r.entity_id, r.recipient_id, r.amount, r.currency, r.source, r.date,
+			COALESCE(p.ingest_job_id::text, '')
+		FROM funding_records r
+		LEFT JOIN funding_record_provenance p ON p.record_id = r.id
+		WHERE r.superseded_at IS NULL AND r.natural_key IN (`+strings.Join(placeholders, ", ")+`)
+		FOR UPDATE OF r
+	`, args...)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("loading existing rows: %w", err)
+	}
+	for existing.Next() {
+		var a activeRecord
+		var key string
+		rec := &a.Record
+		if err := existing.Scan(&a.ID, &key, &rec.EntityID, &rec.RecipientID, &rec.Amount, &rec.Currency,
+			&rec.Source, &rec.Date, &a.JobID); err != nil {
+			existing.Close()
+			return 0, 0, 0, err
+		}
+		active[key] = a
+	}
+	existing.Close()
+	if err := existing.Err(); err != nil {
+		return 0, 0, 0, err
+	}
+
+	inserts, replaces, duplicates := planIngestBatch(job.ID, rows, active)
+	if len(replaces) > 0 {
+		placeholders, args = placeholders[:0], args[:0]
+		for _, old := range replaces {
+			args = append(args, old.ID)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		_, err := tx.ExecContext(ctx,
+			"UPDATE funding_records SET superseded_at = now() WHERE id IN ("+strings.Join(placeholders, ", ")+")", args...)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("superseding records: %w", err)
+		}
+	}
+	if len(inserts) == 0 {
+		return 0, 0, duplicates, nil
+	}
+
+	var values []string
+	args = args[:0]
+	for _, row := range inserts {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7))
+		rec := row.Record
+		args = append(args, rec.EntityID, rec.RecipientID, rec.Amount, rec.Currency, rec.Source, rec.Date, row.NaturalKey)
+	}
+	result, err := tx.QueryContext(ctx,
+		"INSERT INTO funding_records (entity_id, recipient_id, amount, currency, source, date, natural_key) VALUES "+
+			strings.Join(values, ", ")+" ON CONFLICT (natural_key) WHERE superseded_at IS NULL DO NOTHING"+
+			" RETURNING id, natural_key", args...)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("inserting funding rows: %w", err)
+	}
+	ids := map[string]string{}
+	for result.Next() {
+		var id, key string
+		if err := result.Scan(&id, &key); err != nil {
+			result.Close()
+			return 0, 0, 0, fmt.Errorf("reading inserted rows: %w", err)
+		}
+		ids[key] = id
+	}
+	result.Close()
+	if err := result.Err(); err != nil {
+		return 0, 0, 0, fmt.Errorf("inserting funding rows: %w", err)
+	}
+
+	sourceURI := job.SourceURL
+	if sourceURI == "" {
+		sourceURI = job.Path
+	}
+	var loaded []FundingRecord
+	for _, row := range inserts {
+		id, ok := ids[row.NaturalKey]
+		if !ok {
+			// Loaded concurrently by another job.
+			duplicates++
+			continue
+		}
+		rec := row.Record
+		rec.ID = id
+		err := insertProvenance(ctx, tx, id, Provenance{
+			Method:      provenanceIngest,
+			SourceURI:   sourceURI,
+			IngestJobID: job.ID,
+			RowNumber:   row.RowNumber,
+			RetrievedAt: job.RetrievedAt,
+			RawChecksum: rowChecksum(row.Raw),
+			Raw:         strings.TrimRight(row.Raw, "\r\n"),
+		})
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("recording provenance for row %d: %w", row.RowNumber, err)
+		}
+		entry := fundingRecordEntry(rec)
+		if _, err := postEntry(ctx, tx, &entry); err != nil {
+			return 0, 0, 0, fmt.Errorf("posting journal entry for %s: %w", id, err)
+		}
+		loaded = append(loaded, rec)
+		if old, ok := replaces[row.NaturalKey]; ok {
+			reason := fmt.Sprintf("corrected by row %d of %s", row.RowNumber, job.Path)
+			if err := supersedeRecord(ctx, tx, old, rec, job.ID, reason); err != nil {
+				return 0, 0, 0, err
+			}
+			superseded++
+		}
+		inserted++
+	}
+	if err := registerEntities(ctx, tx, loaded); err != nil {
+		return 0, 0, 0, err
+	}
+	return inserted, superseded, duplicates, nil
+}
+
+const ingestJobColumns = `id, source, format, path, COALESCE(source_url, ''), COALESCE(retrieved_at, started_at), checksum,
+	mapping, status, rows_read, rows_inserted, rows_duplicate, rows_superseded, rows_skipped, rows_rejected, checkpoint,
+	COALESCE(error, ''), started_at, updated_at, completed_at`
+
+func scanIngestJob(row interface{ Scan(...interface{}) error }) (*IngestJob, error) {
+	var job IngestJob
+	var mapping []byte
+	var completedAt sql.NullTime
+	err := row.Scan(&job.ID, &job.Source, &job.Format, &job.Path, &job.SourceURL, &job.RetrievedAt, &job.Checksum,
+		&mapping, &job.Status, &job.RowsRead, &job.RowsInserted, &job.RowsDuplicate, &job.RowsSuperseded,
+		&job.RowsSkipped, &job.RowsRejected, &job.Checkpoint, &job.Error, &job.StartedAt, &job.UpdatedAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(mapping) > 0 && string(mapping) != "null" {
+		job.Mapping = &ColumnMapping{}
+		if err := json.Unmarshal(mapping, job.Mapping); err != nil {
+			return nil, fmt.Errorf("decoding job mapping: %w", err)
+		}
+	}
+	if completedAt.Valid {
+		job.CompletedAt = &completedAt.Time
+	}
+	return &job, nil
+}
+
+func getIngestJob(ctx context.Context, id string) (*IngestJob, error) {
+	return scanIngestJob(db.QueryRowContext(ctx, "SELECT "+ingestJobColumns+" FROM funding_ingest_jobs WHERE id = $1", id))
+}
+
+// startIngestJob registers the file as a job, or finds the existing job for
+// the same file contents, and runs it in the background unless it has
+// already completed.
+func startIngestJob(ctx context.Context, req IngestRequest) (*IngestJob, error) {
+	path, err := resolveIngestPath(ingestDir(), req.Path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", req.Path, err)
+	}
+	checksum, err := fileChecksum(f)
+	info, statErr := f.Stat()
+	f.Close()
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", req.Path, err)
+	}
+	retrievedAt := info.ModTime().UTC()
+	if req.RetrievedAt != nil {
+		retrievedAt = req.RetrievedAt.UTC()
+	}
+
+	var mapping interface{}
+	if req.Mapping != nil {
+		buf, err := json.Marshal(req.Mapping)
+		if err != nil {
+			return nil, err
+		}
+		mapping = string(buf)
+	}
+
+	job, err := scanIngestJob(db.QueryRowContext(ctx, `
+		INSERT INTO funding_ingest_jobs (source, format, path, checksum, mapping, status, source_url, retrieved_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8)
+		ON CONFLICT (format, source, checksum) DO UPDATE SET
+			path = EXCLUDED.path,
+			status = CASE WHEN funding_ingest_jobs.status = 'completed' THEN 'completed' ELSE EXCLUDED.status END,
+			updated_at = now()
+		RETURNING `+ingestJobColumns,
+		req.Source, req.Format, req.Path, checksum, mapping, jobRunning, req.SourceURL, retrievedAt))
+	if err != nil {
+		return nil, err
+	}
+
+	if job.Status != jobCompleted {
+		launchIngestJob(job)
+	}
+	return job, nil
+}
+
+// resumeIngestJobs restarts jobs left running by a previous process.
+func resumeIngestJobs() {
+	rows, err := db.Query("SELECT "+ingestJobColumns+" FROM funding_ingest_jobs WHERE status = $1", jobRunning)
+	if err != nil {
+		log.Printf("Warning: Failed to load interrupted ingest jobs: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		job, err := scanIngestJob(rows)
+		if err != nil {
+			log.Printf("Warning: Failed to load ingest job: %v", err)
+			continue
+		}
+		log.Printf("Resuming ingest job %s (%s) from row %d", job.ID, job.Path, job.Checkpoint)
+		launchIngestJob(job)
+	}
+}
+
+func launchIngestJob(job *IngestJob) {
+	activeJobsMu.Lock()
+	if activeJobs[job.ID] {
+		activeJobsMu.Unlock()
+		return
+	}
+	activeJobs[job.ID] = true
+	activeJobsMu.Unlock()
+
+	go func() {
+		defer func() {
+			activeJobsMu.Lock()
+			delete(activeJobs, job.ID)
+			activeJobsMu.Unlock()
+		}()
+
+		err := executeIngestJob(context.Background(), job)
+		status, errText := jobCompleted, ""
+		if err != nil {
+			status, errText = jobFailed, err.Error()
+			log.Printf("Ingest job %s failed at row %d: %v", job.ID, job.Checkpoint, err)
+		} else {
+			log.Printf("Ingest job %s completed: read=%d inserted=%d duplicate=%d skipped=%d rejected=%d",
+				job.ID, job.RowsRead, job.RowsInserted, job.RowsDuplicate, job.RowsSkipped, job.RowsRejected)
+			if job.RowsInserted > 0 {
+				if err := refreshRollups(context.Background()); err != nil {
+					log.Printf("Warning: Funding rollup refresh after ingest failed: %v", err)
+				}
+			}
+		}
+
+		_, uerr := db.Exec(`
+			UPDATE funding_ingest_jobs
+			SET status = $2, error = NULLIF($3, ''), updated_at = now(),
+				completed_at = CASE WHEN $2 = 'completed' THEN now() ELSE NULL END
+			WHERE id = $1
+		`, job.ID, status, errText)
+		if uerr != nil {
+			log.Printf("Warning: Failed to update ingest job %s: %v", job.ID, uerr)
+		}
+	}()
+}
+
+func executeIngestJob(ctx context.Context, job *IngestJob) error {
+	if _, err := db.ExecContext(ctx,
+		"UPDATE funding_ingest_jobs SET status = $2, error = NULL, updated_at = now() WHERE id = $1",
+		job.ID, jobRunning); err != nil {
+		return err
+	}
+
+	path, err := resolveIngestPath(ingestDir(), job.Path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The checkpoint is only meaningful against the same bytes.
+	checksum, err := fileChecksum(f)
+	if err != nil {
+		return err
+	}
+	if checksum != job.Checksum {
+		return fmt.Errorf("source file %s changed since the job started", job.Path)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	rows, parse, err := newRowParser(job, f)
+	if err != nil {
+		return err
+	}
+	return runIngest(ctx, job, rows, parse, sqlIngestStore{db: db})
+}
+
+func handleStartIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req IngestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if err := validateIngestRequest(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	job, err := startIngestJob(r.Context(), req)
+	if err != nil {
+		log.Printf("Failed to start ingest job: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func handleGetIngestJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		rows, err := db.QueryContext(r.Context(),
+			"SELECT "+ingestJobColumns+" FROM funding_ingest_jobs ORDER BY started_at DESC LIMIT 50")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list ingest jobs"})
+			return
+		}
+		defer rows.Close()
+
+		jobs := []*IngestJob{}
+		for rows.Next() {
+			job, err := scanIngestJob(rows)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to list ingest jobs"})
+				return
+			}
+			jobs = append(jobs, job)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"jobs": jobs})
+		return
+	}
+
+	job, err := getIngestJob(r.Context(), id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Ingest job not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load ingest job"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func handleGetIngestRejects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	jobID := q.Get("job_id")
+	if jobID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "job_id query parameter required"})
+		return
+	}
+	limit, offset := defaultSearchLimit, 0
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 && v <= maxSearchLimit {
+		limit = v
+	}
+	if v, err := strconv.Atoi(q.Get("offset")); err == nil && v >= 0 {
+		offset = v
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT job_id, row_number, reason, raw, created_at
+		FROM funding_ingest_rejects WHERE job_id = $1
+		ORDER BY row_number LIMIT $2 OFFSET $3
+	`, jobID, limit, offset)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load rejects"})
+		return
+	}
+	defer rows.Close()
+
+	rejects := []IngestReject{}
+	for rows.Next() {
+		var rej IngestReject
+		if err := rows.Scan(&rej.JobID, &rej.RowNumber, &rej.Reason, &rej.Raw, &rej.CreatedAt); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load rejects"})
+			return
+		}
+		rejects = append(rejects, rej)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id":  jobID,
+		"rejects": rejects,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memIngestStore is an in-memory ingestStore that deduplicates and
+// supersedes on natural key like the SQL store does, and can fail a given
+// batch to simulate an interrupted load.
+type memIngestStore struct {
+	keys       map[string]FundingRecord
+	owners     map[string]string
+	raw        map[string]string
+	superseded []FundingRecord
+	rejects    []IngestReject
+	batches    int
+	failOn     int
+	failWith   error
+}
+
+func newMemIngestStore() *memIngestStore {
+	return &memIngestStore{keys: map[string]FundingRecord{}, owners: map[string]string{}, raw: map[string]string{}}
+}
+
+func (m *memIngestStore) commitBatch(ctx context.Context, job *IngestJob, batch ingestBatch) error {
+	m.batches++
+	if m.failOn > 0 && m.batches == m.failOn {
+		return m.failWith
+	}
+
+	active := map[string]activeRecord{}
+	for key, rec := range m.keys {
+		active[key] = activeRecord{ID: key, JobID: m.owners[key], Record: rec}
+	}
+	inserts, replaces, duplicates := planIngestBatch(job.ID, batch.Rows, active)
+	for _, row := range inserts {
+		if _, ok := replaces[row.NaturalKey]; ok {
+			m.superseded = append(m.superseded, m.keys[row.NaturalKey])
+			job.RowsSuperseded++
+		}
+		m.keys[row.NaturalKey] = row.Record
+		m.owners[row.NaturalKey] = job.ID
+		m.raw[row.NaturalKey] = row.Raw
+	}
+	m.rejects = append(m.rejects, batch.Rejects...)
+
+	job.RowsRead += batch.Read
+	job.RowsInserted += int64(len(inserts))
+	job.RowsDuplicate += duplicates
+	job.RowsSkipped += batch.Skipped
+	job.RowsRejected += int64(len(batch.Rejects))
+	job.Checkpoint = batch.Checkpoint
+	return nil
+}
+
+func ingestFixture(t *testing.T, job *IngestJob, name string, store ingestStore) error {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("open fixture: %v", err)
+	}
+	defer f.Close()
+
+	rows, parse, err := newRowParser(job, f)
+	if err != nil {
+		t.Fatalf("newRowParser: %v", err)
+	}
+	return runIngest(context.Background(), job, rows, parse, store)
+}
+
+type ingestCounts struct {
+	read, inserted, duplicate, skipped, rejected int64
+}
+
+func assertIngestCounts(t *testing.T, job *IngestJob, want ingestCounts) {
+	t.Helper()
+	got := ingestCounts{job.RowsRead, job.RowsInserted, job.RowsDuplicate, job.RowsSkipped, job.RowsRejected}
+	if got != want {
+		t.Errorf("counts = %+v, want %+v", got, want)
+	}
+}
+
+// TestIngestFECIndividual tests loading an FEC individual contributions file
+func TestIngestFECIndividual(t *testing.T) {
+	store := newMemIngestStore()
+	job := &IngestJob{ID: "job1", Format: formatFECIndividual, Source: "FEC"}
+	if err := ingestFixture(t, job, "fec_itcont_sample.txt", store); err != nil {
+		t.Fatalf("runIngest: %v", err)
+	}
+
+	// 3 loaded, 1 repeated SUB_ID, 1 memo entry, bad date + refund + short row rejected
+	assertIngestCounts(t, job, ingestCounts{read: 8, inserted: 3, duplicate: 1, skipped: 1, rejected: 3})
+
+	rec, ok := store.keys["fec:4012345678901234568"]
+	if !ok {
+		t.Fatal("expected ACME PAC contribution to be loaded")
+	}
+	if rec.EntityID != "C00123456" || rec.RecipientID != "C00401224" {
+		t.Errorf("committee donor should use OTHER_ID, got entity=%s recipient=%s", rec.EntityID, rec.RecipientID)
+	}
+	if rec.Amount.String() != "1000.00" || rec.Currency != "USD" {
+		t.Errorf("amount = %s %s, want 1000.00 USD", rec.Amount, rec.Currency)
+	}
+	if rec.EntityName != "ACME PAC" {
+		t.Errorf("entity name = %q, want ACME PAC", rec.EntityName)
+	}
+
+	jane := store.keys["fec:4012345678901234567"]
+	if jane.EntityID != fecDonorID("Doe,  Jane", "22201") {
+		t.Errorf("individual donor ID should be derived from normalized name and ZIP5, got %s", jane.EntityID)
+	}
+
+	wantRejected := map[int64]bool{4: true, 5: true, 6: true}
+	for _, rej := range store.rejects {
+		if !wantRejected[rej.RowNumber] {
+			t.Errorf("unexpected reject at row %d: %s", rej.RowNumber, rej.Reason)
+		}
+		if rej.Raw == "" || rej.Reason == "" {
+			t.Errorf("reject at row %d should carry raw row and reason", rej.RowNumber)
+		}
+	}
+}
+
+// TestIngestFECCommittee tests loading an FEC committee-to-candidate file
+func TestIngestFECCommittee(t *testing.T) {
+	store := newMemIngestStore()
+	job := &IngestJob{ID: "job2", Format: formatFECCommittee, Source: "FEC"}
+	if err := ingestFixture(t, job, "fec_itpas2_sample.txt", store); err != nil {
+		t.Fatalf("runIngest: %v", err)
+	}
+
+	assertIngestCounts(t, job, ingestCounts{read: 2, inserted: 1, rejected: 1})
+	rec := store.keys["fec:4041520241234500001"]
+	if rec.EntityID != "C00123456" || rec.RecipientID != "H4VA08123" {
+		t.Errorf("expected committee to candidate link, got entity=%s recipient=%s", rec.EntityID, rec.RecipientID)
+	}
+	if rec.RecipientName != "FRIENDS OF SMITH" {
+		t.Errorf("recipient name = %q, want FRIENDS OF SMITH", rec.RecipientName)
+	}
+}
+
+// TestIngestGenericCSV tests loading a CSV file through a column mapping
+func TestIngestGenericCSV(t *testing.T) {
+	buf, err := os.ReadFile(filepath.Join("testdata", "generic_mapping.json"))
+	if err != nil {
+		t.Fatalf("read mapping: %v", err)
+	}
+	var mapping ColumnMapping
+	if err := json.Unmarshal(buf, &mapping); err != nil {
+		t.Fatalf("decode mapping: %v", err)
+	}
+
+	store := newMemIngestStore()
+	job := &IngestJob{ID: "job3", Format: formatCSV, Source: "STATE_VA", Mapping: &mapping}
+	if err := ingestFixture(t, job, "generic_contributions.csv", store); err != nil {
+		t.Fatalf("runIngest: %v", err)
+	}
+
+	// missing recipient and sub-cent amount rejected, repeated txn_id deduplicated
+	assertIngestCounts(t, job, ingestCounts{read: 6, inserted: 3, duplicate: 1, rejected: 2})
+
+	rec, ok := store.keys["STATE_VA:T5"]
+	if !ok {
+		t.Fatal("expected quoted row to be loaded")
+	}
+	if rec.EntityID != "D005,LLC" || rec.Source != "STATE_VA" || rec.Date.Format("2006-01-02") != "2024-03-19" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+}
+
+// TestIngestCorrectedSource tests that re-ingesting a corrected file
+// supersedes only the rows whose content changed
+func TestIngestCorrectedSource(t *testing.T) {
+	buf, err := os.ReadFile(filepath.Join("testdata", "generic_mapping.json"))
+	if err != nil {
+		t.Fatalf("read mapping: %v", err)
+	}
+	var mapping ColumnMapping
+	if err := json.Unmarshal(buf, &mapping); err != nil {
+		t.Fatalf("decode mapping: %v", err)
+	}
+
+	store := newMemIngestStore()
+	original := &IngestJob{ID: "job-original", Format: formatCSV, Source: "STATE_VA", Mapping: &mapping}
+	if err := ingestFixture(t, original, "generic_contributions.csv", store); err != nil {
+		t.Fatalf("runIngest: %v", err)
+	}
+
+	corrected := &IngestJob{ID: "job-corrected", Format: formatCSV, Source: "STATE_VA", Mapping: &mapping}
+	if err := ingestFixture(t, corrected, "generic_contributions_corrected.csv", store); err != nil {
+		t.Fatalf("runIngest: %v", err)
+	}
+
+	// T1 amount and T5 date changed, T2 is the same amount written as 25.00,
+	// T6 is new.
+	assertIngestCounts(t, corrected, ingestCounts{read: 4, inserted: 3, duplicate: 1})
+	if corrected.RowsSuperseded != 2 || len(store.superseded) != 2 {
+		t.Fatalf("superseded = %d (%d stored), want 2", corrected.RowsSuperseded, len(store.superseded))
+	}
+	if got := store.keys["STATE_VA:T1"].Amount.String(); got != "550.00" {
+		t.Errorf("T1 amount = %s, want corrected 550.00", got)
+	}
+	if store.owners["STATE_VA:T2"] != "job-original" {
+		t.Errorf("unchanged T2 should stay with the original job, owned by %s", store.owners["STATE_VA:T2"])
+	}
+	if store.raw["STATE_VA:T1"] != "D001,R100,550.00,03/15/2024,T1" {
+		t.Errorf("T1 raw row = %q", store.raw["STATE_VA:T1"])
+	}
+
+	// Resuming the corrected job from scratch supersedes nothing further.
+	corrected.Checkpoint = 0
+	if err := ingestFixture(t, corrected, "generic_contributions_corrected.csv", store); err != nil {
+		t.Fatalf("runIngest: %v", err)
+	}
+	if corrected.RowsSuperseded != 2 {
+		t.Errorf("re-run superseded %d rows, want none beyond the first 2", corrected.RowsSuperseded-2)
+	}
+}
+
+// TestColumnMappingValidation tests mapping compilation errors
+func TestColumnMappingValidation(t *testing.T) {
+	header := []string{"donor", "recipient", "amount", "date"}
+	tests := []struct {
+		name    string
+		mapping ColumnMapping
+		header  []string
+		wantErr bool
+	}{
+		{"complete mapping", ColumnMapping{HasHeader: true, Columns: map[string]string{
+			"entity_id": "donor", "recipient_id": "recipient", "amount": "amount", "date": "date"}}, header, false},
+		{"missing amount", ColumnMapping{HasHeader: true, Columns: map[string]string{
+			"entity_id": "donor", "recipient_id": "recipient", "date": "date"}}, header, true},
+		{"unknown header", ColumnMapping{HasHeader: true, Columns: map[string]string{
+			"entity_id": "giver", "recipient_id": "recipient", "amount": "amount", "date": "date"}}, header, true},
+		{"indexes without header", ColumnMapping{Columns: map[string]string{
+			"entity_id": "0", "recipient_id": "1", "amount": "2", "date": "3"}}, nil, false},
+		{"names without header", ColumnMapping{Columns: map[string]string{
+			"entity_id": "donor", "recipient_id": "1", "amount": "2", "date": "3"}}, nil, true},
+		{"unmapped key column", ColumnMapping{HasHeader: true, KeyColumns: []string{"txn"}, Columns: map[string]string{
+			"entity_id": "donor", "recipient_id": "recipient", "amount": "amount", "date": "date"}}, header, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.mapping.compile(tt.header, "TEST")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestIngestResume tests that an interrupted load resumes from its checkpoint without duplicating rows
+func TestIngestResume(t *testing.T) {
+	saved := ingestBatchSize
+	ingestBatchSize = 2
+	defer func() { ingestBatchSize = saved }()
+
+	store := newMemIngestStore()
+	store.failOn = 3
+	store.failWith = errors.New("connection reset")
+
+	job := &IngestJob{ID: "job4", Format: formatFECIndividual, Source: "FEC"}
+	if err := ingestFixture(t, job, "fec_itcont_sample.txt", store); err == nil {
+		t.Fatal("expected interrupted run to fail")
+	}
+	if job.Checkpoint != 4 {
+		t.Fatalf("checkpoint after two committed batches = %d, want 4", job.Checkpoint)
+	}
+
+	store.failOn = 0
+	if err := ingestFixture(t, job, "fec_itcont_sample.txt", store); err != nil {
+		t.Fatalf("resumed run: %v", err)
+	}
+
+	assertIngestCounts(t, job, ingestCounts{read: 8, inserted: 3, duplicate: 1, skipped: 1, rejected: 3})
+	if len(store.rejects) != 3 {
+		t.Errorf("reject report should list each bad row once, got %d", len(store.rejects))
+	}
+}
+
+// TestResolveIngestPath tests that ingest paths cannot escape the ingest directory
+func TestResolveIngestPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"fec/itcont.txt", false},
+		{"./fec/../itcont.txt", false},
+		{"../secrets.txt", true},
+		{"fec/../../secrets.txt", true},
+		{"/etc/passwd", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		_, err := resolveIngestPath("data/funding", tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveIngestPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Posting directions.
+const (
+	debit  = "debit"
+	credit = "credit"
+)
+
+// Account types. Assets and expenses carry debit balances; the rest carry
+// credit balances.
+const (
+	accountAsset     = "asset"
+	accountLiability = "liability"
+	accountEquity    = "equity"
+	accountRevenue   = "revenue"
+	accountExpense   = "expense"
+)
+
+// accountPrefixes maps the prefix of an account code ("recipient:cand-1")
+// to its type. Accounts are created on first use.
+var accountPrefixes = map[string]string{
+	"recipient":   accountAsset,     // funds received by a recipient
+	"contributor": accountEquity,    // funds given by a contributing entity
+	"processor":   accountAsset,     // money held at the payment processor
+	"donations":   accountLiability, // platform donations owed to a recipient
+	"revenue":     accountRevenue,   // platform income such as premium tiers
+	"expense":     accountExpense,   // fees and write-offs
+	"adjustment":  accountEquity,    // treasurer corrections
+}
+
+// Journal entry sources.
+const (
+	sourceFundingRecord = "funding_record"
+	sourcePayment       = "payment"
+	sourcePaymentRefund = "payment_refund"
+	sourceManual        = "manual"
+	sourceReversal      = "reversal"
+)
+
+const clearingAccount = "processor:clearing"
+
+// JournalEntry is one balanced, immutable transaction in the ledger.
+// Mistakes are corrected by posting a reversal, never by editing.
+type JournalEntry struct {
+	ID          string    `json:"id"`
+	PostedAt    time.Time `json:"posted_at"`
+	Description string    `json:"description"`
+	SourceType  string    `json:"source_type"`
+	SourceID    string    `json:"source_id,omitempty"`
+	ReversalOf  string    `json:"reversal_of,omitempty"`
+	Postings    []Posting `json:"postings"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Posting moves an amount into or out of one account.
+type Posting struct {
+	Account   string `json:"account"`
+	Direction string `json:"direction"`
+	Amount    Amount `json:"amount"`
+	Currency  string `json:"currency"`
+}
+
+// AccountBalance is an account's balance in one currency at a point in time.
+type AccountBalance struct {
+	Account  string    `json:"account"`
+	Type     string    `json:"type"`
+	Currency string    `json:"currency"`
+	Debits   Amount    `json:"debits"`
+	Credits  Amount    `json:"credits"`
+	Balance  Amount    `json:"balance"`
+	AsOf     time.Time `json:"as_of"`
+}
+
+// ReconciliationIssue is one discrepancy found by reconciliation.
+type ReconciliationIssue struct {
+	Kind     string `json:"kind"`
+	Account  string `json:"account,omitempty"`
+	EntryID  string `json:"entry_id,omitempty"`
+	Currency string `json:"currency"`
+	Expected Amount `json:"expected"`
+	Actual   Amount `json:"actual"`
+}
+
+// CurrencyTotals is the trial balance for one currency.
+type CurrencyTotals struct {
+	Currency string `json:"currency"`
+	Debits   Amount `json:"debits"`
+	Credits  Amount `json:"credits"`
+}
+
+// ReconciliationReport checks the journal against itself and against the
+// records it mirrors.
+type ReconciliationReport struct {
+	GeneratedAt  time.Time             `json:"generated_at"`
+	Balanced     bool                  `json:"balanced"`
+	TrialBalance []CurrencyTotals      `json:"trial_balance"`
+	Issues       []ReconciliationIssue `json:"issues"`
+}
+
+// balanceKey identifies an account balance in one currency.
+type balanceKey struct {
+	Account  string
+	Currency string
+}
+
+func accountType(code string) (string, error) {
+	prefix, rest, ok := strings.Cut(code, ":")
+	if !ok || rest == "" {
+		return "", fmt.Errorf("account %q must look like <kind>:<id>", code)
+	}
+	typ, ok := accountPrefixes[prefix]
+	if !ok {
+		return "", fmt.Errorf("unknown account kind %q", prefix)
+	}
+	return typ, nil
+}
+
+func debitNormal(typ string) bool {
+	return typ == accountAsset || typ == accountExpense
+}
+
+// validateEntry checks that an entry is well formed and that its debits
+// equal its credits in every currency.
+func validateEntry(entry JournalEntry) error {
+	if len(entry.Postings) < 2 {
+		return fmt.Errorf("an entry needs at least two postings")
+	}
+	if entry.Description == "" {
+		return fmt.Errorf("description is required")
+	}
+	net := map[string]Amount{}
+	for i, p := range entry.Postings {
+		if _, err := accountType(p.Account); err != nil {
+			return fmt.Errorf("posting %d: %w", i+1, err)
+		}
+		if err := validateCurrency(p.Currency); err != nil {
+			return fmt.Errorf("posting %d: %w", i+1, err)
+		}
+		if p.Amount <= 0 {
+			return fmt.Errorf("posting %d: amount must be positive", i+1)
+		}
+		if !p.Amount.fitsCurrency(p.Currency) {
+			return fmt.Errorf("posting %d: amount %s has more precision than %s allows", i+1, p.Amount, p.Currency)
+		}
+		var err error
+		switch p.Direction {
+		case debit:
+			net[p.Currency], err = net[p.Currency].Add(p.Amount)
+		case credit:
+			net[p.Currency], err = net[p.Currency].Add(-p.Amount)
+		default:
+			return fmt.Errorf("posting %d: direction must be debit or credit", i+1)
+		}
+		if err != nil {
+			return fmt.Errorf("posting %d: %w", i+1, err)
+		}
+	}
+	for currency, diff := range net {
+		if diff != 0 {
+			return fmt.Errorf("entry is unbalanced in %s by %s", currency, diff)
+		}
+	}
+	return nil
+}
+
+// reversalEntry undoes an entry by swapping every debit and credit.
+func reversalEntry(original JournalEntry, description string, at time.Time) JournalEntry {
+	if description == "" {
+		description = "Reversal of " + original.Description
+	}
+	entry := JournalEntry{
+		PostedAt:    at,
+		Description: description,
+		SourceType:  sourceReversal,
+		SourceID:    original.ID,
+		ReversalOf:  original.ID,
+	}
+	for _, p := range original.Postings {
+		p.Direction = map[string]string{debit: credit, credit: debit}[p.Direction]
+		entry.Postings = append(entry.Postings, p)
+	}
+	return entry
+}
+
+// fundingRecordEntry moves a contribution from its entity to its recipient.
+func fundingRecordEntry(record FundingRecord) JournalEntry {
+	return JournalEntry{
+		PostedAt:    record.Date,
+		Description: fmt.Sprintf("Contribution from %s to %s", record.EntityID, record.RecipientID),
+		SourceType:  sourceFundingRecord,
+		SourceID:    record.ID,
+		Postings: []Posting{
+			{Account: "recipient:" + record.RecipientID, Direction: debit, Amount: record.Amount, Currency: record.Currency},
+			{Account: "contributor:" + record.EntityID, Direction: credit, Amount: record.Amount, Currency: record.Currency},
+		},
+	}
+}
+
+// paymentIncomeAccount is where captured money for a payment is owed.
+func paymentIncomeAccount(txn *Transaction) string {
+	if txn.Purpose == purposeDonation {
+		return "donations:" + txn.RecipientID
+	}
+	return "revenue:" + txn.Purpose
+}
+
+// paymentCaptureEntry books a captured charge into the processor clearing
+// account.
+func paymentCaptureEntry(txn *Transaction, at time.Time) JournalEntry {
+	return JournalEntry{
+		PostedAt:    at,
+		Description: fmt.Sprintf("Captured %s payment %s from %s", txn.Purpose, txn.ID, txn.UserID),
+		SourceType:  sourcePayment,
+		SourceID:    txn.ID,
+		Postings: []Posting{
+			{Account: clearingAccount, Direction: debit, Amount: txn.Amount, Currency: txn.Currency},
+			{Account: paymentIncomeAccount(txn), Direction: credit, Amount: txn.Amount, Currency: txn.Currency},
+		},
+	}
+}
+
+// paymentRefundEntry books money returned from the clearing account. The
+// source ID includes the transaction version so each refund posts once.
+func paymentRefundEntry(txn *Transaction, amount Amount, at time.Time) JournalEntry {
+	return JournalEntry{
+		PostedAt:    at,
+		Description: fmt.Sprintf("Refund of %s on payment %s", amount, txn.ID),
+		SourceType:  sourcePaymentRefund,
+		SourceID:    fmt.Sprintf("%s:%d", txn.ID, txn.Version),
+		Postings: []Posting{
+			{Account: paymentIncomeAccount(txn), Direction: debit, Amount: amount, Currency: txn.Currency},
+			{Account: clearingAccount, Direction: credit, Amount: amount, Currency: txn.Currency},
+		},
+	}
+}
+
+// reconcile builds the report from the trial balance, any entries whose
+// postings do not balance, and the expected versus actual balance of each
+// account that mirrors another table.
+func reconcile(totals []CurrencyTotals, unbalanced map[string][]CurrencyTotals, expected, actual map[balanceKey]Amount) ReconciliationReport {
+	report := ReconciliationReport{GeneratedAt: time.Now().UTC(), TrialBalance: totals, Issues: []ReconciliationIssue{}}
+
+	for _, t := range totals {
+		if t.Debits != t.Credits {
+			report.Issues = append(report.Issues, ReconciliationIssue{
+				Kind: "trial_balance", Currency: t.Currency, Expected: t.Debits, Actual: t.Credits,
+			})
+		}
+	}
+
+	ids := make([]string, 0, len(unbalanced))
+	for id := range unbalanced {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, t := range unbalanced[id] {
+			report.Issues = append(report.Issues, ReconciliationIssue{
+				Kind: "unbalanced_entry", EntryID: id, Currency: t.Currency, Expected: t.Debits, Actual: t.Credits,
+			})
+		}
+	}
+
+	keys := make([]balanceKey, 0, len(expected)+len(actual))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	for k := range actual {
+		if _, ok := expected[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Account != keys[j].Account {
+			return keys[i].Account < keys[j].Account
+		}
+		return keys[i].Currency < keys[j].Currency
+	})
+	for _, k := range keys {
+		if expected[k] != actual[k] {
+			report.Issues = append(report.Issues, ReconciliationIssue{
+				Kind: "ledger_mismatch", Account: k.Account, Currency: k.Currency, Expected: expected[k], Actual: actual[k],
+			})
+		}
+	}
+
+	report.Balanced = len(report.Issues) == 0
+	return report
+}
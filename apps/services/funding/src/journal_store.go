@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const journalSchema = `
+	CREATE TABLE IF NOT EXISTS funding_accounts (
+		code VARCHAR(300) PRIMARY KEY,
+		type VARCHAR(20) NOT NULL,
+		created_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS funding_journal_entries (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		posted_at TIMESTAMP NOT NULL,
+		description TEXT NOT NULL,
+		source_type VARCHAR(30) NOT NULL,
+		source_id VARCHAR(255),
+		reversal_of UUID REFERENCES funding_journal_entries(id),
+		created_at TIMESTAMP DEFAULT now() NOT NULL,
+		UNIQUE (source_type, source_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_journal_posted ON funding_journal_entries(posted_at);
+
+	CREATE TABLE IF NOT EXISTS funding_journal_postings (
+		id BIGSERIAL PRIMARY KEY,
+		entry_id UUID NOT NULL REFERENCES funding_journal_entries(id),
+		account_code VARCHAR(300) NOT NULL REFERENCES funding_accounts(code),
+		direction VARCHAR(6) NOT NULL CHECK (direction IN ('debit', 'credit')),
+		amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+		currency CHAR(3) NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_postings_account ON funding_journal_postings(account_code, currency);
+	CREATE INDEX IF NOT EXISTS idx_funding_postings_entry ON funding_journal_postings(entry_id);
+
+	CREATE OR REPLACE FUNCTION funding_journal_immutable() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'funding journal is append-only; post a reversal instead';
+	END $$ LANGUAGE plpgsql;
+
+	CREATE OR REPLACE FUNCTION funding_journal_check_balance() RETURNS trigger AS $$
+	BEGIN
+		IF EXISTS (
+			SELECT 1 FROM funding_journal_postings WHERE entry_id = NEW.entry_id
+			GROUP BY currency
+			HAVING SUM(CASE WHEN direction = 'debit' THEN amount ELSE -amount END) <> 0
+		) THEN
+			RAISE EXCEPTION 'journal entry % is not balanced', NEW.entry_id;
+		END IF;
+		RETURN NULL;
+	END $$ LANGUAGE plpgsql;
+
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'funding_journal_entries_immutable') THEN
+			CREATE TRIGGER funding_journal_entries_immutable BEFORE UPDATE OR DELETE ON funding_journal_entries
+				FOR EACH ROW EXECUTE FUNCTION funding_journal_immutable();
+		END IF;
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'funding_journal_postings_immutable') THEN
+			CREATE TRIGGER funding_journal_postings_immutable BEFORE UPDATE OR DELETE ON funding_journal_postings
+				FOR EACH ROW EXECUTE FUNCTION funding_journal_immutable();
+		END IF;
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'funding_journal_postings_balanced') THEN
+			CREATE CONSTRAINT TRIGGER funding_journal_postings_balanced AFTER INSERT ON funding_journal_postings
+				DEFERRABLE INITIALLY DEFERRED
+				FOR EACH ROW EXECUTE FUNCTION funding_journal_check_balance();
+		END IF;
+	END $$;
+	`
+
+// ReverseRequest asks to reverse a posted entry.
+type ReverseRequest struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+}
+
+// postEntry writes a balanced entry inside tx, creating its accounts as
+// needed. An entry whose source was already posted is skipped and false is
+// returned.
+func postEntry(ctx context.Context, tx *sql.Tx, entry *JournalEntry) (bool, error) {
+	if err := validateEntry(*entry); err != nil {
+		return false, err
+	}
+
+	seen := map[string]bool{}
+	var values []string
+	var args []interface{}
+	for _, p := range entry.Postings {
+		if seen[p.Account] {
+			continue
+		}
+		seen[p.Account] = true
+		typ, _ := accountType(p.Account)
+		values = append(values, fmt.Sprintf("($%d, $%d)", len(args)+1, len(args)+2))
+		args = append(args, p.Account, typ)
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO funding_accounts (code, type) VALUES "+strings.Join(values, ", ")+" ON CONFLICT (code) DO NOTHING", args...)
+	if err != nil {
+		return false, fmt.Errorf("creating accounts: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO funding_journal_entries (posted_at, description, source_type, source_id, reversal_of)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, '')::uuid)
+		ON CONFLICT (source_type, source_id) DO NOTHING
+		RETURNING id, created_at
+	`, entry.PostedAt, entry.Description, entry.SourceType, entry.SourceID, entry.ReversalOf).Scan(&entry.ID, &entry.CreatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("inserting journal entry: %w", err)
+	}
+
+	values, args = values[:0], args[:0]
+	for _, p := range entry.Postings {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, entry.ID, p.Account, p.Direction, p.Amount, p.Currency)
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO funding_journal_postings (entry_id, account_code, direction, amount, currency) VALUES "+
+			strings.Join(values, ", "), args...)
+	if err != nil {
+		return false, fmt.Errorf("inserting postings: %w", err)
+	}
+	return true, nil
+}
+
+// postEntryTx posts a single entry in its own transaction.
+func postEntryTx(ctx context.Context, entry *JournalEntry) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	posted, err := postEntry(ctx, tx, entry)
+	if err != nil {
+		return false, err
+	}
+	return posted, tx.Commit()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func getJournalEntry(ctx context.Context, q queryer, id string) (*JournalEntry, error) {
+	if !isUUID(id) {
+		return nil, sql.ErrNoRows
+	}
+	var entry JournalEntry
+	var sourceID, reversalOf sql.NullString
+	err := q.QueryRowContext(ctx, `
+		SELECT id, posted_at, description, source_type, source_id, reversal_of::text, created_at
+		FROM funding_journal_entries WHERE id = $1
+	`, id).Scan(&entry.ID, &entry.PostedAt, &entry.Description, &entry.SourceType, &sourceID, &reversalOf, &entry.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	entry.SourceID, entry.ReversalOf = sourceID.String, reversalOf.String
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT account_code, direction, amount, currency FROM funding_journal_postings WHERE entry_id = $1 ORDER BY id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Posting
+		if err := rows.Scan(&p.Account, &p.Direction, &p.Amount, &p.Currency); err != nil {
+			return nil, err
+		}
+		entry.Postings = append(entry.Postings, p)
+	}
+	return &entry, rows.Err()
+}
+
+// accountBalances returns an account's balance in each currency counting
+// entries posted at or before asOf.
+func accountBalances(ctx context.Context, account string, asOf time.Time) ([]AccountBalance, error) {
+	typ, err := accountType(account)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.currency,
+			COALESCE(SUM(p.amount) FILTER (WHERE p.direction = 'debit'), 0),
+			COALESCE(SUM(p.amount) FILTER (WHERE p.direction = 'credit'), 0)
+		FROM funding_journal_postings p
+		JOIN funding_journal_entries e ON e.id = p.entry_id
+		WHERE p.account_code = $1 AND e.posted_at <= $2
+		GROUP BY p.currency
+		ORDER BY p.currency
+	`, account, asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := []AccountBalance{}
+	for rows.Next() {
+		b := AccountBalance{Account: account, Type: typ, AsOf: asOf}
+		if err := rows.Scan(&b.Currency, &b.Debits, &b.Credits); err != nil {
+			return nil, err
+		}
+		b.Balance = b.Credits - b.Debits
+		if debitNormal(typ) {
+			b.Balance = b.Debits - b.Credits
+		}
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+// queryBalances runs a query returning (account, currency, amount) rows.
+func queryBalances(ctx context.Context, into map[balanceKey]Amount, query string) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k balanceKey
+		var amount Amount
+		if err := rows.Scan(&k.Account, &k.Currency, &amount); err != nil {
+			return err
+		}
+		into[k] = amount
+	}
+	return rows.Err()
+}
+
+// runReconciliation compares the journal with itself and with the funding
+// records and payments it mirrors.
+func runReconciliation(ctx context.Context) (ReconciliationReport, error) {
+	var totals []CurrencyTotals
+	rows, err := db.QueryContext(ctx, `
+		SELECT currency,
+			COALESCE(SUM(amount) FILTER (WHERE direction = 'debit'), 0),
+			COALESCE(SUM(amount) FILTER (WHERE direction = 'credit'), 0)
+		FROM funding_journal_postings GROUP BY currency ORDER BY currency
+	`)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	for rows.Next() {
+		var t CurrencyTotals
+		if err := rows.Scan(&t.Currency, &t.Debits, &t.Credits); err != nil {
+			rows.Close()
+			return ReconciliationReport{}, err
+		}
+		totals = append(totals, t)
+	}
+	rows.Close()
+
+	unbalanced := map[string][]CurrencyTotals{}
+	rows, err = db.QueryContext(ctx, `
+		SELECT entry_id, currency,
+			COALESCE(SUM(amount) FILTER (WHERE direction = 'debit'), 0),
+			COALESCE(SUM(amount) FILTER (WHERE direction = 'credit'), 0)
+		FROM funding_journal_postings GROUP BY entry_id, currency
+		HAVING SUM(CASE WHEN direction = 'debit' THEN amount ELSE -amount END) <> 0
+	`)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	for rows.Next() {
+		var id string
+		var t CurrencyTotals
+		if err := rows.Scan(&id, &t.Currency, &t.Debits, &t.Credits); err != nil {
+			rows.Close()
+			return ReconciliationReport{}, err
+		}
+		unbalanced[id] = append(unbalanced[id], t)
+	}
+	rows.Close()
+
+	expected := map[balanceKey]Amount{}
+	actual := map[balanceKey]Amount{}
+	for _, query := range []string{
+		`SELECT 'recipient:' || recipient_id, currency, SUM(amount) FROM active_funding_records GROUP BY 1, 2`,
+		`SELECT 'contributor:' || entity_id, currency, SUM(amount) FROM active_funding_records GROUP BY 1, 2`,
+		`SELECT '` + clearingAccount + `', currency, SUM(amount - refunded_amount) FROM funding_payments
+			WHERE status IN ('captured', 'partially_refunded', 'refunded') GROUP BY 1, 2`,
+		`SELECT CASE WHEN purpose = 'donation' THEN 'donations:' || recipient_id ELSE 'revenue:' || purpose END,
+			currency, SUM(amount - refunded_amount) FROM funding_payments
+			WHERE status IN ('captured', 'partially_refunded', 'refunded') GROUP BY 1, 2`,
+	} {
+		if err := queryBalances(ctx, expected, query); err != nil {
+			return ReconciliationReport{}, err
+		}
+	}
+	err = queryBalances(ctx, actual, `
+		SELECT p.account_code, p.currency,
+			SUM(CASE WHEN (a.type IN ('asset', 'expense')) = (p.direction = 'debit') THEN p.amount ELSE -p.amount END)
+		FROM funding_journal_postings p
+		JOIN funding_accounts a ON a.code = p.account_code
+		WHERE split_part(p.account_code, ':', 1) IN ('recipient', 'contributor', 'processor', 'donations', 'revenue')
+		GROUP BY 1, 2
+	`)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+
+	return reconcile(totals, unbalanced, expected, actual), nil
+}
+
+// backfillJournal posts entries for funding records stored before the
+// journal existed.
+func backfillJournal(ctx context.Context) (int, error) {
+	posted := 0
+	for {
+		rows, err := db.QueryContext(ctx, `
+			SELECT r.id, r.entity_id, r.recipient_id, r.amount, r.currency, r.date
+			FROM active_funding_records r
+			WHERE NOT EXISTS (
+				SELECT 1 FROM funding_journal_entries e
+				WHERE e.source_type = $1 AND e.source_id = r.id::text
+			)
+			LIMIT $2
+		`, sourceFundingRecord, ingestBatchSize)
+		if err != nil {
+			return posted, err
+		}
+		var records []FundingRecord
+		for rows.Next() {
+			var rec FundingRecord
+			if err := rows.Scan(&rec.ID, &rec.EntityID, &rec.RecipientID, &rec.Amount, &rec.Currency, &rec.Date); err != nil {
+				rows.Close()
+				return posted, err
+			}
+			records = append(records, rec)
+		}
+		rows.Close()
+		if len(records) == 0 {
+			return posted, nil
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return posted, err
+		}
+		for _, rec := range records {
+			entry := fundingRecordEntry(rec)
+			if _, err := postEntry(ctx, tx, &entry); err != nil {
+				tx.Rollback()
+				return posted, fmt.Errorf("posting record %s: %w", rec.ID, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return posted, err
+		}
+		posted += len(records)
+	}
+}
+
+func handleJournal(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entry, err := getJournalEntry(r.Context(), db, r.URL.Query().Get("id"))
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Journal entry not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Loading journal entry failed: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load journal entry"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+	case http.MethodPost:
+		var entry JournalEntry
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+			return
+		}
+		entry.SourceType, entry.SourceID, entry.ReversalOf = sourceManual, "", ""
+		if entry.PostedAt.IsZero() {
+			entry.PostedAt = time.Now().UTC()
+		}
+		if err := validateEntry(entry); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+			return
+		}
+		if _, err := postEntryTx(r.Context(), &entry); err != nil {
+			log.Printf("Posting journal entry failed: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to post journal entry"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(entry)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+	}
+}
+
+func handleReverseJournalEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req ReverseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "id is required"})
+		return
+	}
+	original, err := getJournalEntry(r.Context(), db, req.ID)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Journal entry not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Loading journal entry failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to reverse journal entry"})
+		return
+	}
+	if original.SourceType == sourceReversal {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "A reversal cannot itself be reversed; post a new entry instead"})
+		return
+	}
+
+	entry := reversalEntry(*original, req.Description, time.Now().UTC())
+	posted, err := postEntryTx(r.Context(), &entry)
+	if err != nil {
+		log.Printf("Reversing journal entry %s failed: %v", req.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to reverse journal entry"})
+		return
+	}
+	if !posted {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Journal entry has already been reversed"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+func handleAccountBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	asOf := time.Now().UTC()
+	if v := q.Get("as_of"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "as_of must be an RFC 3339 timestamp"})
+			return
+		}
+		asOf = t
+	}
+
+	balances, err := accountBalances(r.Context(), q.Get("account"), asOf)
+	if err != nil {
+		if _, typeErr := accountType(q.Get("account")); typeErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: typeErr.Error()})
+			return
+		}
+		log.Printf("Account balance query failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to compute balance"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"account":  q.Get("account"),
+		"as_of":    asOf,
+		"balances": balances,
+	})
+}
+
+func handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	report, err := runReconciliation(r.Context())
+	if err != nil {
+		log.Printf("Reconciliation failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Reconciliation failed"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
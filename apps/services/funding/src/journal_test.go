@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestJournalEntryValidation tests that only balanced entries are accepted
+func TestJournalEntryValidation(t *testing.T) {
+	p := func(account, direction string, amount Amount, currency string) Posting {
+		return Posting{Account: account, Direction: direction, Amount: amount, Currency: currency}
+	}
+	tests := []struct {
+		name     string
+		postings []Posting
+		wantErr  bool
+	}{
+		{"balanced", []Posting{p("recipient:c1", debit, 5000, "USD"), p("contributor:e1", credit, 5000, "USD")}, false},
+		{"split credit", []Posting{
+			p("processor:clearing", debit, 1000, "USD"),
+			p("revenue:premium_tier", credit, 970, "USD"),
+			p("expense:fees", credit, 30, "USD"),
+		}, false},
+		{"balanced per currency", []Posting{
+			p("recipient:c1", debit, 100, "USD"), p("contributor:e1", credit, 100, "USD"),
+			p("recipient:c1", debit, 200, "EUR"), p("contributor:e1", credit, 200, "EUR"),
+		}, false},
+		{"unbalanced", []Posting{p("recipient:c1", debit, 5000, "USD"), p("contributor:e1", credit, 4999, "USD")}, true},
+		{"balanced only across currencies", []Posting{p("recipient:c1", debit, 100, "USD"), p("contributor:e1", credit, 100, "EUR")}, true},
+		{"single posting", []Posting{p("recipient:c1", debit, 100, "USD")}, true},
+		{"zero amount", []Posting{p("recipient:c1", debit, 0, "USD"), p("contributor:e1", credit, 0, "USD")}, true},
+		{"negative amount", []Posting{p("recipient:c1", debit, -100, "USD"), p("contributor:e1", credit, -100, "USD")}, true},
+		{"unknown account kind", []Posting{p("bank:1", debit, 100, "USD"), p("contributor:e1", credit, 100, "USD")}, true},
+		{"bare account kind", []Posting{p("recipient:", debit, 100, "USD"), p("contributor:e1", credit, 100, "USD")}, true},
+		{"bad direction", []Posting{p("recipient:c1", "up", 100, "USD"), p("contributor:e1", credit, 100, "USD")}, true},
+		{"fractional yen", []Posting{p("recipient:c1", debit, 150, "JPY"), p("contributor:e1", credit, 150, "JPY")}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateEntry(JournalEntry{Description: "test", Postings: tt.postings})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateEntry error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestGeneratedEntries tests that entries built from records and payments balance
+func TestGeneratedEntries(t *testing.T) {
+	at := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	record := FundingRecord{ID: "r1", EntityID: "e1", RecipientID: "c1", Amount: 250000, Currency: "USD", Date: at}
+	donation := &Transaction{ID: "p1", UserID: "u1", Purpose: purposeDonation, RecipientID: "c1", Amount: 2500, Currency: "USD", Version: 3}
+	premium := &Transaction{ID: "p2", UserID: "u1", Purpose: purposePremiumTier, Amount: 999, Currency: "EUR", Version: 2}
+
+	entries := []JournalEntry{
+		fundingRecordEntry(record),
+		paymentCaptureEntry(donation, at),
+		paymentCaptureEntry(premium, at),
+		paymentRefundEntry(donation, 500, at),
+	}
+	for _, entry := range entries {
+		if err := validateEntry(entry); err != nil {
+			t.Errorf("%s entry %q: %v", entry.SourceType, entry.Description, err)
+		}
+	}
+
+	if got := entries[1].Postings[1].Account; got != "donations:c1" {
+		t.Errorf("donation credited %s, want donations:c1", got)
+	}
+	if got := entries[2].Postings[1].Account; got != "revenue:premium_tier" {
+		t.Errorf("premium credited %s, want revenue:premium_tier", got)
+	}
+	if entries[3].SourceID != "p1:3" {
+		t.Errorf("refund source id = %s, want p1:3", entries[3].SourceID)
+	}
+
+	original := entries[0]
+	original.ID = "entry-1"
+	reversal := reversalEntry(original, "", at.Add(time.Hour))
+	if err := validateEntry(reversal); err != nil {
+		t.Fatalf("reversal: %v", err)
+	}
+	if reversal.ReversalOf != "entry-1" || reversal.SourceID != "entry-1" {
+		t.Errorf("reversal links to %q/%q, want entry-1", reversal.ReversalOf, reversal.SourceID)
+	}
+	for i, p := range reversal.Postings {
+		if p.Direction == original.Postings[i].Direction || p.Amount != original.Postings[i].Amount {
+			t.Errorf("posting %d = %+v, want %+v with the direction swapped", i, p, original.Postings[i])
+		}
+	}
+	if original.Postings[0].Direction != debit {
+		t.Error("reversalEntry modified the original postings")
+	}
+}
+
+// TestReconciliation tests that the report flags imbalances and drift
+func TestReconciliation(t *testing.T) {
+	totals := []CurrencyTotals{{Currency: "USD", Debits: 10000, Credits: 10000}}
+	expected := map[balanceKey]Amount{
+		{"recipient:c1", "USD"}:   10000,
+		{"contributor:e1", "USD"}: 10000,
+	}
+	actual := map[balanceKey]Amount{
+		{"recipient:c1", "USD"}:   10000,
+		{"contributor:e1", "USD"}: 10000,
+	}
+
+	report := reconcile(totals, nil, expected, actual)
+	if !report.Balanced || len(report.Issues) != 0 {
+		t.Fatalf("clean books reported %+v", report.Issues)
+	}
+
+	totals = append(totals, CurrencyTotals{Currency: "EUR", Debits: 500, Credits: 400})
+	unbalanced := map[string][]CurrencyTotals{"entry-9": {{Currency: "EUR", Debits: 500, Credits: 400}}}
+	actual[balanceKey{"recipient:c1", "USD"}] = 9000
+	actual[balanceKey{"recipient:c2", "USD"}] = 1000
+
+	report = reconcile(totals, unbalanced, expected, actual)
+	if report.Balanced {
+		t.Fatal("imbalanced books reported as balanced")
+	}
+	kinds := map[string]int{}
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	if kinds["trial_balance"] != 1 || kinds["unbalanced_entry"] != 1 || kinds["ledger_mismatch"] != 2 {
+		t.Errorf("issues = %+v, want 1 trial_balance, 1 unbalanced_entry and 2 ledger_mismatch", report.Issues)
+	}
+	last := report.Issues[len(report.Issues)-1]
+	if last.Account != "recipient:c2" || last.Expected != 0 || last.Actual != 1000 {
+		t.Errorf("unexpected ledger account issue = %+v", last)
+	}
+}
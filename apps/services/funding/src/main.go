@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -15,13 +17,21 @@ import (
 var db *sql.DB
 
 type FundingRecord struct {
-	ID          string    `json:"id"`
-	EntityID    string    `json:"entity_id"`
-	Amount      float64   `json:"amount"`
-	Source      string    `json:"source"`
-	RecipientID string    `json:"recipient_id"`
-	Date        time.Time `json:"date"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID                   string      `json:"id"`
+	EntityID             string      `json:"entity_id"`
+	EntityName           string      `json:"entity_name,omitempty"`
+	Amount               Amount      `json:"amount"`
+	Currency             string      `json:"currency"`
+	Source               string      `json:"source"`
+	RecipientID          string      `json:"recipient_id"`
+	RecipientName        string      `json:"recipient_name,omitempty"`
+	CanonicalEntityID    string      `json:"canonical_entity_id,omitempty"`
+	CanonicalRecipientID string      `json:"canonical_recipient_id,omitempty"`
+	Date                 time.Time   `json:"date"`
+	CreatedAt            time.Time   `json:"created_at"`
+	Provenance           *Provenance `json:"provenance,omitempty"`
+	SupersededBy         string      `json:"superseded_by,omitempty"`
+	SupersededAt         *time.Time  `json:"superseded_at,omitempty"`
 }
 
 type HealthResponse struct {
@@ -88,10 +98,52 @@ func main() {
 		port = "4002"
 	}
 
+	if err := createTables(); err != nil {
+		log.Printf("Warning: Failed to create funding tables: %v", err)
+	} else {
+		resumeIngestJobs()
+		startRollupRefresher(rollupInterval())
+		startAnomalyDetector(loadAnomalyConfig())
+		go func() {
+			if n, err := backfillJournal(context.Background()); err != nil {
+				log.Printf("Warning: Journal backfill failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Posted journal entries for %d existing funding records", n)
+			}
+		}()
+	}
+
+	processor, err := newPaymentProcessor(os.Getenv("PAYMENT_PROCESSOR"))
+	if err != nil {
+		log.Fatalf("Failed to configure payments: %v", err)
+	}
+	payments = &PaymentService{processor: processor, store: sqlPaymentStore{db: db}}
+
 	http.HandleFunc("/health", handleHealth)
 	http.HandleFunc("/ready", handleReady)
 	http.HandleFunc("/funding/search", handleSearchFunding)
 	http.HandleFunc("/funding/record", handleRecordFunding)
+	http.HandleFunc("/funding/record/trace", handleTraceRecord)
+	http.HandleFunc("/funding/aggregate", handleAggregateFunding)
+	http.HandleFunc("/funding/alerts", handleListAlerts)
+	http.HandleFunc("/funding/alerts/triage", handleTriageAlert)
+	http.HandleFunc("/funding/alerts/scan", handleScanAlerts)
+	http.HandleFunc("/funding/payments", handlePayments)
+	http.HandleFunc("/funding/payments/refund", handleRefundPayment)
+	http.HandleFunc("/funding/payments/webhook", handlePaymentWebhook)
+	http.HandleFunc("/funding/journal", handleJournal)
+	http.HandleFunc("/funding/journal/reverse", handleReverseJournalEntry)
+	http.HandleFunc("/funding/journal/reconcile", handleReconcile)
+	http.HandleFunc("/funding/accounts/balance", handleAccountBalance)
+	http.HandleFunc("/funding/entities", handleEntities)
+	http.HandleFunc("/funding/entities/candidates", handleEntityCandidates)
+	http.HandleFunc("/funding/entities/resolve", handleResolveEntities)
+	http.HandleFunc("/funding/entities/merge", handleMergeEntities)
+	http.HandleFunc("/funding/entities/split", handleSplitEntities)
+	http.HandleFunc("/funding/entities/revert", handleRevertEntityDecision)
+	http.HandleFunc("/funding/ingest", handleStartIngest)
+	http.HandleFunc("/funding/ingest/jobs", handleGetIngestJob)
+	http.HandleFunc("/funding/ingest/rejects", handleGetIngestRejects)
 
 	log.Printf("Funding Service listening on port %s", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
@@ -124,18 +176,29 @@ func handleSearchFunding(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	entityID := r.URL.Query().Get("entity_id")
-	if entityID == "" {
+	search, err := parseFundingSearch(r.URL.Query())
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "entity_id query parameter required"})
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	records, count, total, err := searchFundingRecords(r.Context(), search)
+	if err != nil {
+		log.Printf("Funding search failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to search funding records"})
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"entity_id": entityID,
-		"records":   []FundingRecord{},
-		"total":     0,
+		"entity_id": search.EntityID,
+		"records":   records,
+		"total":     total,
+		"count":     count,
+		"limit":     search.Limit,
+		"offset":    search.Offset,
 	})
 }
 
@@ -146,18 +209,37 @@ func handleRecordFunding(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var record FundingRecord
-	err := json.NewDecoder(r.Body).Decode(&record)
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRecordBody))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
 		return
 	}
+	var record FundingRecord
+	if err := json.Unmarshal(body, &record); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	if err := validateFundingRecord(record); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	record.Provenance = apiProvenance(record.Provenance, body, time.Now().UTC())
+
+	if err := insertFundingRecord(r.Context(), &record); err != nil {
+		log.Printf("Funding record insert failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to record funding"})
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
 		"status": "recorded",
-		"id":     "placeholder-uuid",
+		"id":     record.ID,
 	})
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// amountScale is the number of decimal places an Amount carries. It matches
+// the NUMERIC(15,2) storage of funding amounts.
+const amountScale = 2
+
+const amountUnit = 100 // 10^amountScale
+
+// maxAmount is the largest amount NUMERIC(15,2) can store, 9999999999999.99.
+const maxAmount Amount = 999999999999999
+
+// currencyExponents lists the supported ISO 4217 codes and how many minor-unit
+// digits each allows. No supported currency may exceed amountScale.
+var currencyExponents = map[string]int{
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CAD": 2,
+	"AUD": 2,
+	"CHF": 2,
+	"MXN": 2,
+	"JPY": 0,
+}
+
+// Amount is an exact monetary amount held as an integer number of hundredths
+// (cents for USD). It is never converted through float64.
+//
+// Rounding rules: input with more precision than a cent is rejected rather
+// than rounded, sums are exact, and derived values such as averages are
+// rounded half-to-even to the cent.
+type Amount int64
+
+// parseAmount parses a plain decimal string such as "1234.5" or "-0.01". It
+// rejects exponents, thousands separators, more than two decimal places and
+// amounts beyond maxAmount either way.
+func parseAmount(s string) (Amount, error) {
+	a, err := parseDecimal(s, false)
+	if err != nil {
+		return 0, err
+	}
+	if a > maxAmount || a < -maxAmount {
+		return 0, fmt.Errorf("amount %q exceeds %s", s, maxAmount)
+	}
+	return a, nil
+}
+
+// parseAmountRounded parses a decimal string of any precision, rounding
+// half-to-even to the cent. It is used for database aggregates such as AVG.
+func parseAmountRounded(s string) (Amount, error) {
+	return parseDecimal(s, true)
+}
+
+func parseDecimal(s string, round bool) (Amount, error) {
+	raw := s
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("invalid amount %q", raw)
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	intPart, fracPart := s, ""
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		intPart, fracPart = s[:dot], s[dot+1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return 0, fmt.Errorf("invalid amount %q", raw)
+	}
+	if !isDigits(intPart) || !isDigits(fracPart) {
+		return 0, fmt.Errorf("invalid amount %q", raw)
+	}
+
+	var rest string
+	if len(fracPart) > amountScale {
+		fracPart, rest = fracPart[:amountScale], fracPart[amountScale:]
+		if !round && strings.Trim(rest, "0") != "" {
+			return 0, fmt.Errorf("amount %q has more than %d decimal places", raw, amountScale)
+		}
+	}
+	for len(fracPart) < amountScale {
+		fracPart += "0"
+	}
+
+	digits := strings.TrimLeft(intPart+fracPart, "0")
+	if digits == "" {
+		digits = "0"
+	}
+	units, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("amount %q is out of range", raw)
+	}
+
+	if round && rest != "" && rest[0] >= '5' {
+		// Exactly half rounds to the even neighbour; anything above rounds up.
+		exactlyHalf := rest[0] == '5' && strings.Trim(rest[1:], "0") == ""
+		if !exactlyHalf || units%2 == 1 {
+			if units == math.MaxInt64 {
+				return 0, fmt.Errorf("amount %q is out of range", raw)
+			}
+			units++
+		}
+	}
+
+	if negative {
+		units = -units
+	}
+	return Amount(units), nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount with exactly two decimal places.
+func (a Amount) String() string {
+	units := int64(a)
+	sign := ""
+	if units < 0 {
+		sign = "-"
+	}
+	// Work in uint64 so math.MinInt64 negates safely.
+	abs := uint64(units)
+	if units < 0 {
+		abs = uint64(-(units + 1)) + 1
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, abs/amountUnit, abs%amountUnit)
+}
+
+// MarshalJSON emits the amount as a decimal string to avoid float rounding in
+// clients.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON accepts either a decimal string ("10.50") or a bare JSON
+// number (10.50). Numbers are parsed from their literal text, never via
+// float64.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if strings.HasPrefix(text, `"`) {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+	}
+	parsed, err := parseAmount(text)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner for NUMERIC columns. Sums of a column may
+// exceed maxAmount, so only the int64 range is enforced.
+func (a *Amount) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		parsed, err := parseDecimal(string(v), false)
+		if err != nil {
+			return err
+		}
+		*a = parsed
+	case string:
+		parsed, err := parseDecimal(v, false)
+		if err != nil {
+			return err
+		}
+		*a = parsed
+	case int64:
+		if v > math.MaxInt64/amountUnit || v < math.MinInt64/amountUnit {
+			return fmt.Errorf("amount %d is out of range", v)
+		}
+		*a = Amount(v * amountUnit)
+	case nil:
+		*a = 0
+	default:
+		return fmt.Errorf("cannot scan %T into Amount", src)
+	}
+	return nil
+}
+
+// Value implements driver.Valuer, sending the exact decimal text to NUMERIC.
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+// Add returns a+b, failing rather than wrapping on overflow.
+func (a Amount) Add(b Amount) (Amount, error) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, fmt.Errorf("amount overflow adding %s and %s", a, b)
+	}
+	return sum, nil
+}
+
+// DivRound divides the amount by n, rounding half-to-even to the cent.
+func (a Amount) DivRound(n int64) Amount {
+	if n == 0 {
+		return 0
+	}
+	q, r := int64(a)/n, int64(a)%n
+	if r == 0 {
+		return Amount(q)
+	}
+	absR, absN := r, n
+	if absR < 0 {
+		absR = -absR
+	}
+	if absN < 0 {
+		absN = -absN
+	}
+	// Direction of the true quotient's fractional part.
+	step := int64(1)
+	if (a < 0) != (n < 0) {
+		step = -1
+	}
+	switch {
+	case 2*absR > absN:
+		q += step
+	case 2*absR == absN && q%2 != 0:
+		q += step
+	}
+	return Amount(q)
+}
+
+// sumAmounts totals amounts exactly, reporting overflow.
+func sumAmounts(amounts []Amount) (Amount, error) {
+	var total Amount
+	for _, a := range amounts {
+		var err error
+		total, err = total.Add(a)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// validateCurrency checks that code is a supported ISO 4217 currency.
+func validateCurrency(code string) error {
+	if code == "" {
+		return fmt.Errorf("currency is required")
+	}
+	if _, ok := currencyExponents[code]; !ok {
+		return fmt.Errorf("unsupported currency %q", code)
+	}
+	return nil
+}
+
+// fitsCurrency reports whether the amount uses no more minor-unit digits than
+// the currency allows (e.g. whole yen only).
+func (a Amount) fitsCurrency(code string) bool {
+	exp, ok := currencyExponents[code]
+	if !ok {
+		return false
+	}
+	step := int64(1)
+	for i := exp; i < amountScale; i++ {
+		step *= 10
+	}
+	return int64(a)%step == 0
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PaymentStatus is the state of a payment transaction.
+type PaymentStatus string
+
+const (
+	paymentPending           PaymentStatus = "pending"
+	paymentCaptured          PaymentStatus = "captured"
+	paymentFailed            PaymentStatus = "failed"
+	paymentRefunded          PaymentStatus = "refunded"
+	paymentPartiallyRefunded PaymentStatus = "partially_refunded"
+)
+
+// paymentTransitions is the transaction state machine. Failed and fully
+// refunded transactions are terminal.
+var paymentTransitions = map[PaymentStatus][]PaymentStatus{
+	paymentPending:           {paymentCaptured, paymentFailed},
+	paymentCaptured:          {paymentPartiallyRefunded, paymentRefunded},
+	paymentPartiallyRefunded: {paymentPartiallyRefunded, paymentRefunded},
+	paymentFailed:            {},
+	paymentRefunded:          {},
+}
+
+// Payment purposes.
+const (
+	purposeDonation    = "donation"
+	purposePremiumTier = "premium_tier"
+)
+
+var (
+	errUnknownTransaction  = errors.New("unknown transaction")
+	errIdempotencyConflict = errors.New("idempotency key was already used for a different request")
+	errInvalidTransition   = errors.New("invalid payment state transition")
+	errConcurrentUpdate    = errors.New("transaction was modified concurrently")
+	errRefundExceedsAmount = errors.New("refund exceeds the refundable amount")
+	errDuplicateKey        = errors.New("idempotency key already exists")
+	errInvalidPayment      = errors.New("invalid payment request")
+	errProcessor           = errors.New("payment processor unavailable")
+)
+
+// Transaction is one payment and its refund progress.
+type Transaction struct {
+	ID             string        `json:"id"`
+	UserID         string        `json:"user_id"`
+	Purpose        string        `json:"purpose"`
+	RecipientID    string        `json:"recipient_id,omitempty"`
+	Amount         Amount        `json:"amount"`
+	Currency       string        `json:"currency"`
+	PaymentMethod  string        `json:"-"`
+	RefundedAmount Amount        `json:"refunded_amount"`
+	Status         PaymentStatus `json:"status"`
+	ProcessorRef   string        `json:"processor_ref,omitempty"`
+	FailureReason  string        `json:"failure_reason,omitempty"`
+	IdempotencyKey string        `json:"-"`
+	Version        int           `json:"-"`
+	CreatedAt      time.Time     `json:"created_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+}
+
+// Refund is one (possibly partial) refund of a captured transaction.
+type Refund struct {
+	ID             string    `json:"id"`
+	TransactionID  string    `json:"transaction_id"`
+	Amount         Amount    `json:"amount"`
+	Reason         string    `json:"reason,omitempty"`
+	ProcessorRef   string    `json:"processor_ref,omitempty"`
+	IdempotencyKey string    `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// PaymentRequest asks to charge a user.
+type PaymentRequest struct {
+	UserID         string `json:"user_id"`
+	Amount         Amount `json:"amount"`
+	Currency       string `json:"currency"`
+	Purpose        string `json:"purpose"`
+	RecipientID    string `json:"recipient_id,omitempty"`
+	PaymentMethod  string `json:"payment_method"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// RefundRequest asks to refund part or all of a transaction. A zero Amount
+// refunds whatever remains.
+type RefundRequest struct {
+	TransactionID  string `json:"transaction_id"`
+	Amount         Amount `json:"amount,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// PaymentEvent is a status callback from the processor.
+type PaymentEvent struct {
+	EventID      string        `json:"event_id"`
+	ProcessorRef string        `json:"processor_ref"`
+	RefundRef    string        `json:"refund_ref,omitempty"`
+	Status       PaymentStatus `json:"status"`
+	Amount       Amount        `json:"amount,omitempty"`
+	Reason       string        `json:"reason,omitempty"`
+}
+
+// ChargeRequest is what a processor needs to take a payment.
+type ChargeRequest struct {
+	Amount         Amount
+	Currency       string
+	PaymentMethod  string
+	Description    string
+	IdempotencyKey string
+}
+
+// ProcessorResult is a processor's answer. Status is captured, failed or
+// pending (the final outcome will arrive as a PaymentEvent).
+type ProcessorResult struct {
+	Ref           string
+	Status        PaymentStatus
+	FailureReason string
+}
+
+// PaymentProcessor is the boundary to an external payment processor. The
+// idempotency key must be forwarded so retries never double charge.
+type PaymentProcessor interface {
+	Charge(ctx context.Context, req ChargeRequest) (ProcessorResult, error)
+	Refund(ctx context.Context, ref string, amount Amount, idempotencyKey string) (ProcessorResult, error)
+}
+
+// paymentStore persists transactions. updateTransaction and saveRefund must
+// only succeed if the stored Version still equals txn.Version, and then
+// increment it. saveRefund inserts the refund and saves txn atomically,
+// failing with errDuplicateKey if the refund is already recorded.
+type paymentStore interface {
+	createTransaction(ctx context.Context, txn *Transaction) error
+	getTransaction(ctx context.Context, id string) (*Transaction, error)
+	getTransactionByKey(ctx context.Context, key string) (*Transaction, error)
+	getTransactionByProcessorRef(ctx context.Context, ref string) (*Transaction, error)
+	updateTransaction(ctx context.Context, txn *Transaction) error
+	saveRefund(ctx context.Context, txn *Transaction, refund *Refund) error
+	getRefundByKey(ctx context.Context, key string) (*Refund, error)
+	recordEvent(ctx context.Context, event PaymentEvent) error
+}
+
+// PaymentService applies the transaction state machine on top of a
+// processor and a store.
+type PaymentService struct {
+	processor PaymentProcessor
+	store     paymentStore
+}
+
+func canTransitionPayment(from, to PaymentStatus) bool {
+	for _, next := range paymentTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func transitionPayment(txn *Transaction, to PaymentStatus) error {
+	if !canTransitionPayment(txn.Status, to) {
+		return fmt.Errorf("%w: %s to %s", errInvalidTransition, txn.Status, to)
+	}
+	txn.Status = to
+	return nil
+}
+
+func validatePaymentRequest(req PaymentRequest) error {
+	if req.UserID == "" {
+		return fmt.Errorf("%w: user_id is required", errInvalidPayment)
+	}
+	if err := validateCurrency(req.Currency); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidPayment, err)
+	}
+	if req.Amount <= 0 {
+		return fmt.Errorf("%w: amount must be positive", errInvalidPayment)
+	}
+	if req.Amount > maxAmount {
+		return fmt.Errorf("%w: amount must not exceed %s", errInvalidPayment, maxAmount)
+	}
+	if !req.Amount.fitsCurrency(req.Currency) {
+		return fmt.Errorf("%w: amount %s has more precision than %s allows", errInvalidPayment, req.Amount, req.Currency)
+	}
+	switch req.Purpose {
+	case purposeDonation:
+		if req.RecipientID == "" {
+			return fmt.Errorf("%w: recipient_id is required for donations", errInvalidPayment)
+		}
+	case purposePremiumTier:
+	default:
+		return fmt.Errorf("%w: purpose must be %s or %s", errInvalidPayment, purposeDonation, purposePremiumTier)
+	}
+	if req.PaymentMethod == "" {
+		return fmt.Errorf("%w: payment_method is required", errInvalidPayment)
+	}
+	if req.IdempotencyKey == "" {
+		return fmt.Errorf("%w: idempotency key is required", errInvalidPayment)
+	}
+	return nil
+}
+
+// ProcessPayment charges a user. Replaying the same idempotency key returns
+// the original transaction instead of charging again; a transaction whose
+// charge never reached the processor is retried under the same key.
+func (s *PaymentService) ProcessPayment(ctx context.Context, req PaymentRequest) (*Transaction, error) {
+	if err := validatePaymentRequest(req); err != nil {
+		return nil, err
+	}
+
+	txn, err := s.store.getTransactionByKey(ctx, req.IdempotencyKey)
+	switch {
+	case err == nil:
+		if txn.UserID != req.UserID || txn.Amount != req.Amount || txn.Currency != req.Currency ||
+			txn.Purpose != req.Purpose || txn.RecipientID != req.RecipientID || txn.PaymentMethod != req.PaymentMethod {
+			return nil, errIdempotencyConflict
+		}
+		if txn.Status != paymentPending || txn.ProcessorRef != "" {
+			return txn, nil
+		}
+	case errors.Is(err, errUnknownTransaction):
+		txn = &Transaction{
+			UserID:         req.UserID,
+			Purpose:        req.Purpose,
+			RecipientID:    req.RecipientID,
+			Amount:         req.Amount,
+			Currency:       req.Currency,
+			PaymentMethod:  req.PaymentMethod,
+			Status:         paymentPending,
+			IdempotencyKey: req.IdempotencyKey,
+		}
+		if err := s.store.createTransaction(ctx, txn); errors.Is(err, errDuplicateKey) {
+			// A concurrent request with the same key won the insert.
+			return s.ProcessPayment(ctx, req)
+		} else if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	result, err := s.processor.Charge(ctx, ChargeRequest{
+		Amount:         req.Amount,
+		Currency:       req.Currency,
+		PaymentMethod:  req.PaymentMethod,
+		Description:    req.Purpose,
+		IdempotencyKey: req.IdempotencyKey,
+	})
+	if err != nil {
+		// The outcome is unknown; leave the transaction pending so a retry
+		// with the same key or a processor callback can settle it.
+		return txn, fmt.Errorf("%w: %v", errProcessor, err)
+	}
+
+	return s.mutate(ctx, txn, func(t *Transaction) error {
+		t.ProcessorRef = result.Ref
+		if result.Status == paymentPending || t.Status == result.Status {
+			return nil
+		}
+		t.FailureReason = result.FailureReason
+		return transitionPayment(t, result.Status)
+	})
+}
+
+// Refund returns money from a captured transaction. A zero amount refunds
+// whatever remains. Replaying the same idempotency key returns the
+// transaction without refunding again.
+func (s *PaymentService) Refund(ctx context.Context, req RefundRequest) (*Transaction, error) {
+	if req.TransactionID == "" {
+		return nil, fmt.Errorf("%w: transaction_id is required", errInvalidPayment)
+	}
+	if req.IdempotencyKey == "" {
+		return nil, fmt.Errorf("%w: idempotency key is required", errInvalidPayment)
+	}
+	if req.Amount < 0 {
+		return nil, fmt.Errorf("%w: refund amount must be positive", errInvalidPayment)
+	}
+
+	if existing, err := s.store.getRefundByKey(ctx, req.IdempotencyKey); err == nil {
+		if existing.TransactionID != req.TransactionID || (req.Amount != 0 && existing.Amount != req.Amount) {
+			return nil, errIdempotencyConflict
+		}
+		return s.store.getTransaction(ctx, req.TransactionID)
+	} else if !errors.Is(err, errUnknownTransaction) {
+		return nil, err
+	}
+
+	txn, err := s.store.getTransaction(ctx, req.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if txn.Status != paymentCaptured && txn.Status != paymentPartiallyRefunded {
+		return nil, fmt.Errorf("%w: cannot refund a %s transaction", errInvalidTransition, txn.Status)
+	}
+	amount := req.Amount
+	if amount == 0 {
+		amount = txn.Amount - txn.RefundedAmount
+	}
+	if err := checkRefundable(txn, amount); err != nil {
+		return nil, err
+	}
+
+	// The processor is the authority on how much can still be refunded, so
+	// a refund it accepts is always recorded, even if another refund landed
+	// locally in the meantime.
+	result, err := s.processor.Refund(ctx, txn.ProcessorRef, amount, req.IdempotencyKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errProcessor, err)
+	}
+	if result.Status == paymentFailed {
+		return nil, fmt.Errorf("%w: refund declined: %s", errInvalidTransition, result.FailureReason)
+	}
+
+	return s.recordRefund(ctx, txn, &Refund{
+		TransactionID:  txn.ID,
+		Amount:         amount,
+		Reason:         req.Reason,
+		ProcessorRef:   result.Ref,
+		IdempotencyKey: req.IdempotencyKey,
+	})
+}
+
+func checkRefundable(txn *Transaction, amount Amount) error {
+	remaining := txn.Amount - txn.RefundedAmount
+	if amount <= 0 || amount > remaining {
+		return fmt.Errorf("%w: %s requested, %s refundable", errRefundExceedsAmount, amount, remaining)
+	}
+	if !amount.fitsCurrency(txn.Currency) {
+		return fmt.Errorf("%w: amount %s has more precision than %s allows", errInvalidPayment, amount, txn.Currency)
+	}
+	return nil
+}
+
+// applyRefund counts a refund the processor has accepted. The remaining
+// amount is not checked again: the money has already been returned.
+func applyRefund(txn *Transaction, amount Amount) error {
+	txn.RefundedAmount += amount
+	if txn.RefundedAmount == txn.Amount {
+		return transitionPayment(txn, paymentRefunded)
+	}
+	return transitionPayment(txn, paymentPartiallyRefunded)
+}
+
+// mutate applies change to txn and saves it, reloading and reapplying when
+// another writer got there first.
+func (s *PaymentService) mutate(ctx context.Context, txn *Transaction, change func(*Transaction) error) (*Transaction, error) {
+	const maxAttempts = 5
+	for attempt := 1; ; attempt++ {
+		if err := change(txn); err != nil {
+			return nil, err
+		}
+		err := s.store.updateTransaction(ctx, txn)
+		if err == nil || !errors.Is(err, errConcurrentUpdate) || attempt == maxAttempts {
+			if err != nil {
+				return nil, err
+			}
+			return txn, nil
+		}
+		if txn, err = s.store.getTransaction(ctx, txn.ID); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// recordRefund saves an accepted refund together with its effect on txn, in
+// one write, reloading txn and reapplying when another writer got there
+// first. A refund already recorded leaves txn unchanged.
+func (s *PaymentService) recordRefund(ctx context.Context, txn *Transaction, refund *Refund) (*Transaction, error) {
+	const maxAttempts = 5
+	for attempt := 1; ; attempt++ {
+		updated := *txn
+		if err := applyRefund(&updated, refund.Amount); err != nil {
+			return nil, err
+		}
+		err := s.store.saveRefund(ctx, &updated, refund)
+		switch {
+		case err == nil:
+			return &updated, nil
+		case errors.Is(err, errDuplicateKey):
+			return s.store.getTransaction(ctx, txn.ID)
+		case !errors.Is(err, errConcurrentUpdate) || attempt == maxAttempts:
+			return nil, err
+		}
+		if txn, err = s.store.getTransaction(ctx, txn.ID); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// HandleEvent applies a processor status callback and logs it. Replayed
+// events and ones the state machine rejects (late or out of order) are
+// acknowledged without changing anything. Refund events carry the
+// processor's refund reference so refunds made through Refund are not
+// counted twice.
+func (s *PaymentService) HandleEvent(ctx context.Context, event PaymentEvent) (*Transaction, error) {
+	if event.EventID == "" || event.ProcessorRef == "" {
+		return nil, fmt.Errorf("%w: event_id and processor_ref are required", errInvalidPayment)
+	}
+	switch event.Status {
+	case paymentCaptured, paymentFailed:
+	case paymentRefunded, paymentPartiallyRefunded:
+		if event.RefundRef == "" {
+			return nil, fmt.Errorf("%w: refund_ref is required for refund events", errInvalidPayment)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported event status %q", errInvalidPayment, event.Status)
+	}
+
+	txn, err := s.store.getTransactionByProcessorRef(ctx, event.ProcessorRef)
+	if err != nil {
+		return nil, err
+	}
+	if txn, err = s.applyEvent(ctx, txn, event); err != nil {
+		return nil, err
+	}
+	if err := s.store.recordEvent(ctx, event); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func (s *PaymentService) applyEvent(ctx context.Context, txn *Transaction, event PaymentEvent) (*Transaction, error) {
+	if event.Status == paymentCaptured || event.Status == paymentFailed {
+		if !canTransitionPayment(txn.Status, event.Status) {
+			return txn, nil
+		}
+		return s.mutate(ctx, txn, func(t *Transaction) error {
+			if t.Status == event.Status {
+				return nil
+			}
+			t.FailureReason = event.Reason
+			return transitionPayment(t, event.Status)
+		})
+	}
+
+	amount := event.Amount
+	if amount == 0 {
+		amount = txn.Amount - txn.RefundedAmount
+	}
+	if !canTransitionPayment(txn.Status, paymentRefunded) || checkRefundable(txn, amount) != nil {
+		return txn, nil
+	}
+	return s.recordRefund(ctx, txn, &Refund{
+		TransactionID:  txn.ID,
+		Amount:         amount,
+		Reason:         event.Reason,
+		ProcessorRef:   event.RefundRef,
+		IdempotencyKey: "processor:" + event.RefundRef,
+	})
+}
+
+// fakeProcessor is a local, deterministic processor for development and
+// tests. Payment method "tok_decline" is declined, "tok_pending" stays
+// pending until a callback arrives and "tok_error" fails to reach the
+// processor; anything else is captured.
+type fakeProcessor struct {
+	mu      sync.Mutex
+	seq     int
+	byKey   map[string]ProcessorResult
+	charges map[string]Amount
+}
+
+func newFakeProcessor() *fakeProcessor {
+	return &fakeProcessor{byKey: map[string]ProcessorResult{}, charges: map[string]Amount{}}
+}
+
+func (f *fakeProcessor) Charge(ctx context.Context, req ChargeRequest) (ProcessorResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if result, ok := f.byKey[req.IdempotencyKey]; ok {
+		return result, nil
+	}
+	if req.PaymentMethod == "tok_error" {
+		return ProcessorResult{}, fmt.Errorf("processor unreachable")
+	}
+
+	f.seq++
+	result := ProcessorResult{Ref: fmt.Sprintf("fake_ch_%d", f.seq), Status: paymentCaptured}
+	switch {
+	case req.PaymentMethod == "tok_decline":
+		result.Status, result.FailureReason = paymentFailed, "card_declined"
+	case req.PaymentMethod == "tok_pending":
+		result.Status = paymentPending
+	}
+	f.byKey[req.IdempotencyKey] = result
+	f.charges[result.Ref] = req.Amount
+	return result, nil
+}
+
+func (f *fakeProcessor) Refund(ctx context.Context, ref string, amount Amount, idempotencyKey string) (ProcessorResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if result, ok := f.byKey[idempotencyKey]; ok {
+		return result, nil
+	}
+	charged, ok := f.charges[ref]
+	if !ok {
+		return ProcessorResult{Status: paymentFailed, FailureReason: "no_such_charge"}, nil
+	}
+	if amount > charged {
+		return ProcessorResult{Status: paymentFailed, FailureReason: "amount_too_large"}, nil
+	}
+
+	f.seq++
+	f.charges[ref] = charged - amount
+	result := ProcessorResult{Ref: fmt.Sprintf("fake_re_%d", f.seq), Status: paymentRefunded}
+	f.byKey[idempotencyKey] = result
+	return result, nil
+}
+
+// newPaymentProcessor returns the processor named by PAYMENT_PROCESSOR. Only
+// the local fake exists today. There is no default: a deploy that forgot the
+// setting must not capture payments without charging anyone.
+func newPaymentProcessor(name string) (PaymentProcessor, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return nil, fmt.Errorf("PAYMENT_PROCESSOR is not set")
+	case "fake":
+		return newFakeProcessor(), nil
+	default:
+		return nil, fmt.Errorf("unknown payment processor %q", name)
+	}
+}
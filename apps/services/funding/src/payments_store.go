@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// maxWebhookBody bounds the size of a processor callback.
+const maxWebhookBody = 64 << 10
+
+const paymentsSchema = `
+	CREATE TABLE IF NOT EXISTS funding_payments (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id VARCHAR(255) NOT NULL,
+		purpose VARCHAR(20) NOT NULL,
+		recipient_id VARCHAR(255),
+		amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+		currency CHAR(3) NOT NULL,
+		payment_method VARCHAR(255) NOT NULL DEFAULT '',
+		refunded_amount NUMERIC(15,2) NOT NULL DEFAULT 0 CHECK (refunded_amount >= 0 AND refunded_amount <= amount),
+		status VARCHAR(20) NOT NULL,
+		processor_ref VARCHAR(255) UNIQUE,
+		failure_reason TEXT,
+		idempotency_key VARCHAR(255) NOT NULL UNIQUE,
+		version INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP DEFAULT now() NOT NULL,
+		updated_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	ALTER TABLE funding_payments ADD COLUMN IF NOT EXISTS payment_method VARCHAR(255) NOT NULL DEFAULT '';
+
+	CREATE INDEX IF NOT EXISTS idx_funding_payments_user ON funding_payments(user_id, created_at DESC);
+
+	CREATE TABLE IF NOT EXISTS funding_payment_refunds (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		payment_id UUID NOT NULL REFERENCES funding_payments(id),
+		amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+		reason TEXT,
+		processor_ref VARCHAR(255) NOT NULL UNIQUE,
+		idempotency_key VARCHAR(255) NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_payment_refunds_payment ON funding_payment_refunds(payment_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS funding_payment_events (
+		event_id VARCHAR(255) PRIMARY KEY,
+		processor_ref VARCHAR(255) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		payload JSONB NOT NULL,
+		received_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+	`
+
+// payments is the service behind the payment endpoints, set up in main.
+var payments *PaymentService
+
+// sqlPaymentStore keeps transactions in Postgres.
+type sqlPaymentStore struct {
+	db *sql.DB
+}
+
+const paymentColumns = `id, user_id, purpose, COALESCE(recipient_id, ''), amount, currency, payment_method, refunded_amount, status,
+	COALESCE(processor_ref, ''), COALESCE(failure_reason, ''), idempotency_key, version, created_at, updated_at`
+
+func scanTransaction(row interface{ Scan(...interface{}) error }) (*Transaction, error) {
+	var txn Transaction
+	err := row.Scan(&txn.ID, &txn.UserID, &txn.Purpose, &txn.RecipientID, &txn.Amount, &txn.Currency,
+		&txn.PaymentMethod, &txn.RefundedAmount, &txn.Status, &txn.ProcessorRef, &txn.FailureReason, &txn.IdempotencyKey,
+		&txn.Version, &txn.CreatedAt, &txn.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownTransaction
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &txn, nil
+}
+
+func (s sqlPaymentStore) createTransaction(ctx context.Context, txn *Transaction) error {
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO funding_payments (user_id, purpose, recipient_id, amount, currency, payment_method, status, idempotency_key)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8)
+		ON CONFLICT (idempotency_key) DO NOTHING
+		RETURNING id, version, created_at, updated_at
+	`, txn.UserID, txn.Purpose, txn.RecipientID, txn.Amount, txn.Currency, txn.PaymentMethod, txn.Status, txn.IdempotencyKey).
+		Scan(&txn.ID, &txn.Version, &txn.CreatedAt, &txn.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return errDuplicateKey
+	}
+	return err
+}
+
+func (s sqlPaymentStore) getTransaction(ctx context.Context, id string) (*Transaction, error) {
+	if !isUUID(id) {
+		return nil, errUnknownTransaction
+	}
+	return scanTransaction(s.db.QueryRowContext(ctx, "SELECT "+paymentColumns+" FROM funding_payments WHERE id = $1", id))
+}
+
+func (s sqlPaymentStore) getTransactionByKey(ctx context.Context, key string) (*Transaction, error) {
+	return scanTransaction(s.db.QueryRowContext(ctx, "SELECT "+paymentColumns+" FROM funding_payments WHERE idempotency_key = $1", key))
+}
+
+func (s sqlPaymentStore) getTransactionByProcessorRef(ctx context.Context, ref string) (*Transaction, error) {
+	return scanTransaction(s.db.QueryRowContext(ctx, "SELECT "+paymentColumns+" FROM funding_payments WHERE processor_ref = $1", ref))
+}
+
+func (s sqlPaymentStore) updateTransaction(ctx context.Context, txn *Transaction) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := saveTransaction(ctx, tx, txn); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveTransaction saves txn and, in the same database transaction, posts
+// journal entries for a new capture or for newly refunded money.
+func saveTransaction(ctx context.Context, tx *sql.Tx, txn *Transaction) error {
+	var prevStatus PaymentStatus
+	var prevRefunded Amount
+	err := tx.QueryRowContext(ctx, `
+		SELECT status, refunded_amount FROM funding_payments WHERE id = $1 AND version = $2 FOR UPDATE
+	`, txn.ID, txn.Version).Scan(&prevStatus, &prevRefunded)
+	if err == sql.ErrNoRows {
+		return errConcurrentUpdate
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE funding_payments SET
+			status = $2,
+			refunded_amount = $3,
+			processor_ref = NULLIF($4, ''),
+			failure_reason = NULLIF($5, ''),
+			version = version + 1,
+			updated_at = now()
+		WHERE id = $1
+		RETURNING version, updated_at
+	`, txn.ID, txn.Status, txn.RefundedAmount, txn.ProcessorRef, txn.FailureReason).
+		Scan(&txn.Version, &txn.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	var entries []JournalEntry
+	if prevStatus == paymentPending && txn.Status != paymentPending && txn.Status != paymentFailed {
+		entries = append(entries, paymentCaptureEntry(txn, txn.UpdatedAt))
+	}
+	if delta := txn.RefundedAmount - prevRefunded; delta > 0 {
+		entries = append(entries, paymentRefundEntry(txn, delta, txn.UpdatedAt))
+	}
+	for i := range entries {
+		if _, err := postEntry(ctx, tx, &entries[i]); err != nil {
+			return fmt.Errorf("posting payment journal entry: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s sqlPaymentStore) saveRefund(ctx context.Context, txn *Transaction, refund *Refund) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO funding_payment_refunds (payment_id, amount, reason, processor_ref, idempotency_key)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+		ON CONFLICT DO NOTHING
+		RETURNING id, created_at
+	`, refund.TransactionID, refund.Amount, refund.Reason, refund.ProcessorRef, refund.IdempotencyKey).
+		Scan(&refund.ID, &refund.CreatedAt)
+	if err == sql.ErrNoRows {
+		return errDuplicateKey
+	}
+	if err != nil {
+		return err
+	}
+	if err := saveTransaction(ctx, tx, txn); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s sqlPaymentStore) getRefundByKey(ctx context.Context, key string) (*Refund, error) {
+	var refund Refund
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, payment_id, amount, COALESCE(reason, ''), processor_ref, idempotency_key, created_at
+		FROM funding_payment_refunds WHERE idempotency_key = $1
+	`, key).Scan(&refund.ID, &refund.TransactionID, &refund.Amount, &refund.Reason, &refund.ProcessorRef,
+		&refund.IdempotencyKey, &refund.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownTransaction
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+func (s sqlPaymentStore) recordEvent(ctx context.Context, event PaymentEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO funding_payment_events (event_id, processor_ref, status, payload)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (event_id) DO NOTHING
+	`, event.EventID, event.ProcessorRef, event.Status, string(payload))
+	return err
+}
+
+// verifyWebhookSignature checks the hex HMAC-SHA256 of the body against the
+// shared secret.
+func verifyWebhookSignature(secret string, body []byte, signature string) bool {
+	want, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// writePaymentError maps service errors onto HTTP statuses.
+func writePaymentError(w http.ResponseWriter, err error, txn *Transaction) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errInvalidPayment):
+		status = http.StatusBadRequest
+	case errors.Is(err, errUnknownTransaction):
+		status = http.StatusNotFound
+	case errors.Is(err, errIdempotencyConflict), errors.Is(err, errInvalidTransition),
+		errors.Is(err, errRefundExceedsAmount), errors.Is(err, errConcurrentUpdate):
+		status = http.StatusConflict
+	case errors.Is(err, errProcessor):
+		status = http.StatusBadGateway
+	}
+	if status == http.StatusInternalServerError || status == http.StatusBadGateway {
+		log.Printf("Payment request failed: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if txn != nil {
+		// The charge never settled; returning the pending transaction lets
+		// the client retry with the same idempotency key.
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "transaction": txn})
+		return
+	}
+	if status == http.StatusInternalServerError {
+		err = errors.New("Failed to process payment")
+	}
+	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
+
+func handlePayments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		txn, err := payments.store.getTransaction(r.Context(), r.URL.Query().Get("id"))
+		if err != nil {
+			writePaymentError(w, err, nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(txn)
+	case http.MethodPost:
+		var req PaymentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+			return
+		}
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			req.IdempotencyKey = key
+		}
+
+		txn, err := payments.ProcessPayment(r.Context(), req)
+		if err != nil {
+			writePaymentError(w, err, txn)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if txn.Status == paymentFailed {
+			w.WriteHeader(http.StatusPaymentRequired)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(txn)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+	}
+}
+
+func handleRefundPayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		req.IdempotencyKey = key
+	}
+
+	txn, err := payments.Refund(r.Context(), req)
+	if err != nil {
+		writePaymentError(w, err, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(txn)
+}
+
+// handlePaymentWebhook receives status callbacks from the processor. Bodies
+// must be signed with PAYMENT_WEBHOOK_SECRET in the X-Payment-Signature
+// header.
+func handlePaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if secret == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Payment webhooks are not configured"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if !verifyWebhookSignature(secret, body, r.Header.Get("X-Payment-Signature")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid signature"})
+		return
+	}
+
+	var event PaymentEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	txn, err := payments.HandleEvent(r.Context(), event)
+	if err != nil {
+		log.Printf("Payment event %s not applied: %v", event.EventID, err)
+		writePaymentError(w, err, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(txn)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// memPaymentStore is an in-memory paymentStore for tests.
+type memPaymentStore struct {
+	mu      sync.Mutex
+	seq     int
+	txns    map[string]Transaction
+	refunds []Refund
+	events  []PaymentEvent
+}
+
+func newMemPaymentStore() *memPaymentStore {
+	return &memPaymentStore{txns: map[string]Transaction{}}
+}
+
+func (m *memPaymentStore) createTransaction(ctx context.Context, txn *Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.txns {
+		if existing.IdempotencyKey == txn.IdempotencyKey {
+			return errDuplicateKey
+		}
+	}
+	m.seq++
+	txn.ID = fmt.Sprintf("pay-%d", m.seq)
+	txn.Version = 1
+	m.txns[txn.ID] = *txn
+	return nil
+}
+
+func (m *memPaymentStore) find(match func(Transaction) bool) (*Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, txn := range m.txns {
+		if match(txn) {
+			return &txn, nil
+		}
+	}
+	return nil, errUnknownTransaction
+}
+
+func (m *memPaymentStore) getTransaction(ctx context.Context, id string) (*Transaction, error) {
+	return m.find(func(t Transaction) bool { return t.ID == id })
+}
+
+func (m *memPaymentStore) getTransactionByKey(ctx context.Context, key string) (*Transaction, error) {
+	return m.find(func(t Transaction) bool { return t.IdempotencyKey == key })
+}
+
+func (m *memPaymentStore) getTransactionByProcessorRef(ctx context.Context, ref string) (*Transaction, error) {
+	return m.find(func(t Transaction) bool { return t.ProcessorRef == ref })
+}
+
+func (m *memPaymentStore) updateTransaction(ctx context.Context, txn *Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.txns[txn.ID].Version != txn.Version {
+		return errConcurrentUpdate
+	}
+	txn.Version++
+	m.txns[txn.ID] = *txn
+	return nil
+}
+
+func (m *memPaymentStore) saveRefund(ctx context.Context, txn *Transaction, refund *Refund) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.refunds {
+		if existing.IdempotencyKey == refund.IdempotencyKey || existing.ProcessorRef == refund.ProcessorRef {
+			return errDuplicateKey
+		}
+	}
+	if m.txns[txn.ID].Version != txn.Version {
+		return errConcurrentUpdate
+	}
+	refund.ID = fmt.Sprintf("refund-%d", len(m.refunds)+1)
+	m.refunds = append(m.refunds, *refund)
+	txn.Version++
+	m.txns[txn.ID] = *txn
+	return nil
+}
+
+func (m *memPaymentStore) getRefundByKey(ctx context.Context, key string) (*Refund, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, refund := range m.refunds {
+		if refund.IdempotencyKey == key {
+			return &refund, nil
+		}
+	}
+	return nil, errUnknownTransaction
+}
+
+func (m *memPaymentStore) recordEvent(ctx context.Context, event PaymentEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+	return nil
+}
+
+// rename gives a stored transaction a fixed ID.
+func (m *memPaymentStore) rename(from, to string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txn := m.txns[from]
+	delete(m.txns, from)
+	txn.ID = to
+	m.txns[to] = txn
+}
+
+func newTestPaymentService() (*PaymentService, *memPaymentStore) {
+	store := newMemPaymentStore()
+	return &PaymentService{processor: newFakeProcessor(), store: store}, store
+}
+
+func testPaymentRequest(key, method string) PaymentRequest {
+	return PaymentRequest{
+		UserID:         "user123",
+		Amount:         2500,
+		Currency:       "USD",
+		Purpose:        purposeDonation,
+		RecipientID:    "cand-1",
+		PaymentMethod:  method,
+		IdempotencyKey: key,
+	}
+}
+
+// TestPaymentTransitions tests the transaction state machine
+func TestPaymentTransitions(t *testing.T) {
+	tests := []struct {
+		from, to PaymentStatus
+		want     bool
+	}{
+		{paymentPending, paymentCaptured, true},
+		{paymentPending, paymentFailed, true},
+		{paymentPending, paymentRefunded, false},
+		{paymentCaptured, paymentPartiallyRefunded, true},
+		{paymentCaptured, paymentRefunded, true},
+		{paymentCaptured, paymentFailed, false},
+		{paymentPartiallyRefunded, paymentPartiallyRefunded, true},
+		{paymentPartiallyRefunded, paymentRefunded, true},
+		{paymentPartiallyRefunded, paymentCaptured, false},
+		{paymentFailed, paymentCaptured, false},
+		{paymentRefunded, paymentPartiallyRefunded, false},
+	}
+
+	for _, tt := range tests {
+		if got := canTransitionPayment(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransitionPayment(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+// TestPaymentIdempotency tests that retried requests never charge twice
+func TestPaymentIdempotency(t *testing.T) {
+	svc, store := newTestPaymentService()
+	ctx := context.Background()
+
+	first, err := svc.ProcessPayment(ctx, testPaymentRequest("k1", "tok_visa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := svc.ProcessPayment(ctx, testPaymentRequest("k1", "tok_visa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID || again.ProcessorRef != first.ProcessorRef || len(store.txns) != 1 {
+		t.Errorf("replay created %+v, want the original %+v", again, first)
+	}
+
+	for name, change := range map[string]func(*PaymentRequest){
+		"amount":         func(r *PaymentRequest) { r.Amount = 9900 },
+		"recipient":      func(r *PaymentRequest) { r.RecipientID = "cand-2" },
+		"payment method": func(r *PaymentRequest) { r.PaymentMethod = "tok_mastercard" },
+	} {
+		changed := testPaymentRequest("k1", "tok_visa")
+		change(&changed)
+		if _, err := svc.ProcessPayment(ctx, changed); !errors.Is(err, errIdempotencyConflict) {
+			t.Errorf("reusing a key for a different %s: err = %v, want errIdempotencyConflict", name, err)
+		}
+	}
+
+	// A charge that never reached the processor stays pending and is retried
+	// under the same key.
+	pending, err := svc.ProcessPayment(ctx, testPaymentRequest("k2", "tok_error"))
+	if !errors.Is(err, errProcessor) || pending == nil || pending.Status != paymentPending {
+		t.Fatalf("unreachable processor: txn = %+v, err = %v", pending, err)
+	}
+	fake := svc.processor
+	svc.processor = unreachableProcessor{}
+	stuck, err := svc.ProcessPayment(ctx, testPaymentRequest("k4", "tok_visa"))
+	if !errors.Is(err, errProcessor) || stuck == nil {
+		t.Fatalf("unreachable processor: txn = %+v, err = %v", stuck, err)
+	}
+	svc.processor = fake
+	retried, err := svc.ProcessPayment(ctx, testPaymentRequest("k4", "tok_visa"))
+	if err != nil || retried.ID != stuck.ID || retried.Status != paymentCaptured {
+		t.Errorf("retry = %+v (err %v), want %s captured", retried, err, stuck.ID)
+	}
+
+	declined, err := svc.ProcessPayment(ctx, testPaymentRequest("k3", "tok_decline"))
+	if err != nil || declined.Status != paymentFailed || declined.FailureReason != "card_declined" {
+		t.Errorf("declined card = %+v (err %v), want failed", declined, err)
+	}
+}
+
+// TestPartialRefunds tests refund bookkeeping and limits
+func TestPartialRefunds(t *testing.T) {
+	svc, store := newTestPaymentService()
+	ctx := context.Background()
+	txn, err := svc.ProcessPayment(ctx, testPaymentRequest("charge", "tok_visa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := svc.Refund(ctx, RefundRequest{TransactionID: txn.ID, Amount: 1000, IdempotencyKey: "r1"})
+	if err != nil || got.Status != paymentPartiallyRefunded || got.RefundedAmount != 1000 {
+		t.Fatalf("first refund = %+v (err %v), want partially refunded 10.00", got, err)
+	}
+	if got, err = svc.Refund(ctx, RefundRequest{TransactionID: txn.ID, Amount: 1000, IdempotencyKey: "r1"}); err != nil || got.RefundedAmount != 1000 {
+		t.Errorf("replayed refund = %+v (err %v), want no change", got, err)
+	}
+	if _, err := svc.Refund(ctx, RefundRequest{TransactionID: txn.ID, Amount: 2000, IdempotencyKey: "r2"}); !errors.Is(err, errRefundExceedsAmount) {
+		t.Errorf("over-refund: err = %v, want errRefundExceedsAmount", err)
+	}
+	got, err = svc.Refund(ctx, RefundRequest{TransactionID: txn.ID, IdempotencyKey: "r3"})
+	if err != nil || got.Status != paymentRefunded || got.RefundedAmount != 2500 {
+		t.Fatalf("remaining refund = %+v (err %v), want fully refunded", got, err)
+	}
+	if _, err := svc.Refund(ctx, RefundRequest{TransactionID: txn.ID, Amount: 1, IdempotencyKey: "r4"}); !errors.Is(err, errInvalidTransition) {
+		t.Errorf("refunding a refunded transaction: err = %v, want errInvalidTransition", err)
+	}
+	if len(store.refunds) != 2 {
+		t.Errorf("recorded %d refunds, want 2", len(store.refunds))
+	}
+
+	declined, _ := svc.ProcessPayment(ctx, testPaymentRequest("declined", "tok_decline"))
+	if _, err := svc.Refund(ctx, RefundRequest{TransactionID: declined.ID, IdempotencyKey: "r5"}); !errors.Is(err, errInvalidTransition) {
+		t.Errorf("refunding a failed payment: err = %v, want errInvalidTransition", err)
+	}
+}
+
+// unreachableProcessor fails every call as if the processor were down.
+type unreachableProcessor struct{}
+
+func (unreachableProcessor) Charge(ctx context.Context, req ChargeRequest) (ProcessorResult, error) {
+	return ProcessorResult{}, errors.New("processor unreachable")
+}
+
+func (unreachableProcessor) Refund(ctx context.Context, ref string, amount Amount, idempotencyKey string) (ProcessorResult, error) {
+	return ProcessorResult{}, errors.New("processor unreachable")
+}
+
+// racingProcessor runs race once its first refund is accepted, before the
+// refund is saved.
+type racingProcessor struct {
+	*fakeProcessor
+	race func()
+}
+
+func (p *racingProcessor) Refund(ctx context.Context, ref string, amount Amount, idempotencyKey string) (ProcessorResult, error) {
+	result, err := p.fakeProcessor.Refund(ctx, ref, amount, idempotencyKey)
+	if race := p.race; race != nil {
+		p.race = nil
+		race()
+	}
+	return result, err
+}
+
+// TestConcurrentRefunds tests that a refund saved after another one that
+// overtook it is still counted on the transaction
+func TestConcurrentRefunds(t *testing.T) {
+	processor := &racingProcessor{fakeProcessor: newFakeProcessor()}
+	store := newMemPaymentStore()
+	svc := &PaymentService{processor: processor, store: store}
+	ctx := context.Background()
+	txn, err := svc.ProcessPayment(ctx, testPaymentRequest("charge", "tok_visa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processor.race = func() {
+		if _, err := svc.Refund(ctx, RefundRequest{TransactionID: txn.ID, Amount: 500, IdempotencyKey: "second"}); err != nil {
+			t.Errorf("overtaking refund: %v", err)
+		}
+	}
+	got, err := svc.Refund(ctx, RefundRequest{TransactionID: txn.ID, Amount: 2000, IdempotencyKey: "first"})
+	if err != nil || got.RefundedAmount != 2500 || got.Status != paymentRefunded {
+		t.Fatalf("overtaken refund = %+v (err %v), want fully refunded", got, err)
+	}
+	if stored, _ := store.getTransaction(ctx, txn.ID); stored.RefundedAmount != 2500 || len(store.refunds) != 2 {
+		t.Errorf("stored %s refunded over %d refunds, want 25.00 over 2", stored.RefundedAmount, len(store.refunds))
+	}
+}
+
+// TestPaymentEvents tests processor status callbacks
+func TestPaymentEvents(t *testing.T) {
+	svc, store := newTestPaymentService()
+	ctx := context.Background()
+	txn, err := svc.ProcessPayment(ctx, testPaymentRequest("async", "tok_pending"))
+	if err != nil || txn.Status != paymentPending {
+		t.Fatalf("pending payment = %+v (err %v)", txn, err)
+	}
+
+	captured := PaymentEvent{EventID: "evt1", ProcessorRef: txn.ProcessorRef, Status: paymentCaptured}
+	if got, err := svc.HandleEvent(ctx, captured); err != nil || got.Status != paymentCaptured {
+		t.Fatalf("capture event = %+v (err %v)", got, err)
+	}
+	// A late failure after capture is acknowledged but ignored.
+	failed := PaymentEvent{EventID: "evt2", ProcessorRef: txn.ProcessorRef, Status: paymentFailed}
+	if got, err := svc.HandleEvent(ctx, failed); err != nil || got.Status != paymentCaptured {
+		t.Errorf("late failure = %+v (err %v), want still captured", got, err)
+	}
+
+	// A refund made through the API and echoed back by the processor is
+	// counted once.
+	refunded, err := svc.Refund(ctx, RefundRequest{TransactionID: txn.ID, Amount: 500, IdempotencyKey: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := PaymentEvent{EventID: "evt3", ProcessorRef: txn.ProcessorRef, RefundRef: store.refunds[0].ProcessorRef,
+		Status: paymentPartiallyRefunded, Amount: 500}
+	if got, err := svc.HandleEvent(ctx, echo); err != nil || got.RefundedAmount != refunded.RefundedAmount {
+		t.Errorf("echoed refund = %+v (err %v), want refunded amount unchanged", got, err)
+	}
+
+	// A refund issued at the processor directly is applied, once.
+	external := PaymentEvent{EventID: "evt4", ProcessorRef: txn.ProcessorRef, RefundRef: "dash_re_1", Status: paymentRefunded}
+	for i := 0; i < 2; i++ {
+		got, err := svc.HandleEvent(ctx, external)
+		if err != nil || got.Status != paymentRefunded || got.RefundedAmount != 2500 {
+			t.Errorf("external refund delivery %d = %+v (err %v), want fully refunded", i+1, got, err)
+		}
+	}
+
+	if _, err := svc.HandleEvent(ctx, PaymentEvent{EventID: "evt5", ProcessorRef: "nope", Status: paymentCaptured}); !errors.Is(err, errUnknownTransaction) {
+		t.Errorf("unknown processor ref: err = %v, want errUnknownTransaction", err)
+	}
+	if len(store.events) != 5 {
+		t.Errorf("logged %d events, want 5", len(store.events))
+	}
+}
+
+// TestWebhookSignature tests callback authentication
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"event_id":"evt1","processor_ref":"fake_ch_1","status":"captured"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if !verifyWebhookSignature("secret", body, signature) {
+		t.Error("valid signature rejected")
+	}
+	if verifyWebhookSignature("other", body, signature) {
+		t.Error("signature accepted with the wrong secret")
+	}
+	if verifyWebhookSignature("secret", append(body, ' '), signature) {
+		t.Error("signature accepted for a modified body")
+	}
+	if verifyWebhookSignature("secret", body, "not-hex") {
+		t.Error("malformed signature accepted")
+	}
+}
+
+// TestNewPaymentProcessor tests that the fake is only used when asked for
+func TestNewPaymentProcessor(t *testing.T) {
+	if _, err := newPaymentProcessor(""); err == nil {
+		t.Error("an unset PAYMENT_PROCESSOR should fail")
+	}
+	if _, err := newPaymentProcessor("stripe"); err == nil {
+		t.Error("an unknown processor should fail")
+	}
+	if p, err := newPaymentProcessor("fake"); err != nil || p == nil {
+		t.Errorf("fake processor = %v, %v", p, err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Provenance methods.
+const (
+	provenanceIngest = "ingest" // loaded from a bulk file
+	provenanceAPI    = "api"    // posted to /funding/record
+	provenanceLegacy = "legacy" // stored before provenance was tracked
+)
+
+// provenanceSchema runs after the ingest schema: it references ingest jobs.
+const provenanceSchema = `
+	CREATE TABLE IF NOT EXISTS funding_record_provenance (
+		record_id UUID PRIMARY KEY REFERENCES funding_records(id),
+		method VARCHAR(20) NOT NULL,
+		source_uri TEXT NOT NULL,
+		ingest_job_id UUID REFERENCES funding_ingest_jobs(id),
+		row_number BIGINT,
+		retrieved_at TIMESTAMP NOT NULL,
+		raw_checksum CHAR(64),
+		raw TEXT,
+		created_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_provenance_job ON funding_record_provenance(ingest_job_id, row_number);
+
+	INSERT INTO funding_record_provenance (record_id, method, source_uri, retrieved_at)
+	SELECT r.id, 'legacy', r.source, r.created_at FROM funding_records r
+	WHERE NOT EXISTS (SELECT 1 FROM funding_record_provenance p WHERE p.record_id = r.id);
+
+	CREATE TABLE IF NOT EXISTS funding_record_supersessions (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		old_record_id UUID NOT NULL REFERENCES funding_records(id),
+		new_record_id UUID NOT NULL REFERENCES funding_records(id),
+		ingest_job_id UUID REFERENCES funding_ingest_jobs(id),
+		reason TEXT NOT NULL,
+		changes JSONB NOT NULL,
+		created_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_supersessions_old ON funding_record_supersessions(old_record_id);
+	CREATE INDEX IF NOT EXISTS idx_funding_supersessions_new ON funding_record_supersessions(new_record_id);
+	`
+
+// Provenance records where a funding record came from.
+type Provenance struct {
+	Method      string    `json:"method"`
+	SourceURI   string    `json:"source_uri"`
+	IngestJobID string    `json:"ingest_job_id,omitempty"`
+	RowNumber   int64     `json:"row_number,omitempty"`
+	RetrievedAt time.Time `json:"retrieved_at"`
+	RawChecksum string    `json:"raw_checksum,omitempty"`
+	Raw         string    `json:"raw,omitempty"`
+}
+
+// Supersession links a record to the corrected version that replaced it.
+type Supersession struct {
+	OldRecordID string               `json:"old_record_id"`
+	NewRecordID string               `json:"new_record_id"`
+	IngestJobID string               `json:"ingest_job_id,omitempty"`
+	Reason      string               `json:"reason"`
+	Changes     map[string][2]string `json:"changes"`
+	CreatedAt   time.Time            `json:"created_at"`
+}
+
+// RecordTrace is a record, its origin and every version before and after it.
+type RecordTrace struct {
+	Record     FundingRecord  `json:"record"`
+	Provenance *Provenance    `json:"provenance"`
+	Job        *IngestJob     `json:"ingest_job,omitempty"`
+	History    []Supersession `json:"history"`
+}
+
+// maxRecordBody bounds a /funding/record request.
+const maxRecordBody = 64 << 10
+
+// apiProvenance builds the provenance of a record posted to the API. The
+// client may name where it found the record and when; the request body is
+// kept as the raw row.
+func apiProvenance(claimed *Provenance, body []byte, now time.Time) *Provenance {
+	p := &Provenance{Method: provenanceAPI, SourceURI: "api", RetrievedAt: now}
+	if claimed != nil {
+		if claimed.SourceURI != "" {
+			p.SourceURI = claimed.SourceURI
+		}
+		if !claimed.RetrievedAt.IsZero() {
+			p.RetrievedAt = claimed.RetrievedAt
+		}
+	}
+	p.Raw = string(body)
+	p.RawChecksum = rowChecksum(p.Raw)
+	return p
+}
+
+// activeRecord is the current version of a record with a natural key.
+type activeRecord struct {
+	ID     string
+	JobID  string
+	Record FundingRecord
+}
+
+// rowChecksum is the hex SHA-256 of a raw source row without its line
+// ending.
+func rowChecksum(raw string) string {
+	sum := sha256.Sum256([]byte(strings.TrimRight(raw, "\r\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordChanges lists the fields that differ between two versions of a
+// record as field → [old, new].
+func recordChanges(old, new FundingRecord) map[string][2]string {
+	changes := map[string][2]string{}
+	for _, f := range []struct {
+		name     string
+		old, new string
+	}{
+		{"entity_id", old.EntityID, new.EntityID},
+		{"recipient_id", old.RecipientID, new.RecipientID},
+		{"amount", old.Amount.String(), new.Amount.String()},
+		{"currency", old.Currency, new.Currency},
+		{"source", old.Source, new.Source},
+		{"date", old.Date.Format(searchDateLayout), new.Date.Format(searchDateLayout)},
+	} {
+		if f.old != f.new {
+			changes[f.name] = [2]string{f.old, f.new}
+		}
+	}
+	return changes
+}
+
+// planIngestBatch decides what to do with each parsed row given the active
+// records that share its natural key. A key seen earlier in the batch, or
+// already loaded by this job, or loaded with identical content is a
+// duplicate. A key loaded by an earlier job with different content is a
+// correction: the row is inserted and replaces maps its key to the record
+// it supersedes.
+func planIngestBatch(jobID string, rows []ingestRow, active map[string]activeRecord) (inserts []ingestRow, replaces map[string]activeRecord, duplicates int64) {
+	replaces = map[string]activeRecord{}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		if seen[row.NaturalKey] {
+			duplicates++
+			continue
+		}
+		seen[row.NaturalKey] = true
+
+		prev, ok := active[row.NaturalKey]
+		if ok && (prev.JobID == jobID || len(recordChanges(prev.Record, row.Record)) == 0) {
+			duplicates++
+			continue
+		}
+		if ok {
+			replaces[row.NaturalKey] = prev
+		}
+		inserts = append(inserts, row)
+	}
+	return inserts, replaces, duplicates
+}
+
+// insertProvenance stores the origin of a newly inserted record.
+func insertProvenance(ctx context.Context, tx *sql.Tx, recordID string, p Provenance) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO funding_record_provenance (record_id, method, source_uri, ingest_job_id, row_number, retrieved_at, raw_checksum, raw)
+		VALUES ($1, $2, $3, NULLIF($4, '')::uuid, NULLIF($5, 0), $6, NULLIF($7, ''), NULLIF($8, ''))
+	`, recordID, p.Method, p.SourceURI, p.IngestJobID, p.RowNumber, p.RetrievedAt, p.RawChecksum, p.Raw)
+	return err
+}
+
+// supersedeRecord links old to the newRecord that replaced it, logs why,
+// and reverses the old version's journal entry. The caller has already set
+// superseded_at on old and posted the entry for newRecord.
+func supersedeRecord(ctx context.Context, tx *sql.Tx, old activeRecord, newRecord FundingRecord, jobID, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE funding_records SET superseded_by = $2 WHERE id = $1
+	`, old.ID, newRecord.ID)
+	if err != nil {
+		return fmt.Errorf("linking superseded record: %w", err)
+	}
+	changes, err := json.Marshal(recordChanges(old.Record, newRecord))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO funding_record_supersessions (old_record_id, new_record_id, ingest_job_id, reason, changes)
+		VALUES ($1, $2, NULLIF($3, '')::uuid, $4, $5)
+	`, old.ID, newRecord.ID, jobID, reason, string(changes))
+	if err != nil {
+		return fmt.Errorf("logging supersession: %w", err)
+	}
+
+	var entryID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT id FROM funding_journal_entries WHERE source_type = $1 AND source_id = $2
+	`, sourceFundingRecord, old.ID).Scan(&entryID)
+	if err == nil {
+		original, err := getJournalEntry(ctx, tx, entryID)
+		if err != nil {
+			return err
+		}
+		reversal := reversalEntry(*original, fmt.Sprintf("Superseded by corrected record %s", newRecord.ID), time.Now().UTC())
+		if _, err := postEntry(ctx, tx, &reversal); err != nil {
+			return fmt.Errorf("reversing superseded entry: %w", err)
+		}
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+const provenanceColumns = `method, source_uri, COALESCE(ingest_job_id::text, ''), COALESCE(row_number, 0), retrieved_at,
+	COALESCE(raw_checksum, ''), COALESCE(raw, '')`
+
+// traceRecord loads a record with its provenance and supersession history.
+func traceRecord(ctx context.Context, id string) (*RecordTrace, error) {
+	if !isUUID(id) {
+		return nil, sql.ErrNoRows
+	}
+	var trace RecordTrace
+	rec := &trace.Record
+	var supersededBy sql.NullString
+	var supersededAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT id, entity_id, amount, currency, source, recipient_id, date, created_at, superseded_by::text, superseded_at
+		FROM funding_records WHERE id = $1
+	`, id).Scan(&rec.ID, &rec.EntityID, &rec.Amount, &rec.Currency, &rec.Source, &rec.RecipientID, &rec.Date,
+		&rec.CreatedAt, &supersededBy, &supersededAt)
+	if err != nil {
+		return nil, err
+	}
+	rec.SupersededBy = supersededBy.String
+	if supersededAt.Valid {
+		rec.SupersededAt = &supersededAt.Time
+	}
+
+	var p Provenance
+	err = db.QueryRowContext(ctx, "SELECT "+provenanceColumns+" FROM funding_record_provenance WHERE record_id = $1", id).
+		Scan(&p.Method, &p.SourceURI, &p.IngestJobID, &p.RowNumber, &p.RetrievedAt, &p.RawChecksum, &p.Raw)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		trace.Provenance = &p
+		if p.IngestJobID != "" {
+			if trace.Job, err = getIngestJob(ctx, p.IngestJobID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Walk the version chain in both directions.
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE chain(old_record_id, new_record_id) AS (
+			SELECT old_record_id, new_record_id FROM funding_record_supersessions
+			WHERE old_record_id = $1 OR new_record_id = $1
+			UNION
+			SELECT s.old_record_id, s.new_record_id FROM funding_record_supersessions s
+			JOIN chain c ON s.new_record_id = c.old_record_id OR s.old_record_id = c.new_record_id
+		)
+		SELECT s.old_record_id, s.new_record_id, COALESCE(s.ingest_job_id::text, ''), s.reason, s.changes, s.created_at
+		FROM funding_record_supersessions s
+		JOIN chain c ON c.old_record_id = s.old_record_id AND c.new_record_id = s.new_record_id
+		ORDER BY s.created_at
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trace.History = []Supersession{}
+	for rows.Next() {
+		var s Supersession
+		var changes []byte
+		if err := rows.Scan(&s.OldRecordID, &s.NewRecordID, &s.IngestJobID, &s.Reason, &changes, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &s.Changes); err != nil {
+			return nil, fmt.Errorf("decoding supersession changes: %w", err)
+		}
+		trace.History = append(trace.History, s)
+	}
+	return &trace, rows.Err()
+}
+
+func handleTraceRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	trace, err := traceRecord(r.Context(), r.URL.Query().Get("id"))
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Funding record not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Tracing funding record failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to trace funding record"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trace)
+}
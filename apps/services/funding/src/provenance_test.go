@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestPlanIngestBatch tests duplicate and correction detection by natural key
+func TestPlanIngestBatch(t *testing.T) {
+	date := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+	rec := func(amount Amount) FundingRecord {
+		return FundingRecord{EntityID: "D1", RecipientID: "R1", Amount: amount, Currency: "USD", Source: "FEC", Date: date}
+	}
+	active := map[string]activeRecord{
+		"k-same":      {ID: "r1", JobID: "old", Record: rec(100)},
+		"k-changed":   {ID: "r2", JobID: "old", Record: rec(100)},
+		"k-this-job":  {ID: "r3", JobID: "new", Record: rec(100)},
+		"k-untracked": {ID: "r4", Record: rec(100)},
+	}
+	rows := []ingestRow{
+		{RowNumber: 1, NaturalKey: "k-same", Record: rec(100)},
+		{RowNumber: 2, NaturalKey: "k-changed", Record: rec(150)},
+		{RowNumber: 3, NaturalKey: "k-this-job", Record: rec(150)},
+		{RowNumber: 4, NaturalKey: "k-new", Record: rec(100)},
+		{RowNumber: 5, NaturalKey: "k-new", Record: rec(200)},
+		{RowNumber: 6, NaturalKey: "k-untracked", Record: rec(300)},
+	}
+
+	inserts, replaces, duplicates := planIngestBatch("new", rows, active)
+	if duplicates != 3 {
+		t.Errorf("duplicates = %d, want 3 (same content, same job, repeated key)", duplicates)
+	}
+	var got []int64
+	for _, row := range inserts {
+		got = append(got, row.RowNumber)
+	}
+	if len(got) != 3 || got[0] != 2 || got[1] != 4 || got[2] != 6 {
+		t.Errorf("inserted rows %v, want [2 4 6]", got)
+	}
+	if len(replaces) != 2 || replaces["k-changed"].ID != "r2" || replaces["k-untracked"].ID != "r4" {
+		t.Errorf("replaces = %+v, want k-changed→r2 and k-untracked→r4", replaces)
+	}
+
+	changes := recordChanges(rec(100), rec(150))
+	if len(changes) != 1 || changes["amount"] != [2]string{"1.00", "1.50"} {
+		t.Errorf("recordChanges = %v, want only amount 1.00 → 1.50", changes)
+	}
+}
+
+// TestAPIProvenance tests provenance captured for API submissions
+func TestAPIProvenance(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	body := []byte(`{"entity_id":"e1","amount":"10.00"}`)
+
+	p := apiProvenance(nil, body, now)
+	if p.Method != provenanceAPI || p.SourceURI != "api" || !p.RetrievedAt.Equal(now) {
+		t.Errorf("default provenance = %+v", p)
+	}
+	if p.Raw != string(body) || p.RawChecksum != rowChecksum(string(body)) || len(p.RawChecksum) != 64 {
+		t.Errorf("raw = %q checksum = %q", p.Raw, p.RawChecksum)
+	}
+
+	fetched := now.Add(-48 * time.Hour)
+	claimed := &Provenance{Method: provenanceIngest, SourceURI: "https://example.gov/report.pdf", RetrievedAt: fetched, RawChecksum: "forged"}
+	p = apiProvenance(claimed, body, now)
+	if p.Method != provenanceAPI || p.SourceURI != claimed.SourceURI || !p.RetrievedAt.Equal(fetched) {
+		t.Errorf("claimed provenance = %+v", p)
+	}
+	if p.RawChecksum == "forged" {
+		t.Error("client-supplied checksum must not be trusted")
+	}
+
+	if rowChecksum("a,b\r\n") != rowChecksum("a,b") {
+		t.Error("line endings should not change the row checksum")
+	}
+}
+
+// TestMalformedIDs tests that IDs which are not UUIDs are not found without
+// reaching the database
+func TestMalformedIDs(t *testing.T) {
+	defer func(p *PaymentService) { payments = p }(payments)
+	payments = &PaymentService{store: sqlPaymentStore{}}
+
+	for path, handler := range map[string]http.HandlerFunc{
+		"/funding/record/trace": handleTraceRecord,
+		"/funding/journal":      handleJournal,
+		"/funding/payments":     handlePayments,
+	} {
+		for _, id := range []string{"", "42", "not-a-uuid", "123e4567-e89b-12d3-a456-42661417400z"} {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, path+"?id="+id, nil))
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("GET %s?id=%s = %d, want 404", path, id, rec.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+	searchDateLayout   = "2006-01-02"
+)
+
+// sortColumns whitelists the columns a search may be ordered by.
+var sortColumns = map[string]string{
+	"date":       "date",
+	"amount":     "amount",
+	"created_at": "created_at",
+}
+
+// FundingFilter selects funding records. It is shared by search and
+// aggregation. Currency is always set so amounts are never summed across
+// currencies.
+type FundingFilter struct {
+	EntityID    string
+	RecipientID string
+	Source      string
+	Currency    string
+	From        *time.Time
+	To          *time.Time
+	MinAmount   *Amount
+	MaxAmount   *Amount
+}
+
+// FundingSearch holds the filters, ordering and paging for a funding search.
+type FundingSearch struct {
+	FundingFilter
+	SortBy string
+	Order  string
+	Limit  int
+	Offset int
+}
+
+const fundingRecordsSchema = `
+	CREATE TABLE IF NOT EXISTS funding_records (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		entity_id VARCHAR(255) NOT NULL,
+		recipient_id VARCHAR(255) NOT NULL,
+		amount NUMERIC(15,2) NOT NULL,
+		source VARCHAR(100) NOT NULL,
+		date DATE NOT NULL,
+		created_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	ALTER TABLE funding_records ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+	ALTER TABLE funding_records ADD COLUMN IF NOT EXISTS superseded_at TIMESTAMP;
+	ALTER TABLE funding_records ADD COLUMN IF NOT EXISTS superseded_by UUID REFERENCES funding_records(id);
+
+	CREATE INDEX IF NOT EXISTS idx_funding_entity ON funding_records(entity_id, date DESC);
+	CREATE INDEX IF NOT EXISTS idx_funding_recipient ON funding_records(recipient_id, date DESC);
+	CREATE INDEX IF NOT EXISTS idx_funding_source ON funding_records(source, date DESC);
+	`
+
+func createTables() error {
+	for _, schema := range []string{fundingRecordsSchema, ingestSchema, provenanceSchema, entitiesSchema, rollupSchema, alertsSchema, paymentsSchema, journalSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateFundingRecord(record FundingRecord) error {
+	if record.EntityID == "" {
+		return fmt.Errorf("entity_id is required")
+	}
+	if record.RecipientID == "" {
+		return fmt.Errorf("recipient_id is required")
+	}
+	if record.Source == "" {
+		return fmt.Errorf("source is required")
+	}
+	if err := validateCurrency(record.Currency); err != nil {
+		return err
+	}
+	if record.Amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	if record.Amount > maxAmount {
+		return fmt.Errorf("amount must not exceed %s", maxAmount)
+	}
+	if !record.Amount.fitsCurrency(record.Currency) {
+		return fmt.Errorf("amount %s has more precision than %s allows", record.Amount, record.Currency)
+	}
+	if record.Date.IsZero() {
+		return fmt.Errorf("date is required")
+	}
+	return nil
+}
+
+// insertFundingRecord stores a record with its provenance and posts its
+// journal entry in the same transaction.
+func insertFundingRecord(ctx context.Context, record *FundingRecord) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO funding_records (entity_id, recipient_id, amount, currency, source, date)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+
+	err = tx.QueryRowContext(ctx, query,
+		record.EntityID,
+		record.RecipientID,
+		record.Amount,
+		record.Currency,
+		record.Source,
+		record.Date,
+	).Scan(&record.ID, &record.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if record.Provenance != nil {
+		if err := insertProvenance(ctx, tx, record.ID, *record.Provenance); err != nil {
+			return fmt.Errorf("recording provenance: %w", err)
+		}
+	}
+	if err := registerEntities(ctx, tx, []FundingRecord{*record}); err != nil {
+		return err
+	}
+	entry := fundingRecordEntry(*record)
+	if _, err := postEntry(ctx, tx, &entry); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func parseFundingFilter(q url.Values) (FundingFilter, error) {
+	filter := FundingFilter{
+		EntityID:    q.Get("entity_id"),
+		RecipientID: q.Get("recipient_id"),
+		Source:      q.Get("source"),
+		Currency:    "USD",
+	}
+
+	if currency := strings.ToUpper(q.Get("currency")); currency != "" {
+		if err := validateCurrency(currency); err != nil {
+			return filter, err
+		}
+		filter.Currency = currency
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		raw := q.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(searchDateLayout, raw)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be a date in YYYY-MM-DD format", p.name)
+		}
+		*p.dst = &t
+	}
+	if filter.From != nil && filter.To != nil && filter.To.Before(*filter.From) {
+		return filter, fmt.Errorf("to must not be before from")
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **Amount
+	}{{"min_amount", &filter.MinAmount}, {"max_amount", &filter.MaxAmount}} {
+		raw := q.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		v, err := parseAmount(raw)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be a decimal amount with at most two decimal places", p.name)
+		}
+		*p.dst = &v
+	}
+	if filter.MinAmount != nil && filter.MaxAmount != nil && *filter.MaxAmount < *filter.MinAmount {
+		return filter, fmt.Errorf("max_amount must not be less than min_amount")
+	}
+
+	return filter, nil
+}
+
+func parseFundingSearch(q url.Values) (FundingSearch, error) {
+	search := FundingSearch{
+		SortBy: "date",
+		Order:  "desc",
+		Limit:  defaultSearchLimit,
+	}
+
+	filter, err := parseFundingFilter(q)
+	if err != nil {
+		return search, err
+	}
+	search.FundingFilter = filter
+
+	if search.EntityID == "" && search.RecipientID == "" && search.Source == "" {
+		return search, fmt.Errorf("entity_id, recipient_id or source query parameter required")
+	}
+
+	if sortBy := q.Get("sort"); sortBy != "" {
+		if _, ok := sortColumns[sortBy]; !ok {
+			return search, fmt.Errorf("sort must be one of date, amount, created_at")
+		}
+		search.SortBy = sortBy
+	}
+	if order := strings.ToLower(q.Get("order")); order != "" {
+		if order != "asc" && order != "desc" {
+			return search, fmt.Errorf("order must be asc or desc")
+		}
+		search.Order = order
+	}
+
+	if raw := q.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return search, fmt.Errorf("limit must be a positive integer")
+		}
+		if limit > maxSearchLimit {
+			limit = maxSearchLimit
+		}
+		search.Limit = limit
+	}
+	if raw := q.Get("offset"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return search, fmt.Errorf("offset must be a non-negative integer")
+		}
+		search.Offset = offset
+	}
+
+	return search, nil
+}
+
+// whereClause renders the filter as a SQL WHERE clause with positional
+// arguments.
+func (s FundingFilter) whereClause() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	// An ID filter matches every record resolved to the same canonical entity.
+	if s.EntityID != "" {
+		add("canonical_entity_id = "+canonicalIDExpr(entityKindEntity), s.EntityID)
+	}
+	if s.RecipientID != "" {
+		add("canonical_recipient_id = "+canonicalIDExpr(entityKindRecipient), s.RecipientID)
+	}
+	if s.Source != "" {
+		add("source = $%d", s.Source)
+	}
+	if s.Currency != "" {
+		add("currency = $%d", s.Currency)
+	}
+	if s.From != nil {
+		add("date >= $%d", *s.From)
+	}
+	if s.To != nil {
+		add("date <= $%d", *s.To)
+	}
+	if s.MinAmount != nil {
+		add("amount >= $%d", *s.MinAmount)
+	}
+	if s.MaxAmount != nil {
+		add("amount <= $%d", *s.MaxAmount)
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (s FundingSearch) orderClause() string {
+	column := sortColumns[s.SortBy]
+	if column == "" {
+		column = "date"
+	}
+	direction := "DESC"
+	if s.Order == "asc" {
+		direction = "ASC"
+	}
+	// id breaks ties so pages are stable
+	return fmt.Sprintf(" ORDER BY %s %s, id %s", column, direction, direction)
+}
+
+// searchFundingRecords returns one page of matching records together with the
+// number of matches and the sum of their amounts across the whole filtered set.
+// Searches are always scoped to a single currency so the sum is meaningful;
+// NUMERIC summation in Postgres keeps it exact.
+func searchFundingRecords(ctx context.Context, s FundingSearch) ([]FundingRecord, int, Amount, error) {
+	where, args := s.whereClause()
+
+	var count int
+	var total Amount
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM active_funding_records"+where, args...,
+	).Scan(&count, &total)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	pageArgs := append(args, s.Limit, s.Offset)
+	query := "SELECT id, entity_id, amount, currency, source, recipient_id, canonical_entity_id, canonical_recipient_id, date, created_at FROM active_funding_records" +
+		where + s.orderClause() +
+		fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+
+	rows, err := db.QueryContext(ctx, query, pageArgs...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	records := []FundingRecord{}
+	for rows.Next() {
+		var rec FundingRecord
+		if err := rows.Scan(&rec.ID, &rec.EntityID, &rec.Amount, &rec.Currency, &rec.Source, &rec.RecipientID, &rec.CanonicalEntityID, &rec.CanonicalRecipientID, &rec.Date, &rec.CreatedAt); err != nil {
+			return nil, 0, 0, err
+		}
+		records = append(records, rec)
+	}
+	return records, count, total, rows.Err()
+}
+
+// isUUID reports whether s is a UUID in canonical form. IDs are checked
+// before they reach a UUID column, where Postgres would reject them.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
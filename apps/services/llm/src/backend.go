@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Backend kinds accepted in model configuration.
+const (
+	backendOllama = "ollama"
+	backendOpenAI = "openai" // any OpenAI-compatible server: llama.cpp server, vLLM, ...
+	backendMock   = "mock"
+)
+
+// BackendRequest is one generation call. Model is the backend's own name
+// for the model, which may differ from the ID clients use. For
+// conversations, Prompt is already in the model's chat template (Raw) and
+// Messages holds the turns it was rendered from, for servers that apply
+// their own template.
+type BackendRequest struct {
+	Model    string
+	Prompt   string
+	Raw      bool
+	Messages []Message
+	Options  GenerationOptions
+}
+
+// chatMessages is the request as chat completion messages.
+func (r BackendRequest) chatMessages() []map[string]string {
+	if len(r.Messages) == 0 {
+		return []map[string]string{{"role": roleUser, "content": r.Prompt}}
+	}
+	messages := make([]map[string]string, len(r.Messages))
+	for i, m := range r.Messages {
+		messages[i] = map[string]string{"role": m.Role, "content": m.Content}
+	}
+	return messages
+}
+
+// BackendResponse is a completed generation. Token counts are zero when
+// the backend does not report them.
+type BackendResponse struct {
+	Text             string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// TokenFunc receives generated text as it arrives. Returning an error
+// stops generation.
+type TokenFunc func(text string) error
+
+// InferenceBackend is the boundary to a model server. Implementations must
+// stop work when ctx is cancelled. Stream returns the same response as
+// Generate after passing the text to onToken piece by piece.
+type InferenceBackend interface {
+	Name() string
+	Generate(ctx context.Context, req BackendRequest) (BackendResponse, error)
+	Stream(ctx context.Context, req BackendRequest, onToken TokenFunc) (BackendResponse, error)
+	Ping(ctx context.Context) error
+}
+
+// backendClient is shared by the HTTP backends. Generation can take
+// minutes, so requests are bounded by their context rather than a client
+// timeout.
+var backendClient = &http.Client{}
+
+// post sends payload to url and returns the response if it is a 200. The
+// caller closes the body; cancelling ctx aborts the request upstream.
+func post(ctx context.Context, url, apiKey string, payload interface{}) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &statusError{url: url, status: resp.StatusCode, message: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
+
+// statusError is a backend answering with a status other than 200.
+type statusError struct {
+	url     string
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned status %d: %s", e.url, e.status, e.message)
+}
+
+// postJSON sends payload to url and decodes a 200 response into out.
+func postJSON(ctx context.Context, url, apiKey string, payload, out interface{}) error {
+	resp, err := post(ctx, url, apiKey, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", url, err)
+	}
+	return nil
+}
+
+// newLineScanner reads a streamed response line by line. A single line can
+// carry a long chunk, so the buffer is larger than bufio's default.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+// getJSON checks that url answers 200 and decodes the response into out,
+// unless out is nil.
+func getJSON(ctx context.Context, url, apiKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", url, err)
+	}
+	return nil
+}
+
+// modelLister is implemented by backends that can list the models they
+// have installed. Models on other backends are taken to be available.
+type modelLister interface {
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// ollamaBackend calls Ollama's native API.
+type ollamaBackend struct {
+	baseURL string
+}
+
+func (b *ollamaBackend) Name() string { return backendOllama + " " + b.baseURL }
+
+func (b *ollamaBackend) Generate(ctx context.Context, req BackendRequest) (BackendResponse, error) {
+	var result struct {
+		Response        string `json:"response"`
+		PromptEvalCount int    `json:"prompt_eval_count"`
+		EvalCount       int    `json:"eval_count"`
+	}
+	err := postJSON(ctx, b.baseURL+"/api/generate", "", map[string]interface{}{
+		"model":   req.Model,
+		"prompt":  req.Prompt,
+		"raw":     req.Raw,
+		"stream":  false,
+		"options": req.Options.ollamaOptions(),
+	}, &result)
+	if err != nil {
+		return BackendResponse{}, err
+	}
+	return BackendResponse{Text: result.Response, PromptTokens: result.PromptEvalCount, CompletionTokens: result.EvalCount}, nil
+}
+
+// Stream reads Ollama's NDJSON stream. The last line has done set and
+// carries the token counts.
+func (b *ollamaBackend) Stream(ctx context.Context, req BackendRequest, onToken TokenFunc) (BackendResponse, error) {
+	url := b.baseURL + "/api/generate"
+	resp, err := post(ctx, url, "", map[string]interface{}{
+		"model":   req.Model,
+		"prompt":  req.Prompt,
+		"raw":     req.Raw,
+		"stream":  true,
+		"options": req.Options.ollamaOptions(),
+	})
+	if err != nil {
+		return BackendResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	scanner := newLineScanner(resp.Body)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var chunk struct {
+			Response        string `json:"response"`
+			Done            bool   `json:"done"`
+			Error           string `json:"error"`
+			PromptEvalCount int    `json:"prompt_eval_count"`
+			EvalCount       int    `json:"eval_count"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return BackendResponse{}, fmt.Errorf("invalid response from %s: %w", url, err)
+		}
+		if chunk.Error != "" {
+			return BackendResponse{}, fmt.Errorf("%s: %s", url, chunk.Error)
+		}
+		if chunk.Response != "" {
+			text.WriteString(chunk.Response)
+			if err := onToken(chunk.Response); err != nil {
+				return BackendResponse{}, err
+			}
+		}
+		if chunk.Done {
+			return BackendResponse{Text: text.String(), PromptTokens: chunk.PromptEvalCount, CompletionTokens: chunk.EvalCount}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return BackendResponse{}, err
+	}
+	return BackendResponse{}, fmt.Errorf("%s ended the stream early", url)
+}
+
+func (b *ollamaBackend) Ping(ctx context.Context) error {
+	return getJSON(ctx, b.baseURL+"/api/tags", "", nil)
+}
+
+// ListModels lists the models pulled into Ollama. A model tagged latest is
+// also listed without its tag, as Ollama resolves it that way.
+func (b *ollamaBackend) ListModels(ctx context.Context) ([]string, error) {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := getJSON(ctx, b.baseURL+"/api/tags", "", &tags); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range tags.Models {
+		names = append(names, m.Name)
+		if name, ok := strings.CutSuffix(m.Name, ":latest"); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// openAIBackend calls the chat completions API that llama.cpp server, vLLM
+// and most hosted providers implement.
+type openAIBackend struct {
+	baseURL string
+	apiKey  string
+}
+
+func (b *openAIBackend) Name() string { return backendOpenAI + " " + b.baseURL }
+
+func (b *openAIBackend) Generate(ctx context.Context, req BackendRequest) (BackendResponse, error) {
+	var result struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	body := map[string]interface{}{
+		"model":    req.Model,
+		"messages": req.chatMessages(),
+		"stream":   false,
+	}
+	req.Options.addOpenAIOptions(body)
+	err := postJSON(ctx, b.baseURL+"/v1/chat/completions", b.apiKey, body, &result)
+	if err != nil {
+		return BackendResponse{}, err
+	}
+	if len(result.Choices) == 0 {
+		return BackendResponse{}, fmt.Errorf("invalid response from %s: no choices", b.baseURL)
+	}
+	return BackendResponse{
+		Text:             result.Choices[0].Message.Content,
+		PromptTokens:     result.Usage.PromptTokens,
+		CompletionTokens: result.Usage.CompletionTokens,
+	}, nil
+}
+
+// Stream reads server-sent chat completion chunks until [DONE]. Usage is
+// requested in a final chunk; servers that ignore the option report zero.
+func (b *openAIBackend) Stream(ctx context.Context, req BackendRequest, onToken TokenFunc) (BackendResponse, error) {
+	url := b.baseURL + "/v1/chat/completions"
+	body := map[string]interface{}{
+		"model":          req.Model,
+		"messages":       req.chatMessages(),
+		"stream":         true,
+		"stream_options": map[string]bool{"include_usage": true},
+	}
+	req.Options.addOpenAIOptions(body)
+	resp, err := post(ctx, url, b.apiKey, body)
+	if err != nil {
+		return BackendResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var result BackendResponse
+	var text strings.Builder
+	scanner := newLineScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			result.Text = text.String()
+			return result, nil
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *struct {
+				PromptTokens     int `json:"prompt_tokens"`
+				CompletionTokens int `json:"completion_tokens"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return BackendResponse{}, fmt.Errorf("invalid response from %s: %w", url, err)
+		}
+		if chunk.Usage != nil {
+			result.PromptTokens = chunk.Usage.PromptTokens
+			result.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			text.WriteString(choice.Delta.Content)
+			if err := onToken(choice.Delta.Content); err != nil {
+				return BackendResponse{}, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return BackendResponse{}, err
+	}
+	return BackendResponse{}, fmt.Errorf("%s ended the stream early", url)
+}
+
+func (b *openAIBackend) Ping(ctx context.Context) error {
+	return getJSON(ctx, b.baseURL+"/v1/models", b.apiKey, nil)
+}
+
+// ListModels lists the models the server serves.
+func (b *openAIBackend) ListModels(ctx context.Context) ([]string, error) {
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := getJSON(ctx, b.baseURL+"/v1/models", b.apiKey, &list); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(list.Data))
+	for i, m := range list.Data {
+		names[i] = m.ID
+	}
+	return names, nil
+}
+
+// mockBackend answers without a model server, for development and CI. The
+// same model, prompt and options always produce the same response, and
+// different seeds different ones. max_tokens (in words) and stop sequences
+// are honoured.
+type mockBackend struct{}
+
+func (mockBackend) Name() string { return backendMock }
+
+func (mockBackend) Generate(ctx context.Context, req BackendRequest) (BackendResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return BackendResponse{}, err
+	}
+	options, _ := json.Marshal(req.Options)
+	sum := sha256.Sum256([]byte(req.Model + "\x00" + req.Prompt + "\x00" + string(options)))
+
+	// Echo the start of the question, which follows any retrieval context.
+	question := strings.TrimSpace(req.Prompt)
+	if i := strings.LastIndex(question, "\n\n"); i >= 0 {
+		question = strings.TrimSpace(question[i+2:])
+	}
+	if len(req.Messages) > 0 {
+		question = req.Messages[len(req.Messages)-1].Content
+	}
+	words := strings.Fields(question)
+	if len(words) > 12 {
+		words = words[:12]
+	}
+	text := fmt.Sprintf("Mock response %s from %s: %s", hex.EncodeToString(sum[:4]), req.Model, strings.Join(words, " "))
+	if max := req.Options.MaxTokens; max != nil {
+		if fields := strings.Fields(text); len(fields) > *max {
+			text = strings.Join(fields[:*max], " ")
+		}
+	}
+	for _, stop := range req.Options.Stop {
+		if i := strings.Index(text, stop); i >= 0 {
+			text = text[:i]
+		}
+	}
+	return BackendResponse{
+		Text:             text,
+		PromptTokens:     len(strings.Fields(req.Prompt)),
+		CompletionTokens: len(strings.Fields(text)),
+	}, nil
+}
+
+// Stream sends the mock response a word at a time.
+func (m mockBackend) Stream(ctx context.Context, req BackendRequest, onToken TokenFunc) (BackendResponse, error) {
+	resp, err := m.Generate(ctx, req)
+	if err != nil {
+		return BackendResponse{}, err
+	}
+	for i, word := range strings.Fields(resp.Text) {
+		if i > 0 {
+			word = " " + word
+		}
+		if err := ctx.Err(); err != nil {
+			return BackendResponse{}, err
+		}
+		if err := onToken(word); err != nil {
+			return BackendResponse{}, err
+		}
+	}
+	return resp, nil
+}
+
+func (mockBackend) Ping(ctx context.Context) error { return nil }
+
+// newBackend builds the backend a model is configured to use.
+func newBackend(cfg ModelConfig, getenv func(string) string) (InferenceBackend, error) {
+	baseURL := strings.TrimRight(cfg.BaseURL, "/")
+	switch cfg.Backend {
+	case backendOllama:
+		if baseURL == "" {
+			return nil, fmt.Errorf("model %s: baseUrl is required for ollama", cfg.ID)
+		}
+		return &ollamaBackend{baseURL: baseURL}, nil
+	case backendOpenAI:
+		if baseURL == "" {
+			return nil, fmt.Errorf("model %s: baseUrl is required for openai", cfg.ID)
+		}
+		var apiKey string
+		if cfg.APIKeyEnv != "" {
+			apiKey = getenv(cfg.APIKeyEnv)
+		}
+		return &openAIBackend{baseURL: strings.TrimSuffix(baseURL, "/v1"), apiKey: apiKey}, nil
+	case backendMock:
+		return mockBackend{}, nil
+	default:
+		return nil, fmt.Errorf("model %s: unknown backend %q", cfg.ID, cfg.Backend)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestOllamaBackend tests requests to and responses from Ollama's API
+func TestOllamaBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			w.Write([]byte(`{"models": []}`))
+		case "/api/generate":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["model"] != "mistral:7b" || body["stream"] != false {
+				t.Errorf("unexpected request body %v", body)
+			}
+			w.Write([]byte(`{"response": "Article I vests legislative power.", "prompt_eval_count": 12, "eval_count": 7}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	backend, err := newBackend(ModelConfig{ModelInfo: ModelInfo{ID: "mistral"}, Backend: backendOllama, BaseURL: server.URL + "/"}, nil)
+	if err != nil {
+		t.Fatalf("newBackend() error = %v", err)
+	}
+	if err := backend.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+	got, err := backend.Generate(context.Background(), BackendRequest{Model: "mistral:7b", Prompt: "Who makes laws?"})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	if got.Text != "Article I vests legislative power." || got.PromptTokens != 12 || got.CompletionTokens != 7 {
+		t.Errorf("Generate() = %+v", got)
+	}
+}
+
+// TestOpenAIBackend tests the OpenAI-compatible chat completions backend
+func TestOpenAIBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/models":
+			w.Write([]byte(`{"data": []}`))
+		case "/v1/chat/completions":
+			var body struct {
+				Model    string              `json:"model"`
+				Messages []map[string]string `json:"messages"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Model != "llama-3-8b" || len(body.Messages) != 1 || body.Messages[0]["content"] != "Define federalism" {
+				t.Errorf("unexpected request body %+v", body)
+			}
+			w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "Shared sovereignty."}}], "usage": {"prompt_tokens": 4, "completion_tokens": 3}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	getenv := func(key string) string {
+		if key == "VLLM_API_KEY" {
+			return "sk-test"
+		}
+		return ""
+	}
+	// A base URL ending in /v1, as OpenAI clients are usually configured, also works.
+	backend, err := newBackend(ModelConfig{Backend: backendOpenAI, BaseURL: server.URL + "/v1", APIKeyEnv: "VLLM_API_KEY"}, getenv)
+	if err != nil {
+		t.Fatalf("newBackend() error = %v", err)
+	}
+	if err := backend.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+	got, err := backend.Generate(context.Background(), BackendRequest{Model: "llama-3-8b", Prompt: "Define federalism"})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	if got.Text != "Shared sovereignty." || got.PromptTokens != 4 || got.CompletionTokens != 3 {
+		t.Errorf("Generate() = %+v", got)
+	}
+
+	unauthorized, _ := newBackend(ModelConfig{Backend: backendOpenAI, BaseURL: server.URL}, getenv)
+	if _, err := unauthorized.Generate(context.Background(), BackendRequest{Model: "llama-3-8b", Prompt: "x"}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Generate() without a key: error = %v, want status 401", err)
+	}
+}
+
+// TestMockBackend tests that the mock backend is deterministic
+func TestMockBackend(t *testing.T) {
+	backend := mockBackend{}
+	req := BackendRequest{Model: "mock-small", Prompt: "Context about Article I.\n\nWhat powers does Congress have?"}
+	first, err := backend.Generate(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	second, _ := backend.Generate(context.Background(), req)
+	if first != second {
+		t.Errorf("mock responses differ: %q vs %q", first.Text, second.Text)
+	}
+	if !strings.Contains(first.Text, "What powers does Congress have?") || strings.Contains(first.Text, "Context") {
+		t.Errorf("mock response should echo the question: %q", first.Text)
+	}
+	other, _ := backend.Generate(context.Background(), BackendRequest{Model: "mock-large", Prompt: req.Prompt})
+	if other.Text == first.Text {
+		t.Error("different models should answer differently")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := backend.Generate(ctx, req); err == nil {
+		t.Error("a cancelled request should fail")
+	}
+}
+
+// TestModelConfiguration tests loading per-model backend configuration
+func TestModelConfiguration(t *testing.T) {
+	file, err := parseModelsFile([]byte(`{"models": [
+		{"id": "liberty-mistral-v1.0", "name": "Liberty Mistral", "contextWindow": 8192, "backend": "ollama", "baseUrl": "http://gpu-1:11434", "upstreamModel": "mistral:7b"},
+		{"id": "llama3", "backend": "openai", "baseUrl": "http://vllm:8000", "apiKeyEnv": "VLLM_API_KEY"},
+		{"id": "mock", "backend": "mock"}
+	]}`))
+	if err != nil {
+		t.Fatalf("parseModelsFile() error = %v", err)
+	}
+	built, err := buildModels(file.Models, "liberty-mistral-v1.0", func(string) string { return "" })
+	if err != nil {
+		t.Fatalf("buildModels() error = %v", err)
+	}
+	if got := built.models["liberty-mistral-v1.0"]; got.config.upstreamName() != "mistral:7b" || got.backend.Name() != "ollama http://gpu-1:11434" {
+		t.Errorf("liberty-mistral = %s via %s", got.config.upstreamName(), got.backend.Name())
+	}
+	if got := built.models["llama3"]; got.config.upstreamName() != "llama3" || got.config.Name != "llama3" {
+		t.Errorf("llama3 should default its upstream model and name to its ID: %+v", got.config)
+	}
+
+	for name, tc := range map[string]struct {
+		configs   []ModelConfig
+		defaultID string
+	}{
+		"unknown backend":  {[]ModelConfig{{ModelInfo: ModelInfo{ID: "a"}, Backend: "tgi"}}, "a"},
+		"missing base URL": {[]ModelConfig{{ModelInfo: ModelInfo{ID: "a"}, Backend: backendOllama}}, "a"},
+		"duplicate ID":     {[]ModelConfig{{ModelInfo: ModelInfo{ID: "a"}, Backend: backendMock}, {ModelInfo: ModelInfo{ID: "a"}, Backend: backendMock}}, "a"},
+		"missing default":  {[]ModelConfig{{ModelInfo: ModelInfo{ID: "a"}, Backend: backendMock}}, "b"},
+		"model without ID": {[]ModelConfig{{Backend: backendMock}}, ""},
+	} {
+		if _, err := buildModels(tc.configs, tc.defaultID, func(string) string { return "" }); err == nil {
+			t.Errorf("%s: buildModels() should fail", name)
+		}
+	}
+	if _, err := parseModelsFile([]byte(`{"models": []}`)); err == nil {
+		t.Error("an empty models file should be rejected")
+	}
+
+	// The built-in models take their backend from the environment.
+	defaults, err := loadModels(func(key string) string {
+		return map[string]string{"LLM_BACKEND": "mock"}[key]
+	})
+	if err != nil {
+		t.Fatalf("loadModels() error = %v", err)
+	}
+	if len(defaults.order) != 4 || defaults.defaultID != "liberty-mistral-v1.0" || defaults.defaultModel().backend.Name() != backendMock {
+		t.Errorf("LLM_BACKEND=mock should serve every built-in model from the mock: %+v", defaults.order)
+	}
+}
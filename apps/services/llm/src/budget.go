@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// maxReplyReserve bounds how much of the context window is kept free for
+// the model's answer.
+const maxReplyReserve = 1024
+
+var errContextTooLong = errors.New("the prompt does not fit in the model's context window")
+
+// promptParts are the pieces of a prompt. When the context window is too
+// small they are given up in order: history (oldest first), then retrieved
+// documents (least relevant first), then the caller's context, which is
+// truncated. System messages in the history and the prompt itself are
+// always kept.
+type promptParts struct {
+	history   []Message
+	extra     string
+	retrieved []Document
+	prompt    string
+}
+
+// ContextTrim reports what was cut to fit the context window.
+type ContextTrim struct {
+	DroppedMessages  int  `json:"dropped_messages,omitempty"`
+	DroppedDocuments int  `json:"dropped_documents,omitempty"`
+	TruncatedContext bool `json:"truncated_context,omitempty"`
+}
+
+// fittedPrompt is a prompt that fits its model's context window. trim is
+// nil if nothing was cut.
+type fittedPrompt struct {
+	messages  []Message
+	prompt    string
+	tokens    int
+	retrieved []Document
+	trim      *ContextTrim
+}
+
+// replyReserve is how many tokens of a window are kept for the reply.
+func replyReserve(contextWindow int) int {
+	reserve := contextWindow / 4
+	if reserve > maxReplyReserve {
+		reserve = maxReplyReserve
+	}
+	return reserve
+}
+
+// retrievalBlock is the caller's context followed by retrieved documents.
+func retrievalBlock(extra string, docs []Document) string {
+	if len(docs) == 0 {
+		return extra
+	}
+	return buildRetrievalContext(extra, docs)
+}
+
+// messages assembles the parts: history, then the context block as a
+// system message, then the prompt.
+func (p promptParts) messages() []Message {
+	messages := append([]Message(nil), p.history...)
+	if block := retrievalBlock(p.extra, p.retrieved); block != "" {
+		messages = append(messages, Message{Role: roleSystem, Content: block})
+	}
+	return append(messages, Message{Role: roleUser, Content: p.prompt})
+}
+
+// fitPrompt renders the parts and cuts them until the prompt, counted with
+// tok, leaves reserve tokens of contextWindow for the reply. A window of
+// zero means no limit.
+func fitPrompt(tok Tokenizer, render func([]Message) string, contextWindow, reserve int, parts promptParts) (*fittedPrompt, error) {
+	budget := math.MaxInt
+	if contextWindow > 0 {
+		budget = contextWindow - reserve
+	}
+	parts.history = append([]Message(nil), parts.history...)
+	parts.retrieved = append([]Document(nil), parts.retrieved...)
+
+	var trim ContextTrim
+	for {
+		messages := parts.messages()
+		prompt := render(messages)
+		tokens := tok.Count(prompt)
+		if tokens <= budget {
+			fitted := &fittedPrompt{messages: messages, prompt: prompt, tokens: tokens, retrieved: parts.retrieved}
+			if trim != (ContextTrim{}) {
+				fitted.trim = &trim
+			}
+			return fitted, nil
+		}
+
+		if dropped := dropOldestTurn(&parts.history); dropped > 0 {
+			trim.DroppedMessages += dropped
+			continue
+		}
+		if len(parts.retrieved) > 0 {
+			parts.retrieved = parts.retrieved[:len(parts.retrieved)-1]
+			trim.DroppedDocuments++
+			continue
+		}
+		if parts.extra != "" && !trim.TruncatedContext {
+			trim.TruncatedContext = true
+			parts.extra = truncateToFit(parts.extra, func(extra string) bool {
+				shorter := parts
+				shorter.extra = extra
+				return tok.Count(render(shorter.messages())) <= budget
+			})
+			continue
+		}
+		return nil, errContextTooLong
+	}
+}
+
+// dropOldestTurn removes the oldest non-system message, and any assistant
+// replies left at the start of the history, since a conversation must not
+// resume on an answer to a dropped question. It returns how many messages
+// were removed.
+func dropOldestTurn(history *[]Message) int {
+	h := *history
+	for i, m := range h {
+		if m.Role == roleSystem {
+			continue
+		}
+		end := i + 1
+		for end < len(h) && h[end].Role == roleAssistant {
+			end++
+		}
+		*history = append(h[:i], h[end:]...)
+		return end - i
+	}
+	return 0
+}
+
+// truncateToFit returns the longest prefix of text, cut at a word
+// boundary, for which fits holds, or "" if there is none.
+func truncateToFit(text string, fits func(string) bool) string {
+	if fits(text) {
+		return text
+	}
+	var cuts []int
+	for i, r := range text {
+		if r == ' ' || r == '\n' {
+			cuts = append(cuts, i)
+		}
+	}
+	// Binary search for the longest prefix that fits.
+	lo, hi := 0, len(cuts)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if fits(strings.TrimRight(text[:cuts[mid-1]], " \n")) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	if lo == 0 {
+		return ""
+	}
+	return strings.TrimRight(text[:cuts[lo-1]], " \n")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestFitPrompt tests cutting history, retrieved documents and context, in
+// that order, to fit the context window
+func TestFitPrompt(t *testing.T) {
+	tok := estimateTokenizer{}
+	long := strings.Repeat("word ", 100) // about 125 tokens
+	docs := []Document{
+		{ID: "constitution-3", Source: "constitution.txt", SourceType: "founding", Text: strings.Repeat("congress ", 35)},
+		{ID: "federalist-10", Source: "federalist.txt", SourceType: "founding", Text: strings.Repeat("faction ", 40)},
+	}
+	parts := promptParts{
+		history: []Message{
+			{Role: roleSystem, Content: "Be brief."},
+			{Role: roleUser, Content: "first " + long},
+			{Role: roleAssistant, Content: "reply one " + long},
+			{Role: roleUser, Content: "second " + long},
+			{Role: roleAssistant, Content: "reply two " + long},
+		},
+		extra:     "User notes: " + long,
+		retrieved: docs,
+		prompt:    "third question",
+	}
+	render := func(m []Message) string { return renderChat(templatePlain, m) }
+
+	all, err := fitPrompt(tok, render, 0, 0, parts)
+	if err != nil || all.trim != nil || len(all.messages) != 7 || len(all.retrieved) != 2 {
+		t.Fatalf("no window should keep everything: %+v, %v", all, err)
+	}
+	if all.tokens != tok.Count(all.prompt) {
+		t.Errorf("tokens = %d, want the prompt's count %d", all.tokens, tok.Count(all.prompt))
+	}
+
+	tests := []struct {
+		name     string
+		budget   int
+		trim     ContextTrim
+		messages int
+		docs     int
+	}{
+		{"drops the oldest turn", 650, ContextTrim{DroppedMessages: 2}, 5, 2},
+		{"drops all history before documents", 400, ContextTrim{DroppedMessages: 4}, 3, 2},
+		{"drops the least relevant document", 300, ContextTrim{DroppedMessages: 4, DroppedDocuments: 1}, 3, 1},
+		{"truncates the caller's context", 100, ContextTrim{DroppedMessages: 4, DroppedDocuments: 2, TruncatedContext: true}, 3, 0},
+	}
+	for _, tt := range tests {
+		fitted, err := fitPrompt(tok, render, tt.budget, 0, parts)
+		if err != nil {
+			t.Fatalf("%s: fitPrompt() error = %v", tt.name, err)
+		}
+		if fitted.tokens > tt.budget {
+			t.Errorf("%s: %d tokens over the budget of %d", tt.name, fitted.tokens, tt.budget)
+		}
+		if fitted.trim == nil || *fitted.trim != tt.trim {
+			t.Errorf("%s: trim = %+v, want %+v", tt.name, fitted.trim, tt.trim)
+		}
+		if len(fitted.messages) != tt.messages || len(fitted.retrieved) != tt.docs {
+			t.Errorf("%s: kept %d messages and %d documents, want %d and %d", tt.name, len(fitted.messages), len(fitted.retrieved), tt.messages, tt.docs)
+		}
+		first, last := fitted.messages[0], fitted.messages[len(fitted.messages)-1]
+		if first.Content != "Be brief." || last.Content != "third question" {
+			t.Errorf("%s: the system prompt and the prompt must be kept", tt.name)
+		}
+	}
+
+	// The reserve for the reply counts against the window.
+	if fitted, _ := fitPrompt(tok, render, 650+replyReserve(2000), replyReserve(2000), parts); fitted.tokens > 650 {
+		t.Errorf("prompt of %d tokens should leave the reply reserve free", fitted.tokens)
+	}
+
+	parts.prompt = long + long
+	if _, err := fitPrompt(tok, render, 200, 0, parts); err != errContextTooLong {
+		t.Errorf("an oversized prompt: error = %v, want errContextTooLong", err)
+	}
+}
+
+// TestTruncateToFit tests cutting text at word boundaries
+func TestTruncateToFit(t *testing.T) {
+	tok := estimateTokenizer{}
+	within := func(n int) func(string) bool {
+		return func(s string) bool { return tok.Count(s) <= n }
+	}
+	text := "We the People of the United States, in Order to form a more perfect Union"
+	if got := truncateToFit(text, within(100)); got != text {
+		t.Errorf("text that fits should be unchanged, got %q", got)
+	}
+	if got := truncateToFit(text, within(5)); got != "We the People of the" {
+		t.Errorf("truncateToFit(5 tokens) = %q", got)
+	}
+	if got := truncateToFit(text, within(0)); got != "" {
+		t.Errorf("truncateToFit(0 tokens) = %q, want empty", got)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response cache stores, chosen with LLM_CACHE.
+const (
+	cacheMemory   = "memory"
+	cachePostgres = "postgres"
+	cacheOff      = "off"
+)
+
+// CacheConfig controls the response cache. MaxBytes bounds the text an
+// in-memory cache holds; Postgres is bounded by MaxEntries only.
+type CacheConfig struct {
+	Store      string
+	TTL        time.Duration
+	MaxEntries int
+	MaxBytes   int
+}
+
+func defaultCacheConfig() CacheConfig {
+	return CacheConfig{Store: cacheMemory, TTL: 24 * time.Hour, MaxEntries: 10000, MaxBytes: 64 << 20}
+}
+
+// loadCacheConfig reads LLM_CACHE (memory, postgres or off), LLM_CACHE_TTL,
+// LLM_CACHE_MAX_ENTRIES and LLM_CACHE_MAX_BYTES. Invalid values are logged
+// and the defaults used.
+func loadCacheConfig(getenv func(string) string) CacheConfig {
+	cfg := defaultCacheConfig()
+	switch raw := getenv("LLM_CACHE"); raw {
+	case "":
+	case cacheMemory, cachePostgres, cacheOff:
+		cfg.Store = raw
+	default:
+		log.Printf("Warning: Invalid LLM_CACHE %q, using %s", raw, cfg.Store)
+	}
+	if raw := getenv("LLM_CACHE_TTL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			cfg.TTL = d
+		} else {
+			log.Printf("Warning: Invalid LLM_CACHE_TTL %q, using %s", raw, cfg.TTL)
+		}
+	}
+	for _, v := range []struct {
+		key string
+		dst *int
+	}{{"LLM_CACHE_MAX_ENTRIES", &cfg.MaxEntries}, {"LLM_CACHE_MAX_BYTES", &cfg.MaxBytes}} {
+		raw := getenv(v.key)
+		if raw == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			*v.dst = n
+		} else {
+			log.Printf("Warning: Invalid %s %q, using %d", v.key, raw, *v.dst)
+		}
+	}
+	return cfg
+}
+
+// cacheEntry is a cached response. The model and corpus versions it was
+// generated with are kept so it can be dropped when either changes.
+type cacheEntry struct {
+	Key              string
+	Model            string
+	ModelVersion     string
+	CorpusVersion    string
+	InferenceID      string
+	Text             string
+	PromptTokens     int
+	CompletionTokens int
+	Hits             int
+	CreatedAt        time.Time
+	ExpiresAt        time.Time
+}
+
+func (e *cacheEntry) response() BackendResponse {
+	return BackendResponse{Text: e.Text, PromptTokens: e.PromptTokens, CompletionTokens: e.CompletionTokens}
+}
+
+// CacheInfo is set on responses served from the cache: the inference that
+// generated it, when, and how often it has been served.
+type CacheInfo struct {
+	InferenceID string    `json:"inference_id"`
+	CachedAt    time.Time `json:"cached_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Hits        int       `json:"hits"`
+}
+
+// responseStore keeps cached responses.
+type responseStore interface {
+	// get returns the live entry for key, counting the hit, or nil.
+	get(ctx context.Context, key string) (*cacheEntry, error)
+	put(ctx context.Context, entry cacheEntry) error
+	// purge drops entries generated from another corpus version, or a model
+	// version not in models (by model ID).
+	purge(ctx context.Context, corpus string, models map[string]string) (int, error)
+}
+
+// Cache state, set in main. While responseCache is nil, as in tests,
+// nothing is cached.
+var (
+	cacheConfig   = defaultCacheConfig()
+	responseCache responseStore
+)
+
+// newResponseStore creates the configured store, or nil if caching is off.
+func newResponseStore(cfg CacheConfig) responseStore {
+	switch cfg.Store {
+	case cachePostgres:
+		return newPostgresResponseStore(cfg.MaxEntries)
+	case cacheOff:
+		return nil
+	default:
+		return newMemoryResponseStore(cfg.MaxEntries, cfg.MaxBytes)
+	}
+}
+
+// normalizePrompt makes trivially different phrasings of a question share
+// a cache entry: case, spacing and closing punctuation are ignored.
+func normalizePrompt(prompt string) string {
+	prompt = strings.Join(strings.Fields(strings.ToLower(prompt)), " ")
+	return strings.TrimRight(prompt, "?!. ")
+}
+
+// cacheKey identifies a response by everything that determines it: the
+// normalized prompt and context, the model and its version, the generation
+// options after defaults and caps, and the retrieval corpus.
+func cacheKey(prompt, extra, model, modelVersion, corpus string, options GenerationOptions) string {
+	data, _ := json.Marshal(struct {
+		Prompt       string            `json:"prompt"`
+		Context      string            `json:"context"`
+		Model        string            `json:"model"`
+		ModelVersion string            `json:"modelVersion"`
+		Corpus       string            `json:"corpus"`
+		Options      GenerationOptions `json:"options"`
+	}{normalizePrompt(prompt), normalizePrompt(extra), model, modelVersion, corpus, options})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// purgeStaleCache drops cached responses that the corpus or a model has
+// changed since. It runs at startup and whenever the models are reloaded.
+func purgeStaleCache(r *modelRegistry) {
+	if responseCache == nil {
+		return
+	}
+	models := map[string]string{}
+	for id, m := range r.models {
+		models[id] = m.config.version()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n, err := responseCache.purge(ctx, corpusVersion(), models)
+	if err != nil {
+		log.Printf("Warning: Purging the response cache failed: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Purged %d cached responses for a changed corpus or model", n)
+	}
+}
+
+// memoryResponseStore is a least-recently-used cache in this process,
+// bounded by entries and by the size of the text it holds.
+type memoryResponseStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	order      *list.List // of *cacheEntry, most recently used first
+	entries    map[string]*list.Element
+}
+
+func newMemoryResponseStore(maxEntries, maxBytes int) *memoryResponseStore {
+	return &memoryResponseStore{maxEntries: maxEntries, maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func entrySize(e *cacheEntry) int {
+	return len(e.Key) + len(e.Text)
+}
+
+func (s *memoryResponseStore) get(ctx context.Context, key string) (*cacheEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !time.Now().Before(e.ExpiresAt) {
+		s.remove(el)
+		return nil, nil
+	}
+	e.Hits++
+	s.order.MoveToFront(el)
+	hit := *e
+	return &hit, nil
+}
+
+func (s *memoryResponseStore) put(ctx context.Context, entry cacheEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[entry.Key]; ok {
+		s.remove(el)
+	}
+	if entrySize(&entry) > s.maxBytes {
+		return nil
+	}
+	s.entries[entry.Key] = s.order.PushFront(&entry)
+	s.bytes += entrySize(&entry)
+	for s.order.Len() > s.maxEntries || s.bytes > s.maxBytes {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+func (s *memoryResponseStore) purge(ctx context.Context, corpus string, models map[string]string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	for el := s.order.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*cacheEntry)
+		if version, ok := models[e.Model]; !ok || version != e.ModelVersion || e.CorpusVersion != corpus {
+			s.remove(el)
+			purged++
+		}
+		el = next
+	}
+	return purged, nil
+}
+
+// remove drops an entry. s.mu must be held.
+func (s *memoryResponseStore) remove(el *list.Element) {
+	e := s.order.Remove(el).(*cacheEntry)
+	delete(s.entries, e.Key)
+	s.bytes -= entrySize(e)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// cacheMaintenance is how often expired entries are deleted and the cache
+// trimmed to its size.
+const cacheMaintenance = time.Minute
+
+const responseCacheSchema = `
+	CREATE TABLE IF NOT EXISTS llm_response_cache (
+		key CHAR(64) PRIMARY KEY,
+		model VARCHAR(255) NOT NULL,
+		model_version VARCHAR(64) NOT NULL,
+		corpus_version VARCHAR(64) NOT NULL,
+		inference_id UUID NOT NULL,
+		response TEXT NOT NULL,
+		prompt_tokens INTEGER NOT NULL DEFAULT 0,
+		completion_tokens INTEGER NOT NULL DEFAULT 0,
+		hits INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_llm_response_cache_expires ON llm_response_cache(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_llm_response_cache_used ON llm_response_cache(last_used_at);
+	`
+
+// postgresResponseStore shares cached responses between replicas and
+// keeps them across restarts. The least recently used entries beyond
+// maxEntries are deleted periodically.
+type postgresResponseStore struct {
+	maxEntries int
+}
+
+func newPostgresResponseStore(maxEntries int) *postgresResponseStore {
+	s := &postgresResponseStore{maxEntries: maxEntries}
+	go s.maintain()
+	return s
+}
+
+func (s *postgresResponseStore) get(ctx context.Context, key string) (*cacheEntry, error) {
+	e := cacheEntry{Key: key}
+	err := db.QueryRowContext(ctx, `
+		UPDATE llm_response_cache SET hits = hits + 1, last_used_at = now()
+		WHERE key = $1 AND expires_at > now() AT TIME ZONE 'UTC'
+		RETURNING model, model_version, corpus_version, inference_id, response,
+			prompt_tokens, completion_tokens, hits, created_at, expires_at
+	`, key).Scan(&e.Model, &e.ModelVersion, &e.CorpusVersion, &e.InferenceID, &e.Text,
+		&e.PromptTokens, &e.CompletionTokens, &e.Hits, &e.CreatedAt, &e.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *postgresResponseStore) put(ctx context.Context, e cacheEntry) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO llm_response_cache (key, model, model_version, corpus_version, inference_id, response,
+			prompt_tokens, completion_tokens, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (key) DO UPDATE SET
+			model = EXCLUDED.model, model_version = EXCLUDED.model_version,
+			corpus_version = EXCLUDED.corpus_version, inference_id = EXCLUDED.inference_id,
+			response = EXCLUDED.response, prompt_tokens = EXCLUDED.prompt_tokens,
+			completion_tokens = EXCLUDED.completion_tokens, hits = 0,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at, last_used_at = now()
+	`, e.Key, e.Model, e.ModelVersion, e.CorpusVersion, e.InferenceID, e.Text,
+		e.PromptTokens, e.CompletionTokens, e.CreatedAt.UTC(), e.ExpiresAt.UTC())
+	return err
+}
+
+func (s *postgresResponseStore) purge(ctx context.Context, corpus string, models map[string]string) (int, error) {
+	current := make([]string, 0, len(models))
+	for id, version := range models {
+		current = append(current, id+"@"+version)
+	}
+	result, err := db.ExecContext(ctx, `
+		DELETE FROM llm_response_cache
+		WHERE corpus_version <> $1 OR NOT (model || '@' || model_version = ANY($2))
+	`, corpus, pq.Array(current))
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// maintain deletes expired entries and those beyond maxEntries.
+func (s *postgresResponseStore) maintain() {
+	ticker := time.NewTicker(cacheMaintenance)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		for _, stmt := range []struct {
+			query string
+			args  []interface{}
+		}{
+			{"DELETE FROM llm_response_cache WHERE expires_at <= now() AT TIME ZONE 'UTC'", nil},
+			{`DELETE FROM llm_response_cache WHERE key IN (
+				SELECT key FROM llm_response_cache ORDER BY last_used_at DESC OFFSET $1)`, []interface{}{s.maxEntries}},
+		} {
+			if _, err := db.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+				log.Printf("Warning: Maintaining the response cache failed: %v", err)
+				break
+			}
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingBackend is the mock backend, counting the generations it runs.
+type countingBackend struct {
+	mockBackend
+	calls int32
+}
+
+func (b *countingBackend) Generate(ctx context.Context, req BackendRequest) (BackendResponse, error) {
+	atomic.AddInt32(&b.calls, 1)
+	return b.mockBackend.Generate(ctx, req)
+}
+
+func (b *countingBackend) Stream(ctx context.Context, req BackendRequest, onToken TokenFunc) (BackendResponse, error) {
+	atomic.AddInt32(&b.calls, 1)
+	return b.mockBackend.Stream(ctx, req, onToken)
+}
+
+// TestCacheKey tests which requests share a cached response
+func TestCacheKey(t *testing.T) {
+	opts := GenerationOptions{Temperature: float64Ptr(0.2)}
+	key := cacheKey("What powers does Article I grant Congress?", "", "m", "v1", "c1", opts)
+	if got := cacheKey("  what powers does  article I grant congress ", "", "m", "v1", "c1", opts); got != key {
+		t.Error("case, spacing and closing punctuation should not matter")
+	}
+	for name, other := range map[string]string{
+		"prompt":        cacheKey("What powers does Article II grant the President?", "", "m", "v1", "c1", opts),
+		"context":       cacheKey("What powers does Article I grant Congress?", "Answer briefly", "m", "v1", "c1", opts),
+		"model":         cacheKey("What powers does Article I grant Congress?", "", "n", "v1", "c1", opts),
+		"model version": cacheKey("What powers does Article I grant Congress?", "", "m", "v2", "c1", opts),
+		"corpus":        cacheKey("What powers does Article I grant Congress?", "", "m", "v1", "c2", opts),
+		"options":       cacheKey("What powers does Article I grant Congress?", "", "m", "v1", "c1", GenerationOptions{Temperature: float64Ptr(0.3)}),
+	} {
+		if other == key {
+			t.Errorf("a different %s should change the key", name)
+		}
+	}
+
+	base := ModelConfig{ModelInfo: ModelInfo{ID: "m"}, Backend: backendOllama, BaseURL: "http://ollama:11434"}
+	bumped, moved := base, base
+	bumped.Version = "2"
+	moved.UpstreamModel = "mistral:7b-v0.3"
+	if base.version() == bumped.version() || base.version() == moved.version() {
+		t.Error("the model version should change with its version and upstream model")
+	}
+	if documentsVersion([]Document{{ID: "a", Text: "x"}}) == documentsVersion([]Document{{ID: "a", Text: "y"}}) {
+		t.Error("the corpus version should change with its text")
+	}
+}
+
+// TestLoadCacheConfig tests reading cache settings
+func TestLoadCacheConfig(t *testing.T) {
+	env := map[string]string{"LLM_CACHE": "postgres", "LLM_CACHE_TTL": "1h", "LLM_CACHE_MAX_ENTRIES": "0", "LLM_CACHE_MAX_BYTES": "1024"}
+	cfg := loadCacheConfig(func(k string) string { return env[k] })
+	if cfg.Store != cachePostgres || cfg.TTL != time.Hour || cfg.MaxEntries != 10000 || cfg.MaxBytes != 1024 {
+		t.Errorf("config = %+v", cfg)
+	}
+	if cfg := loadCacheConfig(func(k string) string { return map[string]string{"LLM_CACHE": "redis"}[k] }); cfg.Store != cacheMemory {
+		t.Errorf("an unknown store should fall back to memory, got %s", cfg.Store)
+	}
+	if newResponseStore(CacheConfig{Store: cacheOff}) != nil {
+		t.Error("LLM_CACHE=off should disable the cache")
+	}
+}
+
+// TestMemoryResponseStore tests expiry, LRU eviction and purging
+func TestMemoryResponseStore(t *testing.T) {
+	ctx := context.Background()
+	entry := func(key, text string, ttl time.Duration) cacheEntry {
+		return cacheEntry{Key: key, Model: "m", ModelVersion: "v1", CorpusVersion: "c1", Text: text, ExpiresAt: time.Now().Add(ttl)}
+	}
+	s := newMemoryResponseStore(2, 100)
+	s.put(ctx, entry("a", "alpha", time.Hour))
+	s.put(ctx, entry("b", "beta", time.Hour))
+	if hit, _ := s.get(ctx, "a"); hit == nil || hit.Text != "alpha" || hit.Hits != 1 {
+		t.Fatalf("get(a) = %+v", hit)
+	}
+	s.put(ctx, entry("c", "gamma", time.Hour))
+	if hit, _ := s.get(ctx, "b"); hit != nil {
+		t.Error("the least recently used entry should be evicted")
+	}
+	if hit, _ := s.get(ctx, "a"); hit == nil || hit.Hits != 2 {
+		t.Errorf("get(a) = %+v, want a second hit", hit)
+	}
+
+	// Text beyond the byte bound evicts older entries; one too large for
+	// the cache is not stored.
+	s.put(ctx, entry("d", strings.Repeat("x", 95), time.Hour))
+	if len(s.entries) != 1 || s.bytes > 100 {
+		t.Errorf("%d entries of %d bytes, want 1 within 100", len(s.entries), s.bytes)
+	}
+	s.put(ctx, entry("e", strings.Repeat("x", 200), time.Hour))
+	if hit, _ := s.get(ctx, "e"); hit != nil {
+		t.Error("an entry larger than the cache should not be stored")
+	}
+
+	s.put(ctx, entry("old", "stale", -time.Second))
+	if hit, _ := s.get(ctx, "old"); hit != nil || s.entries["old"] != nil {
+		t.Error("expired entries should be dropped")
+	}
+
+	s = newMemoryResponseStore(10, 1000)
+	s.put(ctx, entry("a", "alpha", time.Hour))
+	other := entry("b", "beta", time.Hour)
+	other.Model = "n"
+	s.put(ctx, other)
+	s.put(ctx, cacheEntry{Key: "c", Model: "m", ModelVersion: "v1", CorpusVersion: "c0", ExpiresAt: time.Now().Add(time.Hour)})
+	if n, _ := s.purge(ctx, "c1", map[string]string{"m": "v1", "n": "v2"}); n != 2 || s.entries["a"] == nil {
+		t.Errorf("purged %d, want the entries of model n and corpus c0", n)
+	}
+}
+
+// TestGenerateCache tests serving repeated prompts from the cache
+func TestGenerateCache(t *testing.T) {
+	responseCache = newMemoryResponseStore(100, 1<<20)
+	quotas = newMemoryQuotaStore()
+	admissionConfig.Quotas = map[string]TierQuota{tierFree: {RequestsPerDay: 3}}
+	defer func() {
+		responseCache, quotas, admissionConfig = nil, nil, defaultAdmissionConfig()
+	}()
+
+	backend := &countingBackend{}
+	config := ModelConfig{ModelInfo: ModelInfo{ID: "mock"}, Backend: backendMock}
+	registry.Store(newRegistry([]servedModel{{config: config, backend: backend, tokenizer: estimateTokenizer{}}}, "mock"))
+
+	generate := func(body, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(body))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		handleGenerate(rec, req)
+		return rec
+	}
+
+	var first, second InferenceResponse
+	json.NewDecoder(generate(`{"prompt": "What powers does Article I grant Congress?"}`, "").Body).Decode(&first)
+	if first.Cache != nil || backend.calls != 1 {
+		t.Fatalf("first request: cache = %+v after %d generations", first.Cache, backend.calls)
+	}
+
+	// Hits take no generation but count as requests.
+	rec := generate(`{"prompt": "what powers does article I grant congress"}`, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	json.NewDecoder(rec.Body).Decode(&second)
+	if second.Cache == nil || second.Cache.InferenceID != first.ID || second.Cache.Hits != 1 || backend.calls != 1 {
+		t.Fatalf("second request: cache = %+v after %d generations", second.Cache, backend.calls)
+	}
+	if second.Result != first.Result || second.ID == first.ID || len(second.Citations) != len(first.Citations) {
+		t.Errorf("cached response = %+v, want the first's result under a new ID", second)
+	}
+
+	rec = generate(`{"prompt": "What powers does Article I grant Congress?"}`, "application/x-ndjson")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	var token, summary map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &token)
+	json.Unmarshal([]byte(lines[len(lines)-1]), &summary)
+	if len(lines) != 2 || token["text"] != first.Result || summary["cache"] == nil {
+		t.Errorf("cached stream = %s", rec.Body.String())
+	}
+
+	// With the day's three requests spent, hits are turned away too, as is
+	// no_cache, which would generate afresh.
+	if rec := generate(`{"prompt": "What powers does Article I grant Congress?"}`, ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("hit status = %d, want the quota's 429", rec.Code)
+	}
+	if rec := generate(`{"prompt": "What powers does Article I grant Congress?", "no_cache": true}`, ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("no_cache status = %d, want the quota's 429", rec.Code)
+	}
+
+	// A new model version or corpus invalidates the cached response.
+	quotas = nil
+	config.Version = "2"
+	updated := newRegistry([]servedModel{{config: config, backend: backend, tokenizer: estimateTokenizer{}}}, "mock")
+	registry.Store(updated)
+	purgeStaleCache(updated)
+	var third InferenceResponse
+	json.NewDecoder(generate(`{"prompt": "What powers does Article I grant Congress?"}`, "").Body).Decode(&third)
+	if third.Cache != nil || backend.calls != 2 {
+		t.Errorf("after a model update: cache = %+v after %d generations", third.Cache, backend.calls)
+	}
+
+	ragMu.Lock()
+	corpus := ragVersion
+	ragVersion = "changed"
+	ragMu.Unlock()
+	defer func() {
+		ragMu.Lock()
+		ragVersion = corpus
+		ragMu.Unlock()
+	}()
+	json.NewDecoder(generate(`{"prompt": "What powers does Article I grant Congress?"}`, "").Body).Decode(&third)
+	if third.Cache != nil || backend.calls != 3 {
+		t.Errorf("after a corpus update: cache = %+v after %d generations", third.Cache, backend.calls)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message roles.
+const (
+	roleSystem    = "system"
+	roleUser      = "user"
+	roleAssistant = "assistant"
+)
+
+// Chat templates turn a conversation into the prompt format a model was
+// trained on.
+const (
+	templateMistral = "mistral"
+	templateLlama2  = "llama2"
+	templateChatML  = "chatml"
+	templatePlain   = "plain"
+)
+
+// Message is one turn of a conversation.
+type Message struct {
+	ID        int64     `json:"id,omitempty"`
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+func validateRole(role string) error {
+	switch role {
+	case roleSystem, roleUser, roleAssistant:
+		return nil
+	}
+	return fmt.Errorf("role must be system, user or assistant")
+}
+
+func validateChatTemplate(template string) error {
+	switch template {
+	case templateMistral, templateLlama2, templateChatML, templatePlain:
+		return nil
+	}
+	return fmt.Errorf("unknown chat template %q", template)
+}
+
+// renderChat formats messages in a chat template, ending where the model
+// should continue with the assistant's reply. Templates without a system
+// role fold system messages into the next user message.
+func renderChat(template string, messages []Message) string {
+	var b strings.Builder
+	switch template {
+	case templateMistral, templateLlama2:
+		b.WriteString("<s>")
+		var system []string
+		for _, m := range messages {
+			switch m.Role {
+			case roleSystem:
+				system = append(system, m.Content)
+			case roleUser:
+				content := m.Content
+				if len(system) > 0 {
+					joined := strings.Join(system, "\n\n")
+					if template == templateLlama2 {
+						content = "<<SYS>>\n" + joined + "\n<</SYS>>\n\n" + content
+					} else {
+						content = joined + "\n\n" + content
+					}
+					system = nil
+				}
+				b.WriteString("[INST] " + content + " [/INST]")
+			case roleAssistant:
+				b.WriteString(" " + m.Content + "</s>")
+				if template == templateLlama2 {
+					b.WriteString("<s>")
+				}
+			}
+		}
+	case templateChatML:
+		for _, m := range messages {
+			b.WriteString("<|im_start|>" + m.Role + "\n" + m.Content + "<|im_end|>\n")
+		}
+		b.WriteString("<|im_start|>assistant\n")
+	default:
+		for _, m := range messages {
+			b.WriteString(strings.ToUpper(m.Role[:1]) + m.Role[1:] + ": " + m.Content + "\n\n")
+		}
+		b.WriteString("Assistant:")
+	}
+	return b.String()
+}
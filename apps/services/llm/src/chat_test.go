@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRenderChat tests formatting conversations in each chat template
+func TestRenderChat(t *testing.T) {
+	messages := []Message{
+		{Role: roleSystem, Content: "Cite the Constitution."},
+		{Role: roleUser, Content: "Who declares war?"},
+		{Role: roleAssistant, Content: "Congress."},
+		{Role: roleUser, Content: "Where?"},
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{templateMistral, "<s>[INST] Cite the Constitution.\n\nWho declares war? [/INST] Congress.</s>[INST] Where? [/INST]"},
+		{templateLlama2, "<s>[INST] <<SYS>>\nCite the Constitution.\n<</SYS>>\n\nWho declares war? [/INST] Congress.</s><s>[INST] Where? [/INST]"},
+		{templateChatML, "<|im_start|>system\nCite the Constitution.<|im_end|>\n<|im_start|>user\nWho declares war?<|im_end|>\n" +
+			"<|im_start|>assistant\nCongress.<|im_end|>\n<|im_start|>user\nWhere?<|im_end|>\n<|im_start|>assistant\n"},
+		{templatePlain, "System: Cite the Constitution.\n\nUser: Who declares war?\n\nAssistant: Congress.\n\nUser: Where?\n\nAssistant:"},
+	}
+	for _, tt := range tests {
+		if got := renderChat(tt.template, messages); got != tt.want {
+			t.Errorf("renderChat(%s) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+	if err := validateChatTemplate("alpaca"); err == nil {
+		t.Error("unknown templates should be rejected")
+	}
+}
+
+// TestConversationValidation tests conversation and message validation
+func TestConversationValidation(t *testing.T) {
+	mock := ModelConfig{ModelInfo: ModelInfo{ID: "mock", Aliases: []string{"dev"}}}
+	registry.Store(newRegistry([]servedModel{{config: mock, backend: mockBackend{}, tokenizer: estimateTokenizer{}}}, "mock"))
+
+	req := ConversationRequest{UserID: "user-1", Title: "  Article I  "}
+	if err := req.validate(); err != nil || req.Model != "mock" || req.Title != "Article I" {
+		t.Errorf("validate() = %v, request %+v", err, req)
+	}
+	if err := (&ConversationRequest{Model: "mock"}).validate(); err == nil {
+		t.Error("user_id should be required")
+	}
+	if err := (&ConversationRequest{UserID: "user-1", Model: "gpt-9"}).validate(); err == nil {
+		t.Error("unknown models should be rejected")
+	}
+	if req := (ConversationRequest{UserID: "user-1", Model: "dev"}); req.validate() != nil || req.Model != "mock" {
+		t.Errorf("aliases should resolve to the model's ID, got %q", req.Model)
+	}
+	if err := (&ConversationUpdate{}).validate(); err == nil {
+		t.Error("an empty update should be rejected")
+	}
+
+	if err := validateMessage(Message{Role: "moderator", Content: "hi"}); err == nil {
+		t.Error("unknown roles should be rejected")
+	}
+	if err := validateMessage(Message{Role: roleAssistant, Content: "  "}); err == nil {
+		t.Error("empty content should be rejected")
+	}
+
+	if got := conversationTitle("  What   powers does\nCongress have? "); got != "What powers does Congress have?" {
+		t.Errorf("conversationTitle() = %q", got)
+	}
+	title := conversationTitle(strings.Repeat("enumerated ", 10))
+	if !strings.HasSuffix(title, "...") || len(title) > maxTitleLength+3 || strings.Contains(title, "enumerated ...") {
+		t.Errorf("long titles should be cut at a word: %q", title)
+	}
+	if !isUUID("6f9619ff-8b86-4011-b42d-00c04fc964ff") || isUUID("6f9619ff8b864011b42d00c04fc964ff") {
+		t.Error("isUUID() should accept only canonical UUIDs")
+	}
+}
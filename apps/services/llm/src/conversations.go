@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Conversation list limits.
+const (
+	defaultConversationLimit = 50
+	maxConversationLimit     = 200
+	maxTitleLength           = 60
+)
+
+var errConversationNotFound = errors.New("conversation not found")
+
+// Conversation is a persisted multi-turn chat. Messages is only filled in
+// when a single conversation is fetched.
+type Conversation struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Title     string    `json:"title"`
+	Model     string    `json:"model"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Messages  []Message `json:"messages,omitempty"`
+}
+
+// ConversationRequest creates a conversation. SystemPrompt, if set, becomes
+// its first message. UserID is the authenticated user, from the X-User-ID
+// header; a user_id in the body is ignored.
+type ConversationRequest struct {
+	UserID       string `json:"-"`
+	Title        string `json:"title"`
+	Model        string `json:"model"`
+	SystemPrompt string `json:"system_prompt,omitempty"`
+}
+
+// ConversationUpdate changes a conversation's title or model; nil fields
+// are left alone.
+type ConversationUpdate struct {
+	Title *string `json:"title"`
+	Model *string `json:"model"`
+}
+
+func (r *ConversationRequest) validate() error {
+	if r.UserID == "" {
+		return fmt.Errorf("a user is required")
+	}
+	models := registry.Load()
+	if r.Model == "" {
+		r.Model = models.defaultID
+	}
+	model, ok := models.lookup(r.Model)
+	if !ok {
+		return fmt.Errorf("unknown model %q", r.Model)
+	}
+	r.Model = model.config.ID
+	r.Title = strings.TrimSpace(r.Title)
+	return nil
+}
+
+func (u *ConversationUpdate) validate() error {
+	if u.Title == nil && u.Model == nil {
+		return fmt.Errorf("title or model is required")
+	}
+	if u.Model != nil {
+		model, ok := registry.Load().lookup(*u.Model)
+		if !ok {
+			return fmt.Errorf("unknown model %q", *u.Model)
+		}
+		u.Model = &model.config.ID
+	}
+	return nil
+}
+
+func validateMessage(m Message) error {
+	if err := validateRole(m.Role); err != nil {
+		return err
+	}
+	if strings.TrimSpace(m.Content) == "" {
+		return fmt.Errorf("content is required")
+	}
+	return nil
+}
+
+// conversationTitle names a conversation after its first prompt, cut at a
+// word boundary.
+func conversationTitle(prompt string) string {
+	title := strings.Join(strings.Fields(prompt), " ")
+	if utf8.RuneCountInString(title) <= maxTitleLength {
+		return title
+	}
+	runes := []rune(title)[:maxTitleLength]
+	cut := string(runes)
+	if i := strings.LastIndex(cut, " "); i > maxTitleLength/2 {
+		cut = cut[:i]
+	}
+	return cut + "..."
+}
+
+// conversationStore persists conversations and their messages. update and
+// delete only touch a conversation userID owns. Missing conversations, and
+// other users', are errConversationNotFound.
+type conversationStore interface {
+	create(ctx context.Context, req ConversationRequest) (*Conversation, error)
+	// get loads a conversation with its messages, in order.
+	get(ctx context.Context, id string) (*Conversation, error)
+	// list returns a user's conversations, most recently updated first,
+	// without their messages.
+	list(ctx context.Context, userID string, limit int) ([]Conversation, error)
+	update(ctx context.Context, id, userID string, u ConversationUpdate) (*Conversation, error)
+	delete(ctx context.Context, id, userID string) error
+	// appendMessages adds messages in one transaction, bumping the
+	// conversation's updated_at and setting title if it has none.
+	appendMessages(ctx context.Context, id, title string, messages []*Message) error
+}
+
+// conversations is where conversations are kept. Tests replace it.
+var conversations conversationStore = postgresConversationStore{}
+
+// getConversation loads a conversation and its messages. userID must own
+// it; anonymous callers own no conversations.
+func getConversation(ctx context.Context, id, userID string) (*Conversation, error) {
+	if !isUUID(id) || userID == "" {
+		return nil, errConversationNotFound
+	}
+	c, err := conversations.get(ctx, id)
+	if err == nil && c.UserID != userID {
+		return nil, errConversationNotFound
+	}
+	return c, err
+}
+
+func updateConversation(ctx context.Context, id, userID string, u ConversationUpdate) (*Conversation, error) {
+	if !isUUID(id) || userID == "" {
+		return nil, errConversationNotFound
+	}
+	return conversations.update(ctx, id, userID, u)
+}
+
+func deleteConversation(ctx context.Context, id, userID string) error {
+	if !isUUID(id) || userID == "" {
+		return errConversationNotFound
+	}
+	return conversations.delete(ctx, id, userID)
+}
+
+// appendMessages adds messages to a conversation and titles it after its
+// first prompt if it has no title yet.
+func appendMessages(ctx context.Context, id string, messages []*Message) error {
+	title := ""
+	for _, m := range messages {
+		if m.Role == roleUser {
+			title = conversationTitle(m.Content)
+			break
+		}
+	}
+	return conversations.appendMessages(ctx, id, title, messages)
+}
+
+// isUUID reports whether s is a UUID in canonical form.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
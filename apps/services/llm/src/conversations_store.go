@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const conversationsSchema = `
+	CREATE TABLE IF NOT EXISTS llm_conversations (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id VARCHAR(255) NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		model VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT now() NOT NULL,
+		updated_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_llm_conversations_user ON llm_conversations(user_id, updated_at DESC);
+
+	CREATE TABLE IF NOT EXISTS llm_messages (
+		id BIGSERIAL PRIMARY KEY,
+		conversation_id UUID NOT NULL REFERENCES llm_conversations(id) ON DELETE CASCADE,
+		role VARCHAR(20) NOT NULL CHECK (role IN ('system', 'user', 'assistant')),
+		content TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_llm_messages_conversation ON llm_messages(conversation_id, id);
+	`
+
+// createTables creates the service's tables. Each schema is idempotent.
+func createTables() error {
+	for _, schema := range []string{conversationsSchema, inferencesSchema, quotasSchema, responseCacheSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const conversationColumns = "id, user_id, title, model, created_at, updated_at"
+
+func scanConversation(row interface{ Scan(...interface{}) error }) (*Conversation, error) {
+	var c Conversation
+	if err := row.Scan(&c.ID, &c.UserID, &c.Title, &c.Model, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// queryer is satisfied by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertMessage(ctx context.Context, q queryer, conversationID string, m *Message) error {
+	return q.QueryRowContext(ctx, `
+		INSERT INTO llm_messages (conversation_id, role, content)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, conversationID, m.Role, m.Content).Scan(&m.ID, &m.CreatedAt)
+}
+
+// postgresConversationStore keeps conversations in llm_conversations and
+// their messages in llm_messages.
+type postgresConversationStore struct{}
+
+func (postgresConversationStore) create(ctx context.Context, req ConversationRequest) (*Conversation, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	c, err := scanConversation(tx.QueryRowContext(ctx, `
+		INSERT INTO llm_conversations (user_id, title, model)
+		VALUES ($1, $2, $3)
+		RETURNING `+conversationColumns,
+		req.UserID, req.Title, req.Model))
+	if err != nil {
+		return nil, err
+	}
+	c.Messages = []Message{}
+	if req.SystemPrompt != "" {
+		m := Message{Role: roleSystem, Content: req.SystemPrompt}
+		if err := insertMessage(ctx, tx, c.ID, &m); err != nil {
+			return nil, err
+		}
+		c.Messages = append(c.Messages, m)
+	}
+	return c, tx.Commit()
+}
+
+func (postgresConversationStore) get(ctx context.Context, id string) (*Conversation, error) {
+	c, err := scanConversation(db.QueryRowContext(ctx,
+		"SELECT "+conversationColumns+" FROM llm_conversations WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, errConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, role, content, created_at FROM llm_messages
+		WHERE conversation_id = $1 ORDER BY id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	c.Messages = []Message{}
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.Role, &m.Content, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.Messages = append(c.Messages, m)
+	}
+	return c, rows.Err()
+}
+
+func (postgresConversationStore) list(ctx context.Context, userID string, limit int) ([]Conversation, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+conversationColumns+` FROM llm_conversations
+		WHERE user_id = $1 ORDER BY updated_at DESC, id LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	conversations := []Conversation{}
+	for rows.Next() {
+		c, err := scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, *c)
+	}
+	return conversations, rows.Err()
+}
+
+func (postgresConversationStore) update(ctx context.Context, id, userID string, u ConversationUpdate) (*Conversation, error) {
+	c, err := scanConversation(db.QueryRowContext(ctx, `
+		UPDATE llm_conversations
+		SET title = COALESCE($3, title), model = COALESCE($4, model), updated_at = now()
+		WHERE id = $1 AND user_id = $2
+		RETURNING `+conversationColumns,
+		id, userID, u.Title, u.Model))
+	if err == sql.ErrNoRows {
+		return nil, errConversationNotFound
+	}
+	return c, err
+}
+
+func (postgresConversationStore) delete(ctx context.Context, id, userID string) error {
+	res, err := db.ExecContext(ctx,
+		"DELETE FROM llm_conversations WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errConversationNotFound
+	}
+	return nil
+}
+
+func (postgresConversationStore) appendMessages(ctx context.Context, id, title string, messages []*Message) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range messages {
+		if err := insertMessage(ctx, tx, id, m); err != nil {
+			return err
+		}
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE llm_conversations
+		SET updated_at = now(), title = CASE WHEN title = '' THEN $2 ELSE title END
+		WHERE id = $1
+	`, id, title)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errConversationNotFound
+	}
+	return tx.Commit()
+}
+
+func writeConversationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errConversationNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Conversation not found"})
+		return
+	}
+	log.Printf("Conversation query failed: %v", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to access conversations"})
+}
+
+// writeAnonymousError turns away a request without an authenticated user.
+func writeAnonymousError(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: "Authentication required"})
+}
+
+// handleConversations serves the authenticated user's conversations. Single
+// conversations are addressed by ?id=; other users' are not found.
+func handleConversations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id, userID := q.Get("id"), requestUser(r)
+	if userID == "" {
+		writeAnonymousError(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if id != "" {
+			c, err := getConversation(r.Context(), id, userID)
+			if err != nil {
+				writeConversationError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(c)
+			return
+		}
+		limit := defaultConversationLimit
+		if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 && v <= maxConversationLimit {
+			limit = v
+		}
+		list, err := conversations.list(r.Context(), userID, limit)
+		if err != nil {
+			writeConversationError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"conversations": list,
+		})
+
+	case http.MethodPost:
+		var req ConversationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+			return
+		}
+		req.UserID = userID
+		if err := req.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+			return
+		}
+		c, err := conversations.create(r.Context(), req)
+		if err != nil {
+			writeConversationError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+
+	case http.MethodPatch:
+		var u ConversationUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+			return
+		}
+		if err := u.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+			return
+		}
+		c, err := updateConversation(r.Context(), id, userID, u)
+		if err != nil {
+			writeConversationError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+
+	case http.MethodDelete:
+		if err := deleteConversation(r.Context(), id, userID); err != nil {
+			writeConversationError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+	}
+}
+
+// handleConversationMessages appends a message without generating a reply,
+// e.g. to seed a conversation with earlier turns.
+func handleConversationMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+	userID := requestUser(r)
+	if userID == "" {
+		writeAnonymousError(w)
+		return
+	}
+
+	var m Message
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	if err := validateMessage(m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c, err := getConversation(r.Context(), r.URL.Query().Get("id"), userID)
+	if err == nil {
+		err = appendMessages(r.Context(), c.ID, []*Message{&m})
+	}
+	if err != nil {
+		writeConversationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryConversationStore is an in-memory conversationStore for tests. Its
+// clock advances a second per write so ordering is deterministic.
+type memoryConversationStore struct {
+	mu            sync.Mutex
+	clock         time.Time
+	seq           int64
+	conversations map[string]*Conversation
+}
+
+func newMemoryConversationStore() *memoryConversationStore {
+	return &memoryConversationStore{
+		clock:         time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+		conversations: map[string]*Conversation{},
+	}
+}
+
+func (m *memoryConversationStore) tick() time.Time {
+	m.clock = m.clock.Add(time.Second)
+	return m.clock
+}
+
+func (m *memoryConversationStore) addMessage(c *Conversation, msg *Message) {
+	m.seq++
+	msg.ID, msg.CreatedAt = m.seq, m.tick()
+	c.Messages = append(c.Messages, *msg)
+}
+
+// copyOf returns c as a caller may keep it, with or without messages.
+func copyOf(c *Conversation, messages bool) *Conversation {
+	out := *c
+	out.Messages = nil
+	if messages {
+		out.Messages = append([]Message{}, c.Messages...)
+	}
+	return &out
+}
+
+func (m *memoryConversationStore) create(ctx context.Context, req ConversationRequest) (*Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.tick()
+	c := &Conversation{ID: newInferenceID(), UserID: req.UserID, Title: req.Title, Model: req.Model, CreatedAt: now, UpdatedAt: now}
+	if req.SystemPrompt != "" {
+		m.addMessage(c, &Message{Role: roleSystem, Content: req.SystemPrompt})
+	}
+	m.conversations[c.ID] = c
+	return copyOf(c, true), nil
+}
+
+func (m *memoryConversationStore) get(ctx context.Context, id string) (*Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.conversations[id]
+	if !ok {
+		return nil, errConversationNotFound
+	}
+	return copyOf(c, true), nil
+}
+
+func (m *memoryConversationStore) list(ctx context.Context, userID string, limit int) ([]Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []Conversation{}
+	for _, c := range m.conversations {
+		if c.UserID == userID {
+			list = append(list, *copyOf(c, false))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].UpdatedAt.Equal(list[j].UpdatedAt) {
+			return list[i].UpdatedAt.After(list[j].UpdatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// owned returns the conversation if userID owns it.
+func (m *memoryConversationStore) owned(id, userID string) (*Conversation, error) {
+	c, ok := m.conversations[id]
+	if !ok || c.UserID != userID {
+		return nil, errConversationNotFound
+	}
+	return c, nil
+}
+
+func (m *memoryConversationStore) update(ctx context.Context, id, userID string, u ConversationUpdate) (*Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.owned(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Title != nil {
+		c.Title = *u.Title
+	}
+	if u.Model != nil {
+		c.Model = *u.Model
+	}
+	c.UpdatedAt = m.tick()
+	return copyOf(c, false), nil
+}
+
+func (m *memoryConversationStore) delete(ctx context.Context, id, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.owned(id, userID); err != nil {
+		return err
+	}
+	delete(m.conversations, id)
+	return nil
+}
+
+func (m *memoryConversationStore) appendMessages(ctx context.Context, id, title string, messages []*Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.conversations[id]
+	if !ok {
+		return errConversationNotFound
+	}
+	for _, msg := range messages {
+		m.addMessage(c, msg)
+	}
+	if c.Title == "" {
+		c.Title = title
+	}
+	c.UpdatedAt = m.tick()
+	return nil
+}
+
+// useMemoryConversations swaps in an in-memory store and a mock model for
+// the length of a test.
+func useMemoryConversations(t *testing.T) *memoryConversationStore {
+	store := newMemoryConversationStore()
+	saved := conversations
+	conversations = store
+	t.Cleanup(func() { conversations = saved })
+	mock := ModelConfig{ModelInfo: ModelInfo{ID: "mock", Aliases: []string{"dev"}}, Backend: backendMock}
+	registry.Store(newRegistry([]servedModel{{config: mock, backend: mockBackend{}, tokenizer: estimateTokenizer{}}}, "mock"))
+	return store
+}
+
+// serveConversations sends a request from user, or an anonymous one if
+// user is empty, to the conversation handlers and decodes the JSON
+// response into out, if given.
+func serveConversations(t *testing.T, user, method, target, body string, out interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if user != "" {
+		req.Header.Set(userHeader, user)
+	}
+	rec := httptest.NewRecorder()
+	if strings.HasPrefix(target, "/inference/conversations/messages") {
+		handleConversationMessages(rec, req)
+	} else {
+		handleConversations(rec, req)
+	}
+	if out != nil && rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, target, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// TestConversationCRUD tests creating, reading, listing, renaming and
+// deleting conversations
+func TestConversationCRUD(t *testing.T) {
+	useMemoryConversations(t)
+	alice, bob := newInferenceID(), newInferenceID()
+
+	var created Conversation
+	code := serveConversations(t, alice, http.MethodPost, "/inference/conversations",
+		`{"user_id": "`+bob+`", "title": "  Article I  ", "model": "dev", "system_prompt": "Cite the Constitution."}`, &created)
+	if code != http.StatusCreated || !isUUID(created.ID) || created.UserID != alice || created.Title != "Article I" || created.Model != "mock" {
+		t.Fatalf("create = %d %+v", code, created)
+	}
+	if len(created.Messages) != 1 || created.Messages[0].Role != roleSystem {
+		t.Errorf("created messages = %+v, want the system prompt", created.Messages)
+	}
+
+	for _, body := range []string{`{"model": "gpt-9"}`, `{"title":`} {
+		if code := serveConversations(t, alice, http.MethodPost, "/inference/conversations", body, nil); code != http.StatusBadRequest {
+			t.Errorf("create %s = %d, want 400", body, code)
+		}
+	}
+
+	var second Conversation
+	serveConversations(t, alice, http.MethodPost, "/inference/conversations", `{}`, &second)
+	if second.Model != "mock" || second.Title != "" {
+		t.Errorf("defaults = %+v, want the default model and no title", second)
+	}
+	serveConversations(t, bob, http.MethodPost, "/inference/conversations", `{}`, nil)
+
+	var got Conversation
+	if code := serveConversations(t, alice, http.MethodGet, "/inference/conversations?id="+created.ID, "", &got); code != http.StatusOK || got.ID != created.ID || len(got.Messages) != 1 {
+		t.Errorf("get = %d %+v", code, got)
+	}
+
+	var listed struct{ Conversations []Conversation }
+	if code := serveConversations(t, alice, http.MethodGet, "/inference/conversations", "", &listed); code != http.StatusOK || len(listed.Conversations) != 2 {
+		t.Fatalf("list = %d %+v, want alice's 2 conversations", code, listed)
+	}
+	if listed.Conversations[0].ID != second.ID || listed.Conversations[0].Messages != nil {
+		t.Errorf("list = %+v, want the newest first, without messages", listed.Conversations)
+	}
+	serveConversations(t, alice, http.MethodGet, "/inference/conversations?limit=1", "", &listed)
+	if len(listed.Conversations) != 1 {
+		t.Errorf("limit=1 listed %d", len(listed.Conversations))
+	}
+
+	var renamed Conversation
+	code = serveConversations(t, alice, http.MethodPatch, "/inference/conversations?id="+created.ID, `{"title": "War powers"}`, &renamed)
+	if code != http.StatusOK || renamed.Title != "War powers" || renamed.Model != "mock" {
+		t.Errorf("rename = %d %+v", code, renamed)
+	}
+	for _, body := range []string{`{}`, `{"model": "gpt-9"}`} {
+		if code := serveConversations(t, alice, http.MethodPatch, "/inference/conversations?id="+created.ID, body, nil); code != http.StatusBadRequest {
+			t.Errorf("update %s = %d, want 400", body, code)
+		}
+	}
+	serveConversations(t, alice, http.MethodGet, "/inference/conversations", "", &listed)
+	if listed.Conversations[0].ID != created.ID {
+		t.Error("an update should move the conversation to the top of the list")
+	}
+
+	if code := serveConversations(t, alice, http.MethodDelete, "/inference/conversations?id="+created.ID, "", nil); code != http.StatusNoContent {
+		t.Errorf("delete = %d, want 204", code)
+	}
+	if code := serveConversations(t, alice, http.MethodGet, "/inference/conversations?id="+created.ID, "", nil); code != http.StatusNotFound {
+		t.Errorf("get after delete = %d, want 404", code)
+	}
+	if code := serveConversations(t, alice, http.MethodDelete, "/inference/conversations?id="+created.ID, "", nil); code != http.StatusNotFound {
+		t.Errorf("second delete = %d, want 404", code)
+	}
+	if code := serveConversations(t, alice, http.MethodPut, "/inference/conversations", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want 405", code)
+	}
+}
+
+// TestConversationOwnership tests that other users' conversations are
+// reported as missing
+func TestConversationOwnership(t *testing.T) {
+	store := useMemoryConversations(t)
+	alice, bob := newInferenceID(), newInferenceID()
+	c, _ := store.create(context.Background(), ConversationRequest{UserID: alice, Title: "Mine", Model: "mock"})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{"get", http.MethodGet, "/inference/conversations?id=" + c.ID, ""},
+		{"update", http.MethodPatch, "/inference/conversations?id=" + c.ID, `{"title": "Stolen"}`},
+		{"delete", http.MethodDelete, "/inference/conversations?id=" + c.ID, ""},
+		{"append", http.MethodPost, "/inference/conversations/messages?id=" + c.ID, `{"role": "user", "content": "Hi"}`},
+		{"malformed id", http.MethodGet, "/inference/conversations?id=not-a-uuid", ""},
+		{"unknown id", http.MethodGet, "/inference/conversations?id=" + newInferenceID(), ""},
+	}
+	for _, tt := range tests {
+		if code := serveConversations(t, bob, tt.method, tt.target, tt.body, nil); code != http.StatusNotFound {
+			t.Errorf("%s = %d, want 404", tt.name, code)
+		}
+		// A user_id in the query names nobody; the header is the user.
+		if code := serveConversations(t, bob, tt.method, tt.target+"&user_id="+alice, tt.body, nil); code != http.StatusNotFound {
+			t.Errorf("%s naming the owner = %d, want 404", tt.name, code)
+		}
+		if code := serveConversations(t, "", tt.method, tt.target, tt.body, nil); code != http.StatusUnauthorized {
+			t.Errorf("anonymous %s = %d, want 401", tt.name, code)
+		}
+	}
+	if code := serveConversations(t, "", http.MethodGet, "/inference/conversations?user_id="+alice, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("anonymous list = %d, want 401", code)
+	}
+	if code := serveConversations(t, "", http.MethodPost, "/inference/conversations", `{"user_id": "`+alice+`"}`, nil); code != http.StatusUnauthorized {
+		t.Errorf("anonymous create = %d, want 401", code)
+	}
+
+	got, err := store.get(context.Background(), c.ID)
+	if err != nil || got.Title != "Mine" || len(got.Messages) != 0 {
+		t.Errorf("after other users' requests: %+v (err %v), want it unchanged", got, err)
+	}
+	if code := serveConversations(t, alice, http.MethodGet, "/inference/conversations?id="+c.ID, "", nil); code != http.StatusOK {
+		t.Errorf("owner get = %d, want 200", code)
+	}
+	if _, err := getConversation(context.Background(), c.ID, ""); err != errConversationNotFound {
+		t.Errorf("getConversation without a user = %v, want not found", err)
+	}
+	if err := deleteConversation(context.Background(), c.ID, ""); err != errConversationNotFound {
+		t.Errorf("deleteConversation without a user = %v, want not found", err)
+	}
+}
+
+// TestConversationMessages tests appending messages and titling
+// conversations after their first prompt
+func TestConversationMessages(t *testing.T) {
+	store := useMemoryConversations(t)
+	alice := newInferenceID()
+	c, _ := store.create(context.Background(), ConversationRequest{UserID: alice, Model: "mock"})
+	target := "/inference/conversations/messages?id=" + c.ID
+
+	var m Message
+	code := serveConversations(t, alice, http.MethodPost, target, `{"role": "user", "content": "Who   declares war?"}`, &m)
+	if code != http.StatusCreated || m.ID == 0 || m.Role != roleUser {
+		t.Fatalf("append = %d %+v", code, m)
+	}
+	serveConversations(t, alice, http.MethodPost, target, `{"role": "assistant", "content": "Congress."}`, nil)
+	serveConversations(t, alice, http.MethodPost, target, `{"role": "user", "content": "Where?"}`, nil)
+
+	for _, body := range []string{`{"role": "tool", "content": "x"}`, `{"role": "user", "content": "  "}`, `[`} {
+		if code := serveConversations(t, alice, http.MethodPost, target, body, nil); code != http.StatusBadRequest {
+			t.Errorf("append %s = %d, want 400", body, code)
+		}
+	}
+	if code := serveConversations(t, alice, http.MethodGet, target, "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET messages = %d, want 405", code)
+	}
+
+	got, _ := store.get(context.Background(), c.ID)
+	if got.Title != "Who declares war?" {
+		t.Errorf("title = %q, want the first prompt", got.Title)
+	}
+	var roles []string
+	for _, msg := range got.Messages {
+		roles = append(roles, msg.Role)
+	}
+	if strings.Join(roles, ",") != "user,assistant,user" {
+		t.Errorf("messages = %v, want them in order", roles)
+	}
+
+	if title := conversationTitle(strings.Repeat("separation of powers ", 10)); len([]rune(title)) > maxTitleLength+3 || !strings.HasSuffix(title, "...") {
+		t.Errorf("long title = %q, want it cut at a word with an ellipsis", title)
+	}
+}
+
+// TestGenerateConversation tests continuing a conversation through
+// /inference/generate
+func TestGenerateConversation(t *testing.T) {
+	store := useMemoryConversations(t)
+	alice, bob := newInferenceID(), newInferenceID()
+	c, _ := store.create(context.Background(), ConversationRequest{UserID: alice, Model: "mock", SystemPrompt: "Be brief."})
+
+	generate := func(user, body string) (*httptest.ResponseRecorder, InferenceResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(body))
+		if user != "" {
+			req.Header.Set(userHeader, user)
+		}
+		rec := httptest.NewRecorder()
+		handleGenerate(rec, req)
+		var resp InferenceResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	rec, resp := generate(alice, `{"conversation_id": "`+c.ID+`", "prompt": "Who declares war?"}`)
+	if rec.Code != http.StatusOK || resp.ConversationID != c.ID || resp.Model != "mock" {
+		t.Fatalf("generate = %d %s", rec.Code, rec.Body.String())
+	}
+	got, _ := store.get(context.Background(), c.ID)
+	if len(got.Messages) != 3 || got.Messages[1].Content != "Who declares war?" || got.Messages[2].Content != resp.Result {
+		t.Errorf("messages = %+v, want the prompt and reply after the system prompt", got.Messages)
+	}
+	if got.Title != "Who declares war?" {
+		t.Errorf("title = %q, want the first prompt", got.Title)
+	}
+
+	for _, tt := range []struct{ name, user, body string }{
+		{"another user's", bob, `{"conversation_id": "` + c.ID + `", "prompt": "Hi"}`},
+		{"an unknown", bob, `{"conversation_id": "` + newInferenceID() + `", "prompt": "Hi"}`},
+		{"anonymously, another user's", "", `{"conversation_id": "` + c.ID + `", "prompt": "Hi", "user_id": "` + alice + `"}`},
+	} {
+		if rec, _ := generate(tt.user, tt.body); rec.Code != http.StatusNotFound {
+			t.Errorf("continuing %s conversation = %d, want 404", tt.name, rec.Code)
+		}
+	}
+	if got, _ := store.get(context.Background(), c.ID); len(got.Messages) != 3 {
+		t.Errorf("failed requests added messages: %+v", got.Messages)
+	}
+}
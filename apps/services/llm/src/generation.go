@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// generation is a validated /inference/generate request, ready to send to
+// its model's backend.
+type generation struct {
+	// id identifies the inference in responses and llm_inferences.
+	id      string
+	started time.Time
+	req     InferenceRequest
+	// models is the registry the request was resolved in, and requestedID
+	// the model it asked for. modelID and model are the model it is sent
+	// to, which is a fallback if requestedID failed.
+	models      *modelRegistry
+	requestedID string
+	modelID     string
+	model       servedModel
+	tier        string
+	streamed    bool
+	// admission is the request's place in its quota and the queue.
+	admission  *admission
+	backendReq BackendRequest
+	parts      promptParts
+	retrieved  []Document
+	// promptTokens is the prompt's size by the model's tokenizer, and trim
+	// what was cut to fit it in the context window.
+	promptTokens int
+	trim         *ContextTrim
+	// conversation is set when the request continues a conversation; the
+	// turn is stored once the reply is complete.
+	conversation *Conversation
+	// cacheKey is set when the response may come from or go to the
+	// response cache, and cacheHit when it was found there.
+	cacheKey string
+	cacheHit *cacheEntry
+}
+
+// prepareGeneration resolves the model, retrieves founding-document context
+// and plans the backend request. Errors come with the HTTP status to
+// report.
+func prepareGeneration(ctx context.Context, req InferenceRequest) (*generation, int, error) {
+	if req.Prompt == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("prompt is required")
+	}
+
+	g := &generation{id: newInferenceID(), started: time.Now(), req: req}
+	if req.ConversationID != "" {
+		c, err := getConversation(ctx, req.ConversationID, req.UserID)
+		if errors.Is(err, errConversationNotFound) {
+			return nil, http.StatusNotFound, fmt.Errorf("Conversation not found")
+		}
+		if err != nil {
+			log.Printf("Loading conversation failed: %v", err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("Failed to load conversation")
+		}
+		g.conversation = c
+	}
+
+	models := registry.Load()
+	requested := req.ModelID
+	if requested == "" {
+		requested = req.Model
+	}
+	if requested == "" && g.conversation != nil {
+		// Conversations whose model was removed continue on the default.
+		if _, ok := models.lookup(g.conversation.Model); ok {
+			requested = g.conversation.Model
+		}
+	}
+	model := models.defaultModel()
+	if requested != "" {
+		var ok bool
+		if model, ok = models.lookup(requested); !ok {
+			return nil, http.StatusBadRequest, fmt.Errorf("unknown model %q", requested)
+		}
+	}
+	g.models, g.requestedID = models, model.config.ID
+
+	g.tier = userTier(ctx, req.UserID)
+	if !model.config.visibleTo(g.tier) {
+		return nil, http.StatusForbidden, fmt.Errorf("model %s is not available on the %s tier", model.config.ID, g.tier)
+	}
+	if models.modelStatus(model.config.ID) == statusNotInstalled {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("model %s is not installed on its backend", model.config.ID)
+	}
+
+	// Retrieval context for founding documents is found once, and fitted
+	// to each model the request is tried on.
+	g.parts = promptParts{extra: req.Context, retrieved: retrieveContext(req.Prompt, 3), prompt: req.Prompt}
+	if g.conversation != nil {
+		g.parts.history = g.conversation.Messages
+	}
+	if status, err := g.plan(model); err != nil {
+		return nil, status, err
+	}
+	logRetrievalMetadata(req.Prompt, g.retrieved)
+
+	// Conversations depend on their history, so only single prompts are
+	// cached.
+	if responseCache != nil && !req.NoCache && g.conversation == nil {
+		g.cacheKey = cacheKey(req.Prompt, req.Context, g.modelID, model.config.version(), corpusVersion(), g.backendReq.Options)
+	}
+	return g, 0, nil
+}
+
+// fromCache looks the response up in the response cache, reporting
+// whether it was found.
+func (g *generation) fromCache(ctx context.Context) bool {
+	if g.cacheKey == "" {
+		return false
+	}
+	hit, err := responseCache.get(ctx, g.cacheKey)
+	if err != nil {
+		log.Printf("Warning: Reading the response cache failed: %v", err)
+		return false
+	}
+	if hit == nil || hit.ModelVersion != g.model.config.version() || hit.CorpusVersion != corpusVersion() {
+		return false
+	}
+	g.cacheHit = hit
+	return true
+}
+
+// cacheInfo describes the cached response served, or is nil.
+func (g *generation) cacheInfo() *CacheInfo {
+	if g.cacheHit == nil {
+		return nil
+	}
+	return &CacheInfo{InferenceID: g.cacheHit.InferenceID, CachedAt: g.cacheHit.CreatedAt, ExpiresAt: g.cacheHit.ExpiresAt, Hits: g.cacheHit.Hits}
+}
+
+// cache stores a generated response for later requests. Responses from a
+// fallback model are not cached under the requested one.
+func (g *generation) cache(ctx context.Context, resp BackendResponse) {
+	if g.cacheKey == "" || g.cacheHit != nil || g.fallbackFrom() != "" {
+		return
+	}
+	promptTokens, completionTokens := g.usage(resp)
+	now := time.Now().UTC()
+	err := responseCache.put(context.WithoutCancel(ctx), cacheEntry{
+		Key:              g.cacheKey,
+		Model:            g.modelID,
+		ModelVersion:     g.model.config.version(),
+		CorpusVersion:    corpusVersion(),
+		InferenceID:      g.id,
+		Text:             resp.Text,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(cacheConfig.TTL),
+	})
+	if err != nil {
+		log.Printf("Warning: Writing the response cache failed: %v", err)
+	}
+}
+
+// plan targets the generation at model: its options after defaults and
+// caps, and the prompt fitted to its context window in its chat template.
+// g is only changed if the request fits the model.
+func (g *generation) plan(model servedModel) (int, error) {
+	id := model.config.ID
+	options, err := model.config.resolveOptions(g.req.Options, g.tier)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	render := renderPlainPrompt
+	if g.conversation != nil {
+		render = func(messages []Message) string { return renderChat(model.config.ChatTemplate, messages) }
+	}
+	// A requested max_tokens is kept free for the reply. One that only
+	// came from defaults or the tier's cap reserves no more than usual, so a
+	// large cap does not crowd out the prompt.
+	window, reserve := model.config.ContextWindow, replyReserve(model.config.ContextWindow)
+	if g.req.Options.MaxTokens != nil {
+		reserve = *options.MaxTokens
+		if window > 0 && reserve >= window {
+			return http.StatusBadRequest, fmt.Errorf("max_tokens must be less than the context window of %s (%d)", id, window)
+		}
+	} else if options.MaxTokens != nil && *options.MaxTokens < reserve {
+		reserve = *options.MaxTokens
+	}
+	fitted, err := fitPrompt(model.tokenizer, render, window, reserve, g.parts)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if fitted.trim != nil {
+		log.Printf("Trimmed prompt for model %s to %d tokens: %+v", id, fitted.tokens, *fitted.trim)
+	}
+
+	g.model, g.modelID = model, id
+	g.retrieved, g.trim, g.promptTokens = fitted.retrieved, fitted.trim, fitted.tokens
+	g.backendReq = BackendRequest{Model: model.config.upstreamName(), Prompt: fitted.prompt, Options: options}
+	if g.conversation != nil {
+		g.backendReq.Raw, g.backendReq.Messages = true, fitted.messages
+	}
+	return 0, nil
+}
+
+// generate runs the generation, streaming text to onToken if it is not
+// nil. A cached response is sent whole. If the model fails before
+// producing any text, its fallbacks are tried in order, skipping those the
+// user's tier cannot use, that are not installed or that the request does
+// not fit. g then describes the model that answered, or the last one tried.
+func (g *generation) generate(ctx context.Context, onToken TokenFunc) (BackendResponse, error) {
+	if g.cacheHit != nil {
+		resp := g.cacheHit.response()
+		if onToken != nil {
+			if err := onToken(resp.Text); err != nil {
+				return BackendResponse{}, err
+			}
+		}
+		return resp, nil
+	}
+
+	streamed := false
+	relay := onToken
+	if onToken != nil {
+		relay = func(text string) error {
+			streamed = true
+			return onToken(text)
+		}
+	}
+
+	fallbacks := g.model.config.Fallbacks
+	resp, err := callBackend(ctx, g.model, g.backendReq, relay)
+	for _, id := range fallbacks {
+		if err == nil || ctx.Err() != nil || streamed {
+			break
+		}
+		model, ok := g.models.lookup(id)
+		if !ok || !model.config.visibleTo(g.tier) || g.models.modelStatus(id) == statusNotInstalled {
+			continue
+		}
+		failed := g.modelID
+		if _, planErr := g.plan(model); planErr != nil {
+			log.Printf("Skipping fallback model %s: %v", id, planErr)
+			continue
+		}
+		log.Printf("Model %s failed, falling back to %s: %v", failed, id, err)
+		resp, err = callBackend(ctx, g.model, g.backendReq, relay)
+	}
+	return resp, err
+}
+
+// fallbackFrom is the requested model when a fallback answered instead.
+func (g *generation) fallbackFrom() string {
+	if g.modelID == g.requestedID {
+		return ""
+	}
+	return g.requestedID
+}
+
+// renderPlainPrompt is the prompt for a single request: any context, then
+// the prompt, separated by a blank line.
+func renderPlainPrompt(messages []Message) string {
+	parts := make([]string, len(messages))
+	for i, m := range messages {
+		parts[i] = m.Content
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// usage is the prompt and completion token counts, preferring those the
+// backend reports and counting with the model's tokenizer otherwise.
+func (g *generation) usage(resp BackendResponse) (int, int) {
+	prompt, completion := resp.PromptTokens, resp.CompletionTokens
+	if prompt == 0 {
+		prompt = g.promptTokens
+	}
+	if completion == 0 {
+		completion = g.model.tokenizer.Count(resp.Text)
+	}
+	return prompt, completion
+}
+
+// conversationID is the ID of the conversation being continued, if any.
+func (g *generation) conversationID() string {
+	if g.conversation == nil {
+		return ""
+	}
+	return g.conversation.ID
+}
+
+// complete records the inference, caches the response and stores the turn
+// in the conversation. It still runs if the client has gone, since the reply was
+// generated.
+func (g *generation) complete(ctx context.Context, resp BackendResponse) error {
+	g.record(resp, inferenceOK, nil)
+	g.cache(ctx, resp)
+	if g.conversation == nil {
+		return nil
+	}
+	return appendMessages(context.WithoutCancel(ctx), g.conversation.ID, []*Message{
+		{Role: roleUser, Content: g.req.Prompt},
+		{Role: roleAssistant, Content: resp.Text},
+	})
+}
+
+// fail records an inference that did not complete. partial is whatever
+// text was generated before it stopped.
+func (g *generation) fail(ctx context.Context, err error, partial string) {
+	status := inferenceError
+	if ctx.Err() != nil {
+		status = inferenceCancelled
+	}
+	g.record(BackendResponse{Text: partial}, status, err)
+}
+
+// record charges the inference to the user's quota, refunding the request
+// if it failed on our side, and adds it to the inference log.
+func (g *generation) record(resp BackendResponse, status string, err error) {
+	promptTokens, completionTokens := g.usage(resp)
+	g.admission.charge(promptTokens+completionTokens, status == inferenceError)
+	if inferenceLog == nil {
+		return
+	}
+	rec := InferenceRecord{
+		ID:               g.id,
+		UserID:           g.req.UserID,
+		Tier:             g.tier,
+		Model:            g.modelID,
+		RequestedModel:   g.fallbackFrom(),
+		ConversationID:   g.conversationID(),
+		PromptHash:       hashPrompt(g.req.Prompt),
+		Completion:       resp.Text,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Latency:          time.Since(g.started),
+		Status:           status,
+		Streamed:         g.streamed,
+		Cached:           g.cacheHit != nil,
+		CreatedAt:        time.Now().UTC(),
+	}
+	if g.req.StorePrompt {
+		rec.Prompt = g.req.Prompt
+	}
+	for _, doc := range g.retrieved {
+		rec.DocumentIDs = append(rec.DocumentIDs, doc.ID)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	inferenceLog.Record(rec)
+}
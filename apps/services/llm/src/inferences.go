@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outcomes of an inference.
+const (
+	inferenceOK        = "ok"
+	inferenceError     = "error"
+	inferenceCancelled = "cancelled" // the client went away mid-generation
+)
+
+const (
+	defaultUsageDays = 30
+	maxUsageDays     = 366
+	usageDateLayout  = "2006-01-02"
+)
+
+// InferenceRecord is one generation as stored in llm_inferences. Prompt is
+// only kept when the request opted in; PromptHash always is, so repeated
+// prompts can be counted without storing them.
+type InferenceRecord struct {
+	ID               string
+	UserID           string
+	Tier             string
+	Model            string
+	RequestedModel   string // set when a fallback model was used
+	ConversationID   string
+	PromptHash       string
+	Prompt           string
+	Completion       string
+	PromptTokens     int
+	CompletionTokens int
+	Latency          time.Duration
+	DocumentIDs      []string
+	Status           string
+	Error            string
+	Streamed         bool
+	Cached           bool // served from the response cache
+	CreatedAt        time.Time
+}
+
+// newInferenceID returns a random UUID (version 4).
+func newInferenceID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// inferenceSink persists one batch of records.
+type inferenceSink interface {
+	writeInferences(ctx context.Context, records []InferenceRecord) error
+}
+
+// InferenceLogConfig sizes the inference log's buffer.
+type InferenceLogConfig struct {
+	Capacity      int           // records buffered before new ones are dropped
+	BatchSize     int           // maximum records per write
+	FlushInterval time.Duration // longest a record waits for a full batch
+	MaxRetries    int           // write attempts after the first before a batch is dropped
+}
+
+func defaultInferenceLogConfig() InferenceLogConfig {
+	return InferenceLogConfig{Capacity: 5000, BatchSize: 100, FlushInterval: time.Second, MaxRetries: 3}
+}
+
+// InferenceLog writes inference records in batches from a single worker,
+// so a slow database never holds up a response and the number of records
+// in memory is bounded. Records that arrive while the buffer is full are
+// dropped and counted.
+type InferenceLog struct {
+	cfg     InferenceLogConfig
+	sink    inferenceSink
+	records chan InferenceRecord
+	done    chan struct{}
+
+	mu     sync.RWMutex // guards closed against concurrent Record
+	closed bool
+
+	written, dropped atomic.Int64
+}
+
+// inferenceLog is set in main. While it is nil, as in tests, inferences are
+// not recorded.
+var inferenceLog *InferenceLog
+
+func newInferenceLog(cfg InferenceLogConfig, sink inferenceSink) *InferenceLog {
+	l := &InferenceLog{
+		cfg:     cfg,
+		sink:    sink,
+		records: make(chan InferenceRecord, cfg.Capacity),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Record queues a record without blocking. Records that arrive after
+// Close are dropped.
+func (l *InferenceLog) Record(rec InferenceRecord) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+	select {
+	case l.records <- rec:
+	default:
+		if l.dropped.Add(1)%100 == 1 {
+			log.Printf("Warning: inference log is full, %d records dropped so far", l.dropped.Load())
+		}
+	}
+}
+
+// Close writes everything queued and stops the worker, or gives up when
+// ctx expires.
+func (l *InferenceLog) Close(ctx context.Context) error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.records)
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("draining inference log: %d records unwritten: %w", len(l.records), ctx.Err())
+	}
+}
+
+func (l *InferenceLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]InferenceRecord, 0, l.cfg.BatchSize)
+	for {
+		select {
+		case rec, ok := <-l.records:
+			if !ok {
+				l.flush(batch)
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) == l.cfg.BatchSize {
+				l.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				l.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush writes a batch, retrying with backoff, and drops it if it still
+// fails.
+func (l *InferenceLog) flush(batch []InferenceRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := 100 * time.Millisecond
+	var err error
+	for attempt := 0; attempt <= l.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = l.sink.writeInferences(ctx, batch)
+		cancel()
+		if err == nil {
+			l.written.Add(int64(len(batch)))
+			return
+		}
+	}
+	l.dropped.Add(int64(len(batch)))
+	log.Printf("Error: dropping %d inference records after %d attempts: %v", len(batch), l.cfg.MaxRetries+1, err)
+}
+
+// UsageQuery is a parsed usage request: whole days from From to To,
+// inclusive. UserID is set by the handler from the authenticated user.
+type UsageQuery struct {
+	UserID string
+	From   time.Time
+	To     time.Time
+}
+
+// parseUsageQuery reads from and to (YYYY-MM-DD). The range defaults to the
+// thirty days ending today.
+func parseUsageQuery(q url.Values, now time.Time) (UsageQuery, error) {
+	query := UsageQuery{To: now.UTC().Truncate(24 * time.Hour)}
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(usageDateLayout, v)
+		if err != nil {
+			return query, fmt.Errorf("to must be YYYY-MM-DD")
+		}
+		query.To = t
+	}
+	query.From = query.To.AddDate(0, 0, 1-defaultUsageDays)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(usageDateLayout, v)
+		if err != nil {
+			return query, fmt.Errorf("from must be YYYY-MM-DD")
+		}
+		query.From = t
+	}
+	if query.To.Before(query.From) {
+		return query, fmt.Errorf("from must not be after to")
+	}
+	if query.To.Sub(query.From) >= maxUsageDays*24*time.Hour {
+		return query, fmt.Errorf("the range is limited to %d days", maxUsageDays)
+	}
+	return query, nil
+}
+
+// UsageTotals sums inferences. Tokens is prompt plus completion tokens.
+type UsageTotals struct {
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Tokens           int64   `json:"tokens"`
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+}
+
+// add folds one usage row into the totals. latencyMs is the row's summed
+// latency.
+func (t *UsageTotals) add(requests, errors, promptTokens, completionTokens, latencyMs int64) {
+	total := t.AvgLatencyMs*float64(t.Requests) + float64(latencyMs)
+	t.Requests += requests
+	t.Errors += errors
+	t.PromptTokens += promptTokens
+	t.CompletionTokens += completionTokens
+	t.Tokens = t.PromptTokens + t.CompletionTokens
+	if t.Requests > 0 {
+		t.AvgLatencyMs = total / float64(t.Requests)
+	}
+}
+
+type DailyUsage struct {
+	Day string `json:"day"`
+	UsageTotals
+}
+
+type ModelUsage struct {
+	Model string `json:"model"`
+	UsageTotals
+}
+
+// UsageResponse is one user's consumption over a range of days.
+type UsageResponse struct {
+	UserID string       `json:"user_id"`
+	Tier   string       `json:"tier"`
+	From   string       `json:"from"`
+	To     string       `json:"to"`
+	Totals UsageTotals  `json:"totals"`
+	Days   []DailyUsage `json:"days"`
+	Models []ModelUsage `json:"models"`
+}
+
+type TierUsage struct {
+	Tier  string `json:"tier"`
+	Users int64  `json:"users"`
+	UsageTotals
+}
+
+// TierUsageResponse is consumption per tier over a range of days.
+type TierUsageResponse struct {
+	From  string      `json:"from"`
+	To    string      `json:"to"`
+	Tiers []TierUsage `json:"tiers"`
+}
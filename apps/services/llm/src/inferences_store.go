@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// llm_usage_daily is kept up to date as inferences are written, so usage
+// queries never scan llm_inferences.
+const inferencesSchema = `
+	CREATE TABLE IF NOT EXISTS llm_inferences (
+		id UUID PRIMARY KEY,
+		user_id VARCHAR(255) NOT NULL DEFAULT '',
+		tier VARCHAR(20) NOT NULL,
+		model VARCHAR(255) NOT NULL,
+		conversation_id UUID,
+		prompt_hash CHAR(64) NOT NULL,
+		prompt TEXT,
+		completion TEXT NOT NULL DEFAULT '',
+		prompt_tokens INTEGER NOT NULL DEFAULT 0,
+		completion_tokens INTEGER NOT NULL DEFAULT 0,
+		latency_ms INTEGER NOT NULL,
+		document_ids TEXT[] NOT NULL DEFAULT '{}',
+		status VARCHAR(20) NOT NULL CHECK (status IN ('ok', 'error', 'cancelled')),
+		error TEXT,
+		streamed BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP DEFAULT now() NOT NULL
+	);
+
+	ALTER TABLE llm_inferences ADD COLUMN IF NOT EXISTS requested_model VARCHAR(255);
+	ALTER TABLE llm_inferences ADD COLUMN IF NOT EXISTS cached BOOLEAN NOT NULL DEFAULT FALSE;
+
+	CREATE INDEX IF NOT EXISTS idx_llm_inferences_user ON llm_inferences(user_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_llm_inferences_prompt_hash ON llm_inferences(prompt_hash);
+
+	CREATE TABLE IF NOT EXISTS llm_usage_daily (
+		day DATE NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		tier VARCHAR(20) NOT NULL,
+		model VARCHAR(255) NOT NULL,
+		requests BIGINT NOT NULL,
+		errors BIGINT NOT NULL,
+		prompt_tokens BIGINT NOT NULL,
+		completion_tokens BIGINT NOT NULL,
+		latency_ms BIGINT NOT NULL,
+		PRIMARY KEY (day, user_id, tier, model)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_llm_usage_daily_user ON llm_usage_daily(user_id, day);
+	`
+
+// postgresInferenceSink writes inference records to llm_inferences.
+type postgresInferenceSink struct{}
+
+// usageKey is one llm_usage_daily row.
+type usageKey struct {
+	day, userID, tier, model string
+}
+
+type usageRow struct {
+	requests, errors, promptTokens, completionTokens, latencyMs int64
+}
+
+// writeInferences inserts the records and adds them to the daily usage in
+// one transaction. Usage rows are updated in a fixed order so concurrent
+// replicas cannot deadlock.
+func (postgresInferenceSink) writeInferences(ctx context.Context, records []InferenceRecord) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	usage := map[usageKey]*usageRow{}
+	for _, rec := range records {
+		conversationID := sql.NullString{String: rec.ConversationID, Valid: rec.ConversationID != ""}
+		prompt := sql.NullString{String: rec.Prompt, Valid: rec.Prompt != ""}
+		errMsg := sql.NullString{String: rec.Error, Valid: rec.Error != ""}
+		requestedModel := sql.NullString{String: rec.RequestedModel, Valid: rec.RequestedModel != ""}
+		documentIDs := rec.DocumentIDs
+		if documentIDs == nil {
+			documentIDs = []string{}
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO llm_inferences (id, user_id, tier, model, requested_model, conversation_id, prompt_hash, prompt,
+				completion, prompt_tokens, completion_tokens, latency_ms, document_ids, status, error, streamed, cached,
+				created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+			ON CONFLICT (id) DO NOTHING
+		`, rec.ID, rec.UserID, rec.Tier, rec.Model, requestedModel, conversationID, rec.PromptHash, prompt,
+			rec.Completion, rec.PromptTokens, rec.CompletionTokens, rec.Latency.Milliseconds(), pq.Array(documentIDs),
+			rec.Status, errMsg, rec.Streamed, rec.Cached, rec.CreatedAt); err != nil {
+			return err
+		}
+
+		key := usageKey{rec.CreatedAt.UTC().Format(usageDateLayout), rec.UserID, rec.Tier, rec.Model}
+		row := usage[key]
+		if row == nil {
+			row = &usageRow{}
+			usage[key] = row
+		}
+		row.requests++
+		if rec.Status == inferenceError {
+			row.errors++
+		}
+		row.promptTokens += int64(rec.PromptTokens)
+		row.completionTokens += int64(rec.CompletionTokens)
+		row.latencyMs += rec.Latency.Milliseconds()
+	}
+
+	keys := make([]usageKey, 0, len(usage))
+	for k := range usage {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.day != b.day {
+			return a.day < b.day
+		}
+		if a.userID != b.userID {
+			return a.userID < b.userID
+		}
+		if a.tier != b.tier {
+			return a.tier < b.tier
+		}
+		return a.model < b.model
+	})
+	for _, k := range keys {
+		row := usage[k]
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO llm_usage_daily (day, user_id, tier, model, requests, errors, prompt_tokens, completion_tokens, latency_ms)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (day, user_id, tier, model) DO UPDATE SET
+				requests = llm_usage_daily.requests + EXCLUDED.requests,
+				errors = llm_usage_daily.errors + EXCLUDED.errors,
+				prompt_tokens = llm_usage_daily.prompt_tokens + EXCLUDED.prompt_tokens,
+				completion_tokens = llm_usage_daily.completion_tokens + EXCLUDED.completion_tokens,
+				latency_ms = llm_usage_daily.latency_ms + EXCLUDED.latency_ms
+		`, k.day, k.userID, k.tier, k.model, row.requests, row.errors, row.promptTokens, row.completionTokens, row.latencyMs); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// queryUserUsage totals a user's inferences by day and by model.
+func queryUserUsage(ctx context.Context, q UsageQuery) (*UsageResponse, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT day, model, SUM(requests), SUM(errors), SUM(prompt_tokens), SUM(completion_tokens), SUM(latency_ms)
+		FROM llm_usage_daily
+		WHERE user_id = $1 AND day BETWEEN $2 AND $3
+		GROUP BY day, model
+		ORDER BY day, model
+	`, q.UserID, q.From, q.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &UsageResponse{
+		UserID: q.UserID,
+		Tier:   userTier(ctx, q.UserID),
+		From:   q.From.Format(usageDateLayout),
+		To:     q.To.Format(usageDateLayout),
+		Days:   []DailyUsage{},
+		Models: []ModelUsage{},
+	}
+	models := map[string]int{}
+	for rows.Next() {
+		var day time.Time
+		var model string
+		var requests, errors, promptTokens, completionTokens, latencyMs int64
+		if err := rows.Scan(&day, &model, &requests, &errors, &promptTokens, &completionTokens, &latencyMs); err != nil {
+			return nil, err
+		}
+		resp.Totals.add(requests, errors, promptTokens, completionTokens, latencyMs)
+
+		if d := day.Format(usageDateLayout); len(resp.Days) == 0 || resp.Days[len(resp.Days)-1].Day != d {
+			resp.Days = append(resp.Days, DailyUsage{Day: d})
+		}
+		resp.Days[len(resp.Days)-1].add(requests, errors, promptTokens, completionTokens, latencyMs)
+
+		i, ok := models[model]
+		if !ok {
+			i = len(resp.Models)
+			models[model] = i
+			resp.Models = append(resp.Models, ModelUsage{Model: model})
+		}
+		resp.Models[i].add(requests, errors, promptTokens, completionTokens, latencyMs)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(resp.Models, func(i, j int) bool { return resp.Models[i].Tokens > resp.Models[j].Tokens })
+	return resp, nil
+}
+
+// queryTierUsage totals inferences per tier. Users counts the distinct
+// signed-in users who made them.
+func queryTierUsage(ctx context.Context, q UsageQuery) (*TierUsageResponse, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT tier, COUNT(DISTINCT user_id) FILTER (WHERE user_id <> ''),
+			SUM(requests), SUM(errors), SUM(prompt_tokens), SUM(completion_tokens), SUM(latency_ms)
+		FROM llm_usage_daily
+		WHERE day BETWEEN $1 AND $2
+		GROUP BY tier
+		ORDER BY tier
+	`, q.From, q.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &TierUsageResponse{From: q.From.Format(usageDateLayout), To: q.To.Format(usageDateLayout), Tiers: []TierUsage{}}
+	for rows.Next() {
+		var t TierUsage
+		var requests, errors, promptTokens, completionTokens, latencyMs int64
+		if err := rows.Scan(&t.Tier, &t.Users, &requests, &errors, &promptTokens, &completionTokens, &latencyMs); err != nil {
+			return nil, err
+		}
+		t.add(requests, errors, promptTokens, completionTokens, latencyMs)
+		resp.Tiers = append(resp.Tiers, t)
+	}
+	return resp, rows.Err()
+}
+
+// usageToken is the operator token the per-tier report requires, set in
+// main from LLM_USAGE_TOKEN. While it is empty the report is not served.
+var usageToken string
+
+// canReadTierUsage reports whether r carries the operator token.
+func canReadTierUsage(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if usageToken == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(usageToken)) == 1
+}
+
+// handleUsage reports the authenticated user's consumption:
+// GET /inference/usage with optional from and to dates.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	query, err := parseUsageQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	if query.UserID = requestUser(r); query.UserID == "" {
+		writeAnonymousError(w)
+		return
+	}
+	usage, err := queryUserUsage(r.Context(), query)
+	if err != nil {
+		log.Printf("Querying usage failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load usage"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// handleTierUsage reports consumption per tier to operators:
+// GET /inference/usage/tiers with optional from and to dates.
+func handleTierUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+	if !canReadTierUsage(r) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Forbidden"})
+		return
+	}
+
+	query, err := parseUsageQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+	usage, err := queryTierUsage(r.Context(), query)
+	if err != nil {
+		log.Printf("Querying tier usage failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to load usage"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
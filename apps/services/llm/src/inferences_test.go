@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryInferenceSink collects written records, failing the first
+// failures writes.
+type memoryInferenceSink struct {
+	mu       sync.Mutex
+	batches  [][]InferenceRecord
+	failures int
+}
+
+func (s *memoryInferenceSink) writeInferences(ctx context.Context, records []InferenceRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("database unavailable")
+	}
+	s.batches = append(s.batches, append([]InferenceRecord(nil), records...))
+	return nil
+}
+
+func (s *memoryInferenceSink) records() []InferenceRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []InferenceRecord
+	for _, b := range s.batches {
+		all = append(all, b...)
+	}
+	return all
+}
+
+// TestInferenceLog tests batching, retrying and bounding inference records
+func TestInferenceLog(t *testing.T) {
+	sink := &memoryInferenceSink{failures: 1}
+	l := newInferenceLog(InferenceLogConfig{Capacity: 10, BatchSize: 3, FlushInterval: time.Hour, MaxRetries: 1}, sink)
+	for i := 0; i < 7; i++ {
+		l.Record(InferenceRecord{ID: newInferenceID()})
+	}
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := len(sink.records()); got != 7 || len(sink.batches) != 3 {
+		t.Errorf("wrote %d records in %d batches, want 7 in 3", got, len(sink.batches))
+	}
+	if l.written.Load() != 7 || l.dropped.Load() != 0 {
+		t.Errorf("written = %d, dropped = %d", l.written.Load(), l.dropped.Load())
+	}
+
+	// A full buffer drops records rather than blocking the caller.
+	blocked := &memoryInferenceSink{}
+	blocked.mu.Lock()
+	full := newInferenceLog(InferenceLogConfig{Capacity: 2, BatchSize: 1, FlushInterval: time.Hour}, blocked)
+	for i := 0; i < 10; i++ {
+		full.Record(InferenceRecord{})
+	}
+	if full.dropped.Load() == 0 {
+		t.Error("records beyond the buffer should be dropped")
+	}
+	blocked.mu.Unlock()
+	full.Close(context.Background())
+	dropped := full.dropped.Load()
+	full.Record(InferenceRecord{})
+	if full.dropped.Load() != dropped+1 {
+		t.Error("records after Close should be dropped")
+	}
+
+	if id := newInferenceID(); !isUUID(id) || id[14] != '4' {
+		t.Errorf("newInferenceID() = %q, want a version 4 UUID", id)
+	}
+}
+
+// TestGenerateRecordsInference tests what is recorded for completed and
+// failed generations
+func TestGenerateRecordsInference(t *testing.T) {
+	sink := &memoryInferenceSink{}
+	inferenceLog = newInferenceLog(InferenceLogConfig{Capacity: 10, BatchSize: 10, FlushInterval: time.Hour}, sink)
+	defer func() { inferenceLog = nil }()
+
+	mock := ModelConfig{ModelInfo: ModelInfo{ID: "mock"}, Backend: backendMock}
+	failing := ModelConfig{ModelInfo: ModelInfo{ID: "down"}, Backend: backendOllama}
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	registry.Store(newRegistry([]servedModel{
+		{config: mock, backend: mockBackend{}, tokenizer: estimateTokenizer{}},
+		{config: failing, backend: &ollamaBackend{baseURL: down.URL}, tokenizer: estimateTokenizer{}},
+	}, "mock"))
+
+	for _, body := range []string{
+		`{"prompt": "What does the Tenth Amendment reserve?"}`,
+		`{"prompt": "What does the Tenth Amendment reserve?", "store_prompt": true}`,
+		`{"prompt": "What does the Tenth Amendment reserve?", "model": "down"}`,
+	} {
+		handleGenerate(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(body)))
+	}
+	inferenceLog.Close(context.Background())
+
+	records := sink.records()
+	if len(records) != 3 {
+		t.Fatalf("recorded %d inferences, want 3", len(records))
+	}
+	ok, opted, failed := records[0], records[1], records[2]
+	if ok.Status != inferenceOK || ok.Model != "mock" || ok.Tier != tierFree || ok.CompletionTokens == 0 || ok.Completion == "" {
+		t.Errorf("completed inference = %+v", ok)
+	}
+	if ok.Prompt != "" || ok.PromptHash != hashPrompt("What does the Tenth Amendment reserve?") {
+		t.Errorf("the prompt should only be hashed unless opted in: %+v", ok)
+	}
+	if opted.Prompt != "What does the Tenth Amendment reserve?" {
+		t.Errorf("opted-in prompt = %q", opted.Prompt)
+	}
+	if failed.Status != inferenceError || failed.Error == "" || failed.Model != "down" {
+		t.Errorf("failed inference = %+v", failed)
+	}
+	if ok.ID == opted.ID || !isUUID(ok.ID) {
+		t.Errorf("inferences need distinct IDs: %s, %s", ok.ID, opted.ID)
+	}
+}
+
+// TestParseUsageQuery tests reading usage date ranges
+func TestParseUsageQuery(t *testing.T) {
+	now := time.Date(2024, 7, 4, 15, 30, 0, 0, time.UTC)
+	q, err := parseUsageQuery(url.Values{"user_id": {"u1"}}, now)
+	if err != nil {
+		t.Fatalf("parseUsageQuery() error = %v", err)
+	}
+	if q.UserID != "" || q.To.Format(usageDateLayout) != "2024-07-04" || q.From.Format(usageDateLayout) != "2024-06-05" {
+		t.Errorf("default range = %s to %s", q.From, q.To)
+	}
+	q, err = parseUsageQuery(url.Values{"from": {"2024-07-01"}, "to": {"2024-07-01"}}, now)
+	if err != nil || !q.From.Equal(q.To) {
+		t.Errorf("a single day should be allowed: %v, %v", q, err)
+	}
+	for _, v := range []url.Values{
+		{"from": {"July 1"}},
+		{"to": {"2024-13-01"}},
+		{"from": {"2024-07-02"}, "to": {"2024-07-01"}},
+		{"from": {"2022-01-01"}, "to": {"2024-01-01"}},
+	} {
+		if _, err := parseUsageQuery(v, now); err == nil {
+			t.Errorf("parseUsageQuery(%v) should fail", v)
+		}
+	}
+
+	var totals UsageTotals
+	totals.add(2, 1, 100, 40, 3000)
+	totals.add(1, 0, 50, 10, 600)
+	if totals.Requests != 3 || totals.Errors != 1 || totals.Tokens != 200 || totals.AvgLatencyMs != 1200 {
+		t.Errorf("totals = %+v", totals)
+	}
+}
+
+// TestUsageAccess tests that usage is only reported to its user, and the
+// per-tier report only to operators
+func TestUsageAccess(t *testing.T) {
+	defer func(token string) { usageToken = token }(usageToken)
+
+	get := func(handler http.HandlerFunc, target string, header http.Header) int {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	if code := get(handleUsage, "/inference/usage?user_id="+newInferenceID(), nil); code != http.StatusUnauthorized {
+		t.Errorf("anonymous usage naming a user = %d, want 401", code)
+	}
+
+	usageToken = ""
+	if code := get(handleTierUsage, "/inference/usage/tiers", http.Header{"Authorization": {"Bearer "}}); code != http.StatusForbidden {
+		t.Errorf("tier usage without LLM_USAGE_TOKEN = %d, want 403", code)
+	}
+	usageToken = "s3cret"
+	for _, auth := range []string{"", "s3cret", "Bearer wrong", "Bearer s3cret2"} {
+		if code := get(handleTierUsage, "/inference/usage/tiers", http.Header{"Authorization": {auth}}); code != http.StatusForbidden {
+			t.Errorf("tier usage with Authorization %q = %d, want 403", auth, code)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/inference/usage/tiers", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if !canReadTierUsage(req) {
+		t.Error("the operator token should be accepted")
+	}
+}
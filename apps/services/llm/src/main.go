@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -16,45 +18,23 @@ import (
 
 var db *sql.DB
 
-const defaultModelID = "liberty-mistral-v1.0"
-
+// ModelInfo describes a model to clients. Aliases are other IDs it can be
+// requested by. A deprecated model is still served, but clients should
+// move to ReplacedBy. Tiers limits which user tiers can see and use it;
+// empty means every tier.
 type ModelInfo struct {
-	ID            string `json:"id"`
-	Name          string `json:"name"`
-	Description   string `json:"description,omitempty"`
-	Provider      string `json:"provider,omitempty"`
-	ContextWindow int    `json:"contextWindow,omitempty"`
-}
-
-var availableModels = []ModelInfo{
-	{
-		ID:            "liberty-mistral-v1.0",
-		Name:          "Liberty Mistral v1.0",
-		Description:   "Values-first constitutional reasoning with enumerated powers citations",
-		Provider:      "local",
-		ContextWindow: 8192,
-	},
-	{
-		ID:            "mistral",
-		Name:          "Mistral 7B Instruct (Ollama)",
-		Description:   "General-styled Mistral instruct model",
-		Provider:      "ollama-maintained",
-		ContextWindow: 8192,
-	},
-	{
-		ID:            "llama2",
-		Name:          "Llama 2",
-		Description:   "Ollama-hosted Llama 2 baseline",
-		Provider:      "ollama",
-		ContextWindow: 4096,
-	},
-	{
-		ID:            "neural-chat",
-		Name:          "Neural Chat",
-		Description:   "Legacy Neural Chat endpoint",
-		Provider:      "ollama",
-		ContextWindow: 4096,
-	},
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Description   string   `json:"description,omitempty"`
+	Provider      string   `json:"provider,omitempty"`
+	ContextWindow int      `json:"contextWindow,omitempty"`
+	Aliases       []string `json:"aliases,omitempty"`
+	Deprecated    bool     `json:"deprecated,omitempty"`
+	ReplacedBy    string   `json:"replacedBy,omitempty"`
+	Tiers         []string `json:"tiers,omitempty"`
+	// Version is bumped when the model's weights change under the same
+	// name, so responses cached from the old weights are dropped.
+	Version string `json:"version,omitempty"`
 }
 
 type InferenceRequest struct {
@@ -62,15 +42,43 @@ type InferenceRequest struct {
 	Model   string `json:"model"`
 	ModelID string `json:"modelId"`
 	Context string `json:"context,omitempty"`
-	UserID  string `json:"user_id"`
+	// UserID is the authenticated user, from the X-User-ID header set by
+	// the gateway. A user_id in the body is ignored.
+	UserID string `json:"-"`
+	Stream bool   `json:"stream,omitempty"`
+	// ConversationID continues a conversation; Prompt is the next user message.
+	ConversationID string            `json:"conversation_id,omitempty"`
+	Options        GenerationOptions `json:"options,omitempty"`
+	// StorePrompt opts in to keeping the prompt with the inference record;
+	// otherwise only its hash is kept.
+	StorePrompt bool `json:"store_prompt,omitempty"`
+	// NoCache skips the response cache, neither reading nor filling it.
+	NoCache bool `json:"no_cache,omitempty"`
 }
 
 type InferenceResponse struct {
-	Result    string    `json:"result"`
-	Model     string    `json:"model"`
-	Tokens    int       `json:"tokens"`
-	Duration  string    `json:"duration"`
-	CreatedAt time.Time `json:"created_at"`
+	ID     string `json:"id"`
+	Result string `json:"result"`
+	// Model is the model that answered. FallbackFrom is set to the
+	// requested model when it failed and a fallback answered instead.
+	Model            string                 `json:"model"`
+	FallbackFrom     string                 `json:"fallback_from,omitempty"`
+	Tokens           int                    `json:"tokens"`
+	PromptTokens     int                    `json:"prompt_tokens"`
+	CompletionTokens int                    `json:"completion_tokens"`
+	Duration         string                 `json:"duration"`
+	CreatedAt        time.Time              `json:"created_at"`
+	Citations        []RetrievedDocMetadata `json:"citations"`
+	// ConversationID is set when the request continued a conversation.
+	ConversationID string `json:"conversation_id,omitempty"`
+	// ContextTrim is set when history or context was cut to fit the model.
+	ContextTrim *ContextTrim `json:"context_trimmed,omitempty"`
+	// Options are the generation options used, after defaults and caps.
+	Options GenerationOptions `json:"options"`
+	// Queue is set when the request waited for a generation slot.
+	Queue *QueueInfo `json:"queue,omitempty"`
+	// Cache is set when the response came from the response cache.
+	Cache *CacheInfo `json:"cache,omitempty"`
 }
 
 type HealthResponse struct {
@@ -141,13 +149,65 @@ func main() {
 		port = "4004"
 	}
 
+	if err := createTables(); err != nil {
+		log.Printf("Warning: Failed to create LLM tables: %v", err)
+	}
+
+	resilience = loadResilienceConfig(os.Getenv)
+	inferenceLog = newInferenceLog(defaultInferenceLogConfig(), postgresInferenceSink{})
+	usageToken = os.Getenv("LLM_USAGE_TOKEN")
+	admissionConfig = loadAdmissionConfig(os.Getenv)
+	quotas = newPostgresQuotaStore()
+	admissionQueue = newGenerationQueue(admissionConfig.MaxActive, admissionConfig.MaxQueued, admissionConfig.QueueTimeout)
+	cacheConfig = loadCacheConfig(os.Getenv)
+	responseCache = newResponseStore(cacheConfig)
+
+	models, err := loadModels(os.Getenv)
+	if err != nil {
+		log.Fatalf("Failed to configure models: %v", err)
+	}
+	reconcileModels(models)
+	registry.Store(models)
+	purgeStaleCache(models)
+	for _, id := range models.order {
+		model := models.models[id]
+		log.Printf("Model %s served by %s, tokenizer %s, %s", id, model.backend.Name(), model.tokenizer.Name(), models.modelStatus(id))
+	}
+	go watchModels(os.Getenv, modelsRefresh(os.Getenv))
+
 	http.HandleFunc("/health", handleHealth)
 	http.HandleFunc("/ready", handleReady)
 	http.HandleFunc("/inference/generate", handleGenerate)
 	http.HandleFunc("/inference/models", handleListModels)
-
-	log.Printf("LLM Inference Service listening on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	http.HandleFunc("/inference/conversations", handleConversations)
+	http.HandleFunc("/inference/conversations/messages", handleConversationMessages)
+	http.HandleFunc("/inference/usage", handleUsage)
+	http.HandleFunc("/inference/usage/tiers", handleTierUsage)
+
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		log.Printf("LLM Inference Service listening on port %s", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// On SIGTERM stop taking requests, then write out the inference log,
+	// which the usage reports are built from.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down LLM service")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Warning: HTTP shutdown: %v", err)
+	}
+	if err := inferenceLog.Close(ctx); err != nil {
+		log.Printf("Error: %v", err)
+	}
+	log.Printf("Inference log drained: written=%d dropped=%d", inferenceLog.written.Load(), inferenceLog.dropped.Load())
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -167,14 +227,15 @@ func handleReady(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check Ollama availability
-	resp, err := http.Get("http://172.19.0.1:11434/api/tags")
-	if err != nil {
+	// The default model's backend must be reachable
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	backend := registry.Load().defaultModel().backend
+	if err := backend.Ping(ctx); err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Inference service unavailable (Ollama not accessible)"})
+		json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("Inference backend unavailable (%s)", backend.Name())})
 		return
 	}
-	defer resp.Body.Close()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ReadyResponse{Status: "ready"})
@@ -194,57 +255,99 @@ func handleGenerate(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
 		return
 	}
+	req.UserID = requestUser(r)
 
-	if req.Prompt == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "prompt is required"})
+	g, status, err := prepareGeneration(r.Context(), req)
+	if err != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
 		return
 	}
 
-	modelID := req.ModelID
-	if modelID == "" {
-		modelID = req.Model
+	if cfg := g.model.config; cfg.Deprecated {
+		w.Header().Set("Deprecation", "true")
+		log.Printf("Deprecated model %s requested (replaced by %s)", cfg.ID, cfg.ReplacedBy)
+	}
+
+	// Cached responses take no generation, so they count as a request but
+	// skip the other limits and the queue.
+	var refused, denied *admissionError
+	key := quotaKey(r, req.UserID)
+	if g.fromCache(r.Context()) {
+		refused, err = admitCached(r.Context(), key, g.tier, g.id)
+	} else {
+		g.admission, refused, err = admit(r.Context(), key, g.tier, g.id)
+	}
+	if err != nil {
+		log.Printf("Checking quota failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to check quota"})
+		return
+	}
+	if refused != nil {
+		writeAdmissionError(w, refused)
+		return
 	}
-	if modelID == "" {
-		modelID = defaultModelID
+	if g.admission != nil {
+		defer g.admission.release()
 	}
 
-	// Add retrieval context for founding documents
-	contexts := retrieveContext(req.Prompt, 3)
-	if len(contexts) > 0 {
-		req.Context = buildRetrievalContext(req.Context, contexts)
-		logRetrievalMetadata(req.Prompt, contexts)
+	if format := streamFormat(r.Header.Get("Accept"), req.Stream); format != "" {
+		streamGeneration(w, r, format, g)
+		return
 	}
 
-	promptWithContext := req.Prompt
-	if req.Context != "" {
-		promptWithContext = req.Context + "\n\n" + req.Prompt
+	// Requests that never reach the backend are not charged.
+	if err := g.admission.wait(r.Context(), nil); err != nil {
+		g.admission.charge(0, true)
+		if errors.As(err, &denied) {
+			writeAdmissionError(w, denied)
+		}
+		return
 	}
 
-	// Call Ollama
 	start := time.Now()
-	result, err := callOllama(modelID, promptWithContext)
+	generated, err := g.generate(r.Context(), nil)
 	if err != nil {
+		g.fail(r.Context(), err, "")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("Inference failed: %v", err)})
 		return
 	}
+	result := generated.Text
 
+	promptTokens, completionTokens := g.usage(generated)
 	response := InferenceResponse{
-		Result:    result,
-		Model:     modelID,
-		Tokens:    len(result) / 4, // Rough estimate
-		Duration:  time.Since(start).String(),
-		CreatedAt: time.Now().UTC(),
+		ID:               g.id,
+		Result:           result,
+		Model:            g.modelID,
+		FallbackFrom:     g.fallbackFrom(),
+		Tokens:           completionTokens,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Duration:         time.Since(start).String(),
+		CreatedAt:        time.Now().UTC(),
+		Citations:        citations(g.retrieved),
+		ConversationID:   g.conversationID(),
+		ContextTrim:      g.trim,
+		Options:          g.backendReq.Options,
+		Queue:            g.admission.queueInfo(),
+		Cache:            g.cacheInfo(),
 	}
 
-	// Log to database (async)
-	go logInference(req.UserID, modelID, req.Prompt, result)
+	if err := g.complete(r.Context(), generated); err != nil {
+		log.Printf("Saving conversation turn failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to save conversation"})
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleListModels lists the models the user's tier can see, with their
+// availability on their backends.
 func handleListModels(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -252,58 +355,14 @@ func handleListModels(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"models": availableModels,
-	})
-}
-
-func callOllama(model, prompt string) (string, error) {
-	// Call Ollama directly - use gateway IP to reach host machine from container
-	ollamaURL := "http://172.19.0.1:11434/api/generate"
-
-	// Map model IDs to actual Ollama models
-	modelMapping := map[string]string{
-		"liberty-mistral-v1.0": "mistral:7b",
-		"mistral":              "mistral:7b",
-		"llama2":               "llama2",
-		"neural-chat":          "neural-chat",
+	models := registry.Load()
+	response := map[string]interface{}{
+		"models":  models.list(userTier(r.Context(), requestUser(r))),
+		"default": models.defaultID,
 	}
-
-	actualModel := modelMapping[model]
-	if actualModel == "" {
-		actualModel = model // fallback to requested model name
-	}
-
-	payload := map[string]interface{}{
-		"model":  actualModel,
-		"prompt": prompt,
-		"stream": false,
+	if checked := models.checked(); !checked.IsZero() {
+		response["checked_at"] = checked
 	}
-
-	body, _ := json.Marshal(payload)
-	resp, err := http.Post(ollamaURL, "application/json", bytes.NewReader(body))
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("ollama returned status %d", resp.StatusCode)
-	}
-
-	respBody, _ := io.ReadAll(resp.Body)
-	var result map[string]interface{}
-	json.Unmarshal(respBody, &result)
-
-	if response, ok := result["response"].(string); ok {
-		return response, nil
-	}
-	return "", fmt.Errorf("invalid response from Ollama")
-}
-
-func logInference(userID, model, prompt, result string) {
-	// Placeholder for logging to database
-	log.Printf("Inference: user=%s, model=%s, prompt_len=%d, result_len=%d",
-		userID, model, len(prompt), len(result))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
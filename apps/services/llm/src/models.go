@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ModelConfig is a model clients can request and where it is served.
+// UpstreamModel is the backend's name for it, defaulting to the ID.
+type ModelConfig struct {
+	ModelInfo
+	Backend       string `json:"backend"`
+	BaseURL       string `json:"baseUrl,omitempty"`
+	UpstreamModel string `json:"upstreamModel,omitempty"`
+	// ChatTemplate formats conversations for the model (default plain).
+	ChatTemplate string `json:"chatTemplate,omitempty"`
+	// Tokenizer is a tokenizer.json or tokenizer.model file, or a checkpoint
+	// directory holding one. Without it tokens are estimated.
+	Tokenizer string `json:"tokenizer,omitempty"`
+	// Defaults fill generation options a request leaves unset, and TierCaps
+	// bound them per user tier (defaultTierCaps if not set).
+	Defaults GenerationOptions         `json:"defaults,omitempty"`
+	TierCaps map[string]GenerationCaps `json:"tierCaps,omitempty"`
+	// APIKeyEnv names the environment variable holding the API key, so keys
+	// stay out of the config file.
+	APIKeyEnv string `json:"apiKeyEnv,omitempty"`
+	// Timeout bounds each call to the backend, as a duration such as "90s".
+	Timeout string `json:"timeout,omitempty"`
+	// Fallbacks are models tried in order when this one fails.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+}
+
+// servedModel is a configured model with its backend and tokenizer.
+type servedModel struct {
+	config    ModelConfig
+	backend   InferenceBackend
+	tokenizer Tokenizer
+	timeout   time.Duration // zero means no limit
+}
+
+// upstreamName is the name the backend knows the model by.
+func (m ModelConfig) upstreamName() string {
+	if m.UpstreamModel != "" {
+		return m.UpstreamModel
+	}
+	return m.ID
+}
+
+// version identifies what the model answers with: its configured version
+// and where and how it is served. Cached responses from another version
+// are not used.
+func (m ModelConfig) version() string {
+	data, _ := json.Marshal([]string{m.Version, m.Backend, m.BaseURL, m.upstreamName(), m.ChatTemplate, m.Tokenizer})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// visibleTo reports whether users of a tier can see and use the model.
+func (m ModelConfig) visibleTo(tier string) bool {
+	if len(m.Tiers) == 0 {
+		return true
+	}
+	for _, t := range m.Tiers {
+		if t == tier {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultModelsFile is served when LLM_MODELS_FILE is not set.
+//
+//go:embed models.json
+var defaultModelsFile []byte
+
+// modelsFile is the format of a models file. Default is the model used
+// when a request names none; LLM_DEFAULT_MODEL overrides it.
+type modelsFile struct {
+	Default string        `json:"default,omitempty"`
+	Models  []ModelConfig `json:"models"`
+}
+
+// parseModelsFile reads a models file: {"default": id, "models": [ModelConfig, ...]}.
+func parseModelsFile(data []byte) (*modelsFile, error) {
+	var file modelsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid models file: %w", err)
+	}
+	if len(file.Models) == 0 {
+		return nil, fmt.Errorf("models file lists no models")
+	}
+	return &file, nil
+}
+
+// withEnvDefaults fills what a model leaves unset from the environment:
+// the backend from LLM_BACKEND (default ollama), an Ollama base URL from
+// OLLAMA_URL, the timeout from LLM_GENERATE_TIMEOUT (default 2m), and the
+// tokenizer from LLM_TOKENIZER_DIR/<model id> where that exists.
+func withEnvDefaults(configs []ModelConfig, getenv func(string) string) []ModelConfig {
+	backend := getenv("LLM_BACKEND")
+	if backend == "" {
+		backend = backendOllama
+	}
+	ollamaURL := getenv("OLLAMA_URL")
+	if ollamaURL == "" {
+		ollamaURL = "http://localhost:11434"
+	}
+	timeout := getenv("LLM_GENERATE_TIMEOUT")
+	if timeout == "" {
+		timeout = defaultGenerateTimeout.String()
+	}
+	tokenizerDir := getenv("LLM_TOKENIZER_DIR")
+
+	configs = append([]ModelConfig(nil), configs...)
+	for i := range configs {
+		cfg := &configs[i]
+		if cfg.Backend == "" {
+			cfg.Backend = backend
+		}
+		if cfg.Backend == backendOllama && cfg.BaseURL == "" {
+			cfg.BaseURL = ollamaURL
+		}
+		if cfg.Timeout == "" {
+			cfg.Timeout = timeout
+		}
+		if cfg.Tokenizer == "" && tokenizerDir != "" {
+			if path := filepath.Join(tokenizerDir, cfg.ID); fileExists(path) {
+				cfg.Tokenizer = path
+			}
+		}
+	}
+	return configs
+}
+
+// buildModels validates the configuration and creates a backend for every
+// model. defaultID, which may be an alias, must name a current model that
+// every tier can use.
+func buildModels(configs []ModelConfig, defaultID string, getenv func(string) string) (*modelRegistry, error) {
+	var served []servedModel
+	names := map[string]string{} // IDs and aliases to the model they name
+	for _, cfg := range configs {
+		if cfg.ID == "" {
+			return nil, fmt.Errorf("every model needs an id")
+		}
+		if _, dup := names[cfg.ID]; dup {
+			return nil, fmt.Errorf("model %s is configured twice", cfg.ID)
+		}
+		names[cfg.ID] = cfg.ID
+	}
+	for _, cfg := range configs {
+		for _, alias := range cfg.Aliases {
+			if alias == "" {
+				return nil, fmt.Errorf("model %s: aliases must not be empty", cfg.ID)
+			}
+			if other, dup := names[alias]; dup {
+				return nil, fmt.Errorf("model %s: alias %s already names model %s", cfg.ID, alias, other)
+			}
+			names[alias] = cfg.ID
+		}
+	}
+
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			cfg.Name = cfg.ID
+		}
+		if cfg.ChatTemplate == "" {
+			cfg.ChatTemplate = templatePlain
+		}
+		if err := validateChatTemplate(cfg.ChatTemplate); err != nil {
+			return nil, fmt.Errorf("model %s: %w", cfg.ID, err)
+		}
+		if err := cfg.Defaults.validate(); err != nil {
+			return nil, fmt.Errorf("model %s: defaults: %w", cfg.ID, err)
+		}
+		if err := validateTierCaps(cfg.TierCaps); err != nil {
+			return nil, fmt.Errorf("model %s: %w", cfg.ID, err)
+		}
+		if cfg.ReplacedBy != "" {
+			if _, ok := names[cfg.ReplacedBy]; !ok || names[cfg.ReplacedBy] == cfg.ID {
+				return nil, fmt.Errorf("model %s: replacedBy must name another model", cfg.ID)
+			}
+			cfg.ReplacedBy = names[cfg.ReplacedBy]
+		}
+		for _, tier := range cfg.Tiers {
+			if strings.TrimSpace(tier) == "" {
+				return nil, fmt.Errorf("model %s: tiers must not be empty", cfg.ID)
+			}
+		}
+		var fallbacks []string
+		for _, fallback := range cfg.Fallbacks {
+			if _, ok := names[fallback]; !ok || names[fallback] == cfg.ID {
+				return nil, fmt.Errorf("model %s: fallback %s must name another model", cfg.ID, fallback)
+			}
+			fallbacks = append(fallbacks, names[fallback])
+		}
+		cfg.Fallbacks = fallbacks
+		var timeout time.Duration
+		if cfg.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(cfg.Timeout); err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("model %s: invalid timeout %q", cfg.ID, cfg.Timeout)
+			}
+		}
+		backend, err := newBackend(cfg, getenv)
+		if err != nil {
+			return nil, err
+		}
+		var tokenizer Tokenizer = estimateTokenizer{}
+		if cfg.Tokenizer != "" {
+			if tokenizer, err = loadTokenizer(cfg.Tokenizer); err != nil {
+				return nil, fmt.Errorf("model %s: %w", cfg.ID, err)
+			}
+		}
+		served = append(served, servedModel{config: cfg, backend: backend, tokenizer: tokenizer, timeout: timeout})
+	}
+
+	id, ok := names[defaultID]
+	if !ok {
+		return nil, fmt.Errorf("default model %s is not configured", defaultID)
+	}
+	reg := newRegistry(served, id)
+	if def := reg.defaultModel().config; def.Deprecated || len(def.Tiers) > 0 {
+		return nil, fmt.Errorf("default model %s must not be deprecated or limited to some tiers", id)
+	}
+	return reg, nil
+}
+
+// loadModels reads LLM_MODELS_FILE, or the built-in models if it is not
+// set, and builds the registry. The default model is LLM_DEFAULT_MODEL,
+// then the file's default, then the first model that is not deprecated.
+func loadModels(getenv func(string) string) (*modelRegistry, error) {
+	data := defaultModelsFile
+	if path := getenv("LLM_MODELS_FILE"); path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	file, err := parseModelsFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultID := getenv("LLM_DEFAULT_MODEL")
+	if defaultID == "" {
+		defaultID = file.Default
+	}
+	if defaultID == "" {
+		for _, cfg := range file.Models {
+			if !cfg.Deprecated {
+				defaultID = cfg.ID
+				break
+			}
+		}
+	}
+	return buildModels(withEnvDefaults(file.Models, getenv), defaultID, getenv)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// User tiers, as stored in the users table.
+const (
+	tierFree    = "free"
+	tierPower   = "power"
+	tierPremium = "premium"
+)
+
+// Limits on generation options that hold for every model.
+const (
+	maxStopSequences = 4
+	maxStopLength    = 64
+	maxTopK          = 1000
+	maxTemperature   = 2.0
+	maxRepeatPenalty = 2.0
+)
+
+// GenerationOptions control sampling. Unset fields fall back to the model's
+// defaults, then to the backend's own. The same seed and options give the
+// same output from backends that support seeding.
+type GenerationOptions struct {
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"top_p,omitempty"`
+	TopK          *int     `json:"top_k,omitempty"`
+	MaxTokens     *int     `json:"max_tokens,omitempty"`
+	Stop          []string `json:"stop,omitempty"`
+	RepeatPenalty *float64 `json:"repeat_penalty,omitempty"`
+	Seed          *int64   `json:"seed,omitempty"`
+}
+
+// GenerationCaps bound what one tier may request from a model.
+type GenerationCaps struct {
+	MaxTokens int `json:"maxTokens"`
+}
+
+// defaultTierCaps apply to models whose configuration sets none.
+var defaultTierCaps = map[string]GenerationCaps{
+	tierFree:    {MaxTokens: 512},
+	tierPower:   {MaxTokens: 2048},
+	tierPremium: {MaxTokens: 4096},
+}
+
+func (o GenerationOptions) validate() error {
+	if o.Temperature != nil && (*o.Temperature < 0 || *o.Temperature > maxTemperature) {
+		return fmt.Errorf("temperature must be between 0 and %g", maxTemperature)
+	}
+	if o.TopP != nil && (*o.TopP <= 0 || *o.TopP > 1) {
+		return fmt.Errorf("top_p must be in (0, 1]")
+	}
+	if o.TopK != nil && (*o.TopK < 1 || *o.TopK > maxTopK) {
+		return fmt.Errorf("top_k must be between 1 and %d", maxTopK)
+	}
+	if o.MaxTokens != nil && *o.MaxTokens < 1 {
+		return fmt.Errorf("max_tokens must be positive")
+	}
+	if len(o.Stop) > maxStopSequences {
+		return fmt.Errorf("at most %d stop sequences are allowed", maxStopSequences)
+	}
+	for _, s := range o.Stop {
+		if s == "" || len(s) > maxStopLength {
+			return fmt.Errorf("stop sequences must be 1 to %d bytes", maxStopLength)
+		}
+	}
+	if o.RepeatPenalty != nil && (*o.RepeatPenalty <= 0 || *o.RepeatPenalty > maxRepeatPenalty) {
+		return fmt.Errorf("repeat_penalty must be in (0, %g]", maxRepeatPenalty)
+	}
+	if o.Seed != nil && *o.Seed < 0 {
+		return fmt.Errorf("seed must not be negative")
+	}
+	return nil
+}
+
+// withDefaults fills unset options from defaults.
+func (o GenerationOptions) withDefaults(defaults GenerationOptions) GenerationOptions {
+	if o.Temperature == nil {
+		o.Temperature = defaults.Temperature
+	}
+	if o.TopP == nil {
+		o.TopP = defaults.TopP
+	}
+	if o.TopK == nil {
+		o.TopK = defaults.TopK
+	}
+	if o.MaxTokens == nil {
+		o.MaxTokens = defaults.MaxTokens
+	}
+	if o.Stop == nil {
+		o.Stop = defaults.Stop
+	}
+	if o.RepeatPenalty == nil {
+		o.RepeatPenalty = defaults.RepeatPenalty
+	}
+	if o.Seed == nil {
+		o.Seed = defaults.Seed
+	}
+	return o
+}
+
+// capsFor returns the caps for a tier. Unknown tiers get the free tier's.
+func (m ModelConfig) capsFor(tier string) (GenerationCaps, bool) {
+	caps := m.TierCaps
+	if caps == nil {
+		caps = defaultTierCaps
+	}
+	if c, ok := caps[tier]; ok {
+		return c, true
+	}
+	c, ok := caps[tierFree]
+	return c, ok
+}
+
+// resolveOptions merges requested options with the model's defaults and
+// applies the tier's caps. max_tokens defaults to the cap; asking for more
+// is an error rather than silently getting less.
+func (m ModelConfig) resolveOptions(requested GenerationOptions, tier string) (GenerationOptions, error) {
+	if err := requested.validate(); err != nil {
+		return GenerationOptions{}, err
+	}
+	opts := requested.withDefaults(m.Defaults)
+	caps, ok := m.capsFor(tier)
+	if !ok || caps.MaxTokens <= 0 {
+		return opts, nil
+	}
+	if opts.MaxTokens == nil || (requested.MaxTokens == nil && *opts.MaxTokens > caps.MaxTokens) {
+		maxTokens := caps.MaxTokens
+		opts.MaxTokens = &maxTokens
+	}
+	if *opts.MaxTokens > caps.MaxTokens {
+		return GenerationOptions{}, fmt.Errorf("max_tokens exceeds the %s tier limit of %d for %s", tier, caps.MaxTokens, m.ID)
+	}
+	return opts, nil
+}
+
+// validateTierCaps checks a model's configured caps.
+func validateTierCaps(caps map[string]GenerationCaps) error {
+	for tier, c := range caps {
+		if strings.TrimSpace(tier) == "" {
+			return fmt.Errorf("tier caps need a tier name")
+		}
+		if c.MaxTokens < 0 {
+			return fmt.Errorf("tier %s: maxTokens must not be negative", tier)
+		}
+	}
+	return nil
+}
+
+// ollamaOptions is the options object for Ollama's API.
+func (o GenerationOptions) ollamaOptions() map[string]interface{} {
+	opts := map[string]interface{}{}
+	if o.Temperature != nil {
+		opts["temperature"] = *o.Temperature
+	}
+	if o.TopP != nil {
+		opts["top_p"] = *o.TopP
+	}
+	if o.TopK != nil {
+		opts["top_k"] = *o.TopK
+	}
+	if o.MaxTokens != nil {
+		opts["num_predict"] = *o.MaxTokens
+	}
+	if len(o.Stop) > 0 {
+		opts["stop"] = o.Stop
+	}
+	if o.RepeatPenalty != nil {
+		opts["repeat_penalty"] = *o.RepeatPenalty
+	}
+	if o.Seed != nil {
+		opts["seed"] = *o.Seed
+	}
+	return opts
+}
+
+// addOpenAIOptions sets the options on a chat completions request. top_k
+// and the repeat penalty are not part of the OpenAI API; they are sent
+// under the names llama.cpp server (repeat_penalty) and vLLM
+// (repetition_penalty) accept, and only when set.
+func (o GenerationOptions) addOpenAIOptions(body map[string]interface{}) {
+	if o.Temperature != nil {
+		body["temperature"] = *o.Temperature
+	}
+	if o.TopP != nil {
+		body["top_p"] = *o.TopP
+	}
+	if o.TopK != nil {
+		body["top_k"] = *o.TopK
+	}
+	if o.MaxTokens != nil {
+		body["max_tokens"] = *o.MaxTokens
+	}
+	if len(o.Stop) > 0 {
+		body["stop"] = o.Stop
+	}
+	if o.RepeatPenalty != nil {
+		body["repeat_penalty"] = *o.RepeatPenalty
+		body["repetition_penalty"] = *o.RepeatPenalty
+	}
+	if o.Seed != nil {
+		body["seed"] = *o.Seed
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func float64Ptr(v float64) *float64 { return &v }
+func intPtr(v int) *int             { return &v }
+func int64Ptr(v int64) *int64       { return &v }
+
+// TestGenerationOptionsValidation tests the bounds on generation options
+func TestGenerationOptionsValidation(t *testing.T) {
+	valid := GenerationOptions{
+		Temperature:   float64Ptr(0.7),
+		TopP:          float64Ptr(0.9),
+		TopK:          intPtr(40),
+		MaxTokens:     intPtr(256),
+		Stop:          []string{"</s>", "\n\nUser:"},
+		RepeatPenalty: float64Ptr(1.1),
+		Seed:          int64Ptr(42),
+	}
+	if err := valid.validate(); err != nil {
+		t.Errorf("valid options rejected: %v", err)
+	}
+	if err := (GenerationOptions{}).validate(); err != nil {
+		t.Errorf("empty options rejected: %v", err)
+	}
+
+	tests := map[string]GenerationOptions{
+		"temperature too high": {Temperature: float64Ptr(2.5)},
+		"negative temperature": {Temperature: float64Ptr(-0.1)},
+		"zero top_p":           {TopP: float64Ptr(0)},
+		"top_p above one":      {TopP: float64Ptr(1.2)},
+		"zero top_k":           {TopK: intPtr(0)},
+		"zero max_tokens":      {MaxTokens: intPtr(0)},
+		"too many stops":       {Stop: []string{"a", "b", "c", "d", "e"}},
+		"empty stop":           {Stop: []string{""}},
+		"long stop":            {Stop: []string{strings.Repeat("x", maxStopLength+1)}},
+		"zero repeat_penalty":  {RepeatPenalty: float64Ptr(0)},
+		"negative seed":        {Seed: int64Ptr(-1)},
+	}
+	for name, opts := range tests {
+		if err := opts.validate(); err == nil {
+			t.Errorf("%s: validate() should fail", name)
+		}
+	}
+}
+
+// TestResolveOptions tests merging model defaults and applying tier caps
+func TestResolveOptions(t *testing.T) {
+	cfg := ModelConfig{
+		ModelInfo: ModelInfo{ID: "liberty-mistral-v1.0"},
+		Defaults:  GenerationOptions{Temperature: float64Ptr(0.3), MaxTokens: intPtr(1024), Stop: []string{"</s>"}},
+	}
+
+	got, err := cfg.resolveOptions(GenerationOptions{Temperature: float64Ptr(0.9)}, tierPremium)
+	if err != nil {
+		t.Fatalf("resolveOptions() error = %v", err)
+	}
+	if *got.Temperature != 0.9 || *got.MaxTokens != 1024 || len(got.Stop) != 1 {
+		t.Errorf("requested options should override defaults: %+v", got)
+	}
+
+	// A default above the tier's cap is lowered to it; a request above it fails.
+	got, err = cfg.resolveOptions(GenerationOptions{}, tierFree)
+	if err != nil || *got.MaxTokens != defaultTierCaps[tierFree].MaxTokens {
+		t.Errorf("free tier max_tokens = %v, %v, want the cap", got.MaxTokens, err)
+	}
+	if _, err := cfg.resolveOptions(GenerationOptions{MaxTokens: intPtr(2048)}, tierFree); err == nil {
+		t.Error("max_tokens over the free tier's cap should be rejected")
+	}
+	if _, err := cfg.resolveOptions(GenerationOptions{MaxTokens: intPtr(2048)}, tierPower); err != nil {
+		t.Errorf("power tier may request 2048 tokens: %v", err)
+	}
+	if _, err := cfg.resolveOptions(GenerationOptions{MaxTokens: intPtr(600)}, "enterprise"); err == nil {
+		t.Error("unknown tiers should get the free tier's caps")
+	}
+
+	// Without a default max_tokens is the cap.
+	cfg.Defaults = GenerationOptions{}
+	cfg.TierCaps = map[string]GenerationCaps{tierFree: {MaxTokens: 128}, tierPremium: {}}
+	if got, _ := cfg.resolveOptions(GenerationOptions{}, tierFree); got.MaxTokens == nil || *got.MaxTokens != 128 {
+		t.Errorf("max_tokens should default to the configured cap, got %v", got.MaxTokens)
+	}
+	if got, err := cfg.resolveOptions(GenerationOptions{MaxTokens: intPtr(8000)}, tierPremium); err != nil || *got.MaxTokens != 8000 {
+		t.Errorf("a zero cap means no limit: %v, %v", got.MaxTokens, err)
+	}
+	if _, err := cfg.resolveOptions(GenerationOptions{TopK: intPtr(-3)}, tierPremium); err == nil {
+		t.Error("invalid options should be rejected")
+	}
+
+	if _, err := buildModels([]ModelConfig{{ModelInfo: ModelInfo{ID: "m"}, Backend: backendMock, Defaults: GenerationOptions{TopP: float64Ptr(3)}}}, "m", nil); err == nil {
+		t.Error("invalid model defaults should be rejected")
+	}
+	if _, err := buildModels([]ModelConfig{{ModelInfo: ModelInfo{ID: "m"}, Backend: backendMock, TierCaps: map[string]GenerationCaps{tierFree: {MaxTokens: -1}}}}, "m", nil); err == nil {
+		t.Error("negative tier caps should be rejected")
+	}
+}
+
+// TestBackendOptions tests that options reach Ollama and OpenAI-compatible
+// servers under their names
+func TestBackendOptions(t *testing.T) {
+	var ollama, openai map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/api/generate":
+			ollama, _ = body["options"].(map[string]interface{})
+			w.Write([]byte(`{"response": "ok"}`))
+		case "/v1/chat/completions":
+			openai = body
+			w.Write([]byte(`{"choices": [{"message": {"content": "ok"}}]}`))
+		}
+	}))
+	defer server.Close()
+
+	req := BackendRequest{Model: "m", Prompt: "Define liberty", Options: GenerationOptions{
+		Temperature: float64Ptr(0.2), TopK: intPtr(20), MaxTokens: intPtr(64), Stop: []string{"END"}, Seed: int64Ptr(7),
+	}}
+	for _, backend := range []InferenceBackend{&ollamaBackend{baseURL: server.URL}, &openAIBackend{baseURL: server.URL}} {
+		if _, err := backend.Generate(context.Background(), req); err != nil {
+			t.Fatalf("%s: Generate() error = %v", backend.Name(), err)
+		}
+	}
+	if ollama["temperature"] != 0.2 || ollama["num_predict"] != 64.0 || ollama["top_k"] != 20.0 || ollama["seed"] != 7.0 {
+		t.Errorf("ollama options = %v", ollama)
+	}
+	if _, ok := ollama["repeat_penalty"]; ok {
+		t.Error("unset options should not be sent to ollama")
+	}
+	if openai["temperature"] != 0.2 || openai["max_tokens"] != 64.0 || openai["seed"] != 7.0 {
+		t.Errorf("openai options = %v", openai)
+	}
+	if stop, _ := openai["stop"].([]interface{}); len(stop) != 1 || stop[0] != "END" {
+		t.Errorf("openai stop = %v", openai["stop"])
+	}
+	if _, ok := openai["repetition_penalty"]; ok {
+		t.Error("unset options should not be sent to openai")
+	}
+}
+
+// TestSeedReproducibility tests that a seed makes generation repeatable
+func TestSeedReproducibility(t *testing.T) {
+	generate := func(seed int64) string {
+		resp, err := mockBackend{}.Generate(context.Background(), BackendRequest{
+			Model: "mock", Prompt: "What is the Bill of Rights?", Options: GenerationOptions{Seed: &seed},
+		})
+		if err != nil {
+			t.Fatalf("Generate() error = %v", err)
+		}
+		return resp.Text
+	}
+	if generate(1) != generate(1) {
+		t.Error("the same seed should give the same response")
+	}
+	if generate(1) == generate(2) {
+		t.Error("different seeds should give different responses")
+	}
+
+	resp, _ := mockBackend{}.Generate(context.Background(), BackendRequest{
+		Model: "mock", Prompt: "one two three four five", Options: GenerationOptions{MaxTokens: intPtr(3)},
+	})
+	if resp.CompletionTokens != 3 {
+		t.Errorf("max_tokens = 3 gave %d tokens: %q", resp.CompletionTokens, resp.Text)
+	}
+}
+
+// TestGenerateOptions tests that a request's options are resolved and
+// reported
+func TestGenerateOptions(t *testing.T) {
+	registry.Store(newRegistry([]servedModel{{
+		config:    ModelConfig{ModelInfo: ModelInfo{ID: "mock", ContextWindow: 4096}, Backend: backendMock, Defaults: GenerationOptions{Temperature: float64Ptr(0.5)}},
+		backend:   mockBackend{},
+		tokenizer: estimateTokenizer{},
+	}, {
+		// A default max_tokens as large as the window still leaves room for the prompt.
+		config:    ModelConfig{ModelInfo: ModelInfo{ID: "small", ContextWindow: 512}, Backend: backendMock, Defaults: GenerationOptions{Temperature: float64Ptr(0.5)}},
+		backend:   mockBackend{},
+		tokenizer: estimateTokenizer{},
+	}}, "mock"))
+
+	tests := []struct {
+		body      string
+		status    int
+		maxTokens int
+	}{
+		{`{"prompt": "Who wrote the Federalist?", "options": {"seed": 3}}`, http.StatusOK, 512},
+		{`{"prompt": "Who wrote the Federalist?", "options": {"max_tokens": 100}}`, http.StatusOK, 100},
+		{`{"prompt": "Who wrote the Federalist?", "options": {"max_tokens": 1000}}`, http.StatusBadRequest, 0},
+		{`{"prompt": "Who wrote the Federalist?", "options": {"temperature": 9}}`, http.StatusBadRequest, 0},
+		{`{"prompt": "Who wrote the Federalist?", "model": "small", "options": {"max_tokens": 512}}`, http.StatusBadRequest, 0},
+		{`{"prompt": "Who wrote the Federalist?", "model": "small"}`, http.StatusOK, 512},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleGenerate(rec, httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(tt.body)))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.body, rec.Code, tt.status, rec.Body.String())
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var resp InferenceResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.Options.MaxTokens == nil || *resp.Options.MaxTokens != tt.maxTokens {
+			t.Errorf("%s: max_tokens = %v, want %d", tt.body, resp.Options.MaxTokens, tt.maxTokens)
+		}
+		if resp.Options.Temperature == nil || *resp.Options.Temperature != 0.5 {
+			t.Errorf("%s: the model's default temperature should apply", tt.body)
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// queueAging is how long a request waits before it is treated as one
+	// tier higher, so lower tiers are delayed but never starved.
+	queueAging = 15 * time.Second
+	// concurrencyRetryAfter is suggested to users at their concurrency limit.
+	concurrencyRetryAfter = 5 * time.Second
+	// initialGenerationTime seeds the estimate of how long a generation
+	// holds a slot, used for Retry-After until real ones are measured.
+	initialGenerationTime = 10 * time.Second
+)
+
+// TierQuota limits each user of a tier. Zero means no limit.
+type TierQuota struct {
+	RequestsPerDay int `json:"requestsPerDay"`
+	TokensPerDay   int `json:"tokensPerDay"`
+	MaxConcurrent  int `json:"maxConcurrent"`
+}
+
+var defaultTierQuotas = map[string]TierQuota{
+	tierFree:    {RequestsPerDay: 50, TokensPerDay: 50000, MaxConcurrent: 1},
+	tierPower:   {RequestsPerDay: 500, TokensPerDay: 500000, MaxConcurrent: 2},
+	tierPremium: {RequestsPerDay: 2000, TokensPerDay: 2000000, MaxConcurrent: 4},
+}
+
+// AdmissionConfig controls quotas and the admission queue.
+type AdmissionConfig struct {
+	Quotas       map[string]TierQuota
+	MaxActive    int           // generations running at once on this instance
+	MaxQueued    int           // requests waiting before new ones are turned away
+	QueueTimeout time.Duration // longest a request waits for a slot
+}
+
+func defaultAdmissionConfig() AdmissionConfig {
+	return AdmissionConfig{Quotas: defaultTierQuotas, MaxActive: 4, MaxQueued: 64, QueueTimeout: time.Minute}
+}
+
+// loadAdmissionConfig reads LLM_TIER_QUOTAS (JSON, merged over the default
+// quotas), LLM_MAX_ACTIVE, LLM_MAX_QUEUED and LLM_QUEUE_TIMEOUT. Invalid
+// values are logged and the defaults used.
+func loadAdmissionConfig(getenv func(string) string) AdmissionConfig {
+	cfg := defaultAdmissionConfig()
+	if raw := getenv("LLM_TIER_QUOTAS"); raw != "" {
+		quotas, err := parseTierQuotas(raw)
+		if err != nil {
+			log.Printf("Warning: Invalid LLM_TIER_QUOTAS, using the defaults: %v", err)
+		} else {
+			cfg.Quotas = quotas
+		}
+	}
+	for _, v := range []struct {
+		key string
+		dst *int
+	}{{"LLM_MAX_ACTIVE", &cfg.MaxActive}, {"LLM_MAX_QUEUED", &cfg.MaxQueued}} {
+		raw := getenv(v.key)
+		if raw == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			*v.dst = n
+		} else {
+			log.Printf("Warning: Invalid %s %q, using %d", v.key, raw, *v.dst)
+		}
+	}
+	if raw := getenv("LLM_QUEUE_TIMEOUT"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			cfg.QueueTimeout = d
+		} else {
+			log.Printf("Warning: Invalid LLM_QUEUE_TIMEOUT %q, using %s", raw, cfg.QueueTimeout)
+		}
+	}
+	return cfg
+}
+
+// parseTierQuotas reads quotas such as {"free": {"requestsPerDay": 20}}.
+// Tiers not listed keep their default quotas.
+func parseTierQuotas(raw string) (map[string]TierQuota, error) {
+	var overrides map[string]TierQuota
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		return nil, err
+	}
+	quotas := map[string]TierQuota{}
+	for tier, q := range defaultTierQuotas {
+		quotas[tier] = q
+	}
+	for tier, q := range overrides {
+		if strings.TrimSpace(tier) == "" {
+			return nil, fmt.Errorf("quotas need a tier name")
+		}
+		if q.RequestsPerDay < 0 || q.TokensPerDay < 0 || q.MaxConcurrent < 0 {
+			return nil, fmt.Errorf("tier %s: quotas must not be negative", tier)
+		}
+		quotas[tier] = q
+	}
+	return quotas, nil
+}
+
+// quotaFor returns a tier's quota. Unknown tiers get the free tier's.
+func (c AdmissionConfig) quotaFor(tier string) TierQuota {
+	if q, ok := c.Quotas[tier]; ok {
+		return q
+	}
+	return c.Quotas[tierFree]
+}
+
+// tierPriority orders tiers in the admission queue, highest first.
+func tierPriority(tier string) int {
+	switch tier {
+	case tierPremium:
+		return 2
+	case tierPower:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// quotaKey identifies whose quota a request counts against: the user, or
+// for anonymous requests the client address. Clients can write any
+// X-Forwarded-For entries they like, so only the last, appended by the
+// proxy in front of this service, is used.
+func quotaKey(r *http.Request, userID string) string {
+	if userID != "" {
+		return "user:" + userID
+	}
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		hops := strings.Split(fwd[len(fwd)-1], ",")
+		if last := strings.TrimSpace(hops[len(hops)-1]); last != "" {
+			return "ip:" + last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// untilTomorrow is how long until daily quotas reset at midnight UTC.
+func untilTomorrow(now time.Time) time.Duration {
+	day := now.UTC().Truncate(24 * time.Hour)
+	return day.Add(24 * time.Hour).Sub(now)
+}
+
+// admissionError turns a request away before generation. It is reported
+// as 429 with Retry-After.
+type admissionError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *admissionError) Error() string { return e.message }
+
+func writeAdmissionError(w http.ResponseWriter, e *admissionError) {
+	seconds := int(math.Ceil(e.retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: e.message})
+}
+
+// quotaUsage is a user's consumption for one day, and how many of their
+// generations are running.
+type quotaUsage struct {
+	Requests int
+	Tokens   int
+	Active   int
+}
+
+// checkQuota decides whether a request fits in the quota.
+func checkQuota(q TierQuota, usage quotaUsage, now time.Time) *admissionError {
+	switch {
+	case q.RequestsPerDay > 0 && usage.Requests >= q.RequestsPerDay:
+		return &admissionError{fmt.Sprintf("Daily limit of %d requests reached", q.RequestsPerDay), untilTomorrow(now)}
+	case q.TokensPerDay > 0 && usage.Tokens >= q.TokensPerDay:
+		return &admissionError{fmt.Sprintf("Daily limit of %d tokens reached", q.TokensPerDay), untilTomorrow(now)}
+	case q.MaxConcurrent > 0 && usage.Active >= q.MaxConcurrent:
+		return &admissionError{fmt.Sprintf("At most %d generations may run at once", q.MaxConcurrent), concurrencyRetryAfter}
+	}
+	return nil
+}
+
+// quotaStore keeps quota counters where every replica sees them.
+type quotaStore interface {
+	// acquire counts a request against key's quota for day and holds one of
+	// its concurrent generations under leaseID, unless that would exceed
+	// the quota.
+	acquire(ctx context.Context, key string, day time.Time, quota TierQuota, leaseID string) (*admissionError, error)
+	// release ends the lease and charges tokens for the day, refunding the
+	// request if asked.
+	release(ctx context.Context, key string, day time.Time, leaseID string, tokens int, refund bool) error
+}
+
+// Admission state, set in main. While quotas or admissionQueue is nil, as
+// in tests, that check is skipped.
+var (
+	admissionConfig = defaultAdmissionConfig()
+	quotas          quotaStore
+	admissionQueue  *generationQueue
+)
+
+// admission is a request let in past its quota, holding a place in the
+// queue. Its outcome is charged when it is released.
+type admission struct {
+	key     string
+	day     time.Time
+	leaseID string
+	ticket  *queueTicket
+
+	tokens int
+	refund bool
+	once   sync.Once
+}
+
+// admit checks the user's quota and queues the generation. The caller
+// must release the admission.
+func admit(ctx context.Context, key, tier, leaseID string) (*admission, *admissionError, error) {
+	a := &admission{key: key, day: time.Now().UTC().Truncate(24 * time.Hour), leaseID: leaseID}
+	if quotas != nil {
+		denied, err := quotas.acquire(ctx, key, a.day, admissionConfig.quotaFor(tier), leaseID)
+		if err != nil || denied != nil {
+			return nil, denied, err
+		}
+	}
+	if admissionQueue != nil {
+		ticket, denied := admissionQueue.enqueue(tierPriority(tier))
+		if denied != nil {
+			a.release()
+			return nil, denied, nil
+		}
+		a.ticket = ticket
+	}
+	return a, nil, nil
+}
+
+// admitCached counts a response served from the cache against the user's
+// daily requests. It takes no generation, so it is not held to the token
+// or concurrency limits and does not queue.
+func admitCached(ctx context.Context, key, tier, leaseID string) (*admissionError, error) {
+	if quotas == nil {
+		return nil, nil
+	}
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	quota := TierQuota{RequestsPerDay: admissionConfig.quotaFor(tier).RequestsPerDay}
+	denied, err := quotas.acquire(ctx, key, day, quota, leaseID)
+	if err != nil || denied != nil {
+		return denied, err
+	}
+	return nil, quotas.release(ctx, key, day, leaseID, 0, false)
+}
+
+// wait blocks until the generation may start, passing queue positions to
+// onPosition if it is not nil.
+func (a *admission) wait(ctx context.Context, onPosition func(int)) error {
+	if a == nil || a.ticket == nil {
+		return nil
+	}
+	return a.ticket.wait(ctx, onPosition)
+}
+
+// queueInfo reports the wait in the queue, or nil if there was none.
+func (a *admission) queueInfo() *QueueInfo {
+	if a == nil || a.ticket == nil || a.ticket.firstPosition == 0 {
+		return nil
+	}
+	return &QueueInfo{Position: a.ticket.firstPosition, Wait: a.ticket.waited.String()}
+}
+
+// charge sets what the generation is charged when the admission is
+// released.
+func (a *admission) charge(tokens int, refund bool) {
+	if a != nil {
+		a.tokens, a.refund = tokens, refund
+	}
+}
+
+// release frees the queue slot and settles the quota. It is safe to call
+// more than once.
+func (a *admission) release() {
+	a.once.Do(func() {
+		if a.ticket != nil {
+			a.ticket.release()
+		}
+		if quotas == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := quotas.release(ctx, a.key, a.day, a.leaseID, a.tokens, a.refund); err != nil {
+			log.Printf("Warning: Releasing quota for %s failed: %v", a.key, err)
+		}
+	})
+}
+
+// QueueInfo reports a request's wait for a generation slot: its position
+// when it joined the queue and how long it waited.
+type QueueInfo struct {
+	Position int    `json:"position"`
+	Wait     string `json:"wait"`
+}
+
+// generationQueue admits a bounded number of generations at a time. When
+// all slots are busy, requests wait; a freed slot goes to the highest
+// priority, where each queueAging waited counts as one tier, and among
+// equals to the longest waiting.
+type generationQueue struct {
+	mu        sync.Mutex
+	slots     int
+	free      int
+	maxQueued int
+	timeout   time.Duration
+	waiting   []*queueTicket
+	// held is a moving average of how long generations hold a slot.
+	held time.Duration
+}
+
+func newGenerationQueue(slots, maxQueued int, timeout time.Duration) *generationQueue {
+	return &generationQueue{slots: slots, free: slots, maxQueued: maxQueued, timeout: timeout, held: initialGenerationTime}
+}
+
+// queueTicket is one request's place in the queue.
+type queueTicket struct {
+	q        *generationQueue
+	priority int
+	enqueued time.Time
+	admitted chan struct{} // closed when the request gets a slot
+	position chan int      // the latest position while waiting
+
+	// Guarded by q.mu.
+	granted, released bool
+	started           time.Time
+
+	firstPosition int
+	waited        time.Duration
+}
+
+// enqueue takes a slot if one is free and nobody is waiting, or joins the
+// queue. A full queue turns the request away.
+func (q *generationQueue) enqueue(priority int) (*queueTicket, *admissionError) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := &queueTicket{q: q, priority: priority, enqueued: time.Now(), admitted: make(chan struct{}), position: make(chan int, 1)}
+	if q.free > 0 && len(q.waiting) == 0 {
+		q.grant(t)
+		return t, nil
+	}
+	if len(q.waiting) >= q.maxQueued {
+		return nil, &admissionError{"The inference queue is full", q.estimate(len(q.waiting))}
+	}
+	q.waiting = append(q.waiting, t)
+	q.notify()
+	t.firstPosition = q.positionOf(t)
+	return t, nil
+}
+
+// grant gives t a slot. q.mu must be held.
+func (q *generationQueue) grant(t *queueTicket) {
+	q.free--
+	t.granted = true
+	t.started = time.Now()
+	t.waited = t.started.Sub(t.enqueued)
+	close(t.admitted)
+}
+
+// order is the waiting tickets, next to be admitted first. q.mu must be
+// held.
+func (q *generationQueue) order() []*queueTicket {
+	now := time.Now()
+	score := func(t *queueTicket) float64 {
+		return float64(t.priority) + float64(now.Sub(t.enqueued))/float64(queueAging)
+	}
+	ordered := append([]*queueTicket(nil), q.waiting...)
+	sort.SliceStable(ordered, func(i, j int) bool { return score(ordered[i]) > score(ordered[j]) })
+	return ordered
+}
+
+func (q *generationQueue) positionOf(t *queueTicket) int {
+	for i, other := range q.order() {
+		if other == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// notify sends every waiting ticket its position. q.mu must be held.
+func (q *generationQueue) notify() {
+	for i, t := range q.order() {
+		select {
+		case <-t.position:
+		default:
+		}
+		t.position <- i + 1
+	}
+}
+
+// dispatch gives free slots to waiting tickets. q.mu must be held.
+func (q *generationQueue) dispatch() {
+	if q.free == 0 || len(q.waiting) == 0 {
+		return
+	}
+	for q.free > 0 && len(q.waiting) > 0 {
+		next := q.order()[0]
+		q.remove(next)
+		q.grant(next)
+	}
+	q.notify()
+}
+
+func (q *generationQueue) remove(t *queueTicket) {
+	for i, other := range q.waiting {
+		if other == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// estimate is how long until a request with ahead others before it gets
+// a slot.
+func (q *generationQueue) estimate(ahead int) time.Duration {
+	return time.Duration(ahead/q.slots+1) * q.held
+}
+
+// wait blocks until t has a slot, ctx is done or the queue timeout
+// passes.
+func (t *queueTicket) wait(ctx context.Context, onPosition func(int)) error {
+	timer := time.NewTimer(t.q.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-t.admitted:
+			return nil
+		case pos := <-t.position:
+			if onPosition != nil {
+				onPosition(pos)
+			}
+		case <-ctx.Done():
+			t.abandon()
+			return ctx.Err()
+		case <-timer.C:
+			t.q.mu.Lock()
+			retryAfter := t.q.estimate(len(t.q.waiting))
+			t.q.mu.Unlock()
+			if t.abandon() {
+				return &admissionError{"Timed out waiting for a generation slot", retryAfter}
+			}
+			return nil
+		}
+	}
+}
+
+// abandon leaves the queue. It reports false if t was given a slot first,
+// which the caller then holds.
+func (t *queueTicket) abandon() bool {
+	t.q.mu.Lock()
+	defer t.q.mu.Unlock()
+	if t.granted {
+		return false
+	}
+	t.q.remove(t)
+	t.q.notify()
+	return true
+}
+
+// release frees t's slot, if it had one, for the next request.
+func (t *queueTicket) release() {
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !t.granted || t.released {
+		if !t.granted {
+			q.remove(t)
+			q.notify()
+		}
+		return
+	}
+	t.released = true
+	q.held = (q.held*4 + time.Since(t.started)) / 5
+	q.free++
+	q.dispatch()
+}
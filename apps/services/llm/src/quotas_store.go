@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A running generation holds a lease for leaseTTL, renewed every
+// leaseRenewal, so the leases of a replica that dies expire on their own.
+const (
+	leaseTTL            = 2 * time.Minute
+	leaseRenewal        = 30 * time.Second
+	quotaUsageRetention = 7 // days
+)
+
+const quotasSchema = `
+	CREATE TABLE IF NOT EXISTS llm_quota_usage (
+		quota_key VARCHAR(300) NOT NULL,
+		day DATE NOT NULL,
+		requests INTEGER NOT NULL DEFAULT 0,
+		tokens BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (quota_key, day)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_llm_quota_usage_day ON llm_quota_usage(day);
+
+	CREATE TABLE IF NOT EXISTS llm_quota_leases (
+		id UUID PRIMARY KEY,
+		quota_key VARCHAR(300) NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_llm_quota_leases_key ON llm_quota_leases(quota_key, expires_at);
+	`
+
+// postgresQuotaStore keeps quota counters and running generations in
+// Postgres, so they survive restarts and are shared by every replica.
+type postgresQuotaStore struct {
+	mu     sync.Mutex
+	leases map[string]bool // leases held by this replica
+}
+
+func newPostgresQuotaStore() *postgresQuotaStore {
+	s := &postgresQuotaStore{leases: map[string]bool{}}
+	go s.maintain()
+	return s
+}
+
+func (s *postgresQuotaStore) acquire(ctx context.Context, key string, day time.Time, quota TierQuota, leaseID string) (*admissionError, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize admissions per key across replicas.
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", key); err != nil {
+		return nil, err
+	}
+	var usage quotaUsage
+	if err := tx.QueryRowContext(ctx, `
+		SELECT
+			COALESCE((SELECT requests FROM llm_quota_usage WHERE quota_key = $1 AND day = $2), 0),
+			COALESCE((SELECT tokens FROM llm_quota_usage WHERE quota_key = $1 AND day = $2), 0),
+			(SELECT COUNT(*) FROM llm_quota_leases WHERE quota_key = $1 AND expires_at > now())
+	`, key, day).Scan(&usage.Requests, &usage.Tokens, &usage.Active); err != nil {
+		return nil, err
+	}
+	if denied := checkQuota(quota, usage, time.Now()); denied != nil {
+		return denied, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO llm_quota_usage (quota_key, day, requests) VALUES ($1, $2, 1)
+		ON CONFLICT (quota_key, day) DO UPDATE SET requests = llm_quota_usage.requests + 1
+	`, key, day); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO llm_quota_leases (id, quota_key, expires_at)
+		VALUES ($1, $2, now() + $3 * interval '1 second')
+	`, leaseID, key, leaseTTL.Seconds()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.leases[leaseID] = true
+	s.mu.Unlock()
+	return nil, nil
+}
+
+func (s *postgresQuotaStore) release(ctx context.Context, key string, day time.Time, leaseID string, tokens int, refund bool) error {
+	s.mu.Lock()
+	delete(s.leases, leaseID)
+	s.mu.Unlock()
+
+	refunded := 0
+	if refund {
+		refunded = 1
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM llm_quota_leases WHERE id = $1", leaseID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE llm_quota_usage SET tokens = tokens + $3, requests = GREATEST(requests - $4, 0)
+		WHERE quota_key = $1 AND day = $2
+	`, key, day, tokens, refunded); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// maintain renews this replica's leases and clears out expired leases and
+// old counters.
+func (s *postgresQuotaStore) maintain() {
+	ticker := time.NewTicker(leaseRenewal)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		ids := make([]string, 0, len(s.leases))
+		for id := range s.leases {
+			ids = append(ids, id)
+		}
+		s.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		for _, stmt := range []struct {
+			query string
+			args  []interface{}
+		}{
+			{"UPDATE llm_quota_leases SET expires_at = now() + $2 * interval '1 second' WHERE id = ANY($1::uuid[])", []interface{}{pq.Array(ids), leaseTTL.Seconds()}},
+			{"DELETE FROM llm_quota_leases WHERE expires_at < now()", nil},
+			{"DELETE FROM llm_quota_usage WHERE day < current_date - $1::int", []interface{}{quotaUsageRetention}},
+		} {
+			if _, err := db.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+				log.Printf("Warning: Maintaining quota leases failed: %v", err)
+				break
+			}
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryQuotaStore keeps quota counters in memory.
+type memoryQuotaStore struct {
+	mu     sync.Mutex
+	usage  map[string]quotaUsage
+	leases map[string]string // lease ID to quota key
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{usage: map[string]quotaUsage{}, leases: map[string]string{}}
+}
+
+func (s *memoryQuotaStore) acquire(ctx context.Context, key string, day time.Time, quota TierQuota, leaseID string) (*admissionError, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.usage[key]
+	for _, k := range s.leases {
+		if k == key {
+			usage.Active++
+		}
+	}
+	if denied := checkQuota(quota, usage, time.Now()); denied != nil {
+		return denied, nil
+	}
+	usage.Requests++
+	usage.Active = 0
+	s.usage[key] = usage
+	s.leases[leaseID] = key
+	return nil, nil
+}
+
+func (s *memoryQuotaStore) release(ctx context.Context, key string, day time.Time, leaseID string, tokens int, refund bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.leases, leaseID)
+	usage := s.usage[key]
+	usage.Tokens += tokens
+	if refund {
+		usage.Requests--
+	}
+	s.usage[key] = usage
+	return nil
+}
+
+func (s *memoryQuotaStore) get(key string) quotaUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage[key]
+}
+
+// TestLoadAdmissionConfig tests reading quotas and queue limits from the
+// environment
+func TestLoadAdmissionConfig(t *testing.T) {
+	env := map[string]string{
+		"LLM_TIER_QUOTAS":   `{"free": {"requestsPerDay": 20, "maxConcurrent": 1}, "enterprise": {"maxConcurrent": 8}}`,
+		"LLM_MAX_ACTIVE":    "2",
+		"LLM_MAX_QUEUED":    "ten",
+		"LLM_QUEUE_TIMEOUT": "30s",
+	}
+	cfg := loadAdmissionConfig(func(k string) string { return env[k] })
+	if cfg.MaxActive != 2 || cfg.MaxQueued != 64 || cfg.QueueTimeout != 30*time.Second {
+		t.Errorf("config = %+v", cfg)
+	}
+	if q := cfg.quotaFor(tierFree); q.RequestsPerDay != 20 || q.TokensPerDay != 0 {
+		t.Errorf("free quota = %+v, want the override", q)
+	}
+	if q := cfg.quotaFor(tierPremium); q != defaultTierQuotas[tierPremium] {
+		t.Errorf("tiers not overridden should keep their defaults: %+v", q)
+	}
+	if q := cfg.quotaFor("enterprise"); q.MaxConcurrent != 8 {
+		t.Errorf("enterprise quota = %+v", q)
+	}
+	if q := cfg.quotaFor("unknown"); q != cfg.quotaFor(tierFree) {
+		t.Errorf("unknown tiers should get the free quota: %+v", q)
+	}
+
+	for _, raw := range []string{`{"free": {"requestsPerDay": -1}}`, `{"": {}}`, `[1]`} {
+		if _, err := parseTierQuotas(raw); err == nil {
+			t.Errorf("parseTierQuotas(%s) should fail", raw)
+		}
+	}
+	cfg = loadAdmissionConfig(func(k string) string {
+		if k == "LLM_TIER_QUOTAS" {
+			return "{"
+		}
+		return ""
+	})
+	if cfg.quotaFor(tierFree) != defaultTierQuotas[tierFree] {
+		t.Error("invalid quotas should fall back to the defaults")
+	}
+}
+
+// TestCheckQuota tests which limit turns a request away and when to retry
+func TestCheckQuota(t *testing.T) {
+	now := time.Date(2024, 7, 4, 22, 0, 0, 0, time.UTC)
+	quota := TierQuota{RequestsPerDay: 10, TokensPerDay: 1000, MaxConcurrent: 2}
+	tests := []struct {
+		usage      quotaUsage
+		denied     string
+		retryAfter time.Duration
+	}{
+		{quotaUsage{Requests: 9, Tokens: 999, Active: 1}, "", 0},
+		{quotaUsage{Requests: 10}, "requests", 2 * time.Hour},
+		{quotaUsage{Tokens: 1000}, "tokens", 2 * time.Hour},
+		{quotaUsage{Active: 2}, "at once", concurrencyRetryAfter},
+	}
+	for _, tt := range tests {
+		denied := checkQuota(quota, tt.usage, now)
+		if tt.denied == "" {
+			if denied != nil {
+				t.Errorf("%+v: denied: %v", tt.usage, denied)
+			}
+			continue
+		}
+		if denied == nil || !strings.Contains(denied.Error(), tt.denied) || denied.retryAfter != tt.retryAfter {
+			t.Errorf("%+v: denied = %+v, want %q after %s", tt.usage, denied, tt.denied, tt.retryAfter)
+		}
+	}
+	if denied := checkQuota(TierQuota{}, quotaUsage{Requests: 1e6, Tokens: 1e9, Active: 100}, now); denied != nil {
+		t.Errorf("zero quotas mean no limit: %v", denied)
+	}
+
+	rec := httptest.NewRecorder()
+	writeAdmissionError(rec, &admissionError{"slow down", 1500 * time.Millisecond})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("status = %d, Retry-After = %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+// TestQuotaKey tests whose quota a request counts against
+func TestQuotaKey(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/inference/generate", nil)
+	r.RemoteAddr = "10.0.0.5:51234"
+	if got := quotaKey(r, "u1"); got != "user:u1" {
+		t.Errorf("quotaKey() = %q", got)
+	}
+	if got := quotaKey(r, ""); got != "ip:10.0.0.5" {
+		t.Errorf("anonymous quotaKey() = %q", got)
+	}
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if got := quotaKey(r, ""); got != "ip:203.0.113.9" {
+		t.Errorf("forwarded quotaKey() = %q", got)
+	}
+	// Entries before the last are the client's to write.
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.9")
+	if got := quotaKey(r, ""); got != "ip:203.0.113.9" {
+		t.Errorf("quotaKey() with a spoofed first entry = %q, want the last hop", got)
+	}
+	r.Header.Add("X-Forwarded-For", "203.0.113.10")
+	if got := quotaKey(r, ""); got != "ip:203.0.113.10" {
+		t.Errorf("quotaKey() over repeated headers = %q, want the last hop", got)
+	}
+}
+
+// TestGenerationQueue tests slot limits, priority, aging and the bounds on
+// waiting
+func TestGenerationQueue(t *testing.T) {
+	q := newGenerationQueue(1, 3, time.Minute)
+	running, denied := q.enqueue(tierPriority(tierFree))
+	if denied != nil || !running.granted || running.firstPosition != 0 {
+		t.Fatalf("the first request should start at once: %+v, %v", running, denied)
+	}
+
+	free, _ := q.enqueue(tierPriority(tierFree))
+	power, _ := q.enqueue(tierPriority(tierPower))
+	premium, _ := q.enqueue(tierPriority(tierPremium))
+	if free.firstPosition != 1 || power.firstPosition != 1 || premium.firstPosition != 1 {
+		t.Errorf("higher tiers should join ahead: %d, %d, %d", free.firstPosition, power.firstPosition, premium.firstPosition)
+	}
+	if pos := <-free.position; pos != 3 {
+		t.Errorf("free position = %d, want 3", pos)
+	}
+	if _, denied := q.enqueue(tierPriority(tierPremium)); denied == nil || denied.retryAfter <= 0 {
+		t.Errorf("a full queue should turn requests away: %v", denied)
+	}
+
+	// A free request that has waited long enough overtakes the power one.
+	q.mu.Lock()
+	free.enqueued = free.enqueued.Add(-3 * queueAging / 2)
+	q.mu.Unlock()
+
+	var order []*queueTicket
+	for _, next := range []*queueTicket{premium, free, power} {
+		running.release()
+		if err := next.wait(context.Background(), nil); err != nil {
+			t.Fatalf("wait() error = %v", err)
+		}
+		order = append(order, next)
+		running = next
+	}
+	if order[0] != premium || order[1] != free || order[2] != power {
+		t.Error("slots should go by priority with aging")
+	}
+	running.release()
+	running.release()
+	if q.free != 1 || len(q.waiting) != 0 {
+		t.Errorf("free = %d, waiting = %d after every release", q.free, len(q.waiting))
+	}
+
+	// Waiting requests time out, or leave when their client does.
+	q = newGenerationQueue(1, 3, 20*time.Millisecond)
+	held, _ := q.enqueue(0)
+	waiting, _ := q.enqueue(0)
+	var admissionErr *admissionError
+	if err := waiting.wait(context.Background(), nil); !errors.As(err, &admissionErr) {
+		t.Errorf("wait() error = %v, want a timeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	waiting, _ = q.enqueue(0)
+	if err := waiting.wait(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait() error = %v, want cancelled", err)
+	}
+	waiting.release()
+	held.release()
+	if q.free != 1 || len(q.waiting) != 0 {
+		t.Errorf("free = %d, waiting = %d after leaving the queue", q.free, len(q.waiting))
+	}
+}
+
+// TestGenerateQuotas tests that generation is limited by the user's quota
+// and reports its wait in the queue
+func TestGenerateQuotas(t *testing.T) {
+	store := newMemoryQuotaStore()
+	quotas = store
+	admissionConfig = defaultAdmissionConfig()
+	admissionConfig.Quotas = map[string]TierQuota{tierFree: {RequestsPerDay: 2, MaxConcurrent: 1}}
+	admissionQueue = newGenerationQueue(1, 4, time.Minute)
+	defer func() {
+		quotas, admissionQueue, admissionConfig = nil, nil, defaultAdmissionConfig()
+	}()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	registry.Store(newRegistry([]servedModel{
+		{config: ModelConfig{ModelInfo: ModelInfo{ID: "mock"}, Backend: backendMock}, backend: mockBackend{}, tokenizer: estimateTokenizer{}},
+		{config: ModelConfig{ModelInfo: ModelInfo{ID: "down"}, Backend: backendOllama}, backend: &ollamaBackend{baseURL: down.URL}, tokenizer: estimateTokenizer{}},
+	}, "mock"))
+
+	generate := func(body string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:4000"
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		handleGenerate(rec, req)
+		return rec
+	}
+
+	// Failed generations are refunded; completed ones are charged tokens.
+	if rec := generate(`{"prompt": "Who signed the Declaration?", "model": "down"}`, ""); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := generate(`{"prompt": "Who signed the Declaration?"}`, ""); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if usage := store.get("ip:192.0.2.1"); usage.Requests != 1 || usage.Tokens == 0 {
+		t.Errorf("usage = %+v, want one request with its tokens", usage)
+	}
+
+	// The second request waits behind one holding the only slot.
+	held, _ := admissionQueue.enqueue(tierPriority(tierPremium))
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- generate(`{"prompt": "Who signed the Declaration?"}`, "application/x-ndjson") }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		admissionQueue.mu.Lock()
+		queued := len(admissionQueue.waiting)
+		admissionQueue.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the request never joined the queue")
+		}
+	}
+	held.release()
+	rec := <-done
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	var first, last map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if first["type"] != eventQueued || first["position"] != 1.0 {
+		t.Errorf("first event = %v, want queued at 1", first)
+	}
+	if queue, _ := last["queue"].(map[string]interface{}); last["type"] != eventDone || queue["position"] != 1.0 {
+		t.Errorf("summary = %v, want the queue position", last)
+	}
+
+	// The daily limit is now reached.
+	rec = generate(`{"prompt": "Who signed the Declaration?"}`, "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("status = %d, Retry-After = %q: %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+	if store.get("ip:192.0.2.1").Requests != 2 || len(store.leases) != 0 {
+		t.Errorf("usage = %+v, leases = %v", store.get("ip:192.0.2.1"), store.leases)
+	}
+
+	// A new spoofed first X-Forwarded-For entry does not buy a fresh quota.
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(`{"prompt": "Who signed the Declaration?"}`))
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d, 192.0.2.9", i+1))
+		rec := httptest.NewRecorder()
+		handleGenerate(rec, req)
+		if rec.Code != want {
+			t.Errorf("request %d from 192.0.2.9 = %d, want %d", i+1, rec.Code, want)
+		}
+	}
+	if usage := store.get("ip:192.0.2.9"); usage.Requests != 2 || store.get("ip:198.51.100.1").Requests != 0 {
+		t.Errorf("usage = %+v, want the spoofed requests counted against the last hop", usage)
+	}
+
+	// A user_id in the body is not trusted to pick the quota; only the
+	// gateway's header is.
+	user := newInferenceID()
+	if rec := generate(`{"prompt": "Who signed the Declaration?", "user_id": "`+user+`"}`, ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("claimed user status = %d, want the address's 429", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(`{"prompt": "Who signed the Declaration?"}`))
+	req.RemoteAddr = "192.0.2.1:4000"
+	req.Header.Set(userHeader, user)
+	rec = httptest.NewRecorder()
+	handleGenerate(rec, req)
+	if rec.Code != http.StatusOK || store.get("user:"+user).Requests != 1 {
+		t.Errorf("authenticated status = %d, usage = %+v", rec.Code, store.get("user:"+user))
+	}
+}
+
+// TestRequestUser tests reading the authenticated user from the gateway's
+// header
+func TestRequestUser(t *testing.T) {
+	id := newInferenceID()
+	for header, want := range map[string]string{
+		"":                      "",
+		id:                      id,
+		" " + id + " ":          id,
+		strings.ToUpper(id):     id,
+		"admin":                 "",
+		"1 OR 1=1":              "",
+		id + ",00000000-0000-0": "",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/inference/models", nil)
+		r.Header.Set(userHeader, header)
+		if got := requestUser(r); got != want {
+			t.Errorf("requestUser(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
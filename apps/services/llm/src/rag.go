@@ -36,8 +36,9 @@ type RetrievalMetadata struct {
 }
 
 var (
-	ragDocs []Document
-	ragMu   sync.Mutex
+	ragDocs    []Document
+	ragVersion string
+	ragMu      sync.Mutex
 )
 
 func initRagIndex() error {
@@ -80,12 +81,30 @@ func initRagIndex() error {
 		}
 	}
 
+	version := documentsVersion(docs)
 	ragMu.Lock()
-	ragDocs = docs
+	ragDocs, ragVersion = docs, version
 	ragMu.Unlock()
 	return nil
 }
 
+// documentsVersion fingerprints the corpus, so responses cached from one
+// version of it are not served after it changes.
+func documentsVersion(docs []Document) string {
+	h := sha256.New()
+	for _, doc := range docs {
+		h.Write([]byte(doc.ID + "\x00" + doc.Text + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// corpusVersion is the version of the loaded corpus.
+func corpusVersion() string {
+	ragMu.Lock()
+	defer ragMu.Unlock()
+	return ragVersion
+}
+
 func ragDataDir() string {
 	if override := os.Getenv("PRO_LIBERTY_RAG_DATA_DIR"); override != "" {
 		return override
@@ -182,14 +201,7 @@ func logRetrievalMetadata(prompt string, retrieved []Document) {
 	meta := RetrievalMetadata{
 		PromptHash: hashPrompt(prompt),
 		Timestamp:  time.Now().UTC(),
-	}
-	for _, doc := range retrieved {
-		meta.Documents = append(meta.Documents, RetrievedDocMetadata{
-			DocumentID: doc.ID,
-			Source:     doc.Source,
-			SourceType: doc.SourceType,
-			ChunkIndex: doc.ChunkIndex,
-		})
+		Documents:  citations(retrieved),
 	}
 
 	buf, err := json.Marshal(meta)
@@ -210,6 +222,20 @@ func logRetrievalMetadata(prompt string, retrieved []Document) {
 	f.Write([]byte("\n"))
 }
 
+// citations describes retrieved documents for logs and responses.
+func citations(docs []Document) []RetrievedDocMetadata {
+	cited := make([]RetrievedDocMetadata, 0, len(docs))
+	for _, doc := range docs {
+		cited = append(cited, RetrievedDocMetadata{
+			DocumentID: doc.ID,
+			Source:     doc.Source,
+			SourceType: doc.SourceType,
+			ChunkIndex: doc.ChunkIndex,
+		})
+	}
+	return cited
+}
+
 func hashPrompt(prompt string) string {
 	sum := sha256.Sum256([]byte(prompt))
 	return hex.EncodeToString(sum[:])
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Model availability, from reconciling the registry with the models each
+// backend has installed.
+const (
+	statusUnknown      = "unknown"
+	statusAvailable    = "available"
+	statusNotInstalled = "not_installed"
+	statusUnreachable  = "unreachable"
+)
+
+const (
+	defaultModelsRefresh = 30 * time.Second
+	reconcileTimeout     = 10 * time.Second
+)
+
+// ModelEntry is a model as listed by /inference/models.
+type ModelEntry struct {
+	ModelInfo
+	Default   bool   `json:"default,omitempty"`
+	Available bool   `json:"available"`
+	Status    string `json:"status"`
+	// CircuitOpen is set while the model's backend is failing and calls to
+	// it are turned away.
+	CircuitOpen bool `json:"circuitOpen,omitempty"`
+}
+
+// modelRegistry is the set of configured models. The models themselves
+// never change; a reload builds a new registry. Their availability is
+// updated in place.
+type modelRegistry struct {
+	models    map[string]servedModel
+	order     []string
+	aliases   map[string]string
+	defaultID string
+
+	mu        sync.RWMutex
+	status    map[string]string
+	checkedAt time.Time
+}
+
+// registry is the current model registry. It is set in main and replaced
+// when the models file changes.
+var registry atomic.Pointer[modelRegistry]
+
+// newRegistry creates a registry of validated models, in the order given.
+func newRegistry(served []servedModel, defaultID string) *modelRegistry {
+	r := &modelRegistry{
+		models:    map[string]servedModel{},
+		aliases:   map[string]string{},
+		defaultID: defaultID,
+		status:    map[string]string{},
+	}
+	for _, m := range served {
+		r.models[m.config.ID] = m
+		r.order = append(r.order, m.config.ID)
+		for _, alias := range m.config.Aliases {
+			r.aliases[alias] = m.config.ID
+		}
+	}
+	return r
+}
+
+// lookup finds a model by its ID or an alias.
+func (r *modelRegistry) lookup(id string) (servedModel, bool) {
+	if canonical, ok := r.aliases[id]; ok {
+		id = canonical
+	}
+	m, ok := r.models[id]
+	return m, ok
+}
+
+func (r *modelRegistry) defaultModel() servedModel {
+	return r.models[r.defaultID]
+}
+
+// modelStatus is a model's availability as of the last reconcile.
+func (r *modelRegistry) modelStatus(id string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if s, ok := r.status[id]; ok {
+		return s
+	}
+	return statusUnknown
+}
+
+// checked is when availability was last reconciled, or zero if never.
+func (r *modelRegistry) checked() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.checkedAt
+}
+
+// list returns the models users of a tier can see, in configuration order.
+func (r *modelRegistry) list(tier string) []ModelEntry {
+	entries := []ModelEntry{}
+	for _, id := range r.order {
+		m := r.models[id]
+		if !m.config.visibleTo(tier) {
+			continue
+		}
+		status := r.modelStatus(id)
+		entries = append(entries, ModelEntry{
+			ModelInfo:   m.config.ModelInfo,
+			Default:     id == r.defaultID,
+			Available:   status == statusAvailable,
+			Status:      status,
+			CircuitOpen: breakerFor(m.backend).open(resilience),
+		})
+	}
+	return entries
+}
+
+// reconcile asks each backend which models it has installed and updates
+// every model's status. A backend serving several models is asked once.
+func (r *modelRegistry) reconcile(ctx context.Context) {
+	type listing struct {
+		installed map[string]bool
+		err       error
+	}
+	listings := map[string]listing{}
+	status := map[string]string{}
+	for _, id := range r.order {
+		m := r.models[id]
+		lister, ok := m.backend.(modelLister)
+		if !ok {
+			status[id] = statusAvailable
+			continue
+		}
+		l, listed := listings[m.backend.Name()]
+		if !listed {
+			names, err := lister.ListModels(ctx)
+			if err != nil {
+				log.Printf("Warning: Listing models on %s failed: %v", m.backend.Name(), err)
+			}
+			l = listing{installed: map[string]bool{}, err: err}
+			for _, name := range names {
+				l.installed[name] = true
+			}
+			listings[m.backend.Name()] = l
+		}
+		switch {
+		case l.err != nil:
+			status[id] = statusUnreachable
+		case l.installed[m.config.upstreamName()]:
+			status[id] = statusAvailable
+		default:
+			status[id] = statusNotInstalled
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, s := range status {
+		if previous, ok := r.status[id]; (ok && previous != s) || (!ok && s != statusAvailable) {
+			log.Printf("Model %s is %s", id, s)
+		}
+	}
+	r.status = status
+	r.checkedAt = time.Now().UTC()
+}
+
+// reconcileModels reconciles a registry, bounded by reconcileTimeout.
+func reconcileModels(r *modelRegistry) {
+	ctx, cancel := context.WithTimeout(context.Background(), reconcileTimeout)
+	defer cancel()
+	r.reconcile(ctx)
+}
+
+// reloadModels loads the models again and, if they are valid, replaces
+// the registry. Otherwise the current models are kept.
+func reloadModels(getenv func(string) string) error {
+	r, err := loadModels(getenv)
+	if err != nil {
+		log.Printf("Warning: Reloading models failed, keeping the current models: %v", err)
+		return err
+	}
+	reconcileModels(r)
+	registry.Store(r)
+	log.Printf("Reloaded %d models, default %s", len(r.order), r.defaultID)
+	purgeStaleCache(r)
+	return nil
+}
+
+// modelsRefresh is how often the registry is refreshed (LLM_MODELS_REFRESH).
+func modelsRefresh(getenv func(string) string) time.Duration {
+	v := getenv("LLM_MODELS_REFRESH")
+	if v == "" {
+		return defaultModelsRefresh
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: Invalid LLM_MODELS_REFRESH %q, using %s", v, defaultModelsRefresh)
+		return defaultModelsRefresh
+	}
+	return d
+}
+
+// watchModels keeps the registry current. Every interval it reloads the
+// models file if it has changed, or otherwise reconciles availability.
+// SIGHUP reloads at once.
+func watchModels(getenv func(string) string, interval time.Duration) {
+	path := getenv("LLM_MODELS_FILE")
+	modified := modTime(path)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			modified = modTime(path)
+			reloadModels(getenv)
+		case <-ticker.C:
+			if t := modTime(path); !t.Equal(modified) {
+				modified = t
+				reloadModels(getenv)
+				continue
+			}
+			reconcileModels(registry.Load())
+		}
+	}
+}
+
+// modTime is when a file was last modified, or zero if it cannot be read.
+func modTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
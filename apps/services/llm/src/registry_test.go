@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestModelRegistry tests aliases, deprecation and tier visibility
+func TestModelRegistry(t *testing.T) {
+	configs := []ModelConfig{
+		{ModelInfo: ModelInfo{ID: "liberty-mistral-v1.0", Aliases: []string{"liberty"}}, Backend: backendMock},
+		{ModelInfo: ModelInfo{ID: "neural-chat", Deprecated: true, ReplacedBy: "liberty"}, Backend: backendMock},
+		{ModelInfo: ModelInfo{ID: "liberty-70b", Tiers: []string{tierPower, tierPremium}}, Backend: backendMock},
+	}
+	reg, err := buildModels(configs, "liberty", nil)
+	if err != nil {
+		t.Fatalf("buildModels() error = %v", err)
+	}
+	if reg.defaultID != "liberty-mistral-v1.0" {
+		t.Errorf("an alias as the default should resolve, got %s", reg.defaultID)
+	}
+	if m, ok := reg.lookup("liberty"); !ok || m.config.ID != "liberty-mistral-v1.0" {
+		t.Errorf("lookup(liberty) = %v, %v", m.config.ID, ok)
+	}
+	if _, ok := reg.lookup("gpt-9"); ok {
+		t.Error("unknown models should not be found")
+	}
+	if m, _ := reg.lookup("neural-chat"); m.config.ReplacedBy != "liberty-mistral-v1.0" {
+		t.Errorf("replacedBy should name the model's ID, got %q", m.config.ReplacedBy)
+	}
+
+	ids := func(entries []ModelEntry) string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.ID)
+		}
+		return strings.Join(out, ",")
+	}
+	if got := ids(reg.list(tierFree)); got != "liberty-mistral-v1.0,neural-chat" {
+		t.Errorf("free tier sees %s", got)
+	}
+	if got := ids(reg.list(tierPremium)); got != "liberty-mistral-v1.0,neural-chat,liberty-70b" {
+		t.Errorf("premium tier sees %s", got)
+	}
+
+	for name, tc := range map[string]struct {
+		configs   []ModelConfig
+		defaultID string
+	}{
+		"alias naming a model": {[]ModelConfig{{ModelInfo: ModelInfo{ID: "a"}, Backend: backendMock}, {ModelInfo: ModelInfo{ID: "b", Aliases: []string{"a"}}, Backend: backendMock}}, "a"},
+		"duplicate alias":      {[]ModelConfig{{ModelInfo: ModelInfo{ID: "a", Aliases: []string{"x"}}, Backend: backendMock}, {ModelInfo: ModelInfo{ID: "b", Aliases: []string{"x"}}, Backend: backendMock}}, "a"},
+		"unknown replacement":  {[]ModelConfig{{ModelInfo: ModelInfo{ID: "a", ReplacedBy: "b"}, Backend: backendMock}}, "a"},
+		"deprecated default":   {[]ModelConfig{{ModelInfo: ModelInfo{ID: "a", Deprecated: true}, Backend: backendMock}}, "a"},
+		"tier-limited default": {[]ModelConfig{{ModelInfo: ModelInfo{ID: "a", Tiers: []string{tierPremium}}, Backend: backendMock}}, "a"},
+	} {
+		if _, err := buildModels(tc.configs, tc.defaultID, nil); err == nil {
+			t.Errorf("%s: buildModels() should fail", name)
+		}
+	}
+}
+
+// TestReconcileModels tests checking models against what backends have
+// installed
+func TestReconcileModels(t *testing.T) {
+	calls := 0
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"models": [{"name": "mistral:7b"}, {"name": "llama2:latest"}]}`))
+	}))
+	defer ollama.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+	vllm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": [{"id": "llama-3-8b"}]}`))
+	}))
+	defer vllm.Close()
+
+	reg, err := buildModels([]ModelConfig{
+		{ModelInfo: ModelInfo{ID: "liberty"}, Backend: backendOllama, BaseURL: ollama.URL, UpstreamModel: "mistral:7b"},
+		{ModelInfo: ModelInfo{ID: "llama2"}, Backend: backendOllama, BaseURL: ollama.URL},
+		{ModelInfo: ModelInfo{ID: "neural-chat"}, Backend: backendOllama, BaseURL: ollama.URL},
+		{ModelInfo: ModelInfo{ID: "remote"}, Backend: backendOllama, BaseURL: down.URL},
+		{ModelInfo: ModelInfo{ID: "llama3"}, Backend: backendOpenAI, BaseURL: vllm.URL, UpstreamModel: "llama-3-8b"},
+		{ModelInfo: ModelInfo{ID: "mock"}, Backend: backendMock},
+	}, "liberty", nil)
+	if err != nil {
+		t.Fatalf("buildModels() error = %v", err)
+	}
+	if reg.modelStatus("liberty") != statusUnknown || !reg.checked().IsZero() {
+		t.Error("models should be unknown until reconciled")
+	}
+	reg.reconcile(context.Background())
+
+	want := map[string]string{
+		"liberty":     statusAvailable,
+		"llama2":      statusAvailable, // installed as llama2:latest
+		"neural-chat": statusNotInstalled,
+		"remote":      statusUnreachable,
+		"llama3":      statusAvailable,
+		"mock":        statusAvailable,
+	}
+	for _, e := range reg.list(tierFree) {
+		if e.Status != want[e.ID] || e.Available != (want[e.ID] == statusAvailable) {
+			t.Errorf("%s: status %s (available %v), want %s", e.ID, e.Status, e.Available, want[e.ID])
+		}
+	}
+	if calls != 1 {
+		t.Errorf("a shared backend should be asked once, was asked %d times", calls)
+	}
+}
+
+// TestGenerateModelSelection tests that generation honours aliases, tiers,
+// availability and deprecation
+func TestGenerateModelSelection(t *testing.T) {
+	mock := func(info ModelInfo) servedModel {
+		return servedModel{config: ModelConfig{ModelInfo: info, Backend: backendMock}, backend: mockBackend{}, tokenizer: estimateTokenizer{}}
+	}
+	reg := newRegistry([]servedModel{
+		mock(ModelInfo{ID: "liberty", Aliases: []string{"liberty-mistral"}}),
+		mock(ModelInfo{ID: "legacy", Deprecated: true, ReplacedBy: "liberty"}),
+		mock(ModelInfo{ID: "large", Tiers: []string{tierPremium}}),
+		mock(ModelInfo{ID: "missing"}),
+	}, "liberty")
+	reg.status = map[string]string{"missing": statusNotInstalled}
+	registry.Store(reg)
+
+	tests := []struct {
+		model      string
+		status     int
+		answeredBy string
+		deprecated bool
+	}{
+		{"", http.StatusOK, "liberty", false},
+		{"liberty-mistral", http.StatusOK, "liberty", false},
+		{"legacy", http.StatusOK, "legacy", true},
+		{"large", http.StatusForbidden, "", false},
+		{"missing", http.StatusServiceUnavailable, "", false},
+		{"gpt-9", http.StatusBadRequest, "", false},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(InferenceRequest{Prompt: "What is a writ of habeas corpus?", Model: tt.model})
+		rec := httptest.NewRecorder()
+		handleGenerate(rec, httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(string(body))))
+		if rec.Code != tt.status {
+			t.Errorf("model %q: status = %d, want %d: %s", tt.model, rec.Code, tt.status, rec.Body.String())
+			continue
+		}
+		if (rec.Header().Get("Deprecation") == "true") != tt.deprecated {
+			t.Errorf("model %q: Deprecation header = %q", tt.model, rec.Header().Get("Deprecation"))
+		}
+		if tt.status == http.StatusOK {
+			var resp InferenceResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if resp.Model != tt.answeredBy {
+				t.Errorf("model %q: answered by %s, want %s", tt.model, resp.Model, tt.answeredBy)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleListModels(rec, httptest.NewRequest(http.MethodGet, "/inference/models", nil))
+	var list struct {
+		Models  []ModelEntry `json:"models"`
+		Default string       `json:"default"`
+	}
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list.Models) != 3 || list.Default != "liberty" || !list.Models[0].Default {
+		t.Errorf("anonymous users should see the three free models: %+v", list)
+	}
+}
+
+// TestReloadModels tests replacing the registry when the models file
+// changes, and keeping it when the new file is invalid
+func TestReloadModels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models.json")
+	getenv := func(key string) string {
+		return map[string]string{"LLM_MODELS_FILE": path, "LLM_BACKEND": backendMock}[key]
+	}
+	os.WriteFile(path, []byte(`{"default": "a", "models": [{"id": "a"}]}`), 0o644)
+	if err := reloadModels(getenv); err != nil {
+		t.Fatalf("reloadModels() error = %v", err)
+	}
+	if reg := registry.Load(); len(reg.order) != 1 || reg.modelStatus("a") != statusAvailable {
+		t.Fatalf("registry after load = %+v", reg.order)
+	}
+
+	os.WriteFile(path, []byte(`{"models": [{"id": "a", "deprecated": true, "replacedBy": "b"}, {"id": "b", "aliases": ["beta"]}]}`), 0o644)
+	if err := reloadModels(getenv); err != nil {
+		t.Fatalf("reloadModels() error = %v", err)
+	}
+	reg := registry.Load()
+	if _, ok := reg.lookup("beta"); !ok || reg.defaultID != "b" {
+		t.Errorf("the first current model should become the default, got %s", reg.defaultID)
+	}
+
+	os.WriteFile(path, []byte(`{"models": [{"id": "a", "backend": "tgi"}]}`), 0o644)
+	if err := reloadModels(getenv); err == nil {
+		t.Error("an invalid models file should fail to load")
+	}
+	if registry.Load() != reg {
+		t.Error("an invalid models file should leave the registry alone")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultGenerateTimeout bounds a backend call for models that set no
+// timeout of their own.
+const defaultGenerateTimeout = 2 * time.Minute
+
+// ResilienceConfig controls retrying failed backend calls and the circuit
+// breaker kept for each backend.
+type ResilienceConfig struct {
+	Retries        int           // retries after the first attempt
+	RetryBaseDelay time.Duration // backoff before the first retry, doubling after
+	RetryMaxDelay  time.Duration
+	// BreakerThreshold consecutive failures open a backend's circuit, which
+	// turns calls away for BreakerCooldown before letting one through to
+	// probe it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+func defaultResilienceConfig() ResilienceConfig {
+	return ResilienceConfig{
+		Retries:          2,
+		RetryBaseDelay:   250 * time.Millisecond,
+		RetryMaxDelay:    2 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// resilience is set in main from the environment.
+var resilience = defaultResilienceConfig()
+
+// loadResilienceConfig reads LLM_BACKEND_RETRIES, LLM_BREAKER_THRESHOLD and
+// LLM_BREAKER_COOLDOWN. Invalid values are logged and the defaults used.
+func loadResilienceConfig(getenv func(string) string) ResilienceConfig {
+	cfg := defaultResilienceConfig()
+	if raw := getenv("LLM_BACKEND_RETRIES"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+			cfg.Retries = n
+		} else {
+			log.Printf("Warning: Invalid LLM_BACKEND_RETRIES %q, using %d", raw, cfg.Retries)
+		}
+	}
+	if raw := getenv("LLM_BREAKER_THRESHOLD"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			cfg.BreakerThreshold = n
+		} else {
+			log.Printf("Warning: Invalid LLM_BREAKER_THRESHOLD %q, using %d", raw, cfg.BreakerThreshold)
+		}
+	}
+	if raw := getenv("LLM_BREAKER_COOLDOWN"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			cfg.BreakerCooldown = d
+		} else {
+			log.Printf("Warning: Invalid LLM_BREAKER_COOLDOWN %q, using %s", raw, cfg.BreakerCooldown)
+		}
+	}
+	return cfg
+}
+
+// errBackendTimeout is a call that ran past its model's timeout.
+var errBackendTimeout = errors.New("backend timed out")
+
+// circuitOpenError turns a call away from a backend whose circuit is open.
+type circuitOpenError struct {
+	backend string
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%s is failing, not sending requests to it for now", e.backend)
+}
+
+// retryable reports whether a failed call may succeed if sent again: the
+// backend could not be reached, dropped the connection, or answered that
+// it is overloaded or broken.
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.status == http.StatusRequestTimeout || status.status == http.StatusTooManyRequests || status.status >= 500
+	}
+	if errors.Is(err, errBackendTimeout) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// backendFailed reports whether an error counts against the backend's
+// circuit: it failed or timed out, rather than rejecting the request.
+func backendFailed(err error) bool {
+	return retryable(err) || errors.Is(err, errBackendTimeout)
+}
+
+// retryDelay is the backoff before retry n (from 0): the base delay
+// doubled each time up to the maximum, with half of it jittered so
+// replicas do not retry in step.
+func retryDelay(n int, cfg ResilienceConfig) time.Duration {
+	d := cfg.RetryBaseDelay << n
+	if d > cfg.RetryMaxDelay || d <= 0 {
+		d = cfg.RetryMaxDelay
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// circuitBreaker stops calls to a backend that keeps failing. After the
+// threshold of consecutive failures it opens for the cooldown, then lets a
+// single call through; success closes it, failure opens it again.
+type circuitBreaker struct {
+	name string
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a call may go ahead.
+func (b *circuitBreaker) allow(cfg ResilienceConfig) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < cfg.BreakerThreshold {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return &circuitOpenError{backend: b.name}
+	}
+	b.probing = true
+	return nil
+}
+
+// done records a call's outcome. Calls that neither succeeded nor failed
+// on the backend's side, such as ones the client cancelled, leave the
+// circuit as it was.
+func (b *circuitBreaker) done(err error, cfg ResilienceConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.probing
+	b.probing = false
+	switch {
+	case err == nil:
+		if b.failures >= cfg.BreakerThreshold {
+			log.Printf("Circuit for %s closed", b.name)
+		}
+		b.failures = 0
+	case backendFailed(err):
+		b.failures++
+		if probe || b.failures == cfg.BreakerThreshold {
+			b.openUntil = time.Now().Add(cfg.BreakerCooldown)
+			log.Printf("Warning: Circuit for %s opened for %s after %d failures: %v", b.name, cfg.BreakerCooldown, b.failures, err)
+		}
+	}
+}
+
+// open reports whether calls are being turned away.
+func (b *circuitBreaker) open(cfg ResilienceConfig) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= cfg.BreakerThreshold && time.Now().Before(b.openUntil)
+}
+
+// breakers holds a circuit breaker per backend, by name, so models on the
+// same server share one and it outlives model reloads.
+var breakers = struct {
+	sync.Mutex
+	byName map[string]*circuitBreaker
+}{byName: map[string]*circuitBreaker{}}
+
+func breakerFor(backend InferenceBackend) *circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	name := backend.Name()
+	b, ok := breakers.byName[name]
+	if !ok {
+		b = &circuitBreaker{name: name}
+		breakers.byName[name] = b
+	}
+	return b
+}
+
+// callBackend sends req to m's backend, streaming to onToken if it is not
+// nil. Each attempt is bounded by the model's timeout as well as ctx.
+// Transient failures are retried with backoff until text has been
+// streamed, and calls are turned away while the backend's circuit is open.
+func callBackend(ctx context.Context, m servedModel, req BackendRequest, onToken TokenFunc) (BackendResponse, error) {
+	cfg := resilience
+	breaker := breakerFor(m.backend)
+	streamed := false
+	relay := onToken
+	if onToken != nil {
+		relay = func(text string) error {
+			streamed = true
+			return onToken(text)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := breaker.allow(cfg); err != nil {
+			return BackendResponse{}, err
+		}
+		resp, err := attemptBackend(ctx, m, req, relay)
+		if ctx.Err() != nil {
+			// The client went away; that says nothing about the backend.
+			breaker.done(ctx.Err(), cfg)
+			return resp, err
+		}
+		breaker.done(err, cfg)
+		if err == nil || streamed || attempt >= cfg.Retries || !retryable(err) {
+			return resp, err
+		}
+		delay := retryDelay(attempt, cfg)
+		log.Printf("Model %s failed on %s, retrying in %s: %v", m.config.ID, m.backend.Name(), delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return BackendResponse{}, ctx.Err()
+		}
+	}
+}
+
+// attemptBackend makes one call, within the model's timeout.
+func attemptBackend(ctx context.Context, m servedModel, req BackendRequest, onToken TokenFunc) (BackendResponse, error) {
+	callCtx := ctx
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+	var resp BackendResponse
+	var err error
+	if onToken == nil {
+		resp, err = m.backend.Generate(callCtx, req)
+	} else {
+		resp, err = m.backend.Stream(callCtx, req, onToken)
+	}
+	if err != nil && ctx.Err() == nil && callCtx.Err() != nil {
+		err = fmt.Errorf("model %s: %w after %s", m.config.ID, errBackendTimeout, m.timeout)
+	}
+	return resp, err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fastResilience retries and recovers quickly, for tests.
+func fastResilience() ResilienceConfig {
+	return ResilienceConfig{Retries: 2, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 5 * time.Millisecond, BreakerThreshold: 3, BreakerCooldown: 50 * time.Millisecond}
+}
+
+// failures is n copies of status.
+func failures(status, n int) []int {
+	statuses := make([]int, n)
+	for i := range statuses {
+		statuses[i] = status
+	}
+	return statuses
+}
+
+// flakyServer answers Ollama generate requests with each status in turn,
+// then with 200.
+func flakyServer(calls *int32, statuses ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(calls, 1))
+		if n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.Write([]byte(`{"response": "recovered", "done": true}`))
+	}))
+}
+
+// TestRetryable tests which failures are worth retrying
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&statusError{status: http.StatusServiceUnavailable}, true},
+		{&statusError{status: http.StatusTooManyRequests}, true},
+		{&statusError{status: http.StatusNotFound}, false},
+		{&statusError{status: http.StatusBadRequest}, false},
+		{io.ErrUnexpectedEOF, true},
+		{context.Canceled, false},
+		{errBackendTimeout, false},
+		{errors.New("invalid response"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+	_, err := (&ollamaBackend{baseURL: "http://127.0.0.1:1"}).Generate(context.Background(), BackendRequest{Model: "m"})
+	if !retryable(err) {
+		t.Errorf("a refused connection should be retried: %v", err)
+	}
+
+	cfg := defaultResilienceConfig()
+	for n := 0; n < 6; n++ {
+		if d := retryDelay(n, cfg); d < cfg.RetryBaseDelay/2 || d > cfg.RetryMaxDelay {
+			t.Errorf("retryDelay(%d) = %s", n, d)
+		}
+	}
+}
+
+// TestLoadResilienceConfig tests reading retry and breaker settings
+func TestLoadResilienceConfig(t *testing.T) {
+	env := map[string]string{"LLM_BACKEND_RETRIES": "0", "LLM_BREAKER_THRESHOLD": "-2", "LLM_BREAKER_COOLDOWN": "1m"}
+	cfg := loadResilienceConfig(func(k string) string { return env[k] })
+	if cfg.Retries != 0 || cfg.BreakerThreshold != 5 || cfg.BreakerCooldown != time.Minute {
+		t.Errorf("config = %+v", cfg)
+	}
+}
+
+// TestCallBackend tests retries, timeouts and the circuit breaker
+func TestCallBackend(t *testing.T) {
+	resilience = fastResilience()
+	defer func() { resilience = defaultResilienceConfig() }()
+
+	model := func(url string, timeout time.Duration) servedModel {
+		return servedModel{config: ModelConfig{ModelInfo: ModelInfo{ID: "m"}}, backend: &ollamaBackend{baseURL: url}, timeout: timeout}
+	}
+
+	// Transient failures are retried; rejected requests are not.
+	var calls int32
+	flaky := flakyServer(&calls, http.StatusServiceUnavailable, http.StatusBadGateway)
+	defer flaky.Close()
+	resp, err := callBackend(context.Background(), model(flaky.URL, 0), BackendRequest{Model: "m"}, nil)
+	if err != nil || resp.Text != "recovered" || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("callBackend() = %q, %v after %d calls", resp.Text, err, atomic.LoadInt32(&calls))
+	}
+	atomic.StoreInt32(&calls, 0)
+	rejecting := flakyServer(&calls, http.StatusBadRequest)
+	defer rejecting.Close()
+	if _, err := callBackend(context.Background(), model(rejecting.URL, 0), BackendRequest{Model: "m"}, nil); err == nil || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("a 400 should not be retried: %v after %d calls", err, atomic.LoadInt32(&calls))
+	}
+
+	// Streams are retried until they have sent text.
+	atomic.StoreInt32(&calls, 0)
+	streaming := flakyServer(&calls, http.StatusServiceUnavailable)
+	defer streaming.Close()
+	var streamed strings.Builder
+	onToken := func(text string) error { streamed.WriteString(text); return nil }
+	if _, err := callBackend(context.Background(), model(streaming.URL, 0), BackendRequest{Model: "m"}, onToken); err != nil || streamed.String() != "recovered" {
+		t.Errorf("stream: %v, streamed %q", err, streamed.String())
+	}
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"response": "Congress"}` + "\n"))
+	}))
+	defer broken.Close()
+	atomic.StoreInt32(&calls, 0)
+	if _, err := callBackend(context.Background(), model(broken.URL, 0), BackendRequest{Model: "m"}, onToken); err == nil || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("a stream that sent text should not be retried: %v after %d calls", err, atomic.LoadInt32(&calls))
+	}
+
+	// Three failed attempts open the circuit, and the next call is turned
+	// away without reaching the backend.
+	atomic.StoreInt32(&calls, 0)
+	down := flakyServer(&calls, failures(http.StatusServiceUnavailable, 100)...)
+	defer down.Close()
+	downModel := model(down.URL, 0)
+	var open *circuitOpenError
+	if _, err := callBackend(context.Background(), downModel, BackendRequest{Model: "m"}, nil); err == nil || errors.As(err, &open) {
+		t.Fatalf("callBackend() error = %v, want the backend's", err)
+	}
+	if !breakerFor(downModel.backend).open(resilience) {
+		t.Errorf("the circuit should open after %d failures", resilience.BreakerThreshold)
+	}
+	before := atomic.LoadInt32(&calls)
+	if _, err := callBackend(context.Background(), downModel, BackendRequest{Model: "m"}, nil); !errors.As(err, &open) || atomic.LoadInt32(&calls) != before {
+		t.Errorf("an open circuit should turn calls away: %v", err)
+	}
+
+	// After the cooldown a probe that succeeds closes it.
+	time.Sleep(resilience.BreakerCooldown)
+	atomic.StoreInt32(&calls, 1000)
+	if _, err := callBackend(context.Background(), downModel, BackendRequest{Model: "m"}, nil); err != nil {
+		t.Errorf("the probe should reach the recovered backend: %v", err)
+	}
+	if breakerFor(downModel.backend).open(resilience) {
+		t.Error("a successful probe should close the circuit")
+	}
+
+	// A hung backend is cut off at the model's timeout and not retried.
+	atomic.StoreInt32(&calls, 0)
+	stop := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer hung.Close()
+	defer close(stop)
+	start := time.Now()
+	_, err = callBackend(context.Background(), model(hung.URL, 30*time.Millisecond), BackendRequest{Model: "m"}, nil)
+	if !errors.Is(err, errBackendTimeout) || atomic.LoadInt32(&calls) != 1 || time.Since(start) > 5*time.Second {
+		t.Errorf("callBackend() error = %v after %d calls", err, atomic.LoadInt32(&calls))
+	}
+
+	// A cancelled request does not count against the backend.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := breakerFor(&ollamaBackend{baseURL: hung.URL})
+	failures := b.failures
+	callBackend(ctx, model(hung.URL, 0), BackendRequest{Model: "m"}, nil)
+	if b.failures != failures {
+		t.Error("cancelled calls should not count as failures")
+	}
+}
+
+// TestGenerateFallback tests that a failing model falls back in order and
+// the response names the model that answered
+func TestGenerateFallback(t *testing.T) {
+	resilience = fastResilience()
+	defer func() { resilience = defaultResilienceConfig() }()
+
+	var calls int32
+	down := flakyServer(&calls, failures(http.StatusServiceUnavailable, 100)...)
+	defer down.Close()
+	primary := ModelConfig{ModelInfo: ModelInfo{ID: "liberty"}, Backend: backendOllama, Fallbacks: []string{"premium-only", "mock"}}
+	registry.Store(newRegistry([]servedModel{
+		{config: primary, backend: &ollamaBackend{baseURL: down.URL}, tokenizer: estimateTokenizer{}},
+		{config: ModelConfig{ModelInfo: ModelInfo{ID: "premium-only", Tiers: []string{tierPremium}}, Backend: backendMock}, backend: mockBackend{}, tokenizer: estimateTokenizer{}},
+		{config: ModelConfig{ModelInfo: ModelInfo{ID: "mock"}, Backend: backendMock}, backend: mockBackend{}, tokenizer: estimateTokenizer{}},
+	}, "liberty"))
+
+	rec := httptest.NewRecorder()
+	handleGenerate(rec, httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(`{"prompt": "Who may declare war?"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp InferenceResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Model != "mock" || resp.FallbackFrom != "liberty" || !strings.Contains(resp.Result, "from mock") {
+		t.Errorf("model = %s, fallback_from = %s, result = %q", resp.Model, resp.FallbackFrom, resp.Result)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(`{"prompt": "Who may declare war?"}`))
+	req.Header.Set("Accept", "application/x-ndjson")
+	rec = httptest.NewRecorder()
+	handleGenerate(rec, req)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	var summary map[string]interface{}
+	json.Unmarshal([]byte(lines[len(lines)-1]), &summary)
+	if summary["type"] != eventDone || summary["model"] != "mock" || summary["fallback_from"] != "liberty" {
+		t.Errorf("stream summary = %v", summary)
+	}
+
+	// Models that answer report no fallback.
+	rec = httptest.NewRecorder()
+	handleGenerate(rec, httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(`{"prompt": "Who may declare war?", "model": "mock"}`)))
+	if strings.Contains(rec.Body.String(), "fallback_from") {
+		t.Errorf("unexpected fallback: %s", rec.Body.String())
+	}
+}
+
+// TestModelFallbackConfig tests validating fallbacks and timeouts
+func TestModelFallbackConfig(t *testing.T) {
+	configs := []ModelConfig{
+		{ModelInfo: ModelInfo{ID: "liberty-mistral-v1.0", Aliases: []string{"liberty"}}, Backend: backendMock, Fallbacks: []string{"m"}, Timeout: "90s"},
+		{ModelInfo: ModelInfo{ID: "mistral", Aliases: []string{"m"}}, Backend: backendMock, Fallbacks: []string{"liberty"}},
+	}
+	reg, err := buildModels(configs, "liberty", nil)
+	if err != nil {
+		t.Fatalf("buildModels() error = %v", err)
+	}
+	m, _ := reg.lookup("liberty")
+	if len(m.config.Fallbacks) != 1 || m.config.Fallbacks[0] != "mistral" || m.timeout != 90*time.Second {
+		t.Errorf("fallbacks = %v, timeout = %s", m.config.Fallbacks, m.timeout)
+	}
+	if m, _ := reg.lookup("mistral"); m.timeout != 0 {
+		t.Errorf("a model without a timeout should have none, got %s", m.timeout)
+	}
+
+	for _, cfg := range []ModelConfig{
+		{ModelInfo: ModelInfo{ID: "a"}, Backend: backendMock, Fallbacks: []string{"a"}},
+		{ModelInfo: ModelInfo{ID: "a"}, Backend: backendMock, Fallbacks: []string{"missing"}},
+		{ModelInfo: ModelInfo{ID: "a"}, Backend: backendMock, Timeout: "soon"},
+		{ModelInfo: ModelInfo{ID: "a"}, Backend: backendMock, Timeout: "-1s"},
+	} {
+		if _, err := buildModels([]ModelConfig{cfg}, "a", nil); err == nil {
+			t.Errorf("buildModels(%+v) should fail", cfg)
+		}
+	}
+
+	if got := withEnvDefaults([]ModelConfig{{ModelInfo: ModelInfo{ID: "a"}}}, func(string) string { return "" }); got[0].Timeout != defaultGenerateTimeout.String() {
+		t.Errorf("default timeout = %q", got[0].Timeout)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Streaming formats for /inference/generate.
+const (
+	streamSSE    = "sse"
+	streamNDJSON = "ndjson"
+)
+
+// Stream event types. A stream is any number of queued events while the
+// request waits for a generation slot, then token events, followed by
+// exactly one done or error event.
+const (
+	eventQueued = "queued"
+	eventToken  = "token"
+	eventDone   = "done"
+	eventError  = "error"
+)
+
+// StreamSummary ends a successful stream.
+type StreamSummary struct {
+	ID               string                 `json:"id"`
+	Model            string                 `json:"model"`
+	FallbackFrom     string                 `json:"fallback_from,omitempty"`
+	PromptTokens     int                    `json:"prompt_tokens"`
+	CompletionTokens int                    `json:"completion_tokens"`
+	Tokens           int                    `json:"tokens"`
+	Duration         string                 `json:"duration"`
+	CreatedAt        time.Time              `json:"created_at"`
+	Citations        []RetrievedDocMetadata `json:"citations"`
+	ConversationID   string                 `json:"conversation_id,omitempty"`
+	ContextTrim      *ContextTrim           `json:"context_trimmed,omitempty"`
+	Options          GenerationOptions      `json:"options"`
+	Queue            *QueueInfo             `json:"queue,omitempty"`
+	Cache            *CacheInfo             `json:"cache,omitempty"`
+}
+
+// streamFormat picks the response format: an Accept header of
+// text/event-stream or application/x-ndjson, or "stream": true in the body,
+// which means SSE. An empty result means a plain JSON response.
+func streamFormat(accept string, requested bool) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		switch strings.ToLower(mediaType) {
+		case "text/event-stream":
+			return streamSSE
+		case "application/x-ndjson":
+			return streamNDJSON
+		}
+	}
+	if requested {
+		return streamSSE
+	}
+	return ""
+}
+
+// streamWriter writes events in one format and flushes each so the client
+// sees tokens as they arrive.
+type streamWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	format  string
+}
+
+// newStreamWriter sends the response headers for format.
+func newStreamWriter(w http.ResponseWriter, format string) (*streamWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming is not supported by this connection")
+	}
+	if format == streamSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	// Stop proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &streamWriter{w: w, flusher: flusher, format: format}, nil
+}
+
+// send writes one event. In SSE the type is the event name; in NDJSON it is
+// the "type" field of the line.
+func (s *streamWriter) send(eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if s.format == streamSSE {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", eventType, data)
+	} else {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		fields["type"] = eventType
+		line, _ := json.Marshal(fields)
+		_, err = fmt.Fprintf(s.w, "%s\n", line)
+	}
+	if err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *streamWriter) token(text string) error {
+	return s.send(eventToken, map[string]string{"text": text})
+}
+
+func (s *streamWriter) done(summary StreamSummary) error {
+	return s.send(eventDone, summary)
+}
+
+func (s *streamWriter) fail(message string) error {
+	return s.send(eventError, ErrorResponse{Error: message})
+}
+
+// streamGeneration relays tokens from the model's backend as they arrive and
+// ends with a summary. When the client disconnects, the request context is
+// cancelled, which aborts the upstream request and stops generation.
+func streamGeneration(w http.ResponseWriter, r *http.Request, format string, g *generation) {
+	stream, err := newStreamWriter(w, format)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// While waiting for a slot the client is told its place in the queue.
+	err = g.admission.wait(r.Context(), func(position int) {
+		stream.send(eventQueued, map[string]int{"position": position})
+	})
+	if err != nil {
+		g.admission.charge(0, true)
+		if r.Context().Err() == nil {
+			stream.fail(err.Error())
+		}
+		return
+	}
+
+	// The text sent so far is recorded if generation stops early.
+	g.streamed = true
+	var partial strings.Builder
+	onToken := func(text string) error {
+		partial.WriteString(text)
+		return stream.token(text)
+	}
+
+	start := time.Now()
+	generated, err := g.generate(r.Context(), onToken)
+	if err != nil {
+		g.fail(r.Context(), err, partial.String())
+		if r.Context().Err() != nil {
+			log.Printf("Client disconnected, stopped generation: model=%s after %s", g.modelID, time.Since(start))
+			return
+		}
+		stream.fail(fmt.Sprintf("Inference failed: %v", err))
+		return
+	}
+	if err := g.complete(r.Context(), generated); err != nil {
+		log.Printf("Saving conversation turn failed: %v", err)
+		stream.fail("Failed to save conversation")
+		return
+	}
+
+	promptTokens, completionTokens := g.usage(generated)
+	stream.done(StreamSummary{
+		ID:               g.id,
+		Model:            g.modelID,
+		FallbackFrom:     g.fallbackFrom(),
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Tokens:           completionTokens,
+		Duration:         time.Since(start).String(),
+		CreatedAt:        time.Now().UTC(),
+		Citations:        citations(g.retrieved),
+		ConversationID:   g.conversationID(),
+		ContextTrim:      g.trim,
+		Options:          g.backendReq.Options,
+		Queue:            g.admission.queueInfo(),
+		Cache:            g.cacheInfo(),
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStreamFormat tests choosing the streaming format
+func TestStreamFormat(t *testing.T) {
+	tests := []struct {
+		accept    string
+		requested bool
+		want      string
+	}{
+		{"", false, ""},
+		{"application/json", false, ""},
+		{"", true, streamSSE},
+		{"text/event-stream", false, streamSSE},
+		{"application/json, application/x-ndjson;q=0.9", false, streamNDJSON},
+		{"application/x-ndjson", true, streamNDJSON},
+	}
+	for _, tt := range tests {
+		if got := streamFormat(tt.accept, tt.requested); got != tt.want {
+			t.Errorf("streamFormat(%q, %v) = %q, want %q", tt.accept, tt.requested, got, tt.want)
+		}
+	}
+}
+
+// TestStreamGenerate tests streaming a generation in both formats
+func TestStreamGenerate(t *testing.T) {
+	registry.Store(newRegistry([]servedModel{{config: ModelConfig{ModelInfo: ModelInfo{ID: "mock"}, Backend: backendMock}, backend: mockBackend{}, tokenizer: estimateTokenizer{}}}, "mock"))
+
+	for _, format := range []string{"text/event-stream", "application/x-ndjson"} {
+		req := httptest.NewRequest(http.MethodPost, "/inference/generate", strings.NewReader(`{"prompt": "What powers does Congress have?"}`))
+		req.Header.Set("Accept", format)
+		rec := httptest.NewRecorder()
+		handleGenerate(rec, req)
+
+		if ct := rec.Header().Get("Content-Type"); ct != format {
+			t.Fatalf("Content-Type = %q, want %q", ct, format)
+		}
+		var events []map[string]interface{}
+		var types []string
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			var data string
+			if format == "text/event-stream" {
+				if !strings.HasPrefix(line, "data: ") {
+					continue
+				}
+				data = strings.TrimPrefix(line, "data: ")
+			} else if data = line; data == "" {
+				continue
+			}
+			var event map[string]interface{}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatalf("%s: invalid event %q: %v", format, data, err)
+			}
+			events = append(events, event)
+			if format == "application/x-ndjson" {
+				types = append(types, event["type"].(string))
+			}
+		}
+		if format == "text/event-stream" {
+			for _, line := range strings.Split(rec.Body.String(), "\n") {
+				if name, ok := strings.CutPrefix(line, "event: "); ok {
+					types = append(types, name)
+				}
+			}
+		}
+
+		if len(events) < 2 || len(types) != len(events) {
+			t.Fatalf("%s: events = %v, types = %v", format, events, types)
+		}
+		var text strings.Builder
+		for i, event := range events[:len(events)-1] {
+			if types[i] != eventToken {
+				t.Fatalf("%s: event %d is %q, want token", format, i, types[i])
+			}
+			text.WriteString(event["text"].(string))
+		}
+		summary := events[len(events)-1]
+		if types[len(types)-1] != eventDone || summary["model"] != "mock" || summary["completion_tokens"].(float64) == 0 {
+			t.Errorf("%s: summary = %v", format, summary)
+		}
+		if _, ok := summary["citations"].([]interface{}); !ok {
+			t.Errorf("%s: summary should list citations: %v", format, summary)
+		}
+		if !strings.HasPrefix(text.String(), "Mock response") {
+			t.Errorf("%s: streamed text = %q", format, text.String())
+		}
+	}
+}
+
+// TestStreamBackends tests reading streamed tokens from Ollama and
+// OpenAI-compatible servers
+func TestStreamBackends(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["stream"] != true {
+			t.Errorf("%s: stream should be requested", r.URL.Path)
+		}
+		switch r.URL.Path {
+		case "/api/generate":
+			fmt.Fprintln(w, `{"response": "We the", "done": false}`)
+			fmt.Fprintln(w, `{"response": " People", "done": false}`)
+			fmt.Fprintln(w, `{"response": "", "done": true, "prompt_eval_count": 9, "eval_count": 3}`)
+		case "/v1/chat/completions":
+			fmt.Fprint(w, "data: {\"choices\": [{\"delta\": {\"role\": \"assistant\"}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\": [{\"delta\": {\"content\": \"We the\"}}]}\n\n")
+			fmt.Fprint(w, ": keep-alive\n\n")
+			fmt.Fprint(w, "data: {\"choices\": [{\"delta\": {\"content\": \" People\"}}]}\n\n")
+			fmt.Fprint(w, "data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 9, \"completion_tokens\": 3}}\n\n")
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		}
+	}))
+	defer server.Close()
+
+	for _, backend := range []InferenceBackend{&ollamaBackend{baseURL: server.URL}, &openAIBackend{baseURL: server.URL}} {
+		var tokens []string
+		got, err := backend.Stream(context.Background(), BackendRequest{Model: "m", Prompt: "Preamble"}, func(text string) error {
+			tokens = append(tokens, text)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: Stream() error = %v", backend.Name(), err)
+		}
+		if strings.Join(tokens, "|") != "We the| People" {
+			t.Errorf("%s: tokens = %q", backend.Name(), tokens)
+		}
+		if got.Text != "We the People" || got.PromptTokens != 9 || got.CompletionTokens != 3 {
+			t.Errorf("%s: Stream() = %+v", backend.Name(), got)
+		}
+	}
+}
+
+// TestStreamStopsUpstream tests that a disconnecting client stops
+// generation on the backend
+func TestStreamStopsUpstream(t *testing.T) {
+	stopped := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; ; i++ {
+			fmt.Fprintf(w, "{\"response\": \"token%d \", \"done\": false}\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				close(stopped)
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	registry.Store(newRegistry([]servedModel{{config: ModelConfig{ModelInfo: ModelInfo{ID: "slow"}}, backend: &ollamaBackend{baseURL: upstream.URL}, tokenizer: estimateTokenizer{}}}, "slow"))
+	service := httptest.NewServer(http.HandlerFunc(handleGenerate))
+	defer service.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, service.URL, strings.NewReader(`{"prompt": "Recite the Federalist Papers", "stream": true}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			break
+		}
+	}
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation should stop upstream when the client disconnects")
+	}
+}
+
+// TestStreamTokenError tests that a failing token callback stops the stream
+func TestStreamTokenError(t *testing.T) {
+	errStop := errors.New("client gone")
+	calls := 0
+	_, err := mockBackend{}.Stream(context.Background(), BackendRequest{Model: "m", Prompt: "one two three"}, func(string) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || calls != 1 {
+		t.Errorf("Stream() = %v after %d calls, want errStop after 1", err, calls)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// spaceMarker is how SentencePiece tokenizers (Llama, Mistral) write spaces.
+const spaceMarker = "▁"
+
+// maxCachedWords bounds the per-tokenizer word cache.
+const maxCachedWords = 100000
+
+// Tokenizer counts tokens the way a model does. Counts are used to budget
+// prompts and to fill in usage when a backend does not report it.
+type Tokenizer interface {
+	Name() string
+	Count(text string) int
+}
+
+// estimateTokenizer assumes four characters per token, for models without
+// a tokenizer file.
+type estimateTokenizer struct{}
+
+func (estimateTokenizer) Name() string { return "estimate" }
+
+func (estimateTokenizer) Count(text string) int { return estimateTokens(text) }
+
+// estimateTokens approximates a token count at four characters per token.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// bpeTokenizer is a SentencePiece-style BPE tokenizer as used by Llama and
+// Mistral checkpoints: spaces become ▁, a ▁ is prepended to the text, and
+// characters are merged pairwise in priority order. Pieces missing from the
+// vocabulary fall back to one token per byte.
+type bpeTokenizer struct {
+	name  string
+	vocab map[string]bool
+	// rank orders candidate merges, lower first. ok is false if the pair
+	// never merges.
+	rank         func(left, right string) (rank float64, ok bool)
+	byteFallback bool
+	// special tokens are matched in the raw text and count as one token.
+	special map[byte][]string
+
+	mu    sync.Mutex
+	cache map[string]int
+}
+
+func (t *bpeTokenizer) Name() string { return t.name }
+
+func (t *bpeTokenizer) Count(text string) int {
+	total := 0
+	first := true
+	for len(text) > 0 {
+		at, size := t.nextSpecial(text)
+		if at > 0 || size == 0 {
+			segment := text
+			if size > 0 {
+				segment = text[:at]
+			}
+			total += t.countSegment(segment, first)
+		}
+		if size == 0 {
+			break
+		}
+		total++
+		text = text[at+size:]
+		first = false
+	}
+	return total
+}
+
+// nextSpecial finds the first special token in text and returns its offset
+// and length, or a length of zero if there is none.
+func (t *bpeTokenizer) nextSpecial(text string) (int, int) {
+	if len(t.special) == 0 {
+		return 0, 0
+	}
+	for i := 0; i < len(text); i++ {
+		for _, s := range t.special[text[i]] {
+			if strings.HasPrefix(text[i:], s) {
+				return i, len(s)
+			}
+		}
+	}
+	return 0, 0
+}
+
+// countSegment counts text between special tokens. Only the start of the
+// text gets the ▁ prefix.
+func (t *bpeTokenizer) countSegment(segment string, prefix bool) int {
+	normalized := strings.ReplaceAll(segment, " ", spaceMarker)
+	if prefix {
+		normalized = spaceMarker + normalized
+	}
+	// Pieces never span a ▁ that follows other text, so each word is
+	// merged on its own.
+	total := 0
+	start := 0
+	prevMarker := true
+	for i, r := range normalized {
+		marker := r == '▁'
+		if marker && !prevMarker && i > start {
+			total += t.countWord(normalized[start:i])
+			start = i
+		}
+		prevMarker = marker
+	}
+	if start < len(normalized) {
+		total += t.countWord(normalized[start:])
+	}
+	return total
+}
+
+func (t *bpeTokenizer) countWord(word string) int {
+	t.mu.Lock()
+	n, ok := t.cache[word]
+	t.mu.Unlock()
+	if ok {
+		return n
+	}
+
+	symbols := make([]string, 0, utf8.RuneCountInString(word))
+	for _, r := range word {
+		symbols = append(symbols, string(r))
+	}
+	for len(symbols) > 1 {
+		best, bestRank := -1, math.Inf(1)
+		for i := 0; i < len(symbols)-1; i++ {
+			if rank, ok := t.rank(symbols[i], symbols[i+1]); ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		symbols[best] += symbols[best+1]
+		symbols = append(symbols[:best+1], symbols[best+2:]...)
+	}
+	for _, s := range symbols {
+		if !t.vocab[s] && t.byteFallback {
+			n += len(s)
+		} else {
+			n++
+		}
+	}
+
+	t.mu.Lock()
+	if len(t.cache) >= maxCachedWords {
+		t.cache = map[string]int{}
+	}
+	t.cache[word] = n
+	t.mu.Unlock()
+	return n
+}
+
+func newBPETokenizer(name string, vocab map[string]bool, special []string) *bpeTokenizer {
+	t := &bpeTokenizer{name: name, vocab: vocab, special: map[byte][]string{}, cache: map[string]int{}}
+	// Longest first, so "<|im_start|>" wins over "<".
+	sort.Slice(special, func(i, j int) bool { return len(special[i]) > len(special[j]) })
+	for _, s := range special {
+		if s != "" {
+			t.special[s[0]] = append(t.special[s[0]], s)
+		}
+	}
+	return t
+}
+
+// loadTokenizer reads a tokenizer.json (Hugging Face) or tokenizer.model
+// (SentencePiece) file. A directory is searched for either.
+func loadTokenizer(path string) (Tokenizer, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		for _, name := range []string{"tokenizer.json", "tokenizer.model"} {
+			if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+				return loadTokenizer(filepath.Join(path, name))
+			}
+		}
+		return nil, fmt.Errorf("no tokenizer.json or tokenizer.model in %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t *bpeTokenizer
+	if strings.HasSuffix(path, ".json") {
+		t, err = parseHFTokenizer(data)
+	} else {
+		t, err = parseSentencePieceModel(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	t.name = path
+	return t, nil
+}
+
+// parseHFTokenizer reads a Hugging Face tokenizer.json with a BPE model,
+// where merges are ranked by their order in the file.
+func parseHFTokenizer(data []byte) (*bpeTokenizer, error) {
+	var file struct {
+		AddedTokens []struct {
+			Content string `json:"content"`
+		} `json:"added_tokens"`
+		PreTokenizer *struct {
+			Type string `json:"type"`
+		} `json:"pre_tokenizer"`
+		Model struct {
+			Type         string          `json:"type"`
+			Vocab        map[string]int  `json:"vocab"`
+			Merges       json.RawMessage `json:"merges"`
+			ByteFallback bool            `json:"byte_fallback"`
+		} `json:"model"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Model.Type != "BPE" {
+		return nil, fmt.Errorf("unsupported tokenizer model %q, want BPE", file.Model.Type)
+	}
+	if file.PreTokenizer != nil && file.PreTokenizer.Type == "ByteLevel" {
+		return nil, errors.New("byte-level BPE tokenizers are not supported")
+	}
+
+	// Merges are "left right" strings, or [left, right] pairs in newer files.
+	var pairs [][2]string
+	var joined []string
+	if err := json.Unmarshal(file.Model.Merges, &joined); err == nil {
+		for _, m := range joined {
+			left, right, ok := strings.Cut(m, " ")
+			if !ok {
+				return nil, fmt.Errorf("invalid merge %q", m)
+			}
+			pairs = append(pairs, [2]string{left, right})
+		}
+	} else if err := json.Unmarshal(file.Model.Merges, &pairs); err != nil {
+		return nil, fmt.Errorf("invalid merges: %w", err)
+	}
+
+	ranks := make(map[[2]string]float64, len(pairs))
+	for i, p := range pairs {
+		if _, dup := ranks[p]; !dup {
+			ranks[p] = float64(i)
+		}
+	}
+	vocab := make(map[string]bool, len(file.Model.Vocab))
+	for piece := range file.Model.Vocab {
+		vocab[piece] = true
+	}
+	var special []string
+	for _, added := range file.AddedTokens {
+		special = append(special, added.Content)
+	}
+
+	t := newBPETokenizer("", vocab, special)
+	t.byteFallback = file.Model.ByteFallback
+	t.rank = func(left, right string) (float64, bool) {
+		r, ok := ranks[[2]string{left, right}]
+		return r, ok
+	}
+	return t, nil
+}
+
+// SentencePiece piece types and model types, from sentencepiece_model.proto.
+const (
+	spPieceNormal      = 1
+	spPieceControl     = 3
+	spPieceUserDefined = 4
+	spPieceByte        = 6
+	spModelBPE         = 2
+)
+
+// parseSentencePieceModel reads a SentencePiece tokenizer.model, a
+// serialized ModelProto. BPE models merge the pair whose result has the
+// highest score.
+func parseSentencePieceModel(data []byte) (*bpeTokenizer, error) {
+	scores := map[string]float64{}
+	vocab := map[string]bool{}
+	var special []string
+	byteFallback := false
+	modelType := uint64(0)
+
+	err := readProto(data, func(field int, value []byte, _ uint64) error {
+		switch field {
+		case 1: // pieces
+			var piece string
+			var score float32
+			pieceType := uint64(spPieceNormal)
+			if err := readProto(value, func(f int, v []byte, n uint64) error {
+				switch f {
+				case 1:
+					piece = string(v)
+				case 2:
+					score = math.Float32frombits(uint32(n))
+				case 3:
+					pieceType = n
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			switch pieceType {
+			case spPieceControl, spPieceUserDefined:
+				special = append(special, piece)
+			case spPieceByte:
+				byteFallback = true
+			case spPieceNormal:
+				vocab[piece] = true
+				scores[piece] = float64(score)
+			}
+		case 2: // trainer_spec
+			return readProto(value, func(f int, _ []byte, n uint64) error {
+				if f == 3 {
+					modelType = n
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid SentencePiece model: %w", err)
+	}
+	if modelType != 0 && modelType != spModelBPE {
+		return nil, fmt.Errorf("unsupported SentencePiece model type %d, want BPE", modelType)
+	}
+	if len(vocab) == 0 {
+		return nil, errors.New("SentencePiece model has no pieces")
+	}
+
+	t := newBPETokenizer("", vocab, special)
+	t.byteFallback = byteFallback
+	t.rank = func(left, right string) (float64, bool) {
+		score, ok := scores[left+right]
+		return -score, ok
+	}
+	return t, nil
+}
+
+// readProto calls fn for each field of a protobuf message: the payload of
+// length-delimited fields, or the value of varint and fixed-width fields.
+func readProto(data []byte, fn func(field int, payload []byte, value uint64) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("bad field key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		var payload []byte
+		var value uint64
+		switch key & 7 {
+		case 0:
+			value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("bad varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errors.New("truncated field")
+			}
+			payload, data = data[n:n+int(length)], data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			value, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := fn(field, payload, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHFTokenizer tests counting with a Hugging Face tokenizer.json
+func TestHFTokenizer(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "tokenizer.json"), []byte(`{
+		"added_tokens": [{"id": 1, "content": "<s>"}, {"id": 2, "content": "</s>"}],
+		"pre_tokenizer": null,
+		"model": {
+			"type": "BPE",
+			"byte_fallback": true,
+			"vocab": {"▁": 3, "W": 4, "e": 5, "h": 6, "t": 7, "▁t": 8, "he": 9, "▁the": 10, "▁W": 11, "▁We": 12},
+			"merges": ["▁ t", "h e", "▁t he", "▁ W", "▁W e"]
+		}
+	}`), 0o644)
+
+	// A directory is searched for the tokenizer file.
+	tok, err := loadTokenizer(dir)
+	if err != nil {
+		t.Fatalf("loadTokenizer() error = %v", err)
+	}
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"We the", 2},        // ▁We ▁the
+		{"the the the", 3},   // words merge independently
+		{"We\nthe", 4},       // ▁We, a byte for \n, t, he
+		{"<s>We the</s>", 5}, // specials count once; only the text start gets ▁
+		{"é", 3},             // ▁ then two bytes
+	}
+	for _, tt := range tests {
+		if got := tok.Count(tt.text); got != tt.want {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+
+	// Newer files list merges as pairs.
+	pairs, err := parseHFTokenizer([]byte(`{"model": {"type": "BPE", "vocab": {"▁the": 1}, "merges": [["▁", "t"], ["h", "e"], ["▁t", "he"]]}}`))
+	if err != nil {
+		t.Fatalf("parseHFTokenizer() error = %v", err)
+	}
+	if got := pairs.Count("the"); got != 1 {
+		t.Errorf("Count(\"the\") with pair merges = %d, want 1", got)
+	}
+
+	for name, data := range map[string]string{
+		"unigram":    `{"model": {"type": "Unigram"}}`,
+		"byte-level": `{"pre_tokenizer": {"type": "ByteLevel"}, "model": {"type": "BPE", "vocab": {}, "merges": []}}`,
+		"bad merge":  `{"model": {"type": "BPE", "vocab": {}, "merges": ["ab"]}}`,
+	} {
+		if _, err := parseHFTokenizer([]byte(data)); err == nil {
+			t.Errorf("%s: parseHFTokenizer() should fail", name)
+		}
+	}
+	if _, err := loadTokenizer(t.TempDir()); err == nil {
+		t.Error("a directory without a tokenizer should be rejected")
+	}
+}
+
+// protoField encodes one length-delimited protobuf field.
+func protoField(field int, payload []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(field<<3|2))
+	out = binary.AppendUvarint(out, uint64(len(payload)))
+	return append(out, payload...)
+}
+
+func protoVarint(field int, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(field<<3)), v)
+}
+
+func protoPiece(piece string, score float32, pieceType uint64) []byte {
+	msg := protoField(1, []byte(piece))
+	msg = append(msg, binary.AppendUvarint(nil, uint64(2<<3|5))...)
+	msg = binary.LittleEndian.AppendUint32(msg, math.Float32bits(score))
+	msg = append(msg, protoVarint(3, pieceType)...)
+	return protoField(1, msg)
+}
+
+// TestSentencePieceTokenizer tests counting with a SentencePiece model
+func TestSentencePieceTokenizer(t *testing.T) {
+	var model []byte
+	model = append(model, protoPiece("<unk>", 0, 2)...)
+	model = append(model, protoPiece("<s>", 0, spPieceControl)...)
+	model = append(model, protoPiece("[INST]", 0, spPieceControl)...)
+	model = append(model, protoPiece("<0x0A>", 0, spPieceByte)...)
+	for _, p := range []struct {
+		piece string
+		score float32
+	}{
+		{"▁t", -1}, {"he", -2}, {"▁the", -3}, {"▁", -10}, {"t", -11}, {"h", -12}, {"e", -13},
+	} {
+		model = append(model, protoPiece(p.piece, p.score, spPieceNormal)...)
+	}
+	model = append(model, protoField(2, protoVarint(3, spModelBPE))...)
+
+	path := filepath.Join(t.TempDir(), "tokenizer.model")
+	os.WriteFile(path, model, 0o644)
+	tok, err := loadTokenizer(path)
+	if err != nil {
+		t.Fatalf("loadTokenizer() error = %v", err)
+	}
+	if tok.Name() != path {
+		t.Errorf("Name() = %q, want the file path", tok.Name())
+	}
+	for text, want := range map[string]int{
+		"the":             1,
+		"the the":         2,
+		"<s>[INST] the":   3, // two control tokens, then ▁the
+		"the\n":           2, // the newline falls back to a byte
+		"<s>[INST]\nthe ": 6, // \n byte, t, he, ▁
+	} {
+		if got := tok.Count(text); got != want {
+			t.Errorf("Count(%q) = %d, want %d", text, got, want)
+		}
+	}
+
+	unigram := append(protoPiece("▁the", -1, spPieceNormal), protoField(2, protoVarint(3, 1))...)
+	if _, err := parseSentencePieceModel(unigram); err == nil {
+		t.Error("unigram models should be rejected")
+	}
+	if _, err := parseSentencePieceModel([]byte{0x0a, 0xff}); err == nil {
+		t.Error("truncated models should be rejected")
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// userHeader carries the authenticated user's ID. The gateway sets it after
+// validating the caller's token, so a user_id in a request body is never
+// trusted for tiers or quotas. This service must only be reachable through
+// the gateway.
+const userHeader = "X-User-ID"
+
+// requestUser is the authenticated user making r, or "" for anonymous
+// requests. Values that are not user IDs are treated as anonymous.
+func requestUser(r *http.Request) string {
+	id := strings.TrimSpace(r.Header.Get(userHeader))
+	if !isUUID(id) {
+		return ""
+	}
+	return strings.ToLower(id)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// userTier reads a user's tier from the auth service's users table, which
+// shares this database. Anonymous and unknown users, and any lookup
+// failure, get the free tier.
+func userTier(ctx context.Context, userID string) string {
+	if !isUUID(userID) {
+		return tierFree
+	}
+	var tier string
+	err := db.QueryRowContext(ctx, "SELECT tier FROM users WHERE id = $1", userID).Scan(&tier)
+	switch {
+	case err == sql.ErrNoRows:
+		return tierFree
+	case err != nil:
+		log.Printf("Warning: Looking up tier for user %s failed: %v", userID, err)
+		return tierFree
+	case tier == "":
+		return tierFree
+	}
+	return tier
+}